@@ -0,0 +1,346 @@
+package statediff
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ErrPatchPath is returned by Apply and ApplyToJSON when an op's path does
+// not exist in the document (or, for add, when its parent does not exist)
+var ErrPatchPath = errors.New("statediff: patch path not found")
+
+// ErrPatchTest is returned by Apply and ApplyToJSON when a "test" op fails.
+// Numbers are compared by value, so a test for 1.0 matches 1.
+var ErrPatchTest = errors.New("statediff: patch test failed")
+
+// Apply applies the patch to target, which must be a non-nil pointer to a
+// value that round-trips through encoding/json (typically a *T whose diffs
+// produced the patch). Ops are applied in sequence as documented on Patch;
+// besides the RFC 6902 ops, "inc" ops of Config.NumericDeltas are applied.
+//
+// Apply is all-or-nothing: if any op fails, target is left unchanged and the
+// error identifies the failing op. Patches from a State with a PathMapper,
+// precision or encryption describe the transformed document, so they only
+// apply to types whose JSON matches it.
+func (p Patch) Apply(target any) error {
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("statediff: Apply target must be a non-nil pointer, got %T", target)
+	}
+	data, err := json.Marshal(target)
+	if err != nil {
+		return fmt.Errorf("statediff: marshal target: %w", err)
+	}
+	doc, err := decodeJSON(data)
+	if err != nil {
+		return fmt.Errorf("statediff: decode target: %w", err)
+	}
+	if doc, err = p.applyTo(doc); err != nil {
+		return err
+	}
+	if data, err = json.Marshal(doc); err != nil {
+		return fmt.Errorf("statediff: marshal patched document: %w", err)
+	}
+
+	// Decode into a fresh value so fields removed by the patch are cleared
+	fresh := reflect.New(rv.Elem().Type())
+	if err := json.Unmarshal(data, fresh.Interface()); err != nil {
+		return fmt.Errorf("statediff: decode patched document: %w", err)
+	}
+	rv.Elem().Set(fresh.Elem())
+	return nil
+}
+
+// ApplyToJSON applies the patch to a raw JSON document and returns the
+// patched document, e.g. to check server patches in integration tests
+// without the Go types. Numbers are kept exactly as written; object keys of
+// the result are sorted. Like Apply, it fails on the first failing op.
+func (p Patch) ApplyToJSON(doc []byte) ([]byte, error) {
+	v, err := decodeJSON(doc)
+	if err != nil {
+		return nil, fmt.Errorf("statediff: decode document: %w", err)
+	}
+	if v, err = p.applyTo(v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// applyTo applies the ops in order to a decoded JSON document, returning the
+// new root. Containers of doc may be modified in place.
+func (p Patch) applyTo(doc any) (any, error) {
+	for i, op := range p {
+		var err error
+		doc, err = applyOp(doc, op)
+		if err != nil {
+			return nil, fmt.Errorf("statediff: op %d (%s %q): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+// applyOp applies one op and returns the new root
+func applyOp(doc any, op Op) (any, error) {
+	segs, err := parsePtr(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	var value any
+	switch op.Op {
+	case "add", "replace", "test":
+		// Copy the value so later ops cannot modify the patch through the document
+		if value, err = toJSONValue(op.Value); err != nil {
+			return nil, err
+		}
+	case "move", "copy":
+		from, err := parsePtr(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if value, err = lookup(doc, from); err != nil {
+			return nil, err
+		}
+		if op.Op == "copy" {
+			if value, err = toJSONValue(value); err != nil {
+				return nil, err
+			}
+			return setPath(doc, segs, "add", value)
+		}
+		if len(from) < len(segs) && hasPathPrefix(segs, from) {
+			return nil, fmt.Errorf("statediff: cannot move %q into itself", op.From)
+		}
+		if doc, err = setPath(doc, from, "remove", nil); err != nil {
+			return nil, err
+		}
+		return setPath(doc, segs, "add", value)
+	case "inc":
+		cur, err := lookup(doc, segs)
+		if err != nil {
+			return nil, err
+		}
+		if value, err = addNumber(cur, op.Value); err != nil {
+			return nil, err
+		}
+		return setPath(doc, segs, "replace", value)
+	case "remove":
+	default:
+		return nil, fmt.Errorf("statediff: unsupported op %q", op.Op)
+	}
+
+	if op.Op == "test" {
+		cur, err := lookup(doc, segs)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(cur, value) {
+			return nil, ErrPatchTest
+		}
+		return doc, nil
+	}
+	return setPath(doc, segs, op.Op, value)
+}
+
+// jsonEqual reports whether two decoded JSON values are equal as RFC 6902
+// tests compare them: numbers by value, so 1, 1.0 and 1e0 are equal
+func jsonEqual(a, b any) bool {
+	switch x := a.(type) {
+	case map[string]any:
+		y, ok := b.(map[string]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			w, ok := y[k]
+			if !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		y, ok := b.([]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	if x, ok := numberRat(a); ok {
+		y, ok := numberRat(b)
+		return ok && x.Cmp(y) == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// numberRat returns the exact value of a decoded JSON number
+func numberRat(v any) (*big.Rat, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		return new(big.Rat).SetString(string(n))
+	case float64:
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			return nil, false
+		}
+		return new(big.Rat).SetFloat64(n), true
+	}
+	return nil, false
+}
+
+// setPath adds, replaces or removes the value at segs and returns the new root
+func setPath(doc any, segs []string, kind string, value any) (any, error) {
+	if len(segs) == 0 {
+		switch kind {
+		case "remove":
+			return nil, nil
+		default:
+			return value, nil
+		}
+	}
+
+	parent, err := lookup(doc, segs[:len(segs)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := segs[len(segs)-1]
+	switch c := parent.(type) {
+	case map[string]any:
+		if _, ok := c[last]; !ok && kind != "add" {
+			return nil, ErrPatchPath
+		}
+		if kind == "remove" {
+			delete(c, last)
+		} else {
+			c[last] = value
+		}
+		return doc, nil
+	case []any:
+		i, err := arrayIndex(last, len(c), kind == "add")
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case "add":
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = value
+		case "remove":
+			c = append(c[:i], c[i+1:]...)
+		default:
+			c[i] = value
+			return doc, nil
+		}
+		// The slice header changed: store it back into its parent
+		return setAt(doc, segs[:len(segs)-1], c)
+	default:
+		return nil, ErrPatchPath
+	}
+}
+
+// parsePtr splits an RFC 6901 JSON Pointer into unescaped segments.
+// Unlike splitPtr, "/" is the empty key, not the root.
+func parsePtr(ptr string) ([]string, error) {
+	if ptr == "" {
+		return nil, nil
+	}
+	if ptr[0] != '/' {
+		return nil, fmt.Errorf("statediff: invalid JSON pointer %q", ptr)
+	}
+	segs := strings.Split(ptr[1:], "/")
+	for i, s := range segs {
+		segs[i] = unescapePtr(s)
+	}
+	return segs, nil
+}
+
+// lookup returns the value at segs
+func lookup(doc any, segs []string) (any, error) {
+	for _, s := range segs {
+		switch c := doc.(type) {
+		case map[string]any:
+			v, ok := c[s]
+			if !ok {
+				return nil, ErrPatchPath
+			}
+			doc = v
+		case []any:
+			i, err := arrayIndex(s, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = c[i]
+		default:
+			return nil, ErrPatchPath
+		}
+	}
+	return doc, nil
+}
+
+// setAt replaces the value at segs (which must exist) and returns the new root
+func setAt(doc any, segs []string, v any) (any, error) {
+	if len(segs) == 0 {
+		return v, nil
+	}
+	parent, err := lookup(doc, segs[:len(segs)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := segs[len(segs)-1]
+	switch c := parent.(type) {
+	case map[string]any:
+		c[last] = v
+	case []any:
+		i, err := arrayIndex(last, len(c), false)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = v
+	}
+	return doc, nil
+}
+
+// arrayIndex parses an array index segment. For add, n (or "-") is valid
+// and means append.
+func arrayIndex(s string, n int, add bool) (int, error) {
+	if add && s == "-" {
+		return n, nil
+	}
+	// RFC 6901: no sign, no leading zeros
+	if s == "" || (len(s) > 1 && s[0] == '0') || s[0] == '+' || s[0] == '-' {
+		return 0, ErrPatchPath
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil || i > n || (i == n && !add) {
+		return 0, ErrPatchPath
+	}
+	return i, nil
+}
+
+// toJSONValue converts v to its decoded JSON form (a deep copy)
+func toJSONValue(v any) (any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("statediff: marshal op value: %w", err)
+	}
+	return decodeJSON(data)
+}
+
+// decodeJSON decodes a document keeping numbers exact as json.Number
+func decodeJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
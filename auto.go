@@ -0,0 +1,71 @@
+package statediff
+
+import "strings"
+
+// DefaultArrayAutoRatio is the share of changed elements above which
+// ArrayAuto replaces an array whole, when Config.ArrayAutoRatio is 0
+const DefaultArrayAutoRatio = 0.5
+
+// diffArraysAuto diffs the array per element (by key where every element
+// has one, else LCS) and sends it whole instead if more than the configured
+// share of its elements changed
+func diffArraysAuto(path string, old, new []any, cfg ArrayConfig) Patch {
+	var ops Patch
+	if getKey := cfg.keyer(path); getKey != nil && allKeyed(getKey, old) && allKeyed(getKey, new) {
+		ops = diffArraysByKey(path, old, new, cfg)
+	} else {
+		ops = diffArraysLCS(path, old, new, cfg)
+	}
+
+	ratio := cfg.AutoRatio
+	if ratio == 0 {
+		ratio = DefaultArrayAutoRatio
+	}
+	n := max(len(old), len(new))
+	if len(ops) == 0 || n == 0 {
+		return ops
+	}
+	changed := make(map[string]bool)
+	appended := 0
+	for _, op := range ops {
+		for _, ptr := range opPointers(op) {
+			seg, ok := elementSegment(path, ptr)
+			switch {
+			case !ok:
+				return ops // The array itself was replaced
+			case seg == "-":
+				appended++
+			default:
+				changed[seg] = true
+			}
+		}
+	}
+	if float64(len(changed)+appended) > ratio*float64(n) {
+		return Patch{{Op: "replace", Path: path, Value: new}}
+	}
+	return ops
+}
+
+// allKeyed reports whether every element has a key, and no key repeats
+func allKeyed(getKey func(any) (string, bool), arr []any) bool {
+	seen := make(map[string]bool, len(arr))
+	for _, el := range arr {
+		k, ok := getKey(el)
+		if !ok || seen[k] {
+			return false
+		}
+		seen[k] = true
+	}
+	return true
+}
+
+// elementSegment returns the segment naming the element of the array at
+// path that ptr lies in
+func elementSegment(path, ptr string) (string, bool) {
+	rest, ok := strings.CutPrefix(ptr, path+"/")
+	if !ok {
+		return "", false
+	}
+	seg, _, _ := strings.Cut(rest, "/")
+	return seg, true
+}
@@ -0,0 +1,126 @@
+package statediff
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// blobber sends large values at configured paths by reference
+type blobber struct {
+	patterns [][]string
+	min      int
+	store    func(ref string, data []byte) error
+}
+
+func newBlobber(paths []string, min int, store func(string, []byte) error) *blobber {
+	b := &blobber{min: min, store: store}
+	for _, p := range paths {
+		b.patterns = append(b.patterns, splitPtr(p))
+	}
+	return b
+}
+
+// blob is a value sent as {"$blob": ref}. Documents hold it in place of the
+// value, so equal values (equal refs) produce no ops, and the value is
+// handed to the store only when a payload referencing it is encoded.
+type blob struct {
+	b    *blobber
+	ref  string
+	data []byte // JSON encoding of the value
+}
+
+type blobJSON struct {
+	Blob string `json:"$blob"`
+}
+
+// MarshalJSON stores the value and encodes the reference
+func (v *blob) MarshalJSON() ([]byte, error) {
+	if err := v.b.store(v.ref, v.data); err != nil {
+		return nil, fmt.Errorf("statediff: store blob %s: %w", v.ref, err)
+	}
+	return json.Marshal(blobJSON{Blob: v.ref})
+}
+
+// blobRef returns the reference of JSON data
+func blobRef(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// replace swaps large values at blob paths for references
+func (b *blobber) replace(doc any, path []string) any {
+	for _, p := range b.patterns {
+		if matchPattern(p, path) {
+			data, err := json.Marshal(doc)
+			if err != nil || len(data) < b.min {
+				return doc // Decoded JSON always marshals
+			}
+			return &blob{b: b, ref: blobRef(data), data: data}
+		}
+	}
+	switch v := doc.(type) {
+	case map[string]any:
+		for k, val := range v {
+			v[k] = b.replace(val, append(path, k))
+		}
+	case []any:
+		for i, val := range v {
+			v[i] = b.replace(val, append(path, fmt.Sprint(i)))
+		}
+	}
+	return doc
+}
+
+// ResolveBlobs returns the patch with every {"$blob": ref} value of
+// Config.BlobPaths replaced by the value fetched for it, for Go clients
+// that apply patches. fetch returns the JSON of the value (as stored by
+// BlobStore); data that does not hash to its ref is rejected.
+func (p Patch) ResolveBlobs(fetch func(ref string) ([]byte, error)) (Patch, error) {
+	out := make(Patch, len(p))
+	for i, op := range p {
+		if op.Value != nil {
+			v, err := toJSONValue(op.Value)
+			if err != nil {
+				return nil, err
+			}
+			if op.Value, err = resolveBlobs(v, fetch); err != nil {
+				return nil, err
+			}
+		}
+		out[i] = op
+	}
+	return out, nil
+}
+
+func resolveBlobs(doc any, fetch func(string) ([]byte, error)) (any, error) {
+	switch v := doc.(type) {
+	case map[string]any:
+		if ref, ok := v["$blob"].(string); ok && len(v) == 1 && strings.HasPrefix(ref, "sha256:") {
+			data, err := fetch(ref)
+			if err != nil {
+				return nil, fmt.Errorf("statediff: fetch blob %s: %w", ref, err)
+			}
+			if blobRef(data) != ref {
+				return nil, fmt.Errorf("statediff: blob %s does not match its content", ref)
+			}
+			return decodeJSON(data)
+		}
+		for k, val := range v {
+			var err error
+			if v[k], err = resolveBlobs(val, fetch); err != nil {
+				return nil, err
+			}
+		}
+	case []any:
+		for i, val := range v {
+			var err error
+			if v[i], err = resolveBlobs(val, fetch); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return doc, nil
+}
@@ -0,0 +1,138 @@
+package statediff
+
+import (
+	"container/heap"
+	"strings"
+)
+
+// Canonicalize returns the patch in a deterministic form, so that patches
+// can be hashed, compared in tests and deduplicated across workers:
+//   - values are converted to their decoded JSON form (numbers as
+//     json.Number, object keys sorted when marshaled), and add, replace and
+//     test ops carry an explicit null as with Normalize
+//   - ops are sorted by path, then op name, then from
+//
+// Sorting never moves an op past another it depends on, so the result
+// applies exactly like p: ops whose paths (or froms) are equal, nested in
+// one another, or in the same array as an op on an index or "-" (such as
+// "/a/3" and "/a/10/x") keep their relative order. Patches with the same ops in an order that differs
+// only between independent ops canonicalize to the same patch.
+func (p Patch) Canonicalize() (Patch, error) {
+	out := make(Patch, len(p))
+	for i, op := range p {
+		var err error
+		if op.Value, err = canonicalValue(op.Value); err != nil {
+			return nil, err
+		}
+		if op.Old, err = canonicalValue(op.Old); err != nil {
+			return nil, err
+		}
+		out[i] = op
+	}
+	out = out.Normalize()
+
+	// Kahn's algorithm, always taking the smallest op whose dependencies
+	// have been placed
+	n := len(out)
+	after := make([][]int, n) // Ops that must stay after op i
+	waiting := make([]int, n)
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			if dependent(out[i], out[j]) {
+				after[i] = append(after[i], j)
+				waiting[j]++
+			}
+		}
+	}
+	ready := &opQueue{ops: out}
+	for i := 0; i < n; i++ {
+		if waiting[i] == 0 {
+			ready.idx = append(ready.idx, i)
+		}
+	}
+	heap.Init(ready)
+	sorted := make(Patch, 0, n)
+	for ready.Len() > 0 {
+		i := heap.Pop(ready).(int)
+		sorted = append(sorted, out[i])
+		for _, j := range after[i] {
+			if waiting[j]--; waiting[j] == 0 {
+				heap.Push(ready, j)
+			}
+		}
+	}
+	return sorted, nil
+}
+
+// canonicalValue converts an op value to its decoded JSON form
+func canonicalValue(v any) (any, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return toJSONValue(v)
+}
+
+// dependent reports whether swapping a and b could change the result
+func dependent(a, b Op) bool {
+	for _, x := range opPointers(a) {
+		for _, y := range opPointers(b) {
+			if relatedPtrs(x, y) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func opPointers(op Op) []string {
+	if op.Op == "move" || op.Op == "copy" {
+		return []string{op.Path, op.From}
+	}
+	return []string{op.Path}
+}
+
+// relatedPtrs reports whether the values at x and y may affect each other:
+// equal or nested pointers, or an array index and anything in the same
+// array (an add or remove there shifts the other elements)
+func relatedPtrs(x, y string) bool {
+	if x == y || x == "" || y == "" || strings.HasPrefix(y, x+"/") || strings.HasPrefix(x, y+"/") {
+		return true
+	}
+	return inIndexedArray(x, y) || inIndexedArray(y, x)
+}
+
+// inIndexedArray reports whether x ends in an array index (or "-") and y is
+// in the same array
+func inIndexedArray(x, y string) bool {
+	i := strings.LastIndexByte(x, '/')
+	return i >= 0 && isIndexSeg(x[i+1:]) && strings.HasPrefix(y, x[:i+1])
+}
+
+// opQueue is a min-heap of op indexes by path, op name, from and position
+type opQueue struct {
+	ops Patch
+	idx []int
+}
+
+func (q *opQueue) Len() int      { return len(q.idx) }
+func (q *opQueue) Swap(i, j int) { q.idx[i], q.idx[j] = q.idx[j], q.idx[i] }
+func (q *opQueue) Push(x any)    { q.idx = append(q.idx, x.(int)) }
+
+func (q *opQueue) Pop() any {
+	i := q.idx[len(q.idx)-1]
+	q.idx = q.idx[:len(q.idx)-1]
+	return i
+}
+
+func (q *opQueue) Less(i, j int) bool {
+	a, b := q.ops[q.idx[i]], q.ops[q.idx[j]]
+	switch {
+	case a.Path != b.Path:
+		return a.Path < b.Path
+	case a.Op != b.Op:
+		return a.Op < b.Op
+	case a.From != b.From:
+		return a.From < b.From
+	}
+	return q.idx[i] < q.idx[j]
+}
@@ -0,0 +1,464 @@
+package statediff
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var jsonNumberType = reflect.TypeOf(json.Number(""))
+
+// CBOREncoder encodes patches as CBOR (see Patch.CBOR)
+var CBOREncoder = Encoder{Name: "cbor", Encode: Patch.CBOR}
+
+// CBOR encodes the patch as a CBOR (RFC 8949) array of op maps with the
+// same keys as the JSON form. Typed values, such as the root replace of a
+// full state, are encoded from their Go form: []byte fields become byte
+// strings instead of base64 text. Values of diffed ops come from the JSON
+// document, where blobs are already base64 strings. Map keys are sorted.
+func (p Patch) CBOR() ([]byte, error) {
+	buf := cborHead(nil, 4, uint64(len(p)))
+	for _, op := range p {
+		n := 2
+		for _, set := range []bool{op.From != "", op.Value != nil, op.Old != nil} {
+			if set {
+				n++
+			}
+		}
+		buf = cborHead(buf, 5, uint64(n))
+		buf = cborText(cborText(buf, "op"), op.Op)
+		buf = cborText(cborText(buf, "path"), op.Path)
+		if op.From != "" {
+			buf = cborText(cborText(buf, "from"), op.From)
+		}
+		var err error
+		if op.Value != nil {
+			if buf, err = appendCBOR(cborText(buf, "value"), reflect.ValueOf(op.Value)); err != nil {
+				return nil, err
+			}
+		}
+		if op.Old != nil {
+			if buf, err = appendCBOR(cborText(buf, "old"), reflect.ValueOf(op.Old)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf, nil
+}
+
+// MarshalCBOR encodes v as CBOR following its encoding/json form (field
+// names, omitempty, custom marshalers), except that []byte is a byte string
+func MarshalCBOR(v any) ([]byte, error) {
+	return appendCBOR(nil, reflect.ValueOf(v))
+}
+
+// UnmarshalCBOR decodes CBOR into v as encoding/json would decode the
+// equivalent JSON; byte strings decode into []byte (or base64 strings)
+func UnmarshalCBOR(data []byte, v any) error {
+	doc, rest, err := decodeCBOR(data, 0)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return errors.New("statediff: cbor: trailing data")
+	}
+	js, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(js, v)
+}
+
+// appendCBOR appends v. Types with JSON or text marshalers go through their
+// JSON form; everything else is walked like encoding/json would.
+func appendCBOR(buf []byte, v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return append(buf, 0xf6), nil
+	}
+	t := v.Type()
+	if t == jsonNumberType {
+		return cborNumber(buf, json.Number(v.String()))
+	}
+	if v.CanInterface() {
+		if t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType) {
+			if (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) && v.IsNil() {
+				return append(buf, 0xf6), nil
+			}
+			return cborViaJSON(buf, v.Interface())
+		}
+		if v.CanAddr() && (reflect.PointerTo(t).Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType)) {
+			return cborViaJSON(buf, v.Addr().Interface())
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return append(buf, 0xf6), nil
+		}
+		return appendCBOR(buf, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return append(buf, 0xf5), nil
+		}
+		return append(buf, 0xf4), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cborInt(buf, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return cborHead(buf, 0, v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("statediff: cbor: unsupported value %v", f)
+		}
+		if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+			return cborInt(buf, int64(f)), nil
+		}
+		return binary.BigEndian.AppendUint64(append(buf, 0xfb), math.Float64bits(f)), nil
+	case reflect.String:
+		return cborText(buf, v.String()), nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return append(buf, 0xf6), nil
+		}
+		if t.Elem().Kind() == reflect.Uint8 {
+			return append(cborHead(buf, 2, uint64(v.Len())), v.Bytes()...), nil
+		}
+		fallthrough
+	case reflect.Array:
+		buf = cborHead(buf, 4, uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			var err error
+			if buf, err = appendCBOR(buf, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return append(buf, 0xf6), nil
+		}
+		keys := make([]string, 0, v.Len())
+		vals := make(map[string]reflect.Value, v.Len())
+		for it := v.MapRange(); it.Next(); {
+			k, err := mapKeyString(it.Key())
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, k)
+			vals[k] = it.Value()
+		}
+		sort.Strings(keys)
+		buf = cborHead(buf, 5, uint64(len(keys)))
+		for _, k := range keys {
+			var err error
+			if buf, err = appendCBOR(cborText(buf, k), vals[k]); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Struct:
+		fields := jsonFields(t)
+		var present []jsonField
+		for _, f := range fields {
+			fv, ok := fieldByIndex(v, f.index)
+			if ok && !(f.omitEmpty && isEmptyValue(fv)) {
+				present = append(present, f)
+			}
+		}
+		buf = cborHead(buf, 5, uint64(len(present)))
+		for _, f := range present {
+			fv, _ := fieldByIndex(v, f.index)
+			var err error
+			if buf, err = appendCBOR(cborText(buf, f.name), fv); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+	return nil, fmt.Errorf("statediff: cbor: unsupported type %s", t)
+}
+
+// cborViaJSON encodes a value with a custom marshaler through its JSON form
+func cborViaJSON(buf []byte, v any) ([]byte, error) {
+	doc, err := toJSONValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return appendCBOR(buf, reflect.ValueOf(doc))
+}
+
+func cborNumber(buf []byte, n json.Number) ([]byte, error) {
+	if i, err := n.Int64(); err == nil {
+		return cborInt(buf, i), nil
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return nil, fmt.Errorf("statediff: cbor: invalid number %q", n)
+	}
+	return appendCBOR(buf, reflect.ValueOf(f))
+}
+
+// mapKeyString converts a map key as encoding/json does
+func mapKeyString(k reflect.Value) (string, error) {
+	if k.Type().Implements(textMarshalerType) {
+		if k.Kind() == reflect.Pointer && k.IsNil() {
+			return "", nil
+		}
+		b, err := k.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(b), err
+	}
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return fmt.Sprint(k.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return fmt.Sprint(k.Uint()), nil
+	}
+	return "", fmt.Errorf("statediff: cbor: unsupported map key type %s", k.Type())
+}
+
+type jsonField struct {
+	index     []int
+	name      string
+	omitEmpty bool
+}
+
+// jsonFields lists the members encoding/json emits for struct t, inlining
+// untagged embedded structs
+func jsonFields(t reflect.Type) []jsonField {
+	var out []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				for _, sub := range jsonFields(ft) {
+					sub.index = append([]int{i}, sub.index...)
+					out = append(out, sub)
+				}
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		out = append(out, jsonField{index: []int{i}, name: name, omitEmpty: strings.Contains(","+opts+",", ",omitempty,")})
+	}
+	return out
+}
+
+// fieldByIndex is reflect.Value.FieldByIndex that reports nil embedded pointers
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
+
+// cborHead appends the initial byte and argument of a data item
+func cborHead(buf []byte, major byte, n uint64) []byte {
+	m := major << 5
+	switch {
+	case n < 24:
+		return append(buf, m|byte(n))
+	case n <= math.MaxUint8:
+		return append(buf, m|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, m|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, m|26), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, m|27), n)
+	}
+}
+
+func cborInt(buf []byte, i int64) []byte {
+	if i >= 0 {
+		return cborHead(buf, 0, uint64(i))
+	}
+	return cborHead(buf, 1, uint64(-(i + 1)))
+}
+
+func cborText(buf []byte, s string) []byte {
+	return append(cborHead(buf, 3, uint64(len(s))), s...)
+}
+
+// maxCBORDepth bounds nesting when decoding untrusted input
+const maxCBORDepth = 1000
+
+var errCBORTruncated = errors.New("statediff: cbor: unexpected end of data")
+
+// decodeCBOR decodes one data item into a value encoding/json can marshal:
+// byte strings become base64 strings, integers int64 or uint64. Indefinite
+// lengths are not supported.
+func decodeCBOR(data []byte, depth int) (any, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, errors.New("statediff: cbor: nesting too deep")
+	}
+	if len(data) == 0 {
+		return nil, nil, errCBORTruncated
+	}
+	major, ai := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	if major == 7 {
+		switch ai {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		case 25:
+			if len(data) < 2 {
+				return nil, nil, errCBORTruncated
+			}
+			return halfToFloat(binary.BigEndian.Uint16(data)), data[2:], nil
+		case 26:
+			if len(data) < 4 {
+				return nil, nil, errCBORTruncated
+			}
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), data[4:], nil
+		case 27:
+			if len(data) < 8 {
+				return nil, nil, errCBORTruncated
+			}
+			return math.Float64frombits(binary.BigEndian.Uint64(data)), data[8:], nil
+		}
+		return nil, nil, fmt.Errorf("statediff: cbor: unsupported simple value %d", ai)
+	}
+
+	var n uint64
+	switch {
+	case ai < 24:
+		n = uint64(ai)
+	case ai <= 27:
+		size := 1 << (ai - 24)
+		if len(data) < size {
+			return nil, nil, errCBORTruncated
+		}
+		for _, b := range data[:size] {
+			n = n<<8 | uint64(b)
+		}
+		data = data[size:]
+	default:
+		return nil, nil, errors.New("statediff: cbor: indefinite lengths are not supported")
+	}
+
+	switch major {
+	case 0:
+		return n, data, nil
+	case 1:
+		if n > math.MaxInt64 {
+			return nil, nil, errors.New("statediff: cbor: negative integer out of range")
+		}
+		return -1 - int64(n), data, nil
+	case 2, 3:
+		if uint64(len(data)) < n {
+			return nil, nil, errCBORTruncated
+		}
+		if major == 2 {
+			return base64.StdEncoding.EncodeToString(data[:n]), data[n:], nil
+		}
+		return string(data[:n]), data[n:], nil
+	case 4:
+		if n > uint64(len(data)) {
+			return nil, nil, errCBORTruncated // Every item takes at least a byte
+		}
+		arr := make([]any, n)
+		for i := range arr {
+			var err error
+			if arr[i], data, err = decodeCBOR(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+		}
+		return arr, data, nil
+	case 5:
+		if n > uint64(len(data)) {
+			return nil, nil, errCBORTruncated
+		}
+		m := make(map[string]any, n)
+		for i := uint64(0); i < n; i++ {
+			k, rest, err := decodeCBOR(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			ks, ok := k.(string)
+			if !ok {
+				ks = fmt.Sprint(k)
+			}
+			if m[ks], data, err = decodeCBOR(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+		}
+		return m, data, nil
+	default: // 6: tags are ignored
+		return decodeCBOR(data, depth+1)
+	}
+}
+
+// halfToFloat converts an IEEE 754 half-precision float
+func halfToFloat(h uint16) float64 {
+	exp, frac := int(h>>10)&0x1f, float64(h&0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(frac, -24)
+	case 31:
+		f = math.Inf(1)
+		if frac != 0 {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(frac+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
@@ -0,0 +1,161 @@
+// Package clocktest provides a manual clock for deterministic tests of
+// time-based statediff effects, instead of sleeping in tests.
+//
+//	clock := clocktest.New(time.Unix(0, 0))
+//	e := clocktest.Timed[Game, string](clock, "shield", 5*time.Second, applyShield)
+//	state.AddEffect(e, "p1")
+//	clock.Advance(5 * time.Second) // e is now expired
+package clocktest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mxkacsa/statediff"
+)
+
+// Clock is a manually advanced clock. Its Now method satisfies the
+// TimedEffect.TimeFunc contract. Thread-safe.
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	seq    int
+	timers []*Timer
+}
+
+// Timer is a callback scheduled on a Clock
+type Timer struct {
+	clock *Clock
+	at    time.Time
+	seq   int // Tie-breaker: timers due at the same time fire in creation order
+	fn    func()
+}
+
+// New creates a clock set to start
+func New(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+// Now returns the clock's current time
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d and runs every timer that came due,
+// in due order, with Now reporting each timer's due time while it runs.
+// Callbacks run on the calling goroutine without the clock lock held.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	c.mu.Unlock()
+	c.advanceTo(target)
+}
+
+// Set moves the clock to t, running timers due up to t. Setting the clock
+// backwards changes Now but runs no timers.
+func (c *Clock) Set(t time.Time) {
+	c.advanceTo(t)
+}
+
+func (c *Clock) advanceTo(target time.Time) {
+	for {
+		c.mu.Lock()
+		if len(c.timers) == 0 || c.timers[0].at.After(target) {
+			c.now = target
+			c.mu.Unlock()
+			return
+		}
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		if t.at.After(c.now) {
+			c.now = t.at
+		}
+		c.mu.Unlock()
+		t.fn()
+	}
+}
+
+// AfterFunc schedules fn to run once the clock has advanced by d
+func (c *Clock) AfterFunc(d time.Duration, fn func()) *Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.schedule(c.now.Add(d), fn)
+}
+
+// At schedules fn to run once the clock reaches t
+func (c *Clock) At(t time.Time, fn func()) *Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.schedule(t, fn)
+}
+
+// schedule inserts a timer in due order. Caller must hold mu.
+func (c *Clock) schedule(at time.Time, fn func()) *Timer {
+	c.seq++
+	t := &Timer{clock: c, at: at, seq: c.seq, fn: fn}
+	i := sort.Search(len(c.timers), func(i int) bool {
+		other := c.timers[i]
+		return other.at.After(at) || (other.at.Equal(at) && other.seq > t.seq)
+	})
+	c.timers = append(c.timers, nil)
+	copy(c.timers[i+1:], c.timers[i:])
+	c.timers[i] = t
+	return t
+}
+
+// Pending returns the number of timers that have not fired or been stopped
+func (c *Clock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// Stop cancels the timer. Returns false if it already fired or was stopped.
+func (t *Timer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Timed creates a statediff.Timed effect that starts at the clock's current
+// time and reads time from the clock
+func Timed[T, A any](c *Clock, id string, dur time.Duration, fn func(state T, activator A) T) *statediff.TimedEffect[T, A] {
+	now := c.Now()
+	return Window(c, id, now, now.Add(dur), fn)
+}
+
+// Delayed creates a statediff.Delayed effect relative to the clock's current
+// time and reads time from the clock
+func Delayed[T, A any](c *Clock, id string, delay, duration time.Duration, fn func(state T, activator A) T) *statediff.TimedEffect[T, A] {
+	now := c.Now()
+	return Window(c, id, now.Add(delay), now.Add(delay+duration), fn)
+}
+
+// Window creates a statediff.TimedWindow effect that reads time from the clock
+func Window[T, A any](c *Clock, id string, startsAt, expiresAt time.Time, fn func(state T, activator A) T) *statediff.TimedEffect[T, A] {
+	e := statediff.TimedWindow(id, startsAt, expiresAt, fn)
+	e.TimeFunc = c.Now
+	return e
+}
+
+// OnExpire schedules onExpire(e.ID()) on the clock for the first instant the
+// effect reports Expired (one nanosecond past ExpiresAt), the deterministic
+// counterpart of e.ScheduleExpiration. Returns nil if the effect never expires.
+func OnExpire[T, A any](c *Clock, e *statediff.TimedEffect[T, A], onExpire func(effectID string)) *Timer {
+	at := e.ExpiresAt()
+	if at.IsZero() {
+		return nil
+	}
+	id := e.ID()
+	return c.At(at.Add(time.Nanosecond), func() { onExpire(id) })
+}
@@ -0,0 +1,126 @@
+package clocktest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mxkacsa/statediff"
+)
+
+type game struct {
+	Speed int `json:"speed"`
+}
+
+func double(g game, _ string) game {
+	g.Speed *= 2
+	return g
+}
+
+func TestTimedEffect(t *testing.T) {
+	clock := New(time.Unix(1000, 0))
+	s := statediff.MustNew[game, string](game{Speed: 1}, nil)
+	e := Timed[game, string](clock, "boost", 5*time.Second, double)
+	s.AddEffect(e, "p1")
+
+	if s.Get().Speed != 2 {
+		t.Error("Effect should be active immediately")
+	}
+	clock.Advance(4 * time.Second)
+	if e.Remaining() != time.Second {
+		t.Errorf("Remaining = %v, want 1s", e.Remaining())
+	}
+	clock.Advance(time.Second)
+	if e.Expired() || s.Get().Speed != 2 {
+		t.Error("Effect should still be active at its deadline")
+	}
+	clock.Advance(time.Nanosecond)
+	if !e.Expired() || s.Get().Speed != 1 {
+		t.Error("Effect should expire right after its deadline")
+	}
+	if n := s.CleanupExpired(); n != 1 {
+		t.Errorf("CleanupExpired = %d, want 1", n)
+	}
+}
+
+func TestDelayedAndWindow(t *testing.T) {
+	start := time.Unix(0, 0)
+	clock := New(start)
+	d := Delayed[game, string](clock, "later", 2*time.Second, time.Second, double)
+	w := Window[game, string](clock, "window", start.Add(time.Second), time.Time{}, double)
+
+	if d.Started() || w.Started() {
+		t.Error("Effects should not have started")
+	}
+	clock.Advance(time.Second)
+	if d.Started() || !w.Started() {
+		t.Error("Only the window should have started")
+	}
+	clock.Advance(time.Second)
+	if !d.Active() {
+		t.Error("Delayed effect should be active after its delay")
+	}
+	clock.Advance(time.Hour)
+	if !d.Expired() || w.Expired() {
+		t.Error("Delayed effect should expire; open-ended window should not")
+	}
+}
+
+func TestOnExpire(t *testing.T) {
+	clock := New(time.Unix(0, 0))
+	s := statediff.MustNew[game, string](game{Speed: 1}, nil)
+	sess := statediff.NewSession[game, string, string](s)
+	sess.Connect("c", nil)
+
+	e := Timed[game, string](clock, "boost", 3*time.Second, double)
+	s.AddEffect(e, "p1")
+	sess.Tick()
+
+	var expired []string
+	OnExpire(clock, e, func(id string) {
+		expired = append(expired, id)
+		sess.Tick()
+	})
+
+	clock.Advance(3 * time.Second)
+	if len(expired) != 0 {
+		t.Fatal("Callback fired while the effect was still active")
+	}
+	clock.Advance(time.Nanosecond)
+	if len(expired) != 1 || expired[0] != "boost" {
+		t.Fatalf("Expected boost to expire, got %v", expired)
+	}
+	if s.HasEffect("boost") {
+		t.Error("Tick should have removed the expired effect")
+	}
+}
+
+func TestTimersFireInOrder(t *testing.T) {
+	start := time.Unix(0, 0)
+	clock := New(start)
+	var order []int
+	var seen []time.Time
+	record := func(n int) func() {
+		return func() {
+			order = append(order, n)
+			seen = append(seen, clock.Now())
+		}
+	}
+	clock.AfterFunc(3*time.Second, record(3))
+	clock.AfterFunc(time.Second, record(1))
+	clock.AfterFunc(time.Second, record(2)) // Same time: creation order
+	stopped := clock.AfterFunc(2*time.Second, record(99))
+	if !stopped.Stop() || stopped.Stop() {
+		t.Error("Stop should succeed once")
+	}
+
+	clock.Advance(10 * time.Second)
+	if len(order) != 3 || order[0] != 1 || order[1] != 2 || order[2] != 3 {
+		t.Errorf("Fired in order %v, want [1 2 3]", order)
+	}
+	if !seen[0].Equal(start.Add(time.Second)) || !seen[2].Equal(start.Add(3*time.Second)) {
+		t.Errorf("Now during callbacks should be the due time, got %v", seen)
+	}
+	if !clock.Now().Equal(start.Add(10*time.Second)) || clock.Pending() != 0 {
+		t.Error("Clock should end at the target with no pending timers")
+	}
+}
@@ -0,0 +1,143 @@
+package statediff
+
+import "reflect"
+
+// DeepClone returns a deep copy of v using reflection. It is a drop-in
+// Config.Cloner for pointer-heavy states that clonegen does not cover:
+//
+//	Cloner: statediff.DeepClone[Game]
+//
+// Unlike the default JSON clone it keeps nil and empty slices and maps
+// apart, copies fields tagged json:"-", and preserves
+// aliasing: pointers, maps and slices shared within v are shared within the
+// copy too (so cycles are fine). Unexported fields, funcs and channels are
+// copied shallowly.
+func DeepClone[T any](v T) T {
+	c := cloner{seen: make(map[cloneKey]reflect.Value)}
+	src := reflect.ValueOf(&v).Elem()
+	dst := reflect.New(src.Type()).Elem()
+	c.copy(dst, src)
+	return *dst.Addr().Interface().(*T)
+}
+
+// cloneKey identifies a shared reference: the same address can hold values
+// of different types (a struct and its first field)
+type cloneKey struct {
+	ptr uintptr
+	typ reflect.Type
+	len int // Slices sharing an array but of different lengths differ
+}
+
+type cloner struct {
+	seen map[cloneKey]reflect.Value
+}
+
+// copy deep-copies src into dst, which must be settable and of the same type
+func (c *cloner) copy(dst, src reflect.Value) {
+	switch src.Kind() {
+	case reflect.Pointer:
+		if src.IsNil() {
+			return
+		}
+		key := cloneKey{ptr: src.Pointer(), typ: src.Type()}
+		if p, ok := c.seen[key]; ok {
+			dst.Set(p)
+			return
+		}
+		p := reflect.New(src.Type().Elem())
+		c.seen[key] = p
+		c.copy(p.Elem(), src.Elem())
+		dst.Set(p)
+
+	case reflect.Slice:
+		if src.IsNil() {
+			return
+		}
+		key := cloneKey{ptr: src.Pointer(), typ: src.Type(), len: src.Len()}
+		if s, ok := c.seen[key]; ok && src.Len() > 0 {
+			dst.Set(s)
+			return
+		}
+		s := reflect.MakeSlice(src.Type(), src.Len(), src.Cap())
+		if src.Len() > 0 {
+			c.seen[key] = s
+		}
+		if hasRefs(src.Type().Elem()) {
+			for i := 0; i < src.Len(); i++ {
+				c.copy(s.Index(i), src.Index(i))
+			}
+		} else {
+			reflect.Copy(s, src)
+		}
+		dst.Set(s)
+
+	case reflect.Map:
+		if src.IsNil() {
+			return
+		}
+		key := cloneKey{ptr: src.Pointer(), typ: src.Type()}
+		if m, ok := c.seen[key]; ok {
+			dst.Set(m)
+			return
+		}
+		m := reflect.MakeMapWithSize(src.Type(), src.Len())
+		c.seen[key] = m
+		elem := src.Type().Elem()
+		iter := src.MapRange()
+		for iter.Next() {
+			v := reflect.New(elem).Elem()
+			c.copy(v, iter.Value())
+			m.SetMapIndex(iter.Key(), v)
+		}
+		dst.Set(m)
+
+	case reflect.Array:
+		if !hasRefs(src.Type().Elem()) {
+			dst.Set(src)
+			return
+		}
+		for i := 0; i < src.Len(); i++ {
+			c.copy(dst.Index(i), src.Index(i))
+		}
+
+	case reflect.Struct:
+		dst.Set(src) // Also copies unexported fields (shallow)
+		if !hasRefs(src.Type()) {
+			return
+		}
+		for i := 0; i < src.NumField(); i++ {
+			if f := dst.Field(i); f.CanSet() {
+				c.copy(f, src.Field(i))
+			}
+		}
+
+	case reflect.Interface:
+		if src.IsNil() {
+			return
+		}
+		inner := src.Elem()
+		v := reflect.New(inner.Type()).Elem()
+		c.copy(v, inner)
+		dst.Set(v)
+
+	default:
+		dst.Set(src)
+	}
+}
+
+// hasRefs reports whether values of t can reference shared memory
+func hasRefs(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Map, reflect.Interface:
+		return true
+	case reflect.Array:
+		return hasRefs(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if hasRefs(t.Field(i).Type) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -391,6 +391,95 @@ func TestGameClone(t *testing.T) {
 	t.Logf("Test output:\n%s", output)
 }
 
+func TestPointerFields(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "clonegen-ptr-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	testSrc := `package main
+
+type Stats struct {
+	Level *int
+	Tags  []string
+}
+
+type Hero struct {
+	HP     *int
+	Name   *string
+	Stats  *Stats
+	Buffs  []*Stats
+	IDs    []*int
+	ByName map[string]*Stats
+	Marks  map[string]*int
+}
+`
+	if err := os.WriteFile(filepath.Join(tmpDir, "hero.go"), []byte(testSrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "go.mod"), []byte("module testmod\n\ngo 1.21\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(tmpDir)
+	defer os.Chdir(oldDir)
+
+	if err := run(Config{Types: []string{"Stats", "Hero"}, Output: "clone_gen.go"}); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	content, _ := os.ReadFile(filepath.Join(tmpDir, "clone_gen.go"))
+
+	testFile := `package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func ptr[T any](v T) *T { return &v }
+
+func TestHeroClone(t *testing.T) {
+	h := Hero{
+		HP:     ptr(10),
+		Stats:  &Stats{Level: ptr(1), Tags: []string{"a"}},
+		Buffs:  []*Stats{{Level: ptr(2)}, nil},
+		IDs:    []*int{ptr(1), nil},
+		ByName: map[string]*Stats{"x": {Level: ptr(3)}, "nil": nil},
+		Marks:  map[string]*int{"m": ptr(4)},
+	}
+	c := h.Clone()
+	if !reflect.DeepEqual(h, c) {
+		t.Fatalf("clone should equal original")
+	}
+
+	*c.HP = 0
+	*c.Stats.Level = 0
+	c.Stats.Tags[0] = "z"
+	*c.Buffs[0].Level = 0
+	*c.IDs[0] = 0
+	*c.ByName["x"].Level = 0
+	*c.Marks["m"] = 0
+	if *h.HP != 10 || *h.Stats.Level != 1 || h.Stats.Tags[0] != "a" || *h.Buffs[0].Level != 2 ||
+		*h.IDs[0] != 1 || *h.ByName["x"].Level != 3 || *h.Marks["m"] != 4 {
+		t.Error("clone shares pointers with the original")
+	}
+	if c.Name != nil || c.Buffs[1] != nil || c.ByName["nil"] != nil {
+		t.Error("nil pointers should stay nil")
+	}
+}
+`
+	if err := os.WriteFile(filepath.Join(tmpDir, "clone_test.go"), []byte(testFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "test")
+	cmd.Dir = tmpDir
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go test failed: %v\nOutput:\n%s\nGenerated code:\n%s", err, output, content)
+	}
+}
+
 func TestCrossPackageImports(t *testing.T) {
 	tmpDir, err := os.MkdirTemp("", "clonegen-cross-*")
 	if err != nil {
@@ -92,6 +92,7 @@ func run(cfg Config) error {
 
 	// Analyze types
 	analyzer := NewAnalyzer(pkg, cfg.CloneMethod)
+	analyzer.Generating(cfg.Types)
 	typeInfos := make([]*TypeInfo, 0, len(cfg.Types))
 
 	for _, typeName := range cfg.Types {
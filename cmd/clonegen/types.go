@@ -80,6 +80,7 @@ func (k FieldKind) String() string {
 type Analyzer struct {
 	pkg         *Package
 	cloneMethod string
+	generating  map[string]bool // Types whose Clone is generated in this run
 }
 
 // NewAnalyzer creates a new type analyzer
@@ -90,6 +91,21 @@ func NewAnalyzer(pkg *Package, cloneMethod string) *Analyzer {
 	}
 }
 
+// Generating marks types whose Clone method is generated alongside, so
+// fields of those types (and pointers to them) are deep-cloned through it
+// even though the method does not exist in the source yet
+func (a *Analyzer) Generating(typeNames []string) {
+	a.generating = make(map[string]bool, len(typeNames))
+	for _, name := range typeNames {
+		a.generating[name] = true
+	}
+}
+
+// hasClone reports whether a type has, or will get, a Clone method
+func (a *Analyzer) hasClone(typeName string) bool {
+	return a.generating[typeName] || a.pkg.HasCloneMethod(typeName, a.cloneMethod)
+}
+
 // Analyze analyzes a named type
 func (a *Analyzer) Analyze(typeName string) (*TypeInfo, error) {
 	structType, ok := a.pkg.Structs[typeName]
@@ -149,7 +165,7 @@ func (a *Analyzer) categorizeType(info *FieldInfo, expr ast.Expr) {
 	case *ast.Ident:
 		info.Kind = a.identKind(t.Name)
 		if info.Kind == KindStruct {
-			info.HasClone = a.pkg.HasCloneMethod(t.Name, a.cloneMethod)
+			info.HasClone = a.hasClone(t.Name)
 		}
 
 	case *ast.SelectorExpr:
@@ -168,7 +184,7 @@ func (a *Analyzer) categorizeType(info *FieldInfo, expr ast.Expr) {
 		info.ElemKind = a.exprKind(t.X)
 		if info.ElemKind == KindStruct {
 			if ident, ok := t.X.(*ast.Ident); ok {
-				info.HasClone = a.pkg.HasCloneMethod(ident.Name, a.cloneMethod)
+				info.HasClone = a.hasClone(ident.Name)
 			}
 		}
 
@@ -185,13 +201,13 @@ func (a *Analyzer) categorizeType(info *FieldInfo, expr ast.Expr) {
 		info.ElemKind = a.exprKind(t.Elt)
 		if info.ElemKind == KindStruct {
 			if ident, ok := t.Elt.(*ast.Ident); ok {
-				info.HasClone = a.pkg.HasCloneMethod(ident.Name, a.cloneMethod)
+				info.HasClone = a.hasClone(ident.Name)
 			}
 		}
 		// Check for pointer to struct
 		if star, ok := t.Elt.(*ast.StarExpr); ok {
 			if ident, ok := star.X.(*ast.Ident); ok {
-				info.HasClone = a.pkg.HasCloneMethod(ident.Name, a.cloneMethod)
+				info.HasClone = a.hasClone(ident.Name)
 			}
 		}
 
@@ -203,7 +219,13 @@ func (a *Analyzer) categorizeType(info *FieldInfo, expr ast.Expr) {
 		info.ElemKind = a.exprKind(t.Value)
 		if info.ElemKind == KindStruct {
 			if ident, ok := t.Value.(*ast.Ident); ok {
-				info.HasClone = a.pkg.HasCloneMethod(ident.Name, a.cloneMethod)
+				info.HasClone = a.hasClone(ident.Name)
+			}
+		}
+		// Check for pointer to struct
+		if star, ok := t.Value.(*ast.StarExpr); ok {
+			if ident, ok := star.X.(*ast.Ident); ok {
+				info.HasClone = a.hasClone(ident.Name)
 			}
 		}
 
@@ -0,0 +1,36 @@
+package statediff
+
+import "encoding/json"
+
+// Codec marshals and unmarshals states as JSON (see Config.Codec).
+// Implementations must read and write the same JSON as encoding/json for
+// the same values, as goccy/go-json and jsoniter's
+// ConfigCompatibleWithStandardLibrary do.
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// StdCodec is the encoding/json Codec, used by default
+var StdCodec Codec = stdCodec{}
+
+type stdCodec struct{}
+
+func (stdCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (stdCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// jsonCodec returns the codec states are cloned and validated with
+func (s *State[T, A]) jsonCodec() Codec {
+	if s.codec == nil {
+		return StdCodec
+	}
+	return s.codec
+}
+
+// marshal encodes a value the document walk cannot, with Config.Codec
+func (o *diffOptions) marshal(v any) ([]byte, error) {
+	if o == nil || o.codec == nil {
+		return json.Marshal(v)
+	}
+	return o.codec.Marshal(v)
+}
@@ -0,0 +1,110 @@
+package statediff
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CompactEncoder encodes patches with a path dictionary (see Patch.Compact)
+var CompactEncoder = Encoder{Name: "json-patch+paths", Encode: Patch.Compact}
+
+// CompactPatch is the wire form of Patch.Compact: a per-message dictionary
+// of parent pointers and the ops with their paths shortened against it.
+type CompactPatch struct {
+	Paths []string `json:"paths,omitempty"`
+	Ops   Patch    `json:"ops"`
+}
+
+// Compact encodes the patch as JSON with repeated path prefixes replaced by
+// dictionary references, for entity-heavy states where pointers dominate the
+// payload:
+//
+//	{"paths":["/entities/42"],"ops":[{"op":"replace","path":"0/hp","value":90},
+//	  {"op":"replace","path":"0/mp","value":12}]}
+//
+// A path or from starting with a digit is an index into "paths" followed by
+// the rest of the pointer ("0/hp" is "/entities/42/hp"); real pointers start
+// with "/" or are empty, so both forms can be mixed. Only parents shared by
+// at least two pointers are put in the dictionary. ParseCompact decodes it.
+func (p Patch) Compact() ([]byte, error) {
+	counts := make(map[string]int)
+	for _, op := range p {
+		for _, ptr := range []string{op.Path, op.From} {
+			if parent := parentPtr(ptr); parent != "" {
+				counts[parent]++
+			}
+		}
+	}
+
+	var c CompactPatch
+	refs := make(map[string]string)
+	shorten := func(ptr string) string {
+		parent := parentPtr(ptr)
+		if parent == "" || counts[parent] < 2 {
+			return ptr
+		}
+		ref, ok := refs[parent]
+		if !ok {
+			ref = strconv.Itoa(len(c.Paths))
+			if len(ref) >= len(parent) {
+				return ptr // The reference would not be shorter
+			}
+			refs[parent] = ref
+			c.Paths = append(c.Paths, parent)
+		}
+		return ref + ptr[len(parent):]
+	}
+
+	c.Ops = make(Patch, len(p))
+	for i, op := range p {
+		op.Path = shorten(op.Path)
+		if op.From != "" {
+			op.From = shorten(op.From)
+		}
+		c.Ops[i] = op
+	}
+	return json.Marshal(c)
+}
+
+// ParseCompact decodes a Patch.Compact payload back into a patch
+func ParseCompact(data []byte) (Patch, error) {
+	var c CompactPatch
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("statediff: unmarshal compact patch: %w", err)
+	}
+	expand := func(ptr string) (string, error) {
+		if ptr == "" || ptr[0] < '0' || ptr[0] > '9' {
+			return ptr, nil
+		}
+		ref, rest, found := strings.Cut(ptr, "/")
+		i, err := strconv.Atoi(ref)
+		if err != nil || i >= len(c.Paths) {
+			return "", fmt.Errorf("statediff: invalid path reference %q", ptr)
+		}
+		if !found {
+			return c.Paths[i], nil
+		}
+		return c.Paths[i] + "/" + rest, nil
+	}
+	for i := range c.Ops {
+		var err error
+		if c.Ops[i].Path, err = expand(c.Ops[i].Path); err != nil {
+			return nil, err
+		}
+		if c.Ops[i].From, err = expand(c.Ops[i].From); err != nil {
+			return nil, err
+		}
+	}
+	return c.Ops, nil
+}
+
+// parentPtr returns the pointer without its last segment ("" for top-level
+// members and the root)
+func parentPtr(ptr string) string {
+	if i := strings.LastIndexByte(ptr, '/'); i > 0 {
+		return ptr[:i]
+	}
+	return ""
+}
@@ -0,0 +1,171 @@
+package statediff
+
+import (
+	"maps"
+	"slices"
+	"time"
+)
+
+// Preset is a named set of defaults for a common kind of application.
+// Apply one with ConfigBuilder.Preset; Debounce is a Session setting and is
+// applied separately with Session.SetDebounce.
+type Preset struct {
+	Name           string
+	ArrayStrategy  ArrayStrategy
+	ArrayKeyField  string
+	FloatPrecision map[string]int
+	Debounce       time.Duration // Suggested Session debounce
+}
+
+var (
+	// TurnBasedGame: entities in arrays keyed by "id", every change sent immediately.
+	TurnBasedGame = Preset{
+		Name:          "TurnBasedGame",
+		ArrayStrategy: ArrayByKey,
+		ArrayKeyField: "id",
+	}
+
+	// RealtimeGame: positional arrays, floats trimmed to 3 decimals to avoid
+	// jitter churn, broadcasts coalesced to one per 50ms server tick.
+	RealtimeGame = Preset{
+		Name:           "RealtimeGame",
+		ArrayStrategy:  ArrayByIndex,
+		FloatPrecision: map[string]int{"": 3},
+		Debounce:       50 * time.Millisecond,
+	}
+
+	// CollaborativeDoc: elements keyed by "id" so concurrent inserts do not
+	// rewrite their neighbours, keystroke bursts coalesced over 100ms.
+	CollaborativeDoc = Preset{
+		Name:          "CollaborativeDoc",
+		ArrayStrategy: ArrayByKey,
+		ArrayKeyField: "id",
+		Debounce:      100 * time.Millisecond,
+	}
+)
+
+// ConfigBuilder assembles a Config with a fluent API:
+//
+//	cfg, err := statediff.Configure[Game]().
+//	    Preset(statediff.TurnBasedGame).
+//	    WithCloner(func(g Game) Game { return g.Clone() }).
+//	    KeyFieldFor("/players/*/cards", "uid").
+//	    Build()
+type ConfigBuilder[T any] struct {
+	cfg Config[T]
+}
+
+// Configure starts building a Config for state type T
+func Configure[T any]() *ConfigBuilder[T] {
+	return &ConfigBuilder[T]{}
+}
+
+// Preset applies a preset's defaults. Later builder calls override them.
+func (b *ConfigBuilder[T]) Preset(p Preset) *ConfigBuilder[T] {
+	b.cfg.ArrayStrategy = p.ArrayStrategy
+	b.cfg.ArrayKeyField = p.ArrayKeyField
+	b.cfg.FloatPrecision = nil
+	for path, decimals := range p.FloatPrecision {
+		b.FloatPrecision(path, decimals)
+	}
+	return b
+}
+
+// WithCloner sets the deep-copy function (see Config.Cloner)
+func (b *ConfigBuilder[T]) WithCloner(fn func(T) T) *ConfigBuilder[T] {
+	b.cfg.Cloner = fn
+	return b
+}
+
+// ArraysReplace replaces changed arrays whole (the default)
+func (b *ConfigBuilder[T]) ArraysReplace() *ConfigBuilder[T] {
+	b.cfg.ArrayStrategy = ArrayReplace
+	return b
+}
+
+// ArraysByIndex diffs arrays element by element
+func (b *ConfigBuilder[T]) ArraysByIndex() *ConfigBuilder[T] {
+	b.cfg.ArrayStrategy = ArrayByIndex
+	return b
+}
+
+// IndexedAdds sends ArrayByIndex insertions in the middle of arrays at their
+// index (see Config.ArrayIndexedAdds)
+func (b *ConfigBuilder[T]) IndexedAdds() *ConfigBuilder[T] {
+	b.cfg.ArrayIndexedAdds = true
+	return b
+}
+
+// ArraysLCS diffs arrays with minimal inserts and removes (see ArrayLCS)
+func (b *ConfigBuilder[T]) ArraysLCS() *ConfigBuilder[T] {
+	b.cfg.ArrayStrategy = ArrayLCS
+	return b
+}
+
+// ArraysAuto diffs arrays per element, by key field where one is set, and
+// replaces them whole when more than ratio of their elements changed
+// (see ArrayAuto; 0 uses DefaultArrayAutoRatio)
+func (b *ConfigBuilder[T]) ArraysAuto(ratio float64) *ConfigBuilder[T] {
+	b.cfg.ArrayStrategy = ArrayAuto
+	b.cfg.ArrayAutoRatio = ratio
+	return b
+}
+
+// ArraysByKey matches array elements by the given key field
+func (b *ConfigBuilder[T]) ArraysByKey(keyField string) *ConfigBuilder[T] {
+	b.cfg.ArrayStrategy = ArrayByKey
+	b.cfg.ArrayKeyField = keyField
+	return b
+}
+
+// KeyFieldFor sets the key field for arrays at path (see Config.ArrayKeyFields)
+func (b *ConfigBuilder[T]) KeyFieldFor(path, keyField string) *ConfigBuilder[T] {
+	if b.cfg.ArrayKeyFields == nil {
+		b.cfg.ArrayKeyFields = make(map[string]string)
+	}
+	b.cfg.ArrayKeyFields[path] = keyField
+	return b
+}
+
+// Ignore leaves paths out of diffs and full states (see Config.IgnorePaths)
+func (b *ConfigBuilder[T]) Ignore(paths ...string) *ConfigBuilder[T] {
+	b.cfg.IgnorePaths = append(b.cfg.IgnorePaths, paths...)
+	return b
+}
+
+// PathMapper sets the key renaming function (see Config.PathMapper)
+func (b *ConfigBuilder[T]) PathMapper(fn func(name string) string) *ConfigBuilder[T] {
+	b.cfg.PathMapper = fn
+	return b
+}
+
+// FloatPrecision rounds emitted floats under path (see Config.FloatPrecision)
+func (b *ConfigBuilder[T]) FloatPrecision(path string, decimals int) *ConfigBuilder[T] {
+	if b.cfg.FloatPrecision == nil {
+		b.cfg.FloatPrecision = make(map[string]int)
+	}
+	b.cfg.FloatPrecision[path] = decimals
+	return b
+}
+
+// Build validates and returns the configuration
+func (b *ConfigBuilder[T]) Build() (*Config[T], error) {
+	cfg := b.cfg
+	// Copy maps and slices so further builder calls don't modify the returned Config
+	cfg.ArrayKeyFields = maps.Clone(cfg.ArrayKeyFields)
+	cfg.FloatPrecision = maps.Clone(cfg.FloatPrecision)
+	cfg.IgnorePaths = slices.Clone(cfg.IgnorePaths)
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// MustBuild is like Build but panics on an invalid configuration
+func (b *ConfigBuilder[T]) MustBuild() *Config[T] {
+	cfg, err := b.Build()
+	if err != nil {
+		panic(err)
+	}
+	return cfg
+}
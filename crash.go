@@ -0,0 +1,70 @@
+package statediff
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// CrashDump captures the state at the moment of a panic inside Update, Set
+// or Diff (including panics in clones, effects and projections), so
+// production crashes can be reproduced locally. Serializable as JSON.
+type CrashDump struct {
+	Time        time.Time       `json:"time"`
+	Op          string          `json:"op"`    // "update", "set" or "diff"
+	Panic       string          `json:"panic"` // fmt.Sprint of the recovered value
+	Stack       string          `json:"stack"`
+	Base        json.RawMessage `json:"base,omitempty"`      // Base state without effects
+	BaseError   string          `json:"baseError,omitempty"` // Why Base could not be captured
+	Effects     []string        `json:"effects"`             // Effect IDs in application order
+	EffectMetas []EffectMeta    `json:"effectMetas,omitempty"`
+	LastPatch   Patch           `json:"lastPatch,omitempty"` // Last diff computed before the panic
+}
+
+// recoverCrash is deferred by guarded operations. It builds a CrashDump,
+// passes it to Config.OnPanic and re-panics. Caller must hold mu (read or
+// write) for the deferred call, so the dump sees a consistent state.
+func (s *State[T, A]) recoverCrash(op string) {
+	if s.onPanic == nil {
+		return
+	}
+	r := recover()
+	if r == nil {
+		return
+	}
+	dump := CrashDump{
+		Time:  time.Now(),
+		Op:    op,
+		Panic: fmt.Sprint(r),
+		Stack: string(debug.Stack()),
+	}
+	s.dumpState(&dump)
+	if p := s.lastPatch.Load(); p != nil {
+		dump.LastPatch = *p
+	}
+	s.onPanic(dump)
+	panic(r)
+}
+
+// dumpState fills the state part of a dump. A state that cannot be encoded
+// (possibly the cause of the panic) is recorded in BaseError.
+func (s *State[T, A]) dumpState(dump *CrashDump) {
+	defer func() {
+		if r := recover(); r != nil {
+			dump.BaseError = fmt.Sprintf("panic while encoding: %v", r)
+		}
+	}()
+	for _, e := range s.effects {
+		dump.Effects = append(dump.Effects, e.ID())
+		if meta, ok := s.effectMeta[e.ID()]; ok {
+			dump.EffectMetas = append(dump.EffectMetas, meta)
+		}
+	}
+	data, err := s.jsonCodec().Marshal(s.current)
+	if err != nil {
+		dump.BaseError = err.Error()
+		return
+	}
+	dump.Base = data
+}
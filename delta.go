@@ -0,0 +1,123 @@
+package statediff
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// maxExactFloat is the largest integer every float64 below it represents exactly
+const maxExactFloat = 1 << 53
+
+// numberDelta returns new - old when both are whole numbers whose
+// difference is exact, for Config.NumericDeltas. The delta has the type of
+// new: float64, or json.Number with UseNumber.
+func numberDelta(old, new any) (any, bool) {
+	switch n := new.(type) {
+	case float64:
+		o, ok := old.(float64)
+		if !ok || !wholeFloat(o) || !wholeFloat(n) {
+			return nil, false
+		}
+		return n - o, true
+	case json.Number:
+		o, ok := old.(json.Number)
+		if !ok {
+			return nil, false
+		}
+		a, errA := o.Int64()
+		b, errB := n.Int64()
+		if errA != nil || errB != nil || (b < a) != (b-a < 0) {
+			return nil, false // Not integers, or the difference overflows
+		}
+		return json.Number(strconv.FormatInt(b-a, 10)), true
+	}
+	return nil, false
+}
+
+func wholeFloat(f float64) bool {
+	return f == math.Trunc(f) && math.Abs(f) <= maxExactFloat
+}
+
+// addNumber returns cur + delta for an "inc" op. Integers are added
+// exactly; the result has the type of cur.
+func addNumber(cur, delta any) (any, error) {
+	switch delta.(type) {
+	case json.Number, float64:
+	default: // Go numbers in hand-built ops
+		if v, err := toJSONValue(delta); err == nil {
+			delta = v
+		}
+	}
+	if d, ok := delta.(json.Number); ok {
+		if i, err := d.Int64(); err == nil {
+			delta = i
+		}
+	}
+	switch c := cur.(type) {
+	case json.Number:
+		if a, err := c.Int64(); err == nil {
+			if b, ok := delta.(int64); ok && (a+b < a) == (b < 0) {
+				return json.Number(strconv.FormatInt(a+b, 10)), nil
+			}
+		}
+		f, err := c.Float64()
+		if err != nil {
+			return nil, err
+		}
+		d, ok := deltaFloat(delta)
+		if !ok {
+			return nil, fmt.Errorf("statediff: inc value %v is not a number", delta)
+		}
+		return json.Number(strconv.FormatFloat(f+d, 'g', -1, 64)), nil
+	case float64:
+		d, ok := deltaFloat(delta)
+		if !ok {
+			return nil, fmt.Errorf("statediff: inc value %v is not a number", delta)
+		}
+		return c + d, nil
+	}
+	return nil, fmt.Errorf("statediff: inc target is not a number")
+}
+
+func deltaFloat(v any) (float64, bool) {
+	if i, ok := v.(int64); ok {
+		return float64(i), true
+	}
+	return numberValue(v)
+}
+
+// Standard returns the patch with every "inc" op of Config.NumericDeltas
+// turned back into the replace of the new value, for clients that only
+// apply RFC 6902 ops. Fails on inc ops decoded from JSON, which no longer
+// carry the value.
+func (p Patch) Standard() (Patch, error) {
+	out := make(Patch, len(p))
+	for i, op := range p {
+		if op.Op == "inc" {
+			if op.set == nil {
+				return nil, fmt.Errorf("statediff: inc op %q has no value to replace with", op.Path)
+			}
+			op = Op{Op: "replace", Path: op.Path, Value: op.set, Old: op.Old}
+		}
+		out[i] = op
+	}
+	return out, nil
+}
+
+// StandardOps wraps an encoder, encoding patches with Patch.Standard, for
+// Session clients that do not understand "inc" ops.
+// The resulting encoder is named enc.Name + "+standard".
+func StandardOps(enc Encoder) Encoder {
+	return Encoder{
+		Name: enc.Name + "+standard",
+		Encode: func(p Patch) ([]byte, error) {
+			std, err := p.Standard()
+			if err != nil {
+				return nil, err
+			}
+			return enc.Encode(std)
+		},
+	}
+}
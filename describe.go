@@ -0,0 +1,211 @@
+package statediff
+
+import (
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// TypeDesc describes the JSON document of a state type as statediff sees it,
+// for tooling such as schema and client type generators or inspectors.
+type TypeDesc struct {
+	// Kind is the JSON shape: "object", "array", "map", "string", "number",
+	// "bool", or "any" for interfaces and types with custom marshaling
+	Kind   string `json:"kind"`
+	GoType string `json:"goType"`
+	// Nullable is set for pointers, interfaces and NullPaths members
+	Nullable bool `json:"nullable,omitempty"`
+	// Fields are the members of an object, in declaration order
+	Fields []FieldDesc `json:"fields,omitempty"`
+	// Elem describes array elements and map values
+	Elem *TypeDesc `json:"elem,omitempty"`
+	// KeyField is the key field of an array diffed with ArrayByKey or
+	// ArrayAuto. With KeyedArraysAsObjects such arrays are described as
+	// maps keyed by it.
+	KeyField string `json:"keyField,omitempty"`
+	// Ref names the enclosing GoType a recursive type refers back to; the
+	// description is not repeated
+	Ref string `json:"ref,omitempty"`
+}
+
+// FieldDesc describes an object member
+type FieldDesc struct {
+	Name      string            `json:"name"`     // Go field name
+	JSONName  string            `json:"jsonName"` // As emitted (after PathMapper)
+	Path      string            `json:"path"`     // JSON Pointer pattern, "*" for array and map elements
+	OmitEmpty bool              `json:"omitEmpty,omitempty"`
+	Encrypted bool              `json:"encrypted,omitempty"` // Matches EncryptPaths
+	Tag       reflect.StructTag `json:"tag,omitempty"`       // Full struct tag, e.g. for visibility tags
+	Type      *TypeDesc         `json:"type"`
+}
+
+// Describe returns the document model of T under cfg (nil for defaults):
+// fields with their emitted names and paths, keyed arrays, and the struct
+// tags, so tools share one model instead of re-parsing tags themselves.
+func Describe[T any](cfg *Config[T]) *TypeDesc {
+	d := describer{inProgress: make(map[reflect.Type]bool)}
+	if cfg != nil {
+		d.arrays = ArrayConfig{Strategy: cfg.ArrayStrategy, KeyField: cfg.ArrayKeyField, KeyFields: cfg.ArrayKeyFields, keyRules: newKeyRules(cfg.ArrayKeyFields)}
+		d.mapKey = cfg.PathMapper
+		d.keyedObjects = cfg.KeyedArraysAsObjects
+		d.omit = cfg.OmitEmpty
+		for _, p := range cfg.EncryptPaths {
+			d.encrypted = append(d.encrypted, splitPtr(p))
+		}
+		for _, p := range cfg.NullPaths {
+			d.nulls = append(d.nulls, splitPtr(p))
+		}
+		for _, p := range cfg.IgnorePaths {
+			d.ignored = append(d.ignored, splitPtr(p))
+		}
+	}
+	return d.describe(reflect.TypeOf((*T)(nil)).Elem(), nil)
+}
+
+type describer struct {
+	arrays       ArrayConfig
+	mapKey       func(string) string
+	keyedObjects bool
+	omit         OmitEmptyPolicy
+	encrypted    [][]string
+	nulls        [][]string
+	ignored      [][]string            // Members left out of the document
+	inProgress   map[reflect.Type]bool // Struct types on the current path, for recursion
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+func (d *describer) describe(t reflect.Type, path []string) *TypeDesc {
+	desc := &TypeDesc{GoType: t.String()}
+	for t.Kind() == reflect.Pointer {
+		desc.Nullable = true
+		t = t.Elem()
+	}
+
+	switch {
+	case t.Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(jsonMarshalerType):
+		desc.Kind = "any"
+		return desc
+	case t.Implements(textMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType):
+		desc.Kind = "string"
+		return desc
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		desc.Kind = "bool"
+	case reflect.String:
+		desc.Kind = "string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		desc.Kind = "number"
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 && t.Kind() == reflect.Slice {
+			desc.Kind = "string" // []byte is base64
+			break
+		}
+		desc.Kind = "array"
+		elemPath := append(append([]string(nil), path...), "*")
+		desc.Elem = d.describe(t.Elem(), elemPath)
+		if d.arrays.Strategy == ArrayByKey || d.arrays.Strategy == ArrayAuto {
+			desc.KeyField = d.arrays.keyField(joinPtr(path))
+			if d.keyedObjects && desc.KeyField != "" {
+				desc.Kind = "map"
+			}
+		}
+	case reflect.Map:
+		desc.Kind = "map"
+		desc.Elem = d.describe(t.Elem(), append(append([]string(nil), path...), "*"))
+	case reflect.Struct:
+		desc.Kind = "object"
+		if d.inProgress[t] {
+			desc.Ref = t.String()
+			return desc
+		}
+		d.inProgress[t] = true
+		desc.Fields = d.fields(t, path)
+		delete(d.inProgress, t)
+	case reflect.Interface:
+		desc.Kind = "any"
+		desc.Nullable = true
+	default:
+		desc.Kind = "any"
+	}
+	return desc
+}
+
+// fields lists the JSON members of struct t, inlining untagged embedded
+// structs as encoding/json does
+func (d *describer) fields(t reflect.Type, path []string) []FieldDesc {
+	var out []FieldDesc
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				out = append(out, d.fields(ft, path)...)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if d.mapKey != nil {
+			name = d.mapKey(name)
+		}
+
+		fieldPath := append(append([]string(nil), path...), name)
+		if matchAny(d.ignored, fieldPath) {
+			continue
+		}
+		fd := FieldDesc{
+			Name:      f.Name,
+			JSONName:  name,
+			Path:      joinPtr(fieldPath),
+			OmitEmpty: strings.Contains(","+opts+",", ",omitempty,") && d.omit.mayOmit(f.Type),
+			Encrypted: matchAny(d.encrypted, fieldPath),
+			Tag:       f.Tag,
+			Type:      d.describe(f.Type, fieldPath),
+		}
+		if matchAny(d.nulls, fieldPath) {
+			fd.Type.Nullable = true
+		}
+		out = append(out, fd)
+	}
+	return out
+}
+
+func matchAny(patterns [][]string, path []string) bool {
+	for _, p := range patterns {
+		if matchPattern(p, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// joinPtr builds a JSON Pointer from unescaped segments
+func joinPtr(segs []string) string {
+	var b strings.Builder
+	for _, s := range segs {
+		b.WriteByte('/')
+		b.WriteString(escapePtr(s))
+	}
+	return b.String()
+}
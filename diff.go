@@ -3,18 +3,37 @@ package statediff
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"reflect"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 )
 
-// Patch is a list of operations (RFC 6902 JSON Patch compatible)
+// Patch is a list of operations (RFC 6902 JSON Patch compatible).
+//
+// Ops must be applied strictly in sequence: every path refers to the document
+// as left by the ops before it. Diffs rely on this for arrays:
+//   - removes from one array come first, in descending index order, so each
+//     index is still valid when its op is reached
+//   - with DetectMoves, moves restoring the order of reordered keyed
+//     elements follow them
+//   - adds and changes follow in ascending final-index order; an add at an
+//     index inserts there, and "/-" appends after the last element
+//
+// Any RFC 6902 applier that processes ops in order handles these patches.
 type Patch []Op
 
 // Op represents a single patch operation
 type Op struct {
-	Op    string `json:"op"`              // "add", "remove", "replace"
+	Op    string `json:"op"`              // "add", "remove", "replace", "move", "copy", or "inc" with Config.NumericDeltas
 	Path  string `json:"path"`            // JSON Pointer
-	Value any    `json:"value,omitempty"` // New value
+	From  string `json:"from,omitempty"`  // Source pointer of move and copy
+	Value any    `json:"value,omitempty"` // New value, or the amount added by inc
+	Old   any    `json:"old,omitempty"`   // Replaced or removed value, with Config.IncludeOld
+
+	set any // New value of an inc op, for Patch.Standard
 }
 
 // JSON returns the patch as JSON bytes
@@ -30,10 +49,196 @@ func (p Patch) Empty() bool {
 	return len(p) == 0
 }
 
+// Normalize returns a copy of the patch in the strict form some third-party
+// RFC 6902 libraries require: add, replace and test ops carry an explicit
+// "value": null instead of omitting the member when the value is null.
+// Op order already follows the sequential contract documented on Patch.
+func (p Patch) Normalize() Patch {
+	out := make(Patch, len(p))
+	for i, op := range p {
+		if op.Value == nil && (op.Op == "add" || op.Op == "replace" || op.Op == "test") {
+			op.Value = json.RawMessage("null")
+		}
+		out[i] = op
+	}
+	return out
+}
+
 // ArrayConfig configures array diff behavior
 type ArrayConfig struct {
 	Strategy ArrayStrategy
 	KeyField string // For ByKey strategy
+
+	// IndexedAdds sends ByIndex insertions and removals in the middle of an
+	// array at their index (see Config.ArrayIndexedAdds)
+	IndexedAdds bool
+
+	// AutoRatio is the share of changed elements above which ArrayAuto
+	// replaces an array whole (see Config.ArrayAutoRatio)
+	AutoRatio float64
+
+	// KeyFields overrides KeyField for specific arrays, keyed by the array's
+	// JSON Pointer ("*" matches any segment), e.g. {"/players": "id",
+	// "/players/*/cards": "uid"}. The most specific matching pattern wins;
+	// of equally specific ones, the one whose first literal segment comes
+	// earliest.
+	KeyFields map[string]string
+
+	// Identity optionally gives keyed elements a secondary identity that
+	// survives key changes (see Config.ArrayIdentity)
+	Identity func(path string, elem map[string]any) string
+
+	// KeyFunc optionally computes element keys (see Config.ArrayKeyFunc)
+	KeyFunc func(path string, elem map[string]any) (string, bool)
+
+	keyRules []keyRule    // KeyFields sorted most specific first, nil if not built
+	opts     *diffOptions // State-level options that are not array specific
+	held     *heldLog     // Collects numbers FloatEpsilon held back, nil if not collecting
+}
+
+// diffOptions holds State-level diff options carried alongside ArrayConfig.
+// A nil *diffOptions means all defaults.
+type diffOptions struct {
+	mapKey    func(string) string // Renames object keys in emitted documents
+	precision []precisionRule     // Float rounding, most specific pattern first
+	encrypt   *encryptor          // Values sent encrypted, nil if none
+	derived   []derivedRule       // Ops dropped when clients derive the value
+	nulls     [][]string          // Member patterns sent as null when absent
+	moves     bool                // Emit move and copy ops for relocated values
+	maxOps    int                 // Collapse patches with more ops (0 = no limit)
+	maxBytes  int                 // Collapse patches with more JSON bytes (0 = no limit)
+	rootRatio float64             // Replace the root when more top-level members changed (0 = never)
+	maxDepth  int                 // Replace containers at this depth whole (0 = no limit)
+	epsilon   float64             // Numbers closer than this are unchanged
+	numbers   bool                // Decode numbers as json.Number
+	ignore    [][]string          // Patterns of values left out of documents
+	old       bool                // Set Op.Old on replace and remove ops
+	workers   workerPool          // Goroutines for members of large objects, nil if sequential
+	arrays    *ArrayConfig        // Keyed arrays are sent as objects, nil if not
+	deltas    bool                // Send changed whole numbers as inc ops
+	floats    NonFinitePolicy     // Documents of NaN and ±Inf floats
+	omit      OmitEmptyPolicy     // Fields tagged omitempty left out of documents
+	codec     Codec               // Encodes and decodes what the walk cannot, nil for encoding/json
+	blobs     *blobber            // Large values sent by reference, nil if none
+	strict    bool                // Only RFC 6902 ops, with every required member
+}
+
+// precisionRule rounds floats under a path pattern to a number of decimals
+type precisionRule struct {
+	pattern  []string // Unescaped pointer segments, "*" matches any segment
+	decimals int
+}
+
+// keyField returns the key field for the array at path, as it appears in
+// transformed documents. Returns "" if the array has no key field.
+func (c ArrayConfig) keyField(path string) string {
+	field := c.KeyField
+	if len(c.KeyFields) > 0 {
+		rules := c.keyRules
+		if rules == nil {
+			rules = newKeyRules(c.KeyFields) // ArrayConfig built by the caller
+		}
+		segs := splitPtr(path)
+		for _, r := range rules {
+			if matchPattern(r.pattern, segs) {
+				field = r.field
+				break
+			}
+		}
+	}
+	if field != "" && c.opts != nil && c.opts.mapKey != nil {
+		return mapKeyField(field, c.opts.mapKey)
+	}
+	return field
+}
+
+// keyRule sets the key field of arrays under a path pattern
+type keyRule struct {
+	pattern []string // Unescaped pointer segments, "*" matches any segment
+	field   string
+}
+
+// newKeyRules sorts KeyFields most specific first. Of patterns with as many
+// literal segments, the one whose first literal comes earliest wins.
+func newKeyRules(m map[string]string) []keyRule {
+	rules := make([]keyRule, 0, len(m))
+	for path, field := range m {
+		rules = append(rules, keyRule{pattern: splitPtr(path), field: field})
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		a, b := rules[i].pattern, rules[j].pattern
+		if specificity(a) != specificity(b) {
+			return specificity(a) > specificity(b)
+		}
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if (a[k] == "*") != (b[k] == "*") {
+				return b[k] == "*"
+			}
+		}
+		return strings.Join(a, "/") < strings.Join(b, "/")
+	})
+	return rules
+}
+
+// mapKeyField renames each member of a (possibly nested or composite) key field
+func mapKeyField(field string, mapKey func(string) string) string {
+	switch {
+	case strings.Contains(field, ","):
+		parts := strings.Split(field, ",")
+		for i, p := range parts {
+			parts[i] = mapKeyField(p, mapKey)
+		}
+		return strings.Join(parts, ",")
+	case strings.HasPrefix(field, "/"):
+		segs := splitPtr(field)
+		for i, s := range segs {
+			segs[i] = escapePtr(mapKey(s))
+		}
+		return "/" + strings.Join(segs, "/")
+	case strings.Contains(field, "."):
+		segs := strings.Split(field, ".")
+		for i, s := range segs {
+			segs[i] = mapKey(s)
+		}
+		return strings.Join(segs, ".")
+	default:
+		return mapKey(field)
+	}
+}
+
+// keyer returns the key extractor for the array at path, or nil if its
+// elements are not keyed. KeyFunc takes precedence; elements it declines
+// fall back to the key field.
+func (c ArrayConfig) keyer(path string) func(v any) (string, bool) {
+	keyField := c.keyField(path)
+	if c.KeyFunc == nil {
+		if keyField == "" {
+			return nil
+		}
+		return func(v any) (string, bool) { return elementKey(v, keyField) }
+	}
+	return func(v any) (string, bool) {
+		if m, ok := v.(map[string]any); ok {
+			if k, ok := c.KeyFunc(path, m); ok {
+				return k, true
+			}
+		}
+		if keyField == "" {
+			return "", false
+		}
+		return elementKey(v, keyField)
+	}
+}
+
+// specificity ranks patterns of equal length: literal segments beat "*"
+func specificity(pattern []string) int {
+	n := 0
+	for _, p := range pattern {
+		if p != "*" {
+			n++
+		}
+	}
+	return n
 }
 
 // ArrayStrategy determines how arrays are diffed
@@ -42,29 +247,312 @@ type ArrayStrategy int
 const (
 	ArrayReplace ArrayStrategy = iota // Replace entire array (default)
 	ArrayByIndex                      // Diff per index
-	ArrayByKey                        // Match by key field (NOTE: does not track order changes)
+	ArrayByKey                        // Match by key field (reorders replace the array, or are moves with DetectMoves)
+	ArrayLCS                          // Minimal inserts and removes (primitives, unkeyed objects)
+	ArrayAuto                         // Per element (by key, else LCS), or whole when most elements changed
 )
 
+// DiffValues diffs two values without a State, e.g. a loaded save file
+// against the live state or two historical snapshots. cfg sets the array
+// strategy like Config's Array fields; pass State.DiffConfig to diff with
+// all of a state's options (PathMapper, FloatPrecision, ...) as its own
+// diffs do.
+func DiffValues[T any](old, new T, cfg ArrayConfig) (Patch, error) {
+	cfg.keyRules = newKeyRules(cfg.KeyFields) // KeyFields may have been changed
+	return calcDiff(old, new, cfg)
+}
+
 // calcDiff computes the diff between two values
 func calcDiff[T any](old, new T, cfg ArrayConfig) (Patch, error) {
-	oldData, err := json.Marshal(old)
+	oldDoc, err := toDocument(old, cfg)
 	if err != nil {
 		return nil, err
 	}
-	newData, err := json.Marshal(new)
+	return diffDocument(oldDoc, new, cfg)
+}
+
+// diffDocument diffs new against the document of the old value, as built
+// by toDocument. oldDoc is only modified with IncludeOld.
+func diffDocument[T any](oldDoc any, new T, cfg ArrayConfig) (Patch, error) {
+	newDoc, err := toDocument(new, cfg)
 	if err != nil {
 		return nil, err
 	}
+	return diffDocuments(oldDoc, newDoc, cfg), nil
+}
+
+// diffDocuments diffs two documents built by toDocument. oldDoc is only
+// modified with IncludeOld.
+func diffDocuments(oldDoc, newDoc any, cfg ArrayConfig) Patch {
+	patch := cfg.opts.capSize(cfg.opts.finish(diffRoot(oldDoc, newDoc, cfg)), newDoc)
+	return cfg.opts.withOld(patch, oldDoc)
+}
+
+// finish post-processes a complete diff according to the options
+func (o *diffOptions) finish(p Patch) Patch {
+	return o.explicitNulls(o.suppressDerived(p))
+}
+
+// diffRoot diffs two documents of any JSON type. Object roots are diffed
+// member by member, with null (a nil map) treated as an empty object; other
+// roots (arrays, scalars) are diffed like any nested value at path "".
+func diffRoot(old, new any, cfg ArrayConfig) Patch {
+	oldMap, oldObj := objectRoot(old)
+	newMap, newObj := objectRoot(new)
+	if oldObj && newObj {
+		return diffMaps("", oldMap, newMap, cfg)
+	}
+	return diffValues("", old, new, cfg)
+}
+
+// objectRoot returns doc as an object if it is one or null
+func objectRoot(doc any) (map[string]any, bool) {
+	if doc == nil {
+		return nil, true
+	}
+	m, ok := doc.(map[string]any)
+	return m, ok
+}
 
-	var oldMap, newMap map[string]any
-	if err := json.Unmarshal(oldData, &oldMap); err != nil {
-		return nil, fmt.Errorf("unmarshal old state: %w", err)
+// needsTransform reports whether documents must be rewritten before they are
+// diffed or sent, in which case full-state payloads are built from a generic
+// document instead of the typed value.
+func (o *diffOptions) needsTransform() bool {
+	return o != nil && (o.mapKey != nil || len(o.precision) > 0 || o.encrypt != nil || len(o.nulls) > 0 || len(o.ignore) > 0 || o.arrays != nil || o.floats != NonFiniteReject || o.omit != OmitEmptyTags || o.blobs != nil)
+}
+
+// transform rewrites a decoded JSON document according to the options.
+// The document is modified in place where possible; the result must be used.
+func (o *diffOptions) transform(doc any) any {
+	if o == nil {
+		return doc
+	}
+	if o.mapKey != nil {
+		doc = renameKeys(doc, o.mapKey)
+	}
+	if o.arrays != nil {
+		doc = o.objectArrays(doc, "")
+	}
+	if len(o.ignore) > 0 {
+		doc = o.dropIgnored(doc)
+	}
+	if len(o.nulls) > 0 {
+		doc = o.fillNulls(doc)
+	}
+	if len(o.precision) > 0 {
+		doc = o.roundFloats(doc, nil, -1)
 	}
-	if err := json.Unmarshal(newData, &newMap); err != nil {
-		return nil, fmt.Errorf("unmarshal new state: %w", err)
+	if o.blobs != nil {
+		doc = o.blobs.replace(doc, nil)
 	}
+	if o.encrypt != nil {
+		doc = o.encrypt.seal(doc, nil)
+	}
+	return doc
+}
 
-	return diffMaps("", oldMap, newMap, cfg), nil
+// newPrecisionRules converts Config.FloatPrecision into rules ordered so that
+// the most specific (longest) pattern is matched first.
+func newPrecisionRules(m map[string]int) []precisionRule {
+	rules := make([]precisionRule, 0, len(m))
+	for path, decimals := range m {
+		rules = append(rules, precisionRule{pattern: splitPtr(path), decimals: decimals})
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if len(rules[i].pattern) != len(rules[j].pattern) {
+			return len(rules[i].pattern) > len(rules[j].pattern)
+		}
+		return strings.Join(rules[i].pattern, "/") < strings.Join(rules[j].pattern, "/")
+	})
+	return rules
+}
+
+// roundFloats rounds numbers in doc according to the precision rules.
+// decimals is the precision inherited from the parent (-1 means none).
+func (o *diffOptions) roundFloats(doc any, path []string, decimals int) any {
+	for _, r := range o.precision {
+		if matchPattern(r.pattern, path) {
+			decimals = r.decimals
+			break
+		}
+	}
+	switch v := doc.(type) {
+	case map[string]any:
+		for k, val := range v {
+			v[k] = o.roundFloats(val, append(path, k), decimals)
+		}
+	case []any:
+		for i, val := range v {
+			v[i] = o.roundFloats(val, append(path, fmt.Sprint(i)), decimals)
+		}
+	case float64:
+		if decimals >= 0 {
+			scale := math.Pow(10, float64(decimals))
+			return math.Round(v*scale) / scale
+		}
+	case json.Number:
+		// Integers are exact already; only fractions are rounded
+		if decimals >= 0 && strings.ContainsAny(string(v), ".eE") {
+			if f, err := v.Float64(); err == nil {
+				scale := math.Pow(10, float64(decimals))
+				return json.Number(strconv.FormatFloat(math.Round(f*scale)/scale, 'f', -1, 64))
+			}
+		}
+	}
+	return doc
+}
+
+// matchPattern reports whether pattern matches path exactly, segment by segment.
+// A "*" pattern segment matches any single path segment.
+func matchPattern(pattern, path []string) bool {
+	if len(pattern) != len(path) {
+		return false
+	}
+	for i, p := range pattern {
+		if p != "*" && p != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// splitPtr splits a JSON Pointer into unescaped segments ("" -> nil)
+func splitPtr(ptr string) []string {
+	if ptr == "" || ptr == "/" {
+		return nil
+	}
+	parts := strings.Split(strings.TrimPrefix(ptr, "/"), "/")
+	for i, p := range parts {
+		parts[i] = unescapePtr(p)
+	}
+	return parts
+}
+
+// renameKeys recursively renames all object keys in a decoded JSON document
+func renameKeys(doc any, fn func(string) string) any {
+	switch v := doc.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, val := range v {
+			out[fn(k)] = renameKeys(val, fn)
+		}
+		return out
+	case []any:
+		for i := range v {
+			v[i] = renameKeys(v[i], fn)
+		}
+		return v
+	default:
+		return doc
+	}
+}
+
+// toDocument converts a value to the transformed generic document that is
+// diffed and sent to clients.
+func toDocument(v any, cfg ArrayConfig) (any, error) {
+	doc, err := cfg.opts.document(v)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.opts.transform(doc), nil
+}
+
+// decode decodes a JSON document, keeping numbers exact as json.Number
+// with Config.UseNumber
+func (o *diffOptions) decode(data []byte) (any, error) {
+	if o != nil && o.numbers {
+		return decodeJSON(data)
+	}
+	var doc any
+	if o != nil && o.codec != nil {
+		if err := o.codec.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		return doc, nil
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// numberValue returns the value of a decoded JSON number
+func numberValue(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// heldNumber is a number change FloatEpsilon did not send: clients keep
+// sent while the state has cur
+type heldNumber struct {
+	path string
+	sent any
+	cur  float64
+}
+
+// heldLog collects the numbers a diff held back. Safe for the parallel
+// member diffs; a nil log collects nothing.
+type heldLog struct {
+	mu   sync.Mutex
+	nums []heldNumber
+}
+
+func (l *heldLog) add(path string, sent any, cur float64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.nums = append(l.nums, heldNumber{path: path, sent: sent, cur: cur})
+	l.mu.Unlock()
+}
+
+// restoreHeld sets held back numbers in a document of the previous state to
+// the values clients have, so the next diff measures drift from those. A
+// number is only restored where the document still has the held value.
+// The document is modified in place; the result must be used.
+func restoreHeld(doc any, held []heldNumber) any {
+	for _, h := range held {
+		if segs, err := parsePtr(h.path); err == nil {
+			doc = restoreNumber(doc, segs, h)
+		}
+	}
+	return doc
+}
+
+func restoreNumber(doc any, segs []string, h heldNumber) any {
+	if len(segs) == 0 {
+		if n, ok := numberValue(doc); ok && n == h.cur {
+			return h.sent
+		}
+		return doc
+	}
+	switch v := doc.(type) {
+	case map[string]any:
+		if c, ok := v[segs[0]]; ok {
+			v[segs[0]] = restoreNumber(c, segs[1:], h)
+		}
+	case []any:
+		if i, err := strconv.Atoi(segs[0]); err == nil && i >= 0 && i < len(v) {
+			v[i] = restoreNumber(v[i], segs[1:], h)
+		}
+	}
+	return doc
+}
+
+// patchCovers reports whether an add or replace of the patch sets path
+func patchCovers(p Patch, path string) bool {
+	for _, op := range p {
+		if (op.Op == "add" || op.Op == "replace") && (op.Path == "" || op.Path == path || strings.HasPrefix(path, op.Path+"/")) {
+			return true
+		}
+	}
+	return false
 }
 
 func diffMaps(path string, old, new map[string]any, cfg ArrayConfig) Patch {
@@ -85,12 +573,19 @@ func diffMaps(path string, old, new map[string]any, cfg ArrayConfig) Patch {
 	sort.Strings(newKeys)
 
 	// Removed and changed (in sorted order)
-	for _, k := range oldKeys {
+	var changed []Patch
+	if cfg.opts.parallel(len(oldKeys)) {
+		changed = cfg.opts.diffMembers(path, oldKeys, old, new, cfg)
+	}
+	for i, k := range oldKeys {
 		kPath := path + "/" + escapePtr(k)
 		newV, exists := new[k]
-		if !exists {
+		switch {
+		case !exists:
 			ops = append(ops, Op{Op: "remove", Path: kPath})
-		} else {
+		case changed != nil:
+			ops = append(ops, changed[i]...)
+		default:
 			ops = append(ops, diffValues(kPath, old[k], newV, cfg)...)
 		}
 	}
@@ -102,7 +597,13 @@ func diffMaps(path string, old, new map[string]any, cfg ArrayConfig) Patch {
 		}
 	}
 
-	return ops
+	return cfg.opts.memberMoves(path, old, new, ops)
+}
+
+// pastDepth reports whether a container at path is past the MaxDiffDepth
+// limit and is replaced whole. Primitive leaves are always diffed.
+func (o *diffOptions) pastDepth(path string) bool {
+	return o != nil && o.maxDepth > 0 && strings.Count(path, "/") >= o.maxDepth
 }
 
 func diffValues(path string, old, new any, cfg ArrayConfig) Patch {
@@ -117,15 +618,37 @@ func diffValues(path string, old, new any, cfg ArrayConfig) Patch {
 
 	// Nested object
 	if oldMap, ok := old.(map[string]any); ok {
+		if cfg.opts.pastDepth(path) {
+			return Patch{{Op: "replace", Path: path, Value: new}}
+		}
 		return diffMaps(path, oldMap, new.(map[string]any), cfg)
 	}
 
 	// Array
 	if oldArr, ok := old.([]any); ok {
+		if cfg.opts.pastDepth(path) {
+			return Patch{{Op: "replace", Path: path, Value: new}}
+		}
 		return diffArrays(path, oldArr, new.([]any), cfg)
 	}
 
 	// Primitive
+	if raw, ok := old.(json.RawMessage); ok && sameRaw(raw, new.(json.RawMessage)) {
+		return nil
+	}
+	if cfg.opts != nil && cfg.opts.epsilon > 0 {
+		o, okOld := numberValue(old)
+		n, okNew := numberValue(new)
+		if okOld && okNew && math.Abs(o-n) <= cfg.opts.epsilon {
+			cfg.held.add(path, old, n)
+			return nil
+		}
+	}
+	if cfg.opts != nil && cfg.opts.deltas {
+		if d, ok := numberDelta(old, new); ok {
+			return Patch{{Op: "inc", Path: path, Value: d, set: new}}
+		}
+	}
 	return Patch{{Op: "replace", Path: path, Value: new}}
 }
 
@@ -135,6 +658,10 @@ func diffArrays(path string, old, new []any, cfg ArrayConfig) Patch {
 		return diffArraysByIndex(path, old, new, cfg)
 	case ArrayByKey:
 		return diffArraysByKey(path, old, new, cfg)
+	case ArrayLCS:
+		return diffArraysLCS(path, old, new, cfg)
+	case ArrayAuto:
+		return diffArraysAuto(path, old, new, cfg)
 	default:
 		if !reflect.DeepEqual(old, new) {
 			return Patch{{Op: "replace", Path: path, Value: new}}
@@ -144,6 +671,9 @@ func diffArrays(path string, old, new []any, cfg ArrayConfig) Patch {
 }
 
 func diffArraysByIndex(path string, old, new []any, cfg ArrayConfig) Patch {
+	if cfg.IndexedAdds {
+		return diffArraysByIndexAligned(path, old, new, cfg)
+	}
 	var ops Patch
 	minLen := min(len(old), len(new))
 
@@ -165,33 +695,86 @@ func diffArraysByIndex(path string, old, new []any, cfg ArrayConfig) Patch {
 	return ops
 }
 
-func diffArraysByKey(path string, old, new []any, cfg ArrayConfig) Patch {
-	if cfg.KeyField == "" {
-		return Patch{{Op: "replace", Path: path, Value: new}}
+// diffArraysByIndexAligned is diffArraysByIndex that first matches the
+// unchanged leading and trailing elements, so an insertion or removal in the
+// middle is one add or remove at its index. Removes come first (descending),
+// then changes and adds in ascending index order; adds at the end use "/-".
+func diffArraysByIndexAligned(path string, old, new []any, cfg ArrayConfig) Patch {
+	minLen := min(len(old), len(new))
+	prefix := 0
+	for prefix < minLen && reflect.DeepEqual(old[prefix], new[prefix]) {
+		prefix++
 	}
+	suffix := 0
+	for suffix < minLen-prefix && reflect.DeepEqual(old[len(old)-1-suffix], new[len(new)-1-suffix]) {
+		suffix++
+	}
+	oldMid, newMid := old[prefix:len(old)-suffix], new[prefix:len(new)-suffix]
+	common := min(len(oldMid), len(newMid))
 
-	getKey := func(v any) (string, bool) {
-		if m, ok := v.(map[string]any); ok {
-			if k, ok := m[cfg.KeyField]; ok {
-				return fmt.Sprint(k), true
-			}
+	var ops Patch
+	for i := len(oldMid) - 1; i >= common; i-- {
+		ops = append(ops, Op{Op: "remove", Path: fmt.Sprintf("%s/%d", path, prefix+i)})
+	}
+	for i := 0; i < common; i++ {
+		ops = append(ops, diffValues(fmt.Sprintf("%s/%d", path, prefix+i), oldMid[i], newMid[i], cfg)...)
+	}
+	for i := common; i < len(newMid); i++ {
+		p := fmt.Sprintf("%s/%d", path, prefix+i)
+		if suffix == 0 {
+			p = path + "/-"
 		}
-		return "", false
+		ops = append(ops, Op{Op: "add", Path: p, Value: newMid[i]})
+	}
+	return ops
+}
+
+func diffArraysByKey(path string, old, new []any, cfg ArrayConfig) Patch {
+	getKey := cfg.keyer(path)
+	if getKey == nil {
+		return Patch{{Op: "replace", Path: path, Value: new}}
 	}
 
 	oldIdx := make(map[string]int)
 	newIdx := make(map[string]int)
 
 	for i, v := range old {
-		if k, ok := getKey(v); ok {
-			oldIdx[k] = i
+		k, ok := getKey(v)
+		if _, dup := oldIdx[k]; !ok || dup {
+			return Patch{{Op: "replace", Path: path, Value: new}} // Unkeyed or ambiguous
 		}
+		oldIdx[k] = i
 	}
+	newKeys := make([]string, len(new))
 	for i, v := range new {
-		if k, ok := getKey(v); ok {
-			newIdx[k] = i
+		k, ok := getKey(v)
+		if _, dup := newIdx[k]; !ok || dup {
+			return Patch{{Op: "replace", Path: path, Value: new}}
+		}
+		newIdx[k], newKeys[i] = i, k
+	}
+	if cfg.Identity != nil {
+		matchIdentities(path, old, new, oldIdx, newIdx, newKeys, cfg.Identity)
+	}
+
+	// Retained elements must keep their relative order, unless reorders are
+	// sent as moves
+	var retained, reordered []string
+	for _, v := range old {
+		k, _ := getKey(v)
+		if _, kept := newIdx[k]; kept {
+			retained = append(retained, k)
+		}
+	}
+	for _, k := range newKeys {
+		if _, kept := oldIdx[k]; kept {
+			reordered = append(reordered, k)
 		}
 	}
+	inOrder := reflect.DeepEqual(retained, reordered)
+	if !inOrder && (cfg.opts == nil || !cfg.opts.moves) {
+		return Patch{{Op: "replace", Path: path, Value: new}}
+	}
 
 	var ops Patch
 
@@ -208,21 +791,26 @@ func diffArraysByKey(path string, old, new []any, cfg ArrayConfig) Patch {
 	for _, i := range removedIndices {
 		ops = append(ops, Op{Op: "remove", Path: fmt.Sprintf("%s/%d", path, i)})
 	}
+	if !inOrder {
+		ops = append(ops, keyedMoves(path, retained, reordered)...)
+	}
 
 	// Added and changed - iterate over 'new' slice (not map!) to preserve order
 	// This is critical: map iteration order is random in Go, which would cause
 	// non-deterministic patch order and corrupted client state.
+	// Applied in sequence, positions before ni are final when element ni is
+	// reached, so ni is the correct index for both inserts and changes.
+	length := len(old) - len(removedIndices)
 	for ni, v := range new {
-		k, hasKey := getKey(v)
-		if !hasKey {
-			continue // Skip elements without key field
-		}
-
-		if oi, existed := oldIdx[k]; !existed {
-			// New element - add to end
-			ops = append(ops, Op{Op: "add", Path: path + "/-", Value: v})
+		if oi, existed := oldIdx[newKeys[ni]]; !existed {
+			// New element - insert at its index, or append past the last retained one
+			p := fmt.Sprintf("%s/%d", path, ni)
+			if ni == length {
+				p = path + "/-"
+			}
+			ops = append(ops, Op{Op: "add", Path: p, Value: v})
+			length++
 		} else {
-			// Existing element - use ni (new index) for the path
 			ops = append(ops, diffValues(fmt.Sprintf("%s/%d", path, ni), old[oi], new[ni], cfg)...)
 		}
 	}
@@ -230,6 +818,131 @@ func diffArraysByKey(path string, old, new []any, cfg ArrayConfig) Patch {
 	return ops
 }
 
+// elementKey extracts the key of a keyed array element. A key field starting
+// with "/" is a JSON Pointer into the element and one containing "." a
+// dotted path (unless the element has a member of that exact name), for
+// keys in nested objects. Comma-separated fields form a composite key that
+// requires every part.
+func elementKey(v any, keyField string) (string, bool) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return "", false
+	}
+	if strings.Contains(keyField, ",") {
+		parts := strings.Split(keyField, ",")
+		values := make([]string, len(parts))
+		for i, p := range parts {
+			if values[i], ok = elementKey(m, p); !ok {
+				return "", false
+			}
+		}
+		data, _ := json.Marshal(values) // Unambiguous, unlike joining
+		return string(data), true
+	}
+	if k, ok := m[keyField]; ok {
+		return fmt.Sprint(k), true
+	}
+
+	var segs []string
+	switch {
+	case strings.HasPrefix(keyField, "/"):
+		segs = splitPtr(keyField)
+	case strings.Contains(keyField, "."):
+		segs = strings.Split(keyField, ".")
+	default:
+		return "", false
+	}
+	var cur any = m
+	for _, s := range segs {
+		obj, ok := cur.(map[string]any)
+		if !ok {
+			return "", false
+		}
+		if cur, ok = obj[s]; !ok {
+			return "", false
+		}
+	}
+	return fmt.Sprint(cur), true
+}
+
+// matchIdentities pairs removed and added elements with the same secondary
+// identity, re-keying the added element (in newIdx and newKeys) with the
+// removed element's key so it is diffed in place. Identities shared by more
+// than one removed or added element are ignored.
+func matchIdentities(path string, old, new []any, oldIdx, newIdx map[string]int, newKeys []string, identity func(string, map[string]any) string) {
+	removed := make(map[string]string) // Identity -> old key
+	ambiguous := make(map[string]bool)
+	for k, i := range oldIdx {
+		if _, kept := newIdx[k]; kept {
+			continue
+		}
+		if id := elementIdentity(path, old[i], identity); id != "" {
+			if _, dup := removed[id]; dup {
+				ambiguous[id] = true
+			}
+			removed[id] = k
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+	added := make(map[string]int) // Identity -> new index
+	for k, i := range newIdx {
+		if _, existed := oldIdx[k]; existed {
+			continue
+		}
+		if id := elementIdentity(path, new[i], identity); id != "" {
+			if _, dup := added[id]; dup {
+				ambiguous[id] = true
+			}
+			added[id] = i
+		}
+	}
+	for id, i := range added {
+		if oldKey, ok := removed[id]; ok && !ambiguous[id] {
+			delete(newIdx, newKeys[i])
+			newIdx[oldKey], newKeys[i] = i, oldKey
+		}
+	}
+}
+
+func elementIdentity(path string, v any, identity func(string, map[string]any) string) string {
+	if m, ok := v.(map[string]any); ok {
+		return identity(path, m)
+	}
+	return ""
+}
+
+// SnakeCase converts a camelCase or PascalCase name to snake_case.
+// Intended for use as Config.PathMapper:
+//
+//	cfg := &Config[Game]{PathMapper: statediff.SnakeCase}
+//	// "playerName" is emitted as "player_name"
+func SnakeCase(name string) string {
+	out := make([]byte, 0, len(name)+4)
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c >= 'A' && c <= 'Z' {
+			// Start a new word unless this continues an acronym ("userID" -> "user_id")
+			if i > 0 && (name[i-1] < 'A' || name[i-1] > 'Z' ||
+				(i+1 < len(name) && name[i+1] >= 'a' && name[i+1] <= 'z')) && name[i-1] != '_' {
+				out = append(out, '_')
+			}
+			c += 'a' - 'A'
+		}
+		out = append(out, c)
+	}
+	return string(out)
+}
+
+// unescapePtr reverses escapePtr
+func unescapePtr(s string) string {
+	if !strings.Contains(s, "~") {
+		return s
+	}
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~1", "/"), "~0", "~")
+}
+
 // escapePtr escapes JSON Pointer special chars
 func escapePtr(s string) string {
 	out := make([]byte, 0, len(s))
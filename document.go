@@ -0,0 +1,308 @@
+package statediff
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// errNotWalkable makes document fall back to a JSON round trip, for values
+// the walk cannot reproduce exactly (e.g. unexported embedded marshalers)
+var errNotWalkable = errors.New("statediff: value not walkable")
+
+// maxWalkDepth matches the nesting at which encoding/json reports a cycle
+const maxWalkDepth = 1000
+
+// document returns the decoded JSON document of v, exactly as decoding
+// json.Marshal(v) would, by walking the Go value instead of encoding and
+// parsing JSON text. Values with JSON or text marshalers, and anything
+// encoding/json treats specially (",string" fields, invalid UTF-8), still
+// go through JSON. NaN and ±Inf floats follow Config.NonFinite, and
+// json.RawMessage values are kept as they are.
+func (o *diffOptions) document(v any) (any, error) {
+	doc, err := o.walk(reflect.ValueOf(v), 0)
+	if errors.Is(err, errNotWalkable) {
+		data, err := o.marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return o.decode(data)
+	}
+	return doc, err
+}
+
+func (o *diffOptions) walk(v reflect.Value, depth int) (any, error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+	if depth > maxWalkDepth {
+		return nil, errNotWalkable // Let encoding/json report the cycle
+	}
+	t := v.Type()
+	if t.Kind() == reflect.Pointer && t.Elem() == rawMessageType && !v.IsNil() {
+		v, t = v.Elem(), rawMessageType
+	}
+	if t == rawMessageType {
+		if raw := v.Bytes(); len(raw) > 0 && json.Valid(raw) {
+			return json.RawMessage(raw), nil // Kept as sent; see sameRaw
+		}
+	}
+	if t == jsonNumberType || hasMarshaler(v) {
+		return o.viaJSON(v)
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return o.walk(v.Elem(), depth+1)
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if o != nil && o.numbers {
+			return json.Number(strconv.FormatInt(v.Int(), 10)), nil
+		}
+		return float64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if o != nil && o.numbers {
+			return json.Number(strconv.FormatUint(v.Uint(), 10)), nil
+		}
+		return float64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return o.nonFinite(f, t.Bits())
+		}
+		if v.Kind() == reflect.Float64 && (o == nil || !o.numbers) {
+			return f, nil
+		}
+		text := jsonFloat(f, t.Bits())
+		if o != nil && o.numbers {
+			return json.Number(text), nil
+		}
+		return strconv.ParseFloat(text, 64) // float32 values decode from their short form
+	case reflect.String:
+		if !utf8.ValidString(v.String()) {
+			return o.viaJSON(v)
+		}
+		return v.String(), nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil, nil
+		}
+		if isByteSlice(t) {
+			return base64.StdEncoding.EncodeToString(v.Bytes()), nil
+		}
+		fallthrough
+	case reflect.Array:
+		arr := make([]any, v.Len())
+		for i := range arr {
+			var err error
+			if arr[i], err = o.walk(v.Index(i), depth+1); err != nil {
+				return nil, inElement(err, i)
+			}
+		}
+		return arr, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return nil, nil
+		}
+		if k := t.Key().Kind(); k != reflect.String && !t.Key().Implements(textMarshalerType) &&
+			(k < reflect.Int || k > reflect.Uintptr) {
+			return o.viaJSON(v) // Unsupported key type: encoding/json's error
+		}
+		obj := make(map[string]any, v.Len())
+		for it := v.MapRange(); it.Next(); {
+			if !it.Key().CanInterface() && t.Key().Implements(textMarshalerType) {
+				return nil, errNotWalkable
+			}
+			k, err := mapKeyString(it.Key())
+			if err != nil {
+				return nil, err
+			}
+			if obj[k], err = o.walk(it.Value(), depth+1); err != nil {
+				return nil, inMember(err, k)
+			}
+		}
+		return obj, nil
+	case reflect.Struct:
+		fields, ok := walkableFields(t)
+		if !ok {
+			return o.viaJSON(v)
+		}
+		obj := make(map[string]any, len(fields))
+		for _, f := range fields {
+			fv, ok := fieldByIndex(v, f.index)
+			if !ok || (f.omitEmpty && o.omits(fv)) {
+				continue
+			}
+			var err error
+			if obj[f.name], err = o.walk(fv, depth+1); err != nil {
+				return nil, inMember(err, f.name)
+			}
+		}
+		return obj, nil
+	}
+	return o.viaJSON(v) // Channels, functions, complex numbers: encoding/json's error
+}
+
+// rawMessageType is kept verbatim in documents instead of decoded
+var rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+
+// sameRaw reports whether two raw JSON values are equal: byte-wise, or else
+// as decoded JSON, so formatting and member order are not changes
+func sameRaw(a, b json.RawMessage) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+	da, errA := decodeJSON(a)
+	db, errB := decodeJSON(b)
+	return errA == nil && errB == nil && reflect.DeepEqual(da, db)
+}
+
+// viaJSON converts v through its JSON form
+func (o *diffOptions) viaJSON(v reflect.Value) (any, error) {
+	if !v.CanInterface() {
+		return nil, errNotWalkable
+	}
+	var data []byte
+	var err error
+	if v.CanAddr() && v.Kind() != reflect.Pointer {
+		data, err = o.marshal(v.Addr().Interface()) // Finds pointer-receiver marshalers
+	} else {
+		data, err = o.marshal(v.Interface())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return o.decode(data)
+}
+
+// hasMarshaler reports whether encoding/json would call a JSON or text
+// marshaler for v
+func hasMarshaler(v reflect.Value) bool {
+	t := v.Type()
+	if t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType) {
+		return true
+	}
+	pt := reflect.PointerTo(t)
+	return t.Kind() != reflect.Pointer && v.CanAddr() &&
+		(pt.Implements(jsonMarshalerType) || pt.Implements(textMarshalerType))
+}
+
+// isByteSlice reports whether encoding/json encodes slice type t as base64
+func isByteSlice(t reflect.Type) bool {
+	if t.Elem().Kind() != reflect.Uint8 {
+		return false
+	}
+	pt := reflect.PointerTo(t.Elem())
+	return !pt.Implements(jsonMarshalerType) && !pt.Implements(textMarshalerType)
+}
+
+// jsonFloat formats f as encoding/json does
+func jsonFloat(f float64, bits int) string {
+	abs := math.Abs(f)
+	format := byte('f')
+	if abs != 0 && (bits == 64 && (abs < 1e-6 || abs >= 1e21) ||
+		bits == 32 && (float32(abs) < 1e-6 || float32(abs) >= 1e21)) {
+		format = 'e'
+	}
+	b := strconv.AppendFloat(nil, f, format, -1, bits)
+	if format == 'e' {
+		// Clean up e-09 to e-9
+		if n := len(b); n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+	}
+	return string(b)
+}
+
+type walkableStruct struct {
+	fields []jsonField
+	ok     bool
+}
+
+// walkable caches walkableFields per struct type
+var walkable sync.Map // reflect.Type -> walkableStruct
+
+// walkableFields returns the JSON members of struct type t, or false if
+// encoding/json's rules for t go beyond what jsonFields models: field tag
+// options other than omitempty, tag names it would ignore, members hidden by
+// name conflicts, or recursive embedding.
+func walkableFields(t reflect.Type) ([]jsonField, bool) {
+	if w, ok := walkable.Load(t); ok {
+		return w.(walkableStruct).fields, w.(walkableStruct).ok
+	}
+	w := walkableStruct{ok: plainStruct(t, map[reflect.Type]bool{})}
+	if w.ok {
+		w.fields = jsonFields(t)
+		names := make(map[string]bool, len(w.fields))
+		for _, f := range w.fields {
+			if names[f.name] {
+				w.ok = false
+				break
+			}
+			names[f.name] = true
+		}
+	}
+	walkable.Store(t, w)
+	return w.fields, w.ok
+}
+
+func plainStruct(t reflect.Type, embedding map[reflect.Type]bool) bool {
+	if embedding[t] {
+		return false
+	}
+	embedding[t] = true
+	defer delete(embedding, t)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if opts != "" && opts != "omitempty" {
+			return false
+		}
+		if !validTagName(name) {
+			return false
+		}
+		if !f.Anonymous {
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if name != "" && !f.IsExported() {
+			return false // Named by its tag although unexported
+		}
+		if name == "" && ft.Kind() == reflect.Struct && !plainStruct(ft, embedding) {
+			return false
+		}
+	}
+	return true
+}
+
+// validTagName reports whether encoding/json accepts a tag name
+func validTagName(s string) bool {
+	for _, c := range s {
+		switch {
+		case strings.ContainsRune("!#$%&()*+-./:;<=>?@[]^_{|}~ ", c):
+		case !unicode.IsLetter(c) && !unicode.IsDigit(c):
+			return false
+		}
+	}
+	return true
+}
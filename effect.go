@@ -16,6 +16,17 @@ type Effect[T, A any] interface {
 	SetActivator(activator A)
 }
 
+// CloneableEffect is implemented by effects that can produce an independent
+// copy of themselves. State.Fork uses it so that mutating an effect on one
+// copy (e.g. pushing onto a StackEffect) does not affect the other.
+// All built-in effect types implement it.
+type CloneableEffect[T, A any] interface {
+	Effect[T, A]
+	// CloneEffect returns a copy with its own mutable state.
+	// Scheduled expiration timers are not copied.
+	CloneEffect() Effect[T, A]
+}
+
 // Func creates a simple effect from a function.
 // The function receives the state and activator.
 func Func[T, A any](id string, fn func(state T, activator A) T) *FuncEffect[T, A] {
@@ -48,6 +59,12 @@ func (e *FuncEffect[T, A]) SetActivator(activator A) {
 	e.activator = activator
 }
 
+func (e *FuncEffect[T, A]) CloneEffect() Effect[T, A] {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return &FuncEffect[T, A]{id: e.id, fn: e.fn, activator: e.activator}
+}
+
 // Timed creates an effect that expires after duration.
 // The effect is active immediately and expires after dur.
 // Uses time.Now by default - set TimeFunc to nil to disable time checks,
@@ -183,6 +200,19 @@ func (e *TimedEffect[T, A]) SetActivator(activator A) {
 	e.activator = activator
 }
 
+func (e *TimedEffect[T, A]) CloneEffect() Effect[T, A] {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return &TimedEffect[T, A]{
+		id:        e.id,
+		fn:        e.fn,
+		activator: e.activator,
+		startsAt:  e.startsAt,
+		expiresAt: e.expiresAt,
+		TimeFunc:  e.TimeFunc,
+	}
+}
+
 // Active returns true if the effect is currently active (started and not expired).
 // Returns true if TimeFunc is nil (no time checks).
 func (e *TimedEffect[T, A]) Active() bool {
@@ -395,6 +425,12 @@ func (e *CondEffect[T, A]) SetActivator(activator A) {
 	e.activator = activator
 }
 
+func (e *CondEffect[T, A]) CloneEffect() Effect[T, A] {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return &CondEffect[T, A]{id: e.id, cond: e.cond, fn: e.fn, activator: e.activator}
+}
+
 // Toggle creates an effect that can be enabled/disabled.
 func Toggle[T, A any](id string, fn func(state T, activator A) T) *ToggleEffect[T, A] {
 	return &ToggleEffect[T, A]{id: id, fn: fn, enabled: true}
@@ -432,6 +468,12 @@ func (e *ToggleEffect[T, A]) SetActivator(activator A) {
 	e.activator = activator
 }
 
+func (e *ToggleEffect[T, A]) CloneEffect() Effect[T, A] {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return &ToggleEffect[T, A]{id: e.id, fn: e.fn, activator: e.activator, enabled: e.enabled}
+}
+
 func (e *ToggleEffect[T, A]) Enable() {
 	e.mu.Lock()
 	defer e.mu.Unlock()
@@ -494,6 +536,18 @@ func (e *StackEffect[T, A, V]) SetActivator(activator A) {
 	e.activator = activator
 }
 
+// CloneEffect copies the stack; values themselves are copied shallowly
+func (e *StackEffect[T, A, V]) CloneEffect() Effect[T, A] {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return &StackEffect[T, A, V]{
+		id:        e.id,
+		values:    append([]V(nil), e.values...),
+		activator: e.activator,
+		combine:   e.combine,
+	}
+}
+
 func (e *StackEffect[T, A, V]) Push(v V) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
@@ -523,3 +577,89 @@ func (e *StackEffect[T, A, V]) Count() int {
 	defer e.mu.RUnlock()
 	return len(e.values)
 }
+
+// Query creates an effect whose parameters are derived from the base state,
+// e.g. a damage multiplier equal to the number of allies alive. The selector
+// runs on the base state (without effects) and must not modify it; fn
+// receives the state being transformed and the selected params.
+//
+// Inside a State the params are memoized per change cycle: the selector runs
+// again only after the base state or the effects change, however often the
+// state is read in between. Deriving params here instead of capturing them
+// in a closure keeps them from going stale. Called directly, Apply selects
+// from the state it is given.
+func Query[T, A, P any](id string, selector func(base T) P, fn func(state T, params P, activator A) T) *QueryEffect[T, A, P] {
+	return &QueryEffect[T, A, P]{id: id, selector: selector, fn: fn}
+}
+
+// QueryEffect is an effect parameterized by a selector over the base state
+type QueryEffect[T, A, P any] struct {
+	mu        sync.RWMutex
+	id        string
+	selector  func(T) P
+	fn        func(T, P, A) T
+	activator A
+
+	params  P // Memoized selector result for gen
+	gen     uint64
+	hasMemo bool
+}
+
+// baseQuery is implemented by effects that read the base state; withEffects
+// passes it along with the change-cycle generation for memoization, and
+// ExplainEffects passes a sample base to select from without memoizing
+type baseQuery[T, A any] interface {
+	applyWithBase(gen uint64, base, s T, activator A) T
+	applyFromBase(base, s T, activator A) T
+}
+
+func (e *QueryEffect[T, A, P]) ID() string { return e.id }
+
+func (e *QueryEffect[T, A, P]) Apply(s T, activator A) T {
+	return e.fn(s, e.selector(s), activator)
+}
+
+func (e *QueryEffect[T, A, P]) applyWithBase(gen uint64, base, s T, activator A) T {
+	return e.fn(s, e.paramsAt(gen, base), activator)
+}
+
+func (e *QueryEffect[T, A, P]) applyFromBase(base, s T, activator A) T {
+	return e.fn(s, e.selector(base), activator)
+}
+
+// paramsAt returns the params for base, running the selector only if gen
+// differs from the memoized one
+func (e *QueryEffect[T, A, P]) paramsAt(gen uint64, base T) P {
+	e.mu.RLock()
+	if e.hasMemo && e.gen == gen {
+		p := e.params
+		e.mu.RUnlock()
+		return p
+	}
+	e.mu.RUnlock()
+
+	p := e.selector(base)
+	e.mu.Lock()
+	e.params, e.gen, e.hasMemo = p, gen, true
+	e.mu.Unlock()
+	return p
+}
+
+func (e *QueryEffect[T, A, P]) Activator() A {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.activator
+}
+
+func (e *QueryEffect[T, A, P]) SetActivator(activator A) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.activator = activator
+}
+
+// CloneEffect copies the effect without its memoized params
+func (e *QueryEffect[T, A, P]) CloneEffect() Effect[T, A] {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return &QueryEffect[T, A, P]{id: e.id, selector: e.selector, fn: e.fn, activator: e.activator}
+}
@@ -0,0 +1,77 @@
+package statediff
+
+import (
+	"bytes"
+	"compress/gzip"
+)
+
+// Encoder turns a patch into a client payload. Clients are assigned an
+// encoder at Connect via WithEncoder; clients without one receive JSON Patch.
+//
+// Name identifies the output format: clients that share a projection and an
+// encoder name share one encoding per Broadcast, so two encoders producing
+// different bytes must have different names.
+type Encoder struct {
+	Name   string
+	Encode func(Patch) ([]byte, error)
+}
+
+// JSONPatchEncoder encodes patches as RFC 6902 JSON (the default format)
+var JSONPatchEncoder = Encoder{Name: "json-patch", Encode: Patch.JSON}
+
+// Gzip wraps an encoder, compressing its output with gzip.
+// The resulting encoder is named enc.Name + "+gzip".
+func Gzip(enc Encoder) Encoder {
+	return Encoder{
+		Name: enc.Name + "+gzip",
+		Encode: func(p Patch) ([]byte, error) {
+			data, err := enc.Encode(p)
+			if err != nil {
+				return nil, err
+			}
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			if _, err := zw.Write(data); err != nil {
+				return nil, err
+			}
+			if err := zw.Close(); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		},
+	}
+}
+
+// WithEncoder sets the payload format for a client, typically chosen from the
+// capabilities it announced when connecting. Broadcast, Tick, Diff and Full
+// encode the client's output with it.
+func WithEncoder[T any](enc Encoder) ClientOption[T] {
+	return func(o *clientOptions[T]) { o.encoder = &enc }
+}
+
+// encoderCache shares encodings within one Broadcast between clients with
+// the same source diff and encoder name
+type encoderCache map[encodingKey][]byte
+
+type encodingKey struct {
+	source  string // Projection group key, or "" for the unprojected view
+	grouped bool
+	encoder string
+}
+
+// encode returns the cached encoding of p for key, encoding it on first use.
+// A failed encoding is cached as nil so the clients sharing it are skipped.
+func (c *encoderCache) encode(key encodingKey, p Patch, enc Encoder) []byte {
+	if data, ok := (*c)[key]; ok {
+		return data
+	}
+	if *c == nil {
+		*c = make(encoderCache)
+	}
+	data, err := enc.Encode(p)
+	if err != nil {
+		data = nil
+	}
+	(*c)[key] = data
+	return data
+}
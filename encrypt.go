@@ -0,0 +1,93 @@
+package statediff
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// encryptor seals values at configured paths of outgoing documents
+type encryptor struct {
+	paths    []string   // As configured, passed to fn
+	patterns [][]string // Split paths, same order
+	fn       func(path string, plaintext []byte) (string, error)
+}
+
+func newEncryptor(paths []string, fn func(string, []byte) (string, error)) *encryptor {
+	e := &encryptor{paths: paths, fn: fn}
+	for _, p := range paths {
+		e.patterns = append(e.patterns, splitPtr(p))
+	}
+	return e
+}
+
+// sealed is a plaintext value awaiting encryption. Documents hold it in place
+// of the value so diffs compare plaintext (ciphertexts are randomized), and
+// encryption happens only when a payload is encoded.
+type sealed struct {
+	enc   *encryptor
+	path  string // Configured path the value matched
+	plain string // JSON encoding of the value
+}
+
+// MarshalJSON encrypts the value into a JSON string
+func (v *sealed) MarshalJSON() ([]byte, error) {
+	ct, err := v.enc.fn(v.path, []byte(v.plain))
+	if err != nil {
+		return nil, fmt.Errorf("statediff: encrypt %s: %w", v.path, err)
+	}
+	return json.Marshal(ct)
+}
+
+// seal replaces values at encrypted paths with sealed placeholders
+func (e *encryptor) seal(doc any, path []string) any {
+	for i, p := range e.patterns {
+		if matchPattern(p, path) {
+			data, err := json.Marshal(doc)
+			if err != nil {
+				return doc // Decoded JSON always marshals
+			}
+			return &sealed{enc: e, path: e.paths[i], plain: string(data)}
+		}
+	}
+	switch v := doc.(type) {
+	case map[string]any:
+		for k, val := range v {
+			v[k] = e.seal(val, append(path, k))
+		}
+	case []any:
+		for i, val := range v {
+			v[i] = e.seal(val, append(path, fmt.Sprint(i)))
+		}
+	}
+	return doc
+}
+
+// AESGCM returns a Config.Encrypt func that seals values with AES-GCM.
+// keyFor provides the key (16, 24 or 32 bytes) for a configured path, so
+// different fields can use different keys. The output is base64 (standard
+// encoding) of nonce followed by ciphertext.
+func AESGCM(keyFor func(path string) ([]byte, error)) func(path string, plaintext []byte) (string, error) {
+	return func(path string, plaintext []byte) (string, error) {
+		key, err := keyFor(path)
+		if err != nil {
+			return "", err
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return "", err
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return "", err
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, nil)), nil
+	}
+}
@@ -0,0 +1,181 @@
+package statediff
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ElementEventKind identifies what happened to a keyed array element
+type ElementEventKind int
+
+const (
+	ElementAdded   ElementEventKind = iota // Key present now but not before
+	ElementRemoved                         // Key present before but not now
+	ElementMoved                           // Key kept but its order relative to other elements changed
+)
+
+func (k ElementEventKind) String() string {
+	switch k {
+	case ElementAdded:
+		return "added"
+	case ElementRemoved:
+		return "removed"
+	case ElementMoved:
+		return "moved"
+	default:
+		return fmt.Sprintf("ElementEventKind(%d)", int(k))
+	}
+}
+
+// ElementEvent describes a lifecycle change of an element in a keyed array
+// (ArrayByKey or ArrayAuto strategy), e.g. an entity spawning or despawning.
+type ElementEvent struct {
+	Kind ElementEventKind
+	Path string // JSON Pointer of the array
+	Key  string // Element key
+	From int    // Index before the change (-1 for ElementAdded)
+	To   int    // Index after the change (-1 for ElementRemoved)
+}
+
+// ElementEvents reports element lifecycle events for keyed arrays between the
+// previous and current state (with effects). Returns nil if there is no
+// previous state or the array strategy is not ArrayByKey or ArrayAuto.
+// Events are ordered by array path, then removals, additions, and moves.
+func (s *State[T, A]) ElementEvents() ([]ElementEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	prev, cur, ok, _ := s.pending()
+	if !ok {
+		return nil, nil
+	}
+	return s.elementEvents(prev, cur)
+}
+
+// OnElementEvent registers a listener for keyed array element events.
+// Listeners run when a change cycle is committed by ClearPrevious (and thus
+// by Session.Tick), after the state lock is released, so they may call back
+// into the State.
+func (s *State[T, A]) OnElementEvent(fn func(ElementEvent)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.elementListeners = append(s.elementListeners, fn)
+}
+
+// elementEvents computes events between two states (with effects)
+func (s *State[T, A]) elementEvents(prev, cur T) ([]ElementEvent, error) {
+	if s.arrayCfg.Strategy != ArrayByKey && s.arrayCfg.Strategy != ArrayAuto {
+		return nil, nil
+	}
+	cfg := s.arrayCfg.positional()
+	oldDoc, err := toDocument(prev, cfg)
+	if err != nil {
+		return nil, err
+	}
+	newDoc, err := toDocument(cur, cfg)
+	if err != nil {
+		return nil, err
+	}
+	var events []ElementEvent
+	collectElementEvents("", oldDoc, newDoc, cfg, &events)
+	return events, nil
+}
+
+// collectElementEvents walks two documents and records keyed array events
+func collectElementEvents(path string, old, new any, cfg ArrayConfig, out *[]ElementEvent) {
+	// A nil slice encodes as null; treat it as an empty array
+	if _, ok := new.([]any); ok && old == nil {
+		old = []any{}
+	}
+	if _, ok := old.([]any); ok && new == nil {
+		new = []any{}
+	}
+	switch o := old.(type) {
+	case map[string]any:
+		n, ok := new.(map[string]any)
+		if !ok {
+			return
+		}
+		keys := make([]string, 0, len(o))
+		for k := range o {
+			if _, exists := n[k]; exists {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			collectElementEvents(path+"/"+escapePtr(k), o[k], n[k], cfg, out)
+		}
+
+	case []any:
+		n, ok := new.([]any)
+		if !ok {
+			return
+		}
+		getKey := cfg.keyer(path)
+		if getKey == nil {
+			// Unkeyed array: look for keyed arrays nested at stable indices
+			for i := 0; i < min(len(o), len(n)); i++ {
+				collectElementEvents(fmt.Sprintf("%s/%d", path, i), o[i], n[i], cfg, out)
+			}
+			return
+		}
+		collectKeyedEvents(path, o, n, getKey, cfg, out)
+	}
+}
+
+// collectKeyedEvents records events for one keyed array and recurses into
+// elements present on both sides
+func collectKeyedEvents(path string, old, new []any, getKey func(any) (string, bool), cfg ArrayConfig, out *[]ElementEvent) {
+	oldIdx := make(map[string]int, len(old))
+	for i, v := range old {
+		if k, ok := getKey(v); ok {
+			oldIdx[k] = i
+		}
+	}
+	newIdx := make(map[string]int, len(new))
+	var newKeys []string
+	for i, v := range new {
+		if k, ok := getKey(v); ok {
+			newIdx[k] = i
+			newKeys = append(newKeys, k)
+		}
+	}
+
+	// Removed, in old order
+	for i, v := range old {
+		if k, ok := getKey(v); ok && oldIdx[k] == i {
+			if _, exists := newIdx[k]; !exists {
+				*out = append(*out, ElementEvent{Kind: ElementRemoved, Path: path, Key: k, From: i, To: -1})
+			}
+		}
+	}
+
+	// Added, in new order
+	for _, k := range newKeys {
+		if _, existed := oldIdx[k]; !existed {
+			*out = append(*out, ElementEvent{Kind: ElementAdded, Path: path, Key: k, From: -1, To: newIdx[k]})
+		}
+	}
+
+	// Moved: rank among retained elements changed
+	var kept []string
+	for _, k := range newKeys {
+		if _, existed := oldIdx[k]; existed {
+			kept = append(kept, k)
+		}
+	}
+	oldRank := make([]string, len(kept))
+	copy(oldRank, kept)
+	sort.SliceStable(oldRank, func(i, j int) bool { return oldIdx[oldRank[i]] < oldIdx[oldRank[j]] })
+	for rank, k := range kept {
+		if oldRank[rank] != k {
+			*out = append(*out, ElementEvent{Kind: ElementMoved, Path: path, Key: k, From: oldIdx[k], To: newIdx[k]})
+		}
+	}
+
+	// Nested keyed arrays inside retained elements
+	for _, k := range kept {
+		ni := newIdx[k]
+		collectElementEvents(fmt.Sprintf("%s/%d", path, ni), old[oldIdx[k]], new[ni], cfg, out)
+	}
+}
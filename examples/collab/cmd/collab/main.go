@@ -0,0 +1,32 @@
+// Command collab runs the collab reference server:
+//
+//	go run ./examples/collab/cmd/collab -addr :8080
+//
+// Subscribe with GET http://localhost:8080/doc?user=ann (Server-Sent Events)
+// and POST edits to the same URL.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/mxkacsa/statediff/examples/collab"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "listen address")
+	title := flag.String("title", "Untitled", "document title")
+	flag.Parse()
+
+	srv, err := collab.NewServer(collab.Doc{Title: *title}, collab.Options{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	go srv.Run(context.Background())
+
+	http.Handle("/doc", srv)
+	log.Printf("collab listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
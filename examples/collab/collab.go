@@ -0,0 +1,341 @@
+// Package collab is an embeddable reference server for a collaboratively
+// edited document. Clients subscribe with a GET and receive Server-Sent
+// Events whose data is a JSON Patch: the first replaces the whole document,
+// later ones are diffs. Edits are POSTed as JSON.
+//
+//	srv, err := collab.NewServer(collab.Doc{Title: "Notes"}, collab.Options{})
+//	go srv.Run(ctx)
+//	http.Handle("/doc", srv) // GET /doc?user=ann streams, POST /doc?user=ann edits
+//
+// Blocks are keyed by ID and moves are sent as move ops, so reordering a long
+// block costs a few bytes. Options swap the edit handler and the config.
+package collab
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mxkacsa/statediff"
+)
+
+// Doc is the shared document
+type Doc struct {
+	Title    string            `json:"title"`
+	Blocks   []Block           `json:"blocks"`
+	Presence map[string]string `json:"presence,omitempty"` // User -> ID of the block they edit
+}
+
+// Block is a paragraph of the document
+type Block struct {
+	ID     string `json:"id"`
+	Text   string `json:"text"`
+	Author string `json:"author,omitempty"`
+}
+
+// Edit is a change posted by a client
+type Edit struct {
+	// Type is "insert", "update", "delete", "move", "title" or "focus"
+	Type  string `json:"type"`
+	ID    string `json:"id,omitempty"`    // Block to change; the new block for insert
+	After string `json:"after,omitempty"` // For insert and move: block to follow, "" for the top
+	Text  string `json:"text,omitempty"`  // For insert, update and title
+}
+
+// Options customize a Server. Zero values select the defaults.
+type Options struct {
+	// Tick is the broadcast interval of Run. Default 100ms.
+	Tick time.Duration
+	// Handle applies an edit to the base state. Default ApplyEdit.
+	Handle func(d *Doc, user string, e Edit) error
+	// Config is passed to statediff.New. Default: blocks keyed by "id",
+	// with DetectMoves.
+	Config *statediff.Config[Doc]
+	// Buffer is the number of undelivered messages a subscriber may lag
+	// behind before it is dropped (and expected to resubscribe). Default 64.
+	Buffer int
+}
+
+// Server hosts one document. It implements http.Handler.
+type Server struct {
+	state   *statediff.State[Doc, string]
+	session *statediff.Session[Doc, string, string]
+	opts    Options
+
+	mu     sync.Mutex // Serializes broadcasts, subscriptions and edits
+	nextID int
+	subs   map[string]chan []byte // By subscription ID
+}
+
+// NewServer creates a server for the initial document
+func NewServer(initial Doc, opts Options) (*Server, error) {
+	if opts.Tick <= 0 {
+		opts.Tick = 100 * time.Millisecond
+	}
+	if opts.Handle == nil {
+		opts.Handle = ApplyEdit
+	}
+	if opts.Config == nil {
+		opts.Config = &statediff.Config[Doc]{ArrayStrategy: statediff.ArrayByKey, ArrayKeyField: "id", DetectMoves: true}
+	}
+	if opts.Buffer <= 0 {
+		opts.Buffer = 64
+	}
+	state, err := statediff.New[Doc, string](initial, opts.Config)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		state:   state,
+		session: statediff.NewSession[Doc, string, string](state),
+		opts:    opts,
+		subs:    make(map[string]chan []byte),
+	}, nil
+}
+
+// State returns the document state
+func (s *Server) State() *statediff.State[Doc, string] { return s.state }
+
+// Session returns the session subscribers are connected to
+func (s *Server) Session() *statediff.Session[Doc, string, string] { return s.session }
+
+// ServeHTTP streams the document on GET and applies an edit on POST.
+// Both take the user in the "user" query parameter.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		http.Error(w, "missing user", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.stream(w, r)
+	case http.MethodPost:
+		var e Edit
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.Apply(user, e); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Apply applies an edit on behalf of user and broadcasts its diff right
+// away: the state only keeps one previous version, so each edit is sent
+// before the next
+func (s *Server) Apply(user string, e Edit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	s.send(s.session.ApplyUpdate(func(d *Doc) { err = s.opts.Handle(d, user, e) }))
+	return err
+}
+
+// stream sends Server-Sent Events until the client goes away or lags behind
+func (s *Server) stream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	id, ch, err := s.subscribe()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer s.unsubscribe(id)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case data, ok := <-ch:
+			if !ok {
+				return // Dropped for lagging behind
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// subscribe connects a new subscriber and queues the full document for it.
+// Pending changes are broadcast first, so the next diff does not repeat
+// what the full document has.
+func (s *Server) subscribe() (string, chan []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.broadcastLocked()
+
+	s.nextID++
+	id := fmt.Sprint(s.nextID)
+	s.session.Connect(id, nil)
+	data, err := s.session.Full(id)
+	if err != nil {
+		s.session.Disconnect(id)
+		return "", nil, err
+	}
+	ch := make(chan []byte, s.opts.Buffer)
+	ch <- data
+	s.subs[id] = ch
+	return id, ch, nil
+}
+
+func (s *Server) unsubscribe(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropLocked(id)
+}
+
+func (s *Server) dropLocked(id string) {
+	if ch, ok := s.subs[id]; ok {
+		close(ch)
+		delete(s.subs, id)
+		s.session.Disconnect(id)
+	}
+}
+
+// Run broadcasts changes made outside of Apply (e.g. through State) every
+// Options.Tick until ctx is done
+func (s *Server) Run(ctx context.Context) error {
+	t := time.NewTicker(s.opts.Tick)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			s.Broadcast()
+		}
+	}
+}
+
+// Broadcast sends pending changes to all subscribers now
+func (s *Server) Broadcast() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.broadcastLocked()
+}
+
+func (s *Server) broadcastLocked() {
+	s.send(s.session.Tick())
+}
+
+// send queues diffs for the subscribers. Caller must hold mu.
+func (s *Server) send(diffs map[string][]byte) {
+	for id, data := range diffs {
+		select {
+		case s.subs[id] <- data:
+		default:
+			s.dropLocked(id)
+		}
+	}
+}
+
+// ErrNoBlock is returned by ApplyEdit for edits of blocks that do not exist
+var ErrNoBlock = errors.New("collab: no such block")
+
+// ApplyEdit is the default edit handler
+func ApplyEdit(d *Doc, user string, e Edit) error {
+	switch e.Type {
+	case "title":
+		d.Title = e.Text
+		return nil
+	case "focus":
+		if e.ID == "" {
+			delete(d.Presence, user)
+			return nil
+		}
+		if blockIndex(d.Blocks, e.ID) < 0 {
+			return ErrNoBlock
+		}
+		if d.Presence == nil {
+			d.Presence = make(map[string]string)
+		}
+		d.Presence[user] = e.ID
+		return nil
+	case "insert":
+		if e.ID == "" || blockIndex(d.Blocks, e.ID) >= 0 {
+			return fmt.Errorf("collab: insert needs a new block ID, got %q", e.ID)
+		}
+		at, err := insertIndex(d.Blocks, e.After)
+		if err != nil {
+			return err
+		}
+		d.Blocks = append(d.Blocks, Block{})
+		copy(d.Blocks[at+1:], d.Blocks[at:])
+		d.Blocks[at] = Block{ID: e.ID, Text: e.Text, Author: user}
+		return nil
+	}
+
+	i := blockIndex(d.Blocks, e.ID)
+	if i < 0 {
+		return ErrNoBlock
+	}
+	switch e.Type {
+	case "update":
+		d.Blocks[i].Text = e.Text
+		d.Blocks[i].Author = user
+	case "delete":
+		d.Blocks = append(d.Blocks[:i], d.Blocks[i+1:]...)
+		for u, id := range d.Presence {
+			if id == e.ID {
+				delete(d.Presence, u)
+			}
+		}
+	case "move":
+		if e.After == e.ID {
+			return nil
+		}
+		if e.After != "" && blockIndex(d.Blocks, e.After) < 0 {
+			return ErrNoBlock
+		}
+		b := d.Blocks[i]
+		d.Blocks = append(d.Blocks[:i], d.Blocks[i+1:]...)
+		at, err := insertIndex(d.Blocks, e.After)
+		if err != nil {
+			return err
+		}
+		d.Blocks = append(d.Blocks, Block{})
+		copy(d.Blocks[at+1:], d.Blocks[at:])
+		d.Blocks[at] = b
+	default:
+		return fmt.Errorf("collab: unknown edit %q", e.Type)
+	}
+	return nil
+}
+
+func blockIndex(blocks []Block, id string) int {
+	for i, b := range blocks {
+		if b.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// insertIndex returns the index just after the block after ("" for the top)
+func insertIndex(blocks []Block, after string) (int, error) {
+	if after == "" {
+		return 0, nil
+	}
+	i := blockIndex(blocks, after)
+	if i < 0 {
+		return 0, ErrNoBlock
+	}
+	return i + 1, nil
+}
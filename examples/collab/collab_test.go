@@ -0,0 +1,85 @@
+package collab
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mxkacsa/statediff"
+)
+
+func TestServer(t *testing.T) {
+	srv, err := NewServer(Doc{Title: "Notes", Blocks: []Block{{ID: "a", Text: "first"}, {ID: "b", Text: "second"}}}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/?user=ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := bufio.NewScanner(resp.Body)
+	doc := []byte("null")
+	receive := func() statediff.Patch {
+		t.Helper()
+		for events.Scan() {
+			data, ok := strings.CutPrefix(events.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var patch statediff.Patch
+			if err := json.Unmarshal([]byte(data), &patch); err != nil {
+				t.Fatal(err)
+			}
+			if doc, err = patch.ApplyToJSON(doc); err != nil {
+				t.Fatal(err)
+			}
+			return patch
+		}
+		t.Fatal("stream ended")
+		return nil
+	}
+	receive() // Full document
+
+	var patches []statediff.Patch
+	for _, body := range []string{
+		`{"type":"move","id":"a","after":"b"}`,
+		`{"type":"insert","id":"c","text":"third"}`,
+		`{"type":"focus","id":"c"}`,
+	} {
+		resp, err := http.Post(ts.URL+"/?user=bo", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("%s: status %d", body, resp.StatusCode)
+		}
+		patches = append(patches, receive())
+	}
+
+	var got Doc
+	json.Unmarshal(doc, &got)
+	if want := srv.State().Get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Client document %+v, want %+v", got, want)
+	}
+	if len(patches[0]) != 1 || patches[0][0].Op != "move" {
+		t.Errorf("Expected the block move as a move op: %v", patches[0])
+	}
+
+	resp, err = http.Post(ts.URL+"/?user=bo", "application/json", strings.NewReader(`{"type":"update","id":"zz"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for an unknown block, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,32 @@
+// Command wsgame runs the wsgame reference server:
+//
+//	go run ./examples/wsgame/cmd/wsgame -addr :8080 -players alice,bob
+//
+// and connects players at ws://localhost:8080/ws?player=alice.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/mxkacsa/statediff/examples/wsgame"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "listen address")
+	players := flag.String("players", "alice,bob", "comma-separated player IDs")
+	flag.Parse()
+
+	srv, err := wsgame.NewServer(wsgame.NewGame(strings.Split(*players, ",")...), wsgame.Options{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	go srv.Run(context.Background())
+
+	http.Handle("/ws", srv)
+	log.Printf("wsgame listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
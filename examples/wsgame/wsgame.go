@@ -0,0 +1,294 @@
+// Package wsgame is an embeddable reference server for a card game synced
+// over WebSocket. Every message sent to a client is a JSON Patch: the first
+// replaces the whole document, later ones are diffs of the player's view.
+// Clients send Actions as JSON text messages.
+//
+//	srv, err := wsgame.NewServer(wsgame.NewGame("alice", "bob"), wsgame.Options{})
+//	go srv.Run(ctx)
+//	http.Handle("/ws", srv) // ws://host/ws?player=alice
+//
+// Options swap the projection, the action handler and the statediff config,
+// so the server can be adapted one part at a time.
+package wsgame
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mxkacsa/statediff"
+	"github.com/mxkacsa/statediff/examples/internal/wsconn"
+)
+
+// Game is the shared game state
+type Game struct {
+	Round   int      `json:"round"`
+	Phase   string   `json:"phase"`
+	Turn    string   `json:"turn"`
+	Players []Player `json:"players"`
+}
+
+// Player is a seat at the table
+type Player struct {
+	ID    string `json:"id"`
+	Score int    `json:"score"`
+	Hand  []int  `json:"hand,omitempty"` // Only visible to its owner
+}
+
+// Action is a message from a client
+type Action struct {
+	Type string `json:"type"`           // "play" or "pass"
+	Card int    `json:"card,omitempty"` // For "play"
+}
+
+// NewGame deals a fresh game for the given players
+func NewGame(players ...string) Game {
+	g := Game{Round: 1, Phase: "playing"}
+	for i, id := range players {
+		hand := make([]int, 5)
+		for c := range hand {
+			hand[c] = i*5 + c + 1
+		}
+		g.Players = append(g.Players, Player{ID: id, Hand: hand})
+	}
+	if len(players) > 0 {
+		g.Turn = players[0]
+	}
+	return g
+}
+
+// Options customize a Server. Zero values select the defaults.
+type Options struct {
+	// Tick is the broadcast interval of Run. Default 50ms.
+	Tick time.Duration
+	// Project returns the view of a player. Default HideHands.
+	Project func(player string) func(Game) Game
+	// Handle applies an action to the base state. Default HandleAction.
+	Handle func(g *Game, player string, a Action) error
+	// Config is passed to statediff.New. Default: players keyed by "id".
+	Config *statediff.Config[Game]
+}
+
+// Server hosts one game. It implements http.Handler for the WebSocket endpoint.
+type Server struct {
+	state   *statediff.State[Game, string]
+	session *statediff.Session[Game, string, string]
+	opts    Options
+
+	mu    sync.Mutex // Serializes broadcasts, joins and actions
+	conns map[string]*wsconn.Conn
+}
+
+// NewServer creates a server for the initial game
+func NewServer(initial Game, opts Options) (*Server, error) {
+	if opts.Tick <= 0 {
+		opts.Tick = 50 * time.Millisecond
+	}
+	if opts.Project == nil {
+		opts.Project = HideHands
+	}
+	if opts.Handle == nil {
+		opts.Handle = HandleAction
+	}
+	if opts.Config == nil {
+		opts.Config = &statediff.Config[Game]{ArrayStrategy: statediff.ArrayByKey, ArrayKeyField: "id"}
+	}
+	state, err := statediff.New[Game, string](initial, opts.Config)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		state:   state,
+		session: statediff.NewSession[Game, string, string](state),
+		opts:    opts,
+		conns:   make(map[string]*wsconn.Conn),
+	}, nil
+}
+
+// State returns the game state, e.g. to add effects
+func (s *Server) State() *statediff.State[Game, string] { return s.state }
+
+// Session returns the session the players are connected to
+func (s *Server) Session() *statediff.Session[Game, string, string] { return s.session }
+
+// ServeHTTP upgrades a request for ?player=ID to a WebSocket and serves the
+// player until the connection closes. A reconnect replaces the old connection.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	player := r.URL.Query().Get("player")
+	if player == "" {
+		http.Error(w, "missing player", http.StatusBadRequest)
+		return
+	}
+	conn, err := wsconn.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if err := s.join(player, conn); err != nil {
+		log.Printf("wsgame: join %s: %v", player, err)
+		return
+	}
+	defer s.leave(player, conn)
+
+	for {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var a Action
+		if err := json.Unmarshal(msg, &a); err != nil {
+			continue
+		}
+		if err := s.act(player, a); err != nil {
+			log.Printf("wsgame: %s %s: %v", player, a.Type, err)
+		}
+	}
+}
+
+// act applies an action and broadcasts its diffs right away: the state only
+// keeps one previous version, so each update is sent before the next
+func (s *Server) act(player string, a Action) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	s.send(s.session.ApplyUpdate(func(g *Game) { err = s.opts.Handle(g, player, a) }))
+	return err
+}
+
+// join connects the player and sends the full view. Pending changes are
+// broadcast first, so the next diff does not repeat what the full view has.
+func (s *Server) join(player string, conn *wsconn.Conn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.broadcastLocked()
+
+	if old, ok := s.conns[player]; ok {
+		old.Close()
+	}
+	s.session.Connect(player, s.opts.Project(player))
+	data, err := s.session.Full(player)
+	if err != nil {
+		s.session.Disconnect(player)
+		return err
+	}
+	if err := conn.WriteMessage(data); err != nil {
+		s.session.Disconnect(player)
+		return err
+	}
+	s.conns[player] = conn
+	return nil
+}
+
+// leave disconnects the player unless it reconnected on another connection
+func (s *Server) leave(player string, conn *wsconn.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns[player] == conn {
+		delete(s.conns, player)
+		s.session.Disconnect(player)
+	}
+}
+
+// Run broadcasts changes made outside of actions (e.g. by effects, or
+// through State) every Options.Tick until ctx is done
+func (s *Server) Run(ctx context.Context) error {
+	t := time.NewTicker(s.opts.Tick)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			s.Broadcast()
+		}
+	}
+}
+
+// Broadcast sends pending changes to all players now
+func (s *Server) Broadcast() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.broadcastLocked()
+}
+
+func (s *Server) broadcastLocked() {
+	s.send(s.session.Tick())
+}
+
+// send delivers diffs to the connected players. Caller must hold mu.
+func (s *Server) send(diffs map[string][]byte) {
+	for player, data := range diffs {
+		if conn, ok := s.conns[player]; ok {
+			if err := conn.WriteMessage(data); err != nil {
+				conn.Close() // The read loop ends and the player leaves
+			}
+		}
+	}
+}
+
+// HideHands is the default projection: other players' hands are removed
+func HideHands(player string) func(Game) Game {
+	return func(g Game) Game {
+		players := make([]Player, len(g.Players))
+		for i, p := range g.Players {
+			if p.ID != player {
+				p.Hand = nil
+			}
+			players[i] = p
+		}
+		g.Players = players
+		return g
+	}
+}
+
+// ErrNotYourTurn is returned by HandleAction for actions out of turn
+var ErrNotYourTurn = errors.New("wsgame: not your turn")
+
+// HandleAction is the default rules: on their turn, players play a card from
+// their hand (scoring its value) or pass; the turn then moves on, and a new
+// round starts after the last player.
+func HandleAction(g *Game, player string, a Action) error {
+	if g.Turn != player {
+		return ErrNotYourTurn
+	}
+	seat := -1
+	for i, p := range g.Players {
+		if p.ID == player {
+			seat = i
+		}
+	}
+	if seat < 0 {
+		return fmt.Errorf("wsgame: unknown player %q", player)
+	}
+
+	switch a.Type {
+	case "play":
+		p := &g.Players[seat]
+		idx := -1
+		for i, c := range p.Hand {
+			if c == a.Card {
+				idx = i
+			}
+		}
+		if idx < 0 {
+			return fmt.Errorf("wsgame: card %d not in hand", a.Card)
+		}
+		p.Hand = append(p.Hand[:idx:idx], p.Hand[idx+1:]...)
+		p.Score += a.Card
+	case "pass":
+	default:
+		return fmt.Errorf("wsgame: unknown action %q", a.Type)
+	}
+
+	next := (seat + 1) % len(g.Players)
+	if next == 0 {
+		g.Round++
+	}
+	g.Turn = g.Players[next].ID
+	return nil
+}
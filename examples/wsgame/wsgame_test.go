@@ -0,0 +1,98 @@
+package wsgame
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mxkacsa/statediff"
+	"github.com/mxkacsa/statediff/examples/internal/wsconn"
+)
+
+// client mirrors the document a player sees by applying every message
+type client struct {
+	conn *wsconn.Conn
+	doc  []byte
+}
+
+func (c *client) receive(t *testing.T) {
+	t.Helper()
+	msg, err := c.conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var patch statediff.Patch
+	if err := json.Unmarshal(msg, &patch); err != nil {
+		t.Fatal(err)
+	}
+	doc := c.doc
+	if doc == nil {
+		doc = []byte("null")
+	}
+	if c.doc, err = patch.ApplyToJSON(doc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *client) game(t *testing.T) Game {
+	t.Helper()
+	var g Game
+	if err := json.Unmarshal(c.doc, &g); err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestServer(t *testing.T) {
+	srv, err := NewServer(NewGame("alice", "bob"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	players := map[string]*client{}
+	for _, id := range []string{"alice", "bob"} {
+		conn, err := wsconn.Dial(url + "/?player=" + id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		players[id] = &client{conn: conn}
+		players[id].receive(t) // Full state
+	}
+	if g := players["bob"].game(t); g.Players[0].Hand != nil || len(g.Players[1].Hand) != 5 {
+		t.Fatalf("Bob should only see his own hand: %+v", g)
+	}
+
+	if err := players["alice"].conn.WriteMessage([]byte(`{"type":"play","card":3}`)); err != nil {
+		t.Fatal(err)
+	}
+	for id, c := range players {
+		c.receive(t)
+		if want := HideHands(id)(srv.State().Get()); !reflect.DeepEqual(c.game(t), want) {
+			t.Errorf("%s sees %+v, want %+v", id, c.game(t), want)
+		}
+	}
+	if g := srv.State().Get(); g.Players[0].Score != 3 || len(g.Players[0].Hand) != 4 {
+		t.Errorf("Unexpected state after play: %+v", g)
+	}
+}
+
+func TestHandleAction(t *testing.T) {
+	g := NewGame("alice", "bob")
+	if err := HandleAction(&g, "bob", Action{Type: "pass"}); err != ErrNotYourTurn {
+		t.Errorf("Expected ErrNotYourTurn, got %v", err)
+	}
+	if err := HandleAction(&g, "alice", Action{Type: "play", Card: 42}); err == nil {
+		t.Error("Expected error for a card not in hand")
+	}
+	HandleAction(&g, "alice", Action{Type: "pass"})
+	HandleAction(&g, "bob", Action{Type: "play", Card: 6})
+	if g.Round != 2 || g.Turn != "alice" || g.Players[1].Score != 6 {
+		t.Errorf("Unexpected game after a round: %+v", g)
+	}
+}
@@ -0,0 +1,165 @@
+package statediff
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// explainValueMax is how many bytes of a value's JSON Explain shows
+const explainValueMax = 80
+
+// Explain renders the patch as one line per op for debugging, e.g.
+//
+//	players[alice].score: 100 → 200
+//	players[carol]: added {"name":"carol","score":0}
+//	items[2]: removed "sword"
+//
+// old is the value the patch applies to (the previous state) and cfg the
+// state's diff configuration (State.DiffConfig): elements of keyed arrays
+// are named by their key, other elements by index. Long values are cut
+// short. Fails if the patch does not apply to old.
+func (p Patch) Explain(old any, cfg ArrayConfig) (string, error) {
+	doc, err := toDocument(old, cfg)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for i, op := range p {
+		segs, err := parsePtr(op.Path)
+		if err != nil {
+			return "", err
+		}
+		var inserted any
+		if op.Op == "add" {
+			inserted = op.Value
+		}
+		b.WriteString(explainPath(doc, segs, inserted, cfg))
+		b.WriteString(": ")
+		prev, err := lookup(doc, segs)
+		exists := err == nil
+		switch op.Op {
+		case "replace":
+			fmt.Fprintf(&b, "%s → %s", explainValue(prev), explainValue(op.Value))
+		case "add":
+			if _, isArr := parentArray(doc, segs); exists && !isArr {
+				fmt.Fprintf(&b, "%s → %s", explainValue(prev), explainValue(op.Value))
+			} else {
+				b.WriteString("added " + explainValue(op.Value))
+			}
+		case "remove":
+			b.WriteString("removed " + explainValue(prev))
+		case "move", "copy":
+			from, err := parsePtr(op.From)
+			if err != nil {
+				return "", err
+			}
+			verb := "moved"
+			if op.Op == "copy" {
+				verb = "copied"
+			}
+			fmt.Fprintf(&b, "%s from %s", verb, explainPath(doc, from, nil, cfg))
+		case "inc":
+			next, err := addNumber(prev, op.Value)
+			if err != nil {
+				return "", &PatchError{Index: i, Op: op, Reason: err.Error()}
+			}
+			delta := explainValue(op.Value)
+			if !strings.HasPrefix(delta, "-") {
+				delta = "+" + delta
+			}
+			fmt.Fprintf(&b, "%s → %s (%s)", explainValue(prev), explainValue(next), delta)
+		default:
+			fmt.Fprintf(&b, "%s %s", op.Op, explainValue(op.Value))
+		}
+		b.WriteByte('\n')
+		if doc, err = applyOp(doc, op); err != nil {
+			return "", &PatchError{Index: i, Op: op, Reason: err.Error()}
+		}
+	}
+	return b.String(), nil
+}
+
+// explainPath names the value at segs in doc, e.g. players[alice].score.
+// value is the element an add inserts into an array, which has no key in
+// doc yet.
+func explainPath(doc any, segs []string, value any, cfg ArrayConfig) string {
+	if len(segs) == 0 {
+		return "(root)"
+	}
+	var b strings.Builder
+	cur := doc
+	for k, seg := range segs {
+		arr, isArr := cur.([]any)
+		if !isArr {
+			if k > 0 {
+				b.WriteByte('.')
+			}
+			if identifier(seg) {
+				b.WriteString(seg)
+			} else {
+				b.WriteString(strconv.Quote(seg))
+			}
+			cur, _ = lookup(cur, []string{seg})
+			continue
+		}
+
+		el, err := lookup(arr, []string{seg})
+		if k == len(segs)-1 && value != nil {
+			el, err = value, nil // Inserted element
+		}
+		label := seg
+		if getKey := cfg.keyer(joinPtr(segs[:k])); getKey != nil && err == nil {
+			if key, ok := getKey(el); ok {
+				label = key
+			}
+		}
+		if !identifier(label) && !isIndexSeg(label) {
+			label = strconv.Quote(label)
+		}
+		b.WriteString("[" + label + "]")
+		cur = el
+	}
+	return b.String()
+}
+
+// parentArray returns the array holding the value at segs, if it is one
+func parentArray(doc any, segs []string) ([]any, bool) {
+	if len(segs) == 0 {
+		return nil, false
+	}
+	parent, err := lookup(doc, segs[:len(segs)-1])
+	if err != nil {
+		return nil, false
+	}
+	arr, ok := parent.([]any)
+	return arr, ok
+}
+
+// identifier reports whether s can be shown after a dot
+func identifier(s string) bool {
+	for i, c := range s {
+		if c != '_' && !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') && !(i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// explainValue renders a value as JSON, cut to explainValueMax bytes
+func explainValue(v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("<%v>", err)
+	}
+	if len(data) > explainValueMax {
+		n := explainValueMax - 3
+		for n > 0 && !utf8.RuneStart(data[n]) {
+			n--
+		}
+		return string(data[:n]) + "..."
+	}
+	return string(data)
+}
@@ -0,0 +1,91 @@
+package statediff
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// DefaultFlapWindow is the window of Config.FlapLimit when FlapWindow is 0
+const DefaultFlapWindow = 10 * time.Second
+
+// FlapReport describes a path that changed in more committed ticks than
+// Config.FlapLimit within one window, e.g. a field a buggy effect toggles
+// every tick. Each path is reported once per window.
+type FlapReport struct {
+	Path    string        // JSON Pointer as emitted
+	Changes int           // Ticks that changed the path in the window so far
+	Window  time.Duration // Length of the window
+}
+
+// flapDetector counts changes per path in fixed windows
+type flapDetector struct {
+	limit  int
+	window time.Duration
+	start  time.Time
+	counts map[string]int
+}
+
+func newFlapDetector(limit int, window time.Duration) *flapDetector {
+	if limit <= 0 {
+		return nil
+	}
+	return &flapDetector{limit: limit, window: flapWindow(window)}
+}
+
+// flapWindow applies the default to a configured window
+func flapWindow(window time.Duration) time.Duration {
+	if window <= 0 {
+		return DefaultFlapWindow
+	}
+	return window
+}
+
+// observe records the paths changed by one committed tick and returns the
+// ones that just crossed the limit, sorted by path
+func (d *flapDetector) observe(now time.Time, p Patch) []FlapReport {
+	if d.counts == nil || now.Sub(d.start) >= d.window {
+		d.start, d.counts = now, make(map[string]int)
+	}
+	seen := make(map[string]bool, len(p))
+	var reports []FlapReport
+	for _, op := range p {
+		if seen[op.Path] {
+			continue
+		}
+		seen[op.Path] = true
+		d.counts[op.Path]++
+		if n := d.counts[op.Path]; n == d.limit+1 {
+			reports = append(reports, FlapReport{Path: op.Path, Changes: n, Window: d.window})
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Path < reports[j].Path })
+	return reports
+}
+
+// flapNotice is flap reports due to the OnFlap hook once the state lock is
+// released
+type flapNotice struct {
+	reports []FlapReport
+	onFlap  func(FlapReport) // Hook at the time of the commit, nil to log
+}
+
+// observeFlaps feeds the diff of a committed change to the flap detector, if
+// enabled. Caller must hold mu; deliver the notice after unlocking.
+func (s *State[T, A]) observeFlaps(patch Patch) flapNotice {
+	if s.flaps == nil {
+		return flapNotice{}
+	}
+	return flapNotice{reports: s.flaps.observe(time.Now(), patch), onFlap: s.onFlap}
+}
+
+// deliver sends flap reports to the hook or the log. Call without mu held.
+func (n flapNotice) deliver() {
+	for _, r := range n.reports {
+		if n.onFlap != nil {
+			n.onFlap(r)
+			continue
+		}
+		log.Printf("statediff: %s changed in %d ticks within %v; check the effects and updates writing it", r.Path, r.Changes, r.Window)
+	}
+}
@@ -0,0 +1,55 @@
+package statediff
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Frame holds the payloads of one tick in buffers that are reused across
+// ticks, so steady-state ticks avoid allocating output. Payloads are
+// read-only views into the frame and are valid until Release.
+type Frame[ID comparable] struct {
+	Payloads map[ID][]byte
+
+	pool interface{ Put(any) }
+	buf  bytes.Buffer // Arena for encoded patches
+	enc  *json.Encoder
+}
+
+// TickFrame is Tick with pooled output: it runs the same cleanup, broadcast
+// and commit cycle, and returns payloads in a Frame. Call Release once the
+// payloads have been sent; do not retain them afterwards.
+func (s *Session[T, A, ID]) TickFrame() *Frame[ID] {
+	f, _ := s.frames.Get().(*Frame[ID])
+	if f == nil {
+		f = &Frame[ID]{Payloads: make(map[ID][]byte), pool: &s.frames}
+		f.enc = json.NewEncoder(&f.buf)
+	}
+
+	s.tickMu.Lock()
+	defer s.tickMu.Unlock()
+	s.tickInto(f.Payloads, f.encode)
+	return f
+}
+
+// encode appends p to the arena and returns a view of it.
+// If the arena grows, earlier views keep pointing at the old (still valid)
+// memory; the grown buffer is reused from the next frame on.
+func (f *Frame[ID]) encode(p Patch) []byte {
+	start := f.buf.Len()
+	if err := f.enc.Encode(p); err != nil {
+		f.buf.Truncate(start)
+		return nil
+	}
+	b := f.buf.Bytes()
+	end := len(b) - 1 // Encoder terminates each value with a newline
+	return b[start:end:end]
+}
+
+// Release returns the frame's buffers for reuse by later ticks.
+// The frame and its payloads must not be used afterwards.
+func (f *Frame[ID]) Release() {
+	clear(f.Payloads)
+	f.buf.Reset()
+	f.pool.Put(f)
+}
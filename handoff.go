@@ -0,0 +1,126 @@
+package statediff
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// HandoffBundle is what a server transfers to move a live session to
+// another server: the snapshot (base state and registry effects) and the
+// clients that are expected to reconnect there.
+type HandoffBundle[T any, ID comparable] struct {
+	Snapshot Snapshot[T] `json:"snapshot"`
+	Clients  []ID        `json:"clients"`
+}
+
+// HandoffTransfer delivers an encoded HandoffBundle to the new owner, e.g.
+// by writing it to shared storage or POSTing it to the target server, and
+// returns the address clients should reconnect to.
+type HandoffTransfer func(ctx context.Context, bundle []byte) (address string, err error)
+
+// Redirect is the message that tells a client to reconnect elsewhere:
+//
+//	{"redirect":"wss://eu-2.example.com/match/42"}
+type Redirect struct {
+	Redirect string `json:"redirect"`
+}
+
+// HandoffResult is what the old server sends out after a Handoff: every
+// client's Final diff (if any), then the Redirect message.
+type HandoffResult[ID comparable] struct {
+	Final    map[ID][]byte
+	Redirect []byte
+	Clients  []ID
+}
+
+// Handoff moves the session to another server for a zero-downtime drain.
+// It broadcasts pending changes one last time, freezes the state (writers
+// block), captures the base state, registry effects and connected clients,
+// and passes the bundle to transfer. The freeze ends when Handoff returns;
+// on error nothing was handed off and the session carries on. After a
+// successful handoff this server no longer owns the session: send the
+// result and stop routing commands here, since later writes are not part
+// of the bundle. extra is stored in Snapshot.Extra.
+func (s *Session[T, A, ID]) Handoff(ctx context.Context, extra any, transfer HandoffTransfer) (*HandoffResult[ID], error) {
+	var extraJSON json.RawMessage
+	if extra != nil {
+		var err error
+		if extraJSON, err = json.Marshal(extra); err != nil {
+			return nil, fmt.Errorf("statediff: marshal handoff extra: %w", err)
+		}
+	}
+
+	s.tickMu.Lock()
+	defer s.tickMu.Unlock()
+	final := s.tick()
+
+	s.state.freeze()
+	defer s.state.unfreeze()
+
+	bundle := HandoffBundle[T, ID]{
+		Snapshot: Snapshot[T]{
+			Version:      SnapshotVersion,
+			State:        s.state.GetBase(),
+			StateVersion: s.state.Version(),
+			Effects:      s.state.EffectMetas(),
+			SavedAt:      time.Now(),
+			Extra:        extraJSON,
+		},
+		Clients: s.IDs(),
+	}
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("statediff: marshal handoff: %w", err)
+	}
+	address, err := transfer(ctx, data)
+	if err != nil {
+		return nil, fmt.Errorf("statediff: handoff transfer: %w", err)
+	}
+	redirect, err := json.Marshal(Redirect{Redirect: address})
+	if err != nil {
+		return nil, err
+	}
+	return &HandoffResult[ID]{Final: final, Redirect: redirect, Clients: bundle.Clients}, nil
+}
+
+// ResumeHandoff recreates a handed-off session's state on the new server.
+// Clients listed in the bundle reconnect (and get a Full state) as usual;
+// it returns them so the server can expect, or time out, each one.
+func ResumeHandoff[T, A any, ID comparable](data []byte, cfg *Config[T], factory EffectFactory[T, A], opts ...RestoreOption) (*RestoreResult[T, A], []ID, error) {
+	var bundle HandoffBundle[T, ID]
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, nil, fmt.Errorf("statediff: unmarshal handoff: %w", err)
+	}
+	o := restoreOptions{now: time.Now}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	result, err := restoreSnapshot(&bundle.Snapshot, cfg, factory, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	return result, bundle.Clients, nil
+}
+
+// freeze makes writers wait until unfreeze
+func (s *State[T, A]) freeze() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.frozen {
+		s.cycleDone.Wait()
+	}
+	if s.cycleDone == nil {
+		s.cycleDone = sync.NewCond(&s.mu)
+	}
+	s.frozen = true
+}
+
+func (s *State[T, A]) unfreeze() {
+	s.mu.Lock()
+	s.frozen = false
+	s.cycleDone.Broadcast()
+	s.mu.Unlock()
+}
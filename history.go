@@ -0,0 +1,139 @@
+package statediff
+
+import "errors"
+
+// ErrVersionUnavailable is returned by DiffSince and Session.Resume when the
+// version is not in the history (too old, never committed, or HistorySize
+// is 0); the client needs a full resync
+var ErrVersionUnavailable = errors.New("statediff: version not in history")
+
+// history is a ring buffer of the states (with effects) clients were last
+// brought to, by version
+type history[T any] struct {
+	entries []historyEntry[T]
+	start   int // Index of the oldest entry once the buffer is full
+}
+
+type historyEntry[T any] struct {
+	version uint64
+	state   T
+}
+
+// resized returns h with room for size entries, keeping the newest ones.
+// Returns nil if size is 0.
+func (h *history[T]) resized(size int) *history[T] {
+	if size <= 0 {
+		return nil
+	}
+	if h != nil && cap(h.entries) == size {
+		return h
+	}
+	out := &history[T]{entries: make([]historyEntry[T], 0, size)}
+	if h != nil {
+		all := h.ordered()
+		out.entries = append(out.entries, all[max(0, len(all)-size):]...)
+	}
+	return out
+}
+
+// record adds the state of a version, replacing the oldest entry when full.
+// A version already recorded last is not added again.
+func (h *history[T]) record(version uint64, state T) {
+	if h == nil {
+		return
+	}
+	if len(h.entries) > 0 && h.newest().version == version {
+		return
+	}
+	if len(h.entries) < cap(h.entries) {
+		h.entries = append(h.entries, historyEntry[T]{version, state})
+		return
+	}
+	h.entries[h.start] = historyEntry[T]{version, state}
+	h.start = (h.start + 1) % len(h.entries)
+}
+
+// reset drops every entry
+func (h *history[T]) reset() {
+	if h == nil {
+		return
+	}
+	clear(h.entries)
+	h.entries, h.start = h.entries[:0], 0
+}
+
+// get returns the state of a version
+func (h *history[T]) get(version uint64) (T, bool) {
+	if h != nil {
+		for _, e := range h.entries {
+			if e.version == version {
+				return e.state, true
+			}
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+func (h *history[T]) newest() historyEntry[T] {
+	return h.entries[(h.start+len(h.entries)-1)%len(h.entries)]
+}
+
+// ordered returns the entries from oldest to newest
+func (h *history[T]) ordered() []historyEntry[T] {
+	return append(append([]historyEntry[T](nil), h.entries[h.start:]...), h.entries[:h.start]...)
+}
+
+// DiffSince returns the patch from the state (as seen through project, or
+// the full view if nil) of a version a client received to the current one,
+// and the version it leads to, e.g. for a reconnecting client that kept its
+// state. The versions retained are those sent by the last Config.HistorySize
+// Session ticks (or ClearPrevious calls); for others it returns
+// ErrVersionUnavailable and the client needs Full.
+func (s *State[T, A]) DiffSince(version uint64, project func(T) T) (Patch, uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	old, ok := s.history.get(version)
+	if !ok {
+		return nil, 0, ErrVersionUnavailable
+	}
+	cur, now := s.withEffects(s.current), s.version
+	if s.cyc != nil {
+		cur, now = s.clone(s.cyc.cur), s.cyc.version // Match the running tick
+	}
+	if project != nil {
+		old, cur = project(old), project(cur)
+	}
+	patch, err := calcDiff(old, cur, s.arrayCfg)
+	if err != nil {
+		return nil, 0, err
+	}
+	return patch, now, nil
+}
+
+// Resume returns the payload bringing a reconnecting client from the version
+// it last received to the current state (see State.DiffSince), encoded like
+// its Diff and versioned with SetVersioned. Returns ErrVersionUnavailable if
+// the version is no longer retained; send Full instead.
+func (s *Session[T, A, ID]) Resume(id ID, version uint64) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	patch, now, err := s.state.DiffSince(version, s.view(id))
+	if err != nil {
+		return nil, err
+	}
+	if patch == nil {
+		patch = Patch{}
+	}
+	var data []byte
+	if enc, ok := s.encoders[id]; ok {
+		data, err = enc.Encode(patch)
+	} else {
+		data, err = patch.JSON()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.wrapVersion(version, now, data), nil
+}
@@ -0,0 +1,164 @@
+package statediff
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Channel is the part of a Session a Hub needs. Session[T, A, ID] implements
+// it for any T and A, so sessions over different state types can share a Hub.
+type Channel[ID comparable] interface {
+	Tick() map[ID][]byte
+	Full(id ID) ([]byte, error)
+	IsConnected(id ID) bool
+	Disconnect(id ID)
+}
+
+// Envelope tags a payload with the channel it belongs to.
+// Hub output is a JSON array of envelopes, one per channel with data for the client:
+//
+//	[{"ch":"global","data":[...]},{"ch":"match:42","data":[...]}]
+//
+// Payloads that are not JSON (e.g. from a Gzip encoder) are sent as a
+// base64 string, as with versioned payloads.
+type Envelope struct {
+	Channel string          `json:"ch"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// Hub coordinates several sessions (e.g. global chat, lobby, match) whose
+// clients share one transport connection. Clients are connected to each
+// session directly (each session owns its projections); the Hub ticks all
+// sessions together and multiplexes their output into one message per client.
+// Thread-safe.
+type Hub[ID comparable] struct {
+	mu       sync.RWMutex
+	channels map[string]Channel[ID]
+}
+
+// NewHub creates an empty hub
+func NewHub[ID comparable]() *Hub[ID] {
+	return &Hub[ID]{channels: make(map[string]Channel[ID])}
+}
+
+// Register adds a session under a channel name.
+// Returns an error if the name is already in use.
+func (h *Hub[ID]) Register(name string, ch Channel[ID]) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, exists := h.channels[name]; exists {
+		return fmt.Errorf("statediff: channel %q already registered", name)
+	}
+	h.channels[name] = ch
+	return nil
+}
+
+// Unregister removes a channel. Returns false if it was not registered.
+func (h *Hub[ID]) Unregister(name string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, exists := h.channels[name]; !exists {
+		return false
+	}
+	delete(h.channels, name)
+	return true
+}
+
+// Channel returns a registered channel, or nil if not found
+func (h *Hub[ID]) Channel(name string) Channel[ID] {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.channels[name]
+}
+
+// Channels returns the names of all registered channels in sorted order
+func (h *Hub[ID]) Channels() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.sortedNames()
+}
+
+// sortedNames returns channel names in deterministic order. Caller must hold mu.
+func (h *Hub[ID]) sortedNames() []string {
+	names := make([]string, 0, len(h.channels))
+	for name := range h.channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ChannelsOf returns the sorted names of the channels a client is connected to
+func (h *Hub[ID]) ChannelsOf(id ID) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var names []string
+	for _, name := range h.sortedNames() {
+		if h.channels[name].IsConnected(id) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Tick ticks every channel and returns one envelope array per client that
+// received data on at least one channel. Envelopes are ordered by channel name.
+func (h *Hub[ID]) Tick() map[ID][]byte {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	perClient := make(map[ID][]Envelope)
+	for _, name := range h.sortedNames() {
+		for id, data := range h.channels[name].Tick() {
+			perClient[id] = append(perClient[id], Envelope{Channel: name, Data: envelopeData(data)})
+		}
+	}
+
+	result := make(map[ID][]byte, len(perClient))
+	for id, envs := range perClient {
+		result[id], _ = json.Marshal(envs) // Cannot fail: envelope data is valid JSON
+	}
+	return result
+}
+
+// envelopeData returns a channel payload as envelope data, base64 encoded
+// if it is not JSON
+func envelopeData(data []byte) json.RawMessage {
+	if !json.Valid(data) {
+		data, _ = json.Marshal(data) // As base64
+	}
+	return data
+}
+
+// Full returns the full state of every channel the client is connected to,
+// as an envelope array (for initial sync over the shared connection).
+func (h *Hub[ID]) Full(id ID) ([]byte, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	envs := []Envelope{}
+	for _, name := range h.sortedNames() {
+		ch := h.channels[name]
+		if !ch.IsConnected(id) {
+			continue
+		}
+		data, err := ch.Full(id)
+		if err != nil {
+			return nil, fmt.Errorf("statediff: full state for channel %q: %w", name, err)
+		}
+		envs = append(envs, Envelope{Channel: name, Data: envelopeData(data)})
+	}
+	return json.Marshal(envs)
+}
+
+// Disconnect removes the client from every channel (e.g. when its transport
+// connection closes).
+func (h *Hub[ID]) Disconnect(id ID) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, ch := range h.channels {
+		ch.Disconnect(id)
+	}
+}
@@ -0,0 +1,55 @@
+package statediff
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// validateIgnorePaths checks that no pattern ignores the whole document
+func validateIgnorePaths(paths []string) error {
+	for _, p := range paths {
+		if len(splitPtr(p)) == 0 {
+			return fmt.Errorf("statediff: IgnorePaths %q must not be the root", p)
+		}
+	}
+	return nil
+}
+
+// dropIgnored removes the values at ignored paths, with everything below
+// them, from doc. Modifies doc in place; the result must be used.
+func (o *diffOptions) dropIgnored(doc any) any {
+	for _, pattern := range o.ignore {
+		doc = dropPath(doc, pattern)
+	}
+	return doc
+}
+
+func dropPath(doc any, pattern []string) any {
+	seg, rest := pattern[0], pattern[1:]
+	switch v := doc.(type) {
+	case map[string]any:
+		for k, child := range v {
+			if seg != "*" && seg != k {
+				continue
+			}
+			if len(rest) == 0 {
+				delete(v, k)
+			} else {
+				v[k] = dropPath(child, rest)
+			}
+		}
+	case []any:
+		out := v[:0]
+		for i, child := range v {
+			if seg == "*" || seg == strconv.Itoa(i) {
+				if len(rest) == 0 {
+					continue
+				}
+				child = dropPath(child, rest)
+			}
+			out = append(out, child)
+		}
+		return out
+	}
+	return doc
+}
@@ -0,0 +1,56 @@
+package statediff
+
+import "fmt"
+
+// objectArrays rewrites keyed arrays as objects keyed by element key, for
+// Config.KeyedArraysAsObjects. Nested keyed arrays are found by their path
+// in the rewritten document. Arrays with an unkeyed or duplicate element
+// are left as arrays.
+func (o *diffOptions) objectArrays(doc any, path string) any {
+	switch v := doc.(type) {
+	case map[string]any:
+		for k, val := range v {
+			v[k] = o.objectArrays(val, path+"/"+escapePtr(k))
+		}
+	case []any:
+		if obj, ok := o.arrays.arrayObject(path, v); ok {
+			for k, val := range obj {
+				obj[k] = o.objectArrays(val, path+"/"+escapePtr(k))
+			}
+			return obj
+		}
+		for i, val := range v {
+			v[i] = o.objectArrays(val, fmt.Sprintf("%s/%d", path, i))
+		}
+	}
+	return doc
+}
+
+// arrayObject returns the keyed array at path as an object of its elements
+func (c ArrayConfig) arrayObject(path string, arr []any) (map[string]any, bool) {
+	getKey := c.keyer(path)
+	if getKey == nil {
+		return nil, false
+	}
+	obj := make(map[string]any, len(arr))
+	for _, el := range arr {
+		k, ok := getKey(el)
+		if _, dup := obj[k]; !ok || dup {
+			return nil, false
+		}
+		obj[k] = el
+	}
+	return obj, true
+}
+
+// positional returns c without KeyedArraysAsObjects, for code that works
+// on the arrays themselves
+func (c ArrayConfig) positional() ArrayConfig {
+	if c.opts == nil || c.opts.arrays == nil {
+		return c
+	}
+	o := *c.opts
+	o.arrays = nil
+	c.opts = &o
+	return c
+}
@@ -0,0 +1,134 @@
+package statediff
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// lcsMaxCells bounds the LCS table (old x new elements left after trimming
+// the common prefix and suffix); larger arrays are replaced whole
+const lcsMaxCells = 1 << 20
+
+// diffArraysLCS diffs arrays with a minimal edit script: elements of the
+// longest common subsequence stay, the rest are removed or inserted at their
+// index. Within a run of removals and insertions at the same place, elements
+// are paired up and diffed in place, so an edited object becomes field ops
+// rather than a remove and an add.
+func diffArraysLCS(path string, old, new []any, cfg ArrayConfig) Patch {
+	// Trim the common prefix and suffix: cheap, and covers single inserts
+	// and removes at either end without a table
+	pre := 0
+	for pre < len(old) && pre < len(new) && reflect.DeepEqual(old[pre], new[pre]) {
+		pre++
+	}
+	suf := 0
+	for suf < len(old)-pre && suf < len(new)-pre &&
+		reflect.DeepEqual(old[len(old)-1-suf], new[len(new)-1-suf]) {
+		suf++
+	}
+	a, b := old[pre:len(old)-suf], new[pre:len(new)-suf]
+	if len(a)*len(b) > lcsMaxCells {
+		return Patch{{Op: "replace", Path: path, Value: new}}
+	}
+
+	// match[i] is the index in b kept for a[i], or -1 if a[i] is not kept
+	match := lcsMatch(a, b)
+
+	// Pair leftover elements between consecutive kept ones: gaps are walked
+	// in order, pairing the t-th removed with the t-th inserted element
+	pairOld := make([]int, len(a)) // a index -> b index it is diffed into, or -1
+	newFrom := make([]int, len(b)) // b index -> a index it comes from, or -1
+	for j := range newFrom {
+		newFrom[j] = -1
+	}
+	ai, bj := 0, 0
+	for ai <= len(a) {
+		// Next kept pair (or the end of both slices)
+		na, nb := ai, len(b)
+		for na < len(a) && match[na] < 0 {
+			na++
+		}
+		if na < len(a) {
+			nb = match[na]
+		}
+		for t := 0; ai+t < na; t++ {
+			pairOld[ai+t] = -1
+			if bj+t < nb {
+				pairOld[ai+t] = bj + t
+				newFrom[bj+t] = ai + t
+			}
+		}
+		if na == len(a) {
+			break
+		}
+		pairOld[na] = nb
+		newFrom[nb] = na
+		ai, bj = na+1, nb+1
+	}
+
+	var ops Patch
+
+	// Removes first, in descending index order
+	for i := len(a) - 1; i >= 0; i-- {
+		if pairOld[i] < 0 {
+			ops = append(ops, Op{Op: "remove", Path: fmt.Sprintf("%s/%d", path, pre+i)})
+		}
+	}
+
+	// Then inserts and in-place changes in ascending final index order
+	length := len(old)
+	for i := range a {
+		if pairOld[i] < 0 {
+			length--
+		}
+	}
+	for j, v := range b {
+		ni := pre + j
+		if oi := newFrom[j]; oi >= 0 {
+			ops = append(ops, diffValues(fmt.Sprintf("%s/%d", path, ni), a[oi], v, cfg)...)
+			continue
+		}
+		p := fmt.Sprintf("%s/%d", path, ni)
+		if ni == length {
+			p = path + "/-"
+		}
+		ops = append(ops, Op{Op: "add", Path: p, Value: v})
+		length++
+	}
+	return ops
+}
+
+// lcsMatch returns, for every element of a, the index of the element of b
+// it is matched with in a longest common subsequence, or -1
+func lcsMatch(a, b []any) []int {
+	n, m := len(a), len(b)
+	// lcs[i*(m+1)+j] is the LCS length of a[i:] and b[j:]
+	lcs := make([]int32, (n+1)*(m+1))
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if reflect.DeepEqual(a[i], b[j]) {
+				lcs[i*(m+1)+j] = lcs[(i+1)*(m+1)+j+1] + 1
+			} else {
+				lcs[i*(m+1)+j] = max(lcs[(i+1)*(m+1)+j], lcs[i*(m+1)+j+1])
+			}
+		}
+	}
+
+	match := make([]int, n)
+	for i := range match {
+		match[i] = -1
+	}
+	for i, j := 0, 0; i < n && j < m; {
+		switch {
+		case reflect.DeepEqual(a[i], b[j]):
+			match[i] = j
+			i++
+			j++
+		case lcs[(i+1)*(m+1)+j] >= lcs[i*(m+1)+j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return match
+}
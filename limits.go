@@ -0,0 +1,99 @@
+package statediff
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Limits are hard caps on the state document, protecting the server from a
+// bug or malicious command that balloons the state and stalls every diff.
+// Zero fields are unlimited.
+type Limits struct {
+	MaxBytes    int // JSON size of the document
+	MaxDepth    int // Nesting depth of objects and arrays (root container = 1)
+	MaxArrayLen int // Elements in any single array
+}
+
+func (l Limits) enabled() bool {
+	return l.MaxBytes > 0 || l.MaxDepth > 0 || l.MaxArrayLen > 0
+}
+
+// Limit kinds reported in LimitError.Limit
+const (
+	LimitBytes    = "bytes"
+	LimitDepth    = "depth"
+	LimitArrayLen = "array length"
+)
+
+// LimitError reports a state document exceeding a configured limit
+type LimitError struct {
+	Limit string // LimitBytes, LimitDepth or LimitArrayLen
+	Path  string // JSON Pointer of the offending value (empty for LimitBytes)
+	Value int
+	Max   int
+}
+
+func (e *LimitError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("statediff: state %s %d exceeds limit %d", e.Limit, e.Value, e.Max)
+	}
+	return fmt.Sprintf("statediff: state %s %d at %s exceeds limit %d", e.Limit, e.Value, e.Path, e.Max)
+}
+
+// check returns a *LimitError if v exceeds the limits, measuring the
+// document o builds of v
+func (l Limits) check(v any, o *diffOptions) error {
+	doc, err := o.document(v)
+	if err != nil {
+		return err
+	}
+	if l.MaxBytes > 0 {
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		if len(data) > l.MaxBytes {
+			return &LimitError{Limit: LimitBytes, Value: len(data), Max: l.MaxBytes}
+		}
+	}
+	return l.walk(doc, "", 0)
+}
+
+// walk checks depth and array lengths below doc, which sits at depth
+func (l Limits) walk(doc any, path string, depth int) error {
+	switch v := doc.(type) {
+	case map[string]any:
+		depth++
+		if l.MaxDepth > 0 && depth > l.MaxDepth {
+			return &LimitError{Limit: LimitDepth, Path: path, Value: depth, Max: l.MaxDepth}
+		}
+		for k, val := range v {
+			if err := l.walk(val, path+"/"+escapePtr(k), depth); err != nil {
+				return err
+			}
+		}
+	case []any:
+		depth++
+		if l.MaxDepth > 0 && depth > l.MaxDepth {
+			return &LimitError{Limit: LimitDepth, Path: path, Value: depth, Max: l.MaxDepth}
+		}
+		if l.MaxArrayLen > 0 && len(v) > l.MaxArrayLen {
+			return &LimitError{Limit: LimitArrayLen, Path: path, Value: len(v), Max: l.MaxArrayLen}
+		}
+		for i, val := range v {
+			if err := l.walk(val, fmt.Sprintf("%s/%d", path, i), depth); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reportLimit delivers a limit violation to the hook, if any
+func (s *State[T, A]) reportLimit(err error) {
+	if err != nil && s.onLimit != nil {
+		if le, ok := err.(*LimitError); ok {
+			s.onLimit(le)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package statediff
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// memberMoves rewrites the ops diffMaps produced for one object when move
+// detection is on. An added member whose value equals a removed member's
+// old value becomes a move from it (and the remove is dropped); otherwise,
+// if it equals an unchanged member, a copy from that member. Only object and
+// array values are relocated: for scalars the value is as short as the path.
+//
+// The ops at one object level touch distinct members, so sources keep their
+// paths until the adds are reached, which come last.
+func (o *diffOptions) memberMoves(path string, old, new map[string]any, ops Patch) Patch {
+	if o == nil || !o.moves || len(ops) < 2 {
+		return ops
+	}
+
+	// Removed members that can be moved, in op (sorted key) order
+	var sources []int
+	var unchanged []string
+	for i, op := range ops {
+		if op.Op != "remove" {
+			continue
+		}
+		if k, direct, ok := memberOf(path, op.Path); ok && direct && relocatable(old[k]) {
+			if _, kept := new[k]; !kept {
+				sources = append(sources, i)
+			}
+		}
+	}
+
+	drop := make(map[int]bool)
+	unchangedDone := false
+	for i, op := range ops {
+		if op.Op != "add" || !relocatable(op.Value) {
+			continue
+		}
+		k, direct, ok := memberOf(path, op.Path)
+		if !ok || !direct {
+			continue
+		}
+		if _, existed := old[k]; existed {
+			continue
+		}
+
+		moved := false
+		for _, si := range sources {
+			sk, _, _ := memberOf(path, ops[si].Path)
+			if !drop[si] && reflect.DeepEqual(old[sk], op.Value) {
+				ops[i] = Op{Op: "move", Path: op.Path, From: ops[si].Path}
+				drop[si], moved = true, true
+				break
+			}
+		}
+		if moved {
+			continue
+		}
+
+		if !unchangedDone {
+			unchanged = unchangedMembers(old, new, ops, path)
+			unchangedDone = true
+		}
+		for _, uk := range unchanged {
+			if reflect.DeepEqual(new[uk], op.Value) {
+				ops[i] = Op{Op: "copy", Path: op.Path, From: path + "/" + escapePtr(uk)}
+				break
+			}
+		}
+	}
+
+	if len(drop) == 0 {
+		return ops
+	}
+	out := ops[:0]
+	for i, op := range ops {
+		if !drop[i] {
+			out = append(out, op)
+		}
+	}
+	return out
+}
+
+// unchangedMembers returns the relocatable members of both old and new that
+// no op in ops touches, in sorted key order
+func unchangedMembers(old, new map[string]any, ops Patch, path string) []string {
+	touched := make(map[string]bool)
+	for _, op := range ops {
+		if k, _, ok := memberOf(path, op.Path); ok {
+			touched[k] = true
+		}
+	}
+	var keys []string
+	for k, v := range new {
+		if _, ok := old[k]; ok && !touched[k] && relocatable(v) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// memberOf returns the unescaped name of the member of path that ptr
+// points to (direct) or lies below
+func memberOf(path, ptr string) (name string, direct, ok bool) {
+	if len(ptr) <= len(path) || ptr[:len(path)] != path || ptr[len(path)] != '/' {
+		return "", false, false
+	}
+	rest := ptr[len(path)+1:]
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		return unescapePtr(rest[:i]), false, true
+	}
+	return unescapePtr(rest), true, true
+}
+
+// relocatable reports whether v is worth a move or copy: a non-empty object
+// or array
+func relocatable(v any) bool {
+	switch c := v.(type) {
+	case map[string]any:
+		return len(c) > 0
+	case []any:
+		return len(c) > 0
+	}
+	return false
+}
+
+// keyedMoves returns the moves that turn the keyed elements of the array at
+// path from order from into order to (the same keys). Elements on a longest
+// increasing subsequence stay put; each other element, in the order of to,
+// moves to just after its predecessor in to, which is already in place.
+func keyedMoves(path string, from, to []string) Patch {
+	pos := make(map[string]int, len(from))
+	for i, k := range from {
+		pos[k] = i
+	}
+	seq := make([]int, len(to))
+	for i, k := range to {
+		seq[i] = pos[k]
+	}
+	stay := make(map[string]bool, len(to))
+	for _, i := range longestIncreasing(seq) {
+		stay[to[i]] = true
+	}
+
+	cur := append([]string(nil), from...)
+	var ops Patch
+	for t, k := range to {
+		if stay[k] {
+			continue
+		}
+		ci := indexOf(cur, k)
+		cur = append(cur[:ci], cur[ci+1:]...)
+		ni := 0
+		if t > 0 {
+			ni = indexOf(cur, to[t-1]) + 1
+		}
+		cur = append(cur, "")
+		copy(cur[ni+1:], cur[ni:])
+		cur[ni] = k
+
+		p := fmt.Sprintf("%s/%d", path, ni)
+		if ni == len(cur)-1 {
+			p = path + "/-"
+		}
+		ops = append(ops, Op{Op: "move", Path: p, From: fmt.Sprintf("%s/%d", path, ci)})
+	}
+	return ops
+}
+
+// longestIncreasing returns the indices into seq of a longest strictly
+// increasing subsequence, in ascending order
+func longestIncreasing(seq []int) []int {
+	tails := make([]int, 0, len(seq)) // tails[l]: index ending the best run of length l+1
+	prev := make([]int, len(seq))
+	for i, v := range seq {
+		l := sort.Search(len(tails), func(j int) bool { return seq[tails[j]] >= v })
+		prev[i] = -1
+		if l > 0 {
+			prev[i] = tails[l-1]
+		}
+		if l == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[l] = i
+		}
+	}
+	out := make([]int, len(tails))
+	if len(tails) == 0 {
+		return out
+	}
+	for i, j := len(tails)-1, tails[len(tails)-1]; i >= 0; i-- {
+		out[i], j = j, prev[j]
+	}
+	return out
+}
+
+func indexOf(s []string, v string) int {
+	for i, x := range s {
+		if x == v {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,178 @@
+package statediff
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// MsgPackEncoder encodes patches as MessagePack (see Patch.MsgPack), for
+// clients where JSON size or parse time matters:
+//
+//	session.Connect(id, project, statediff.WithEncoder[T](statediff.MsgPackEncoder))
+var MsgPackEncoder = Encoder{Name: "msgpack", Encode: Patch.MsgPack}
+
+// MsgPack encodes the patch as a MessagePack array of op maps with the same
+// keys as the JSON form ("op", "path", "from", "value", "old"; empty ones
+// omitted). Whole numbers are sent as integers, other numbers as float64;
+// object keys are sorted, so equal patches encode to equal bytes.
+func (p Patch) MsgPack() ([]byte, error) {
+	buf := appendArrayHeader(make([]byte, 0, 16*len(p)+1), len(p))
+	for _, op := range p {
+		n := 2
+		for _, set := range []bool{op.From != "", op.Value != nil, op.Old != nil} {
+			if set {
+				n++
+			}
+		}
+		buf = appendMapHeader(buf, n)
+		buf = appendString(appendString(buf, "op"), op.Op)
+		buf = appendString(appendString(buf, "path"), op.Path)
+		if op.From != "" {
+			buf = appendString(appendString(buf, "from"), op.From)
+		}
+		var err error
+		if op.Value != nil {
+			if buf, err = appendMsgPack(appendString(buf, "value"), op.Value); err != nil {
+				return nil, err
+			}
+		}
+		if op.Old != nil {
+			if buf, err = appendMsgPack(appendString(buf, "old"), op.Old); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf, nil
+}
+
+// appendMsgPack appends v, a decoded JSON value or any value that marshals
+// to JSON
+func appendMsgPack(buf []byte, v any) ([]byte, error) {
+	switch x := v.(type) {
+	case nil:
+		return append(buf, 0xc0), nil
+	case bool:
+		if x {
+			return append(buf, 0xc3), nil
+		}
+		return append(buf, 0xc2), nil
+	case string:
+		return appendString(buf, x), nil
+	case float64:
+		return appendNumber(buf, x), nil
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return appendInt(buf, i), nil
+		}
+		f, err := x.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("statediff: msgpack: invalid number %q", x)
+		}
+		return appendFloat(buf, f), nil
+	case map[string]any:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf = appendMapHeader(buf, len(keys))
+		for _, k := range keys {
+			var err error
+			if buf, err = appendMsgPack(appendString(buf, k), x[k]); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case []any:
+		buf = appendArrayHeader(buf, len(x))
+		for _, e := range x {
+			var err error
+			if buf, err = appendMsgPack(buf, e); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+	// Typed values (e.g. full states) and raw JSON go through their JSON form
+	doc, err := toJSONValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return appendMsgPack(buf, doc)
+}
+
+// appendNumber appends whole numbers as integers, others as float64
+func appendNumber(buf []byte, f float64) []byte {
+	if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+		return appendInt(buf, int64(f))
+	}
+	return appendFloat(buf, f)
+}
+
+func appendFloat(buf []byte, f float64) []byte {
+	return binary.BigEndian.AppendUint64(append(buf, 0xcb), math.Float64bits(f))
+}
+
+func appendInt(buf []byte, i int64) []byte {
+	switch {
+	case i >= 0 && i <= 0x7f:
+		return append(buf, byte(i))
+	case i >= -32 && i < 0:
+		return append(buf, byte(i))
+	case i > 0 && i <= math.MaxUint8:
+		return append(buf, 0xcc, byte(i))
+	case i > 0 && i <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xcd), uint16(i))
+	case i > 0 && i <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xce), uint32(i))
+	case i > 0:
+		return binary.BigEndian.AppendUint64(append(buf, 0xcf), uint64(i))
+	case i >= math.MinInt8:
+		return append(buf, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xd1), uint16(i))
+	case i >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xd2), uint32(i))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, 0xd3), uint64(i))
+	}
+}
+
+func appendString(buf []byte, s string) []byte {
+	switch n := len(s); {
+	case n <= 31:
+		buf = append(buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		buf = binary.BigEndian.AppendUint16(append(buf, 0xda), uint16(n))
+	default:
+		buf = binary.BigEndian.AppendUint32(append(buf, 0xdb), uint32(n))
+	}
+	return append(buf, s...)
+}
+
+func appendArrayHeader(buf []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(buf, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xdc), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(buf, 0xdd), uint32(n))
+	}
+}
+
+func appendMapHeader(buf []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(buf, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xde), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(buf, 0xdf), uint32(n))
+	}
+}
@@ -0,0 +1,89 @@
+package statediff
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// NonFinitePolicy selects how NaN and ±Inf floats, which JSON cannot
+// represent, are sent (see Config.NonFinite)
+type NonFinitePolicy int
+
+const (
+	// NonFiniteReject fails New and Diff with a *NonFiniteError
+	// naming the path of the value
+	NonFiniteReject NonFinitePolicy = iota
+	// NonFiniteNull sends NaN and ±Inf as null
+	NonFiniteNull
+	// NonFiniteClamp sends NaN as 0 and ±Inf as the largest finite value
+	// of the field's type
+	NonFiniteClamp
+)
+
+// NonFiniteError reports a NaN or ±Inf float in a state with the
+// NonFiniteReject policy
+type NonFiniteError struct {
+	Path  string // JSON Pointer of the value, as named by the json tags
+	Value float64
+}
+
+func (e *NonFiniteError) Error() string {
+	return fmt.Sprintf("statediff: unsupported float %v at %s (see Config.NonFinite)", e.Value, displayPtr(e.Path))
+}
+
+// nonFinite returns the document value of the non-finite float f of the
+// given bit size, per the policy
+func (o *diffOptions) nonFinite(f float64, bits int) (any, error) {
+	if o == nil {
+		return nil, &NonFiniteError{Value: f}
+	}
+	switch o.floats {
+	case NonFiniteNull:
+		return nil, nil
+	case NonFiniteClamp:
+		max := math.MaxFloat64
+		if bits == 32 {
+			max = math.MaxFloat32
+		}
+		switch {
+		case math.IsNaN(f):
+			f = 0
+		case f > 0:
+			f = max
+		default:
+			f = -max
+		}
+		text := jsonFloat(f, bits)
+		if o.numbers {
+			return json.Number(text), nil
+		}
+		return strconv.ParseFloat(text, 64) // As a float32 field decodes
+
+	}
+	return nil, &NonFiniteError{Value: f}
+}
+
+// inMember prefixes the path of a *NonFiniteError from below a member
+func inMember(err error, seg string) error {
+	if e, ok := err.(*NonFiniteError); ok {
+		e.Path = "/" + escapePtr(seg) + e.Path
+	}
+	return err
+}
+
+// inElement prefixes the path of a *NonFiniteError from below an element
+func inElement(err error, i int) error {
+	return inMember(err, strconv.Itoa(i))
+}
+
+// isNonFiniteMarshal reports whether encoding/json failed on a NaN or ±Inf
+func isNonFiniteMarshal(err error) bool {
+	var uve *json.UnsupportedValueError
+	if !errors.As(err, &uve) {
+		return false
+	}
+	return uve.Str == "NaN" || uve.Str == "+Inf" || uve.Str == "-Inf"
+}
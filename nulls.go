@@ -0,0 +1,72 @@
+package statediff
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// validateNullPaths checks that every pattern names an object member
+func validateNullPaths(paths []string) error {
+	for _, p := range paths {
+		segs := splitPtr(p)
+		if len(segs) == 0 || segs[len(segs)-1] == "*" {
+			return fmt.Errorf("statediff: NullPaths %q must end in a member name", p)
+		}
+	}
+	return nil
+}
+
+// fillNulls adds an explicit null for every absent member matching one of
+// the patterns whose parent object exists. Modifies doc in place.
+func (o *diffOptions) fillNulls(doc any) any {
+	for _, pattern := range o.nulls {
+		fillNull(doc, pattern)
+	}
+	return doc
+}
+
+func fillNull(doc any, pattern []string) {
+	seg, rest := pattern[0], pattern[1:]
+	switch v := doc.(type) {
+	case map[string]any:
+		if len(rest) == 0 {
+			if _, ok := v[seg]; !ok {
+				v[seg] = nil
+			}
+			return
+		}
+		if seg == "*" {
+			for _, child := range v {
+				fillNull(child, rest)
+			}
+		} else if child, ok := v[seg]; ok {
+			fillNull(child, rest)
+		}
+	case []any:
+		if len(rest) == 0 {
+			return
+		}
+		if seg == "*" {
+			for _, child := range v {
+				fillNull(child, rest)
+			}
+		} else if i, err := strconv.Atoi(seg); err == nil && i >= 0 && i < len(v) {
+			fillNull(v[i], rest)
+		}
+	}
+}
+
+// explicitNulls makes add and replace ops of null values carry "value": null,
+// which Op would otherwise omit
+func (o *diffOptions) explicitNulls(p Patch) Patch {
+	if o == nil || (len(o.nulls) == 0 && !o.strict) {
+		return p
+	}
+	for i := range p {
+		if p[i].Value == nil && (p[i].Op == "add" || p[i].Op == "replace") {
+			p[i].Value = json.RawMessage("null")
+		}
+	}
+	return p
+}
@@ -0,0 +1,33 @@
+package statediff
+
+// includeOld reports whether diffs carry old values, which modifies the old
+// document
+func (o *diffOptions) includeOld() bool {
+	return o != nil && o.old
+}
+
+// withOld sets Old on the replace, inc and remove ops of p to the value each one
+// overwrites, by applying p in order to oldDoc (which is modified).
+// Ops are left without Old if p does not apply, which a diff always does.
+func (o *diffOptions) withOld(p Patch, oldDoc any) Patch {
+	if !o.includeOld() {
+		return p
+	}
+	doc := oldDoc
+	for i, op := range p {
+		if op.Op == "replace" || op.Op == "inc" || op.Op == "remove" {
+			segs, err := parsePtr(op.Path)
+			if err != nil {
+				return p
+			}
+			if p[i].Old, err = lookup(doc, segs); err != nil {
+				return p
+			}
+		}
+		var err error
+		if doc, err = applyOp(doc, op); err != nil {
+			return p
+		}
+	}
+	return p
+}
@@ -0,0 +1,57 @@
+package statediff
+
+import "reflect"
+
+// OmitEmptyPolicy selects which fields tagged omitempty are left out of
+// documents (see Config.OmitEmpty)
+type OmitEmptyPolicy int
+
+const (
+	// OmitEmptyTags follows encoding/json: false, 0, "", nil, and empty
+	// slices, maps and arrays are left out
+	OmitEmptyTags OmitEmptyPolicy = iota
+	// OmitEmptyNil leaves out nil pointers, interfaces, slices and maps
+	// only, so zero values are sent
+	OmitEmptyNil
+	// OmitEmptyNever ignores omitempty: zero values are sent, and nil
+	// values as null
+	OmitEmptyNever
+)
+
+// omits reports whether a field tagged omitempty holding v is left out
+func (p OmitEmptyPolicy) omits(v reflect.Value) bool {
+	switch p {
+	case OmitEmptyNil:
+		switch v.Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.Slice, reflect.Map:
+			return v.IsNil()
+		}
+		return false
+	case OmitEmptyNever:
+		return false
+	}
+	return isEmptyValue(v)
+}
+
+// mayOmit reports whether a field of type t tagged omitempty can be left out
+func (p OmitEmptyPolicy) mayOmit(t reflect.Type) bool {
+	switch p {
+	case OmitEmptyNil:
+		switch t.Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.Slice, reflect.Map:
+			return true
+		}
+		return false
+	case OmitEmptyNever:
+		return false
+	}
+	return true
+}
+
+// omits reports whether the walk leaves out a field tagged omitempty
+func (o *diffOptions) omits(v reflect.Value) bool {
+	if o == nil {
+		return isEmptyValue(v)
+	}
+	return o.omit.omits(v)
+}
@@ -0,0 +1,168 @@
+package statediff
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+)
+
+// Backpressure selects what an Outbox does when a client's queue is full
+type Backpressure int
+
+const (
+	// BackpressureDisconnect drops the client's queue and disconnects it
+	// from the channel; Push reports it so the caller can close the connection.
+	BackpressureDisconnect Backpressure = iota
+	// BackpressureKeyframe replaces the queue with one full state payload,
+	// so a client that catches up resyncs from a single message.
+	BackpressureKeyframe
+	// BackpressureCoalesce squashes the queued patches into one (see Squash).
+	// Payloads that are not JSON Patches (versioned, gzip, MessagePack, CBOR
+	// or Compact) cannot be merged and fall back to a keyframe.
+	BackpressureCoalesce
+)
+
+// Outbox buffers a channel's payloads per client between ticks and the
+// transport writers sending them, so a stalled connection holds at most
+// limit payloads instead of buffering without bound:
+//
+//	out := statediff.NewOutbox[string](session, 16, statediff.BackpressureCoalesce)
+//	for range ticker.C {
+//		for _, id := range out.Tick() {
+//			conns[id].Close() // Disconnected for falling behind
+//		}
+//		// Each writer goroutine sends out.Next(id) while it returns true
+//	}
+//
+// Keyframes are built right when the queue overflows, so Push should follow
+// the tick that produced its payloads before further updates; otherwise the
+// keyframe already holds changes the next tick sends again.
+// Thread-safe.
+type Outbox[ID comparable] struct {
+	mu     sync.Mutex
+	ch     Channel[ID]
+	limit  int
+	policy Backpressure
+	queues map[ID][][]byte
+}
+
+// NewOutbox creates an outbox for ch holding at most limit payloads per
+// client (0 disables the limit) and applying policy when a queue overflows.
+func NewOutbox[ID comparable](ch Channel[ID], limit int, policy Backpressure) *Outbox[ID] {
+	return &Outbox[ID]{ch: ch, limit: limit, policy: policy, queues: make(map[ID][][]byte)}
+}
+
+// Tick ticks the channel and queues its payloads (see Push).
+// Returns the clients disconnected for falling behind.
+func (o *Outbox[ID]) Tick() []ID {
+	return o.Push(o.ch.Tick())
+}
+
+// Push queues one payload per client, e.g. the result of a Session tick.
+// Returns the clients disconnected for falling behind: with
+// BackpressureDisconnect, or when their keyframe could not be built.
+func (o *Outbox[ID]) Push(payloads map[ID][]byte) []ID {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var dropped []ID
+	for id, data := range payloads {
+		q := append(o.queues[id], data)
+		if o.limit > 0 && len(q) > o.limit {
+			var ok bool
+			if q, ok = o.overflow(id, q); !ok {
+				delete(o.queues, id)
+				o.ch.Disconnect(id)
+				dropped = append(dropped, id)
+				continue
+			}
+		}
+		o.queues[id] = q
+	}
+	return dropped
+}
+
+// overflow applies the policy to a queue over the limit.
+// ok is false if the client has to be disconnected.
+func (o *Outbox[ID]) overflow(id ID, q [][]byte) (_ [][]byte, ok bool) {
+	switch o.policy {
+	case BackpressureCoalesce:
+		if data, ok := coalescePayloads(q); ok {
+			return [][]byte{data}, true
+		}
+		fallthrough
+	case BackpressureKeyframe:
+		full, err := o.ch.Full(id)
+		if err != nil {
+			return nil, false
+		}
+		return [][]byte{full}, true
+	}
+	return nil, false
+}
+
+// coalescePayloads squashes queued JSON Patch payloads into one.
+// ok is false if any of them is not a JSON Patch.
+func coalescePayloads(q [][]byte) ([]byte, bool) {
+	patches := make([]Patch, len(q))
+	for i, data := range q {
+		var ok bool
+		if patches[i], ok = decodePatchPayload(data); !ok {
+			return nil, false
+		}
+	}
+	data, err := Squash(patches...).JSON()
+	return data, err == nil
+}
+
+// decodePatchPayload decodes a JSON Patch payload, keeping numbers exact.
+// ok is false for anything else, e.g. versioned or binary payloads.
+func decodePatchPayload(data []byte) (Patch, bool) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var p Patch
+	if err := dec.Decode(&p); err != nil || dec.More() {
+		return nil, false
+	}
+	for _, op := range p {
+		switch op.Op {
+		case "add", "remove", "replace", "move", "copy", "test", "inc":
+		default:
+			return nil, false
+		}
+	}
+	return p, true
+}
+
+// Next removes and returns the oldest queued payload of a client.
+// ok is false if its queue is empty.
+func (o *Outbox[ID]) Next(id ID) (data []byte, ok bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	q := o.queues[id]
+	if len(q) == 0 {
+		return nil, false
+	}
+	data = q[0]
+	if len(q) == 1 {
+		delete(o.queues, id)
+	} else {
+		o.queues[id] = q[1:]
+	}
+	return data, true
+}
+
+// Len returns the number of payloads queued for a client
+func (o *Outbox[ID]) Len(id ID) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.queues[id])
+}
+
+// Remove drops a client's queue (e.g. when its connection closes).
+// The client stays connected to the channel.
+func (o *Outbox[ID]) Remove(id ID) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.queues, id)
+}
@@ -0,0 +1,64 @@
+package statediff
+
+import "sync"
+
+// ParallelDiffMin is the number of members an object needs before its
+// members are diffed in parallel with Config.DiffWorkers. Smaller objects
+// are not worth the goroutines.
+const ParallelDiffMin = 64
+
+// workerPool bounds the goroutines diffs fan out to. Shared by all diffs of
+// a state; when every slot is taken, members are diffed on the caller.
+type workerPool chan struct{}
+
+func newWorkerPool(workers int) workerPool {
+	if workers <= 1 {
+		return nil
+	}
+	return make(workerPool, workers-1) // The calling goroutine is a worker too
+}
+
+// parallel reports whether the members of an object of n members are
+// diffed in parallel
+func (o *diffOptions) parallel(n int) bool {
+	return o != nil && o.workers != nil && n >= ParallelDiffMin
+}
+
+// diffMembers diffs the members of old that are also in new, the ones
+// named by keys, fanning them out across the worker pool. Results are
+// returned by position in keys, so the merged patch does not depend on
+// scheduling. A panic in a worker is re-raised on the caller.
+func (o *diffOptions) diffMembers(path string, keys []string, old, new map[string]any, cfg ArrayConfig) []Patch {
+	out := make([]Patch, len(keys))
+	var wg sync.WaitGroup
+	var once sync.Once
+	var panicked any
+	for i, k := range keys {
+		newV, exists := new[k]
+		if !exists {
+			continue
+		}
+		kPath := path + "/" + escapePtr(k)
+		select {
+		case o.workers <- struct{}{}:
+			wg.Add(1)
+			go func() {
+				defer func() {
+					if r := recover(); r != nil {
+						once.Do(func() { panicked = r })
+					}
+					<-o.workers
+					wg.Done()
+				}()
+				out[i] = diffValues(kPath, old[k], newV, cfg)
+			}()
+		default:
+			out[i] = diffValues(kPath, old[k], newV, cfg)
+		}
+	}
+	wg.Wait()
+	if panicked != nil {
+		panic(panicked)
+	}
+	return out
+}
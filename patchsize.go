@@ -0,0 +1,118 @@
+package statediff
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// capSize enforces RootReplaceRatio, MaxPatchOps and MaxPatchBytes on a
+// finished patch. An oversized patch is first collapsed per top-level
+// member: every member touched by more than one op is sent whole. If that
+// is still too large, the whole document newDoc is sent as one root replace.
+func (o *diffOptions) capSize(p Patch, newDoc any) Patch {
+	if o == nil || len(p) == 0 {
+		return p
+	}
+	root := Patch{{Op: "replace", Path: "", Value: nullValue(newDoc)}}
+	if o.rootRatio > 0 && len(p) > 1 && o.mostlyChanged(p, newDoc) {
+		return root
+	}
+	if (o.maxOps <= 0 && o.maxBytes <= 0) || o.fits(p) {
+		return p
+	}
+	obj, ok := newDoc.(map[string]any)
+	if !ok {
+		return root
+	}
+
+	var members []string
+	groups := make(map[string]Patch)
+	for _, op := range p {
+		m, ok := topMember(op.Path)
+		if !ok {
+			return root
+		}
+		if op.From != "" {
+			if from, ok := topMember(op.From); !ok || from != m {
+				return root // Relocations across members need both sides
+			}
+		}
+		if _, seen := groups[m]; !seen {
+			members = append(members, m)
+		}
+		groups[m] = append(groups[m], op)
+	}
+
+	var collapsed Patch
+	for _, m := range members {
+		ops := groups[m]
+		switch v, exists := obj[m]; {
+		case len(ops) == 1:
+			collapsed = append(collapsed, ops[0])
+		case exists:
+			// add replaces an existing member and creates a missing one
+			collapsed = append(collapsed, Op{Op: "add", Path: "/" + escapePtr(m), Value: nullValue(v)})
+		default:
+			collapsed = append(collapsed, Op{Op: "remove", Path: "/" + escapePtr(m)})
+		}
+	}
+	if o.fits(collapsed) {
+		return collapsed
+	}
+	return root
+}
+
+// mostlyChanged reports whether p touches more than the RootReplaceRatio
+// share of the top-level members of the old and new documents
+func (o *diffOptions) mostlyChanged(p Patch, newDoc any) bool {
+	obj, ok := newDoc.(map[string]any)
+	if !ok {
+		return false
+	}
+	touched := make(map[string]bool)
+	members := len(obj)
+	for _, op := range p {
+		for _, ptr := range opPointers(op) {
+			m, ok := topMember(ptr)
+			if !ok {
+				return false // Already a root op
+			}
+			if !touched[m] {
+				touched[m] = true
+				if _, exists := obj[m]; !exists {
+					members++ // Removed from the old document
+				}
+			}
+		}
+	}
+	return float64(len(touched)) > o.rootRatio*float64(members)
+}
+
+// fits reports whether p is within the size thresholds
+func (o *diffOptions) fits(p Patch) bool {
+	if o.maxOps > 0 && len(p) > o.maxOps {
+		return false
+	}
+	if o.maxBytes > 0 {
+		data, err := json.Marshal(p)
+		return err == nil && len(data) <= o.maxBytes
+	}
+	return true
+}
+
+// topMember returns the unescaped top-level member a pointer lies in
+func topMember(ptr string) (string, bool) {
+	if !strings.HasPrefix(ptr, "/") {
+		return "", false
+	}
+	seg, _, _ := strings.Cut(ptr[1:], "/")
+	return unescapePtr(seg), true
+}
+
+// nullValue makes a nil op value marshal as an explicit null
+func nullValue(v any) any {
+	if v == nil {
+		return json.RawMessage("null")
+	}
+	return v
+}
@@ -10,11 +10,12 @@ import (
 
 // Snapshot represents saved state that can be restored
 type Snapshot[T any] struct {
-	Version int             `json:"version"` // Schema version for forward compatibility
-	State   T               `json:"state"`
-	Effects []EffectMeta    `json:"effects,omitempty"`
-	SavedAt time.Time       `json:"savedAt"`
-	Extra   json.RawMessage `json:"extra,omitempty"`
+	Version      int             `json:"version"` // Schema version for forward compatibility
+	State        T               `json:"state"`
+	StateVersion uint64          `json:"stateVersion,omitempty"` // State.Version when saved
+	Effects      []EffectMeta    `json:"effects,omitempty"`
+	SavedAt      time.Time       `json:"savedAt"`
+	Extra        json.RawMessage `json:"extra,omitempty"`
 }
 
 // Current snapshot version
@@ -28,9 +29,96 @@ type RestoreResult[T, A any] struct {
 
 // EffectMeta stores effect info for recreation
 type EffectMeta struct {
-	ID     string          `json:"id"`
-	Type   string          `json:"type"`
-	Params json.RawMessage `json:"params,omitempty"`
+	ID      string          `json:"id"`
+	Type    string          `json:"type"`
+	Version int             `json:"version,omitempty"` // Params version, see EffectTemplate.Version
+	Params  json.RawMessage `json:"params,omitempty"`
+	Timing  *EffectTiming   `json:"timing,omitempty"` // Captured for timed effects by State.EffectMetas
+}
+
+// EffectTiming records when a timed effect starts and expires, both as
+// durations relative to the capture time and as wall-clock times, so restore
+// can resume the remaining time or keep the original schedule.
+type EffectTiming struct {
+	StartsIn  time.Duration `json:"startsIn,omitempty"`  // Until start (0 once started)
+	Remaining time.Duration `json:"remaining,omitempty"` // Until expiry (0 if expired or no expiry)
+	StartsAt  time.Time     `json:"startsAt,omitempty"`  // Zero means active immediately
+	ExpiresAt time.Time     `json:"expiresAt,omitempty"` // Zero means never expires
+}
+
+// windowed is implemented by effects with a start and expiry (TimedEffect)
+type windowed interface {
+	StartsAt() time.Time
+	ExpiresAt() time.Time
+	UntilStart() time.Duration
+	Remaining() time.Duration
+	SetStartsAt(t time.Time)
+	SetExpiresAt(t time.Time)
+}
+
+// captureTiming records the effect's schedule, or nil for untimed effects
+func captureTiming(e any) *EffectTiming {
+	w, ok := e.(windowed)
+	if !ok {
+		return nil
+	}
+	return &EffectTiming{
+		StartsIn:  w.UntilStart(),
+		Remaining: w.Remaining(),
+		StartsAt:  w.StartsAt(),
+		ExpiresAt: w.ExpiresAt(),
+	}
+}
+
+// TimerMode selects how Restore treats the saved schedule of timed effects
+type TimerMode int
+
+const (
+	// TimersAsCreated keeps the times the factory set (default)
+	TimersAsCreated TimerMode = iota
+	// TimersResume restarts the remaining time from the moment of restore:
+	// a 10s buff saved with 3s left has 3s left after any downtime
+	TimersResume
+	// TimersWallClock restores the original wall-clock start and expiry, so
+	// downtime counts against the effect
+	TimersWallClock
+)
+
+// RestoreOption configures Restore
+type RestoreOption func(*restoreOptions)
+
+type restoreOptions struct {
+	timers TimerMode
+	now    func() time.Time
+}
+
+// WithTimerMode sets how saved effect timing is applied on restore
+func WithTimerMode(mode TimerMode) RestoreOption {
+	return func(o *restoreOptions) { o.timers = mode }
+}
+
+// applyTiming reschedules a restored effect from its saved timing
+func (o *restoreOptions) applyTiming(e any, t *EffectTiming) {
+	w, ok := e.(windowed)
+	if !ok || t == nil {
+		return
+	}
+	switch o.timers {
+	case TimersResume:
+		now := o.now()
+		var startsAt, expiresAt time.Time
+		if !t.StartsAt.IsZero() {
+			startsAt = now.Add(t.StartsIn)
+		}
+		if !t.ExpiresAt.IsZero() {
+			expiresAt = now.Add(t.Remaining) // Remaining already includes StartsIn
+		}
+		w.SetStartsAt(startsAt)
+		w.SetExpiresAt(expiresAt)
+	case TimersWallClock:
+		w.SetStartsAt(t.StartsAt)
+		w.SetExpiresAt(t.ExpiresAt)
+	}
 }
 
 // EffectFactory recreates effects from metadata.
@@ -39,6 +127,19 @@ type EffectFactory[T, A any] func(meta EffectMeta) (Effect[T, A], error)
 
 // Save writes state to a JSON file (atomic write)
 func Save[T, A any](path string, state *State[T, A], effects []EffectMeta, extra any) error {
+	return save(path, state, effects, extra, func(v any) ([]byte, error) {
+		return json.MarshalIndent(v, "", "  ")
+	})
+}
+
+// SaveCBOR is Save with a CBOR file: smaller, and []byte fields (textures,
+// compressed payloads) are stored as is instead of as base64. Load and
+// Restore read both formats.
+func SaveCBOR[T, A any](path string, state *State[T, A], effects []EffectMeta, extra any) error {
+	return save(path, state, effects, extra, MarshalCBOR)
+}
+
+func save[T, A any](path string, state *State[T, A], effects []EffectMeta, extra any, marshal func(any) ([]byte, error)) error {
 	var extraJSON json.RawMessage
 	if extra != nil {
 		var err error
@@ -49,14 +150,15 @@ func Save[T, A any](path string, state *State[T, A], effects []EffectMeta, extra
 	}
 
 	snap := Snapshot[T]{
-		Version: SnapshotVersion,
-		State:   state.GetBase(),
-		Effects: effects,
-		SavedAt: time.Now(),
-		Extra:   extraJSON,
+		Version:      SnapshotVersion,
+		State:        state.GetBase(),
+		StateVersion: state.Version(),
+		Effects:      effects,
+		SavedAt:      time.Now(),
+		Extra:        extraJSON,
 	}
 
-	data, err := json.MarshalIndent(snap, "", "  ")
+	data, err := marshal(snap)
 	if err != nil {
 		return fmt.Errorf("marshal: %w", err)
 	}
@@ -80,7 +182,7 @@ func Save[T, A any](path string, state *State[T, A], effects []EffectMeta, extra
 	return nil
 }
 
-// Load reads state from a JSON file
+// Load reads state from a file written by Save or SaveCBOR
 func Load[T any](path string) (*Snapshot[T], error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -90,8 +192,12 @@ func Load[T any](path string) (*Snapshot[T], error) {
 		return nil, fmt.Errorf("read: %w", err)
 	}
 
+	unmarshal := json.Unmarshal
+	if len(data) > 0 && data[0]>>5 == 5 { // A CBOR map; JSON starts with '{' or space
+		unmarshal = UnmarshalCBOR
+	}
 	var snap Snapshot[T]
-	if err := json.Unmarshal(data, &snap); err != nil {
+	if err := unmarshal(data, &snap); err != nil {
 		return nil, fmt.Errorf("unmarshal: %w", err)
 	}
 
@@ -102,7 +208,17 @@ func Load[T any](path string) (*Snapshot[T], error) {
 // Returns RestoreResult which includes both the state and any effect recreation errors.
 // Effect errors are non-fatal - the state is still returned with successfully recreated effects.
 // Note: Restored effects have zero-value activator - set them after restore if needed.
-func Restore[T, A any](path string, cfg *Config[T], factory EffectFactory[T, A]) (*RestoreResult[T, A], error) {
+// Use WithTimerMode to reschedule timed effects from their saved EffectTiming.
+// The metadata of restored effects is kept, so EffectMetas (and thus the
+// next Save) includes them; it is upgraded to the current template
+// versions once SetEffectRegistry is called, and migrates again on the next
+// restore otherwise.
+func Restore[T, A any](path string, cfg *Config[T], factory EffectFactory[T, A], opts ...RestoreOption) (*RestoreResult[T, A], error) {
+	o := restoreOptions{now: time.Now}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	snap, err := Load[T](path)
 	if err != nil {
 		return nil, err
@@ -110,7 +226,11 @@ func Restore[T, A any](path string, cfg *Config[T], factory EffectFactory[T, A])
 	if snap == nil {
 		return nil, nil // No saved state
 	}
+	return restoreSnapshot(snap, cfg, factory, o)
+}
 
+// restoreSnapshot creates a state from a snapshot and recreates its effects
+func restoreSnapshot[T, A any](snap *Snapshot[T], cfg *Config[T], factory EffectFactory[T, A], o restoreOptions) (*RestoreResult[T, A], error) {
 	state, err := New[T, A](snap.State, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("create state: %w", err)
@@ -127,20 +247,43 @@ func Restore[T, A any](path string, cfg *Config[T], factory EffectFactory[T, A])
 				continue
 			}
 			if effect != nil {
+				o.applyTiming(effect, meta.Timing)
 				var zeroActivator A
 				if err := state.AddEffect(effect, zeroActivator); err != nil {
 					result.EffectErrors = append(result.EffectErrors, err)
 					continue
 				}
+				state.restoredMeta(meta)
 			}
 		}
 		// Clear the "previous" state that AddEffect created
 		state.ClearPrevious()
 	}
+	state.mu.Lock()
+	state.version = snap.StateVersion
+	if state.history != nil {
+		state.history.reset()
+		state.history.record(state.version, state.withEffects(state.current))
+	}
+	state.mu.Unlock()
 
 	return result, nil
 }
 
+// restoredMeta keeps the metadata of an effect recreated from it, for
+// EffectMetas
+func (s *State[T, A]) restoredMeta(meta EffectMeta) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.registry != nil {
+		if m, err := s.registry.Migrate(meta); err == nil {
+			meta = m
+		}
+	}
+	meta.Timing = nil // Captured afresh by EffectMetas
+	s.rememberMeta(meta)
+}
+
 // MakeEffectMeta creates metadata for an effect.
 // Returns an error if params cannot be marshaled to JSON.
 func MakeEffectMeta(id, typ string, params any) (EffectMeta, error) {
@@ -0,0 +1,86 @@
+package statediff
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// EscapePointer escapes an object key for use as a JSON Pointer segment
+// ("~" as "~0", "/" as "~1"), as the paths of patches are escaped
+func EscapePointer(key string) string {
+	return escapePtr(key)
+}
+
+// UnescapePointer returns the object key of an escaped JSON Pointer segment
+func UnescapePointer(seg string) string {
+	return unescapePtr(seg)
+}
+
+// FormatPointer joins unescaped segments into a JSON Pointer, e.g.
+// FormatPointer("players", "0", "a/b") is "/players/0/a~1b".
+// No segments is the root, "".
+func FormatPointer(segs ...string) string {
+	return joinPtr(segs)
+}
+
+// ParsePointer splits an RFC 6901 JSON Pointer into unescaped segments.
+// The root "" has none; "/" is the empty key.
+func ParsePointer(ptr string) ([]string, error) {
+	if reason := pointerSyntax(ptr); reason != "" {
+		return nil, errors.New("statediff: " + reason)
+	}
+	return parsePtr(ptr)
+}
+
+// GetByPointer returns the value at ptr in doc. doc is a decoded JSON
+// document (maps, slices and values as from json.Unmarshal into an any or
+// ApplyToJSON); any other value is converted through JSON first. Returns
+// ErrPatchPath if the value does not exist.
+func GetByPointer(doc any, ptr string) (any, error) {
+	segs, err := ParsePointer(ptr)
+	if err != nil {
+		return nil, err
+	}
+	if doc, err = jsonDocument(doc); err != nil {
+		return nil, err
+	}
+	return lookup(doc, segs)
+}
+
+// SetByPointer sets the value at ptr in the decoded JSON document doc and
+// returns the new root: an object member is added or replaced, an array
+// element replaced, and "-" appends to an array. The value is stored in its
+// decoded JSON form. doc is modified in place where possible, so the result
+// must be used, as with append. Returns ErrPatchPath if the parent of ptr
+// does not exist.
+func SetByPointer(doc any, ptr string, value any) (any, error) {
+	segs, err := ParsePointer(ptr)
+	if err != nil {
+		return nil, err
+	}
+	v, err := toJSONValue(value)
+	if err != nil {
+		return nil, err
+	}
+	kind := "add"
+	if len(segs) > 0 {
+		parent, err := lookup(doc, segs[:len(segs)-1])
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := parent.([]any); ok && segs[len(segs)-1] != "-" {
+			kind = "replace"
+		}
+	}
+	return setPath(doc, segs, kind, v)
+}
+
+// jsonDocument returns v if it is a decoded JSON document, or its decoded
+// JSON form
+func jsonDocument(v any) (any, error) {
+	switch v.(type) {
+	case nil, map[string]any, []any, string, float64, json.Number, bool:
+		return v, nil
+	}
+	return toJSONValue(v)
+}
@@ -0,0 +1,196 @@
+package statediff
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Ref is a reference to a value in another state document, sent as
+// {"$ref":"/world/entities/42"}. The first segment names the target (a
+// RefTargets entry, typically the Hub channel of the state), the rest is a
+// JSON Pointer into its document. Normalized states hold Refs instead of
+// copies of shared data, so a change is sent once, on the channel that owns it.
+type Ref string
+
+type refJSON struct {
+	Ref string `json:"$ref"`
+}
+
+// MarshalJSON encodes the reference as {"$ref": r}
+func (r Ref) MarshalJSON() ([]byte, error) {
+	return json.Marshal(refJSON{Ref: string(r)})
+}
+
+// UnmarshalJSON decodes {"$ref": ...}
+func (r *Ref) UnmarshalJSON(data []byte) error {
+	var v refJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*r = Ref(v.Ref)
+	return nil
+}
+
+// RefResolver looks up the target of a reference, as a decoded JSON value
+type RefResolver interface {
+	Resolve(ref string) (any, bool)
+}
+
+// RefTargets resolves references by their first segment: "/world/entities/42"
+// is /entities/42 of the "world" target. *State and *Session implement
+// RefResolver for their own document. Populate the map before diffs start.
+type RefTargets map[string]RefResolver
+
+// Resolve implements RefResolver
+func (t RefTargets) Resolve(ref string) (any, bool) {
+	segs, err := parsePtr(ref)
+	if err != nil || len(segs) == 0 {
+		return nil, false
+	}
+	target, ok := t[segs[0]]
+	if !ok {
+		return nil, false
+	}
+	return target.Resolve(joinPtr(segs[1:]))
+}
+
+// Resolve returns the value at the JSON Pointer ptr of the current state
+// (with effects), as a decoded JSON value
+func (s *State[T, A]) Resolve(ptr string) (any, bool) {
+	segs, err := parsePtr(ptr)
+	if err != nil {
+		return nil, false
+	}
+	doc, err := toDocument(s.Get(), s.arrayCfg)
+	if err != nil {
+		return nil, false
+	}
+	v, err := lookup(doc, segs)
+	return v, err == nil
+}
+
+// Resolve looks up ptr in the session's state
+func (s *Session[T, A, ID]) Resolve(ptr string) (any, bool) {
+	return s.state.Resolve(ptr)
+}
+
+// RefError reports a reference whose target does not exist
+type RefError struct {
+	Path string // JSON Pointer of the {"$ref"} object
+	Ref  string
+}
+
+func (e *RefError) Error() string {
+	return fmt.Sprintf("statediff: dangling reference %q at %s", e.Ref, e.Path)
+}
+
+// ValidateRefs returns a *RefError for the first reference in v (any value
+// that marshals to JSON) that r cannot resolve
+func ValidateRefs(v any, r RefResolver) error {
+	doc, err := toJSONValue(v)
+	if err != nil {
+		return err
+	}
+	return validateRefs(doc, "", r)
+}
+
+// ResolveRefs returns the decoded JSON document of v with every reference
+// replaced by its target, e.g. to hand a denormalized view to a client that
+// cannot follow refs. References inside targets are left as they are.
+func ResolveRefs(v any, r RefResolver) (any, error) {
+	doc, err := toJSONValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return resolveRefs(doc, "", r)
+}
+
+// refOf returns the target of a {"$ref": "..."} object
+func refOf(v any) (string, bool) {
+	m, ok := v.(map[string]any)
+	if !ok || len(m) != 1 {
+		return "", false
+	}
+	ref, ok := m["$ref"].(string)
+	return ref, ok && strings.HasPrefix(ref, "/")
+}
+
+func validateRefs(doc any, path string, r RefResolver) error {
+	if ref, ok := refOf(doc); ok {
+		if _, found := r.Resolve(ref); !found {
+			return &RefError{Path: path, Ref: ref}
+		}
+		return nil
+	}
+	switch c := doc.(type) {
+	case map[string]any:
+		for k, v := range c {
+			if err := validateRefs(v, path+"/"+escapePtr(k), r); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for i, v := range c {
+			if err := validateRefs(v, fmt.Sprintf("%s/%d", path, i), r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func resolveRefs(doc any, path string, r RefResolver) (any, error) {
+	if ref, ok := refOf(doc); ok {
+		v, found := r.Resolve(ref)
+		if !found {
+			return nil, &RefError{Path: path, Ref: ref}
+		}
+		return v, nil
+	}
+	switch c := doc.(type) {
+	case map[string]any:
+		for k, v := range c {
+			rv, err := resolveRefs(v, path+"/"+escapePtr(k), r)
+			if err != nil {
+				return nil, err
+			}
+			c[k] = rv
+		}
+	case []any:
+		for i, v := range c {
+			rv, err := resolveRefs(v, fmt.Sprintf("%s/%d", path, i), r)
+			if err != nil {
+				return nil, err
+			}
+			c[i] = rv
+		}
+	}
+	return doc, nil
+}
+
+// checkRefs validates the references a patch introduces. Called without the
+// state lock, so targets may be other states or this one.
+func (s *State[T, A]) checkRefs(p Patch) error {
+	if s.refs == nil {
+		return nil
+	}
+	for _, op := range p {
+		if op.Op != "add" && op.Op != "replace" {
+			continue
+		}
+		// Retargeting a ref replaces just its "$ref" member
+		if parent, ok := strings.CutSuffix(op.Path, "/$ref"); ok {
+			if ref, isStr := op.Value.(string); isStr {
+				if _, found := s.refs.Resolve(ref); !found {
+					return &RefError{Path: parent, Ref: ref}
+				}
+				continue
+			}
+		}
+		if err := validateRefs(op.Value, op.Path, s.refs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package statediff
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// EffectTemplate describes how to build an effect type from JSON params
+// (e.g. loaded from content files).
+type EffectTemplate[T, A any] struct {
+	// Create builds an effect with the given ID from its params. Required.
+	Create func(id string, params json.RawMessage) (Effect[T, A], error)
+
+	// Validate checks params before Create is called. Optional.
+	// Returning a non-empty slice rejects the params with an *EffectParamsError.
+	Validate func(params json.RawMessage) []ParamError
+
+	// Version is the current params version (0 for unversioned templates).
+	// Metadata created through the registry records it, and older metadata is
+	// upgraded with Migrate before validation.
+	Version int
+
+	// Migrate upgrades params from version `from` to version from+1.
+	// Called repeatedly until params reach Version. Required if Version > 0
+	// and saves with older versions must still load.
+	Migrate func(from int, params json.RawMessage) (json.RawMessage, error)
+}
+
+// ParamError describes one problem with effect params
+type ParamError struct {
+	Field  string // JSON field name, empty for the params document itself
+	Reason string
+}
+
+func (e ParamError) Error() string {
+	if e.Field == "" {
+		return e.Reason
+	}
+	return e.Field + ": " + e.Reason
+}
+
+// EffectParamsError is returned when effect params fail template validation
+type EffectParamsError struct {
+	Type   string
+	ID     string
+	Errors []ParamError
+}
+
+func (e *EffectParamsError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, pe := range e.Errors {
+		msgs[i] = pe.Error()
+	}
+	return fmt.Sprintf("statediff: invalid params for effect %q (type %s): %s",
+		e.ID, e.Type, strings.Join(msgs, "; "))
+}
+
+// RequireFields returns a validator that checks params is a JSON object
+// containing every listed field with a non-null value.
+func RequireFields(fields ...string) func(params json.RawMessage) []ParamError {
+	return func(params json.RawMessage) []ParamError {
+		var obj map[string]json.RawMessage
+		if len(params) == 0 || json.Unmarshal(params, &obj) != nil || obj == nil {
+			return []ParamError{{Reason: "params must be a JSON object"}}
+		}
+		var errs []ParamError
+		for _, f := range fields {
+			if v, ok := obj[f]; !ok || string(v) == "null" {
+				errs = append(errs, ParamError{Field: f, Reason: "required"})
+			}
+		}
+		return errs
+	}
+}
+
+// EffectRegistry maps effect type names to templates.
+// Thread-safe: templates can be registered while effects are being created.
+type EffectRegistry[T, A any] struct {
+	mu        sync.RWMutex
+	templates map[string]EffectTemplate[T, A]
+}
+
+// NewEffectRegistry creates an empty registry
+func NewEffectRegistry[T, A any]() *EffectRegistry[T, A] {
+	return &EffectRegistry[T, A]{templates: make(map[string]EffectTemplate[T, A])}
+}
+
+// Register adds a template for an effect type.
+// Returns an error if the type is already registered or Create is nil.
+func (r *EffectRegistry[T, A]) Register(typ string, tmpl EffectTemplate[T, A]) error {
+	if tmpl.Create == nil {
+		return fmt.Errorf("statediff: effect template %q has no Create func", typ)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.templates[typ]; exists {
+		return fmt.Errorf("statediff: effect type %q already registered", typ)
+	}
+	r.templates[typ] = tmpl
+	return nil
+}
+
+// Types returns the registered effect type names in sorted order
+func (r *EffectRegistry[T, A]) Types() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	types := make([]string, 0, len(r.templates))
+	for typ := range r.templates {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Meta creates metadata for an effect of a registered type, stamped with the
+// template's current Version.
+func (r *EffectRegistry[T, A]) Meta(id, typ string, params any) (EffectMeta, error) {
+	r.mu.RLock()
+	tmpl, ok := r.templates[typ]
+	r.mu.RUnlock()
+	if !ok {
+		return EffectMeta{}, fmt.Errorf("statediff: unknown effect type %q", typ)
+	}
+	meta, err := MakeEffectMeta(id, typ, params)
+	if err != nil {
+		return EffectMeta{}, err
+	}
+	meta.Version = tmpl.Version
+	return meta, nil
+}
+
+// Migrate upgrades meta to the current version of its template.
+// Metadata already at the current version is returned unchanged.
+// Returns an error for unknown types, versions newer than the template,
+// or missing/failed migrations.
+func (r *EffectRegistry[T, A]) Migrate(meta EffectMeta) (EffectMeta, error) {
+	r.mu.RLock()
+	tmpl, ok := r.templates[meta.Type]
+	r.mu.RUnlock()
+	if !ok {
+		return meta, fmt.Errorf("statediff: unknown effect type %q", meta.Type)
+	}
+	return migrateMeta(meta, tmpl)
+}
+
+// migrateMeta upgrades meta step by step to tmpl.Version
+func migrateMeta[T, A any](meta EffectMeta, tmpl EffectTemplate[T, A]) (EffectMeta, error) {
+	if meta.Version > tmpl.Version {
+		return meta, fmt.Errorf("statediff: effect %q (type %s) has version %d, newer than supported %d",
+			meta.ID, meta.Type, meta.Version, tmpl.Version)
+	}
+	if meta.Version < tmpl.Version && tmpl.Migrate == nil {
+		return meta, fmt.Errorf("statediff: effect %q (type %s) has version %d and no migration to %d",
+			meta.ID, meta.Type, meta.Version, tmpl.Version)
+	}
+	for meta.Version < tmpl.Version {
+		params, err := tmpl.Migrate(meta.Version, meta.Params)
+		if err != nil {
+			return meta, fmt.Errorf("statediff: migrate effect %q (type %s) from version %d: %w",
+				meta.ID, meta.Type, meta.Version, err)
+		}
+		meta.Params = params
+		meta.Version++
+	}
+	return meta, nil
+}
+
+// Validate checks params against the template of the given type without
+// creating an effect. Older versions are migrated first.
+// Returns *EffectParamsError on validation failure.
+func (r *EffectRegistry[T, A]) Validate(meta EffectMeta) error {
+	_, _, err := r.template(meta)
+	return err
+}
+
+// Create migrates and validates params, then builds the effect described by meta
+func (r *EffectRegistry[T, A]) Create(meta EffectMeta) (Effect[T, A], error) {
+	tmpl, meta, err := r.template(meta)
+	if err != nil {
+		return nil, err
+	}
+	e, err := tmpl.Create(meta.ID, meta.Params)
+	if err != nil {
+		return nil, fmt.Errorf("statediff: create effect %q (type %s): %w", meta.ID, meta.Type, err)
+	}
+	if e == nil {
+		return nil, fmt.Errorf("statediff: create effect %q (type %s): template returned nil", meta.ID, meta.Type)
+	}
+	return e, nil
+}
+
+// Factory returns an EffectFactory backed by the registry, for use with Restore
+func (r *EffectRegistry[T, A]) Factory() EffectFactory[T, A] {
+	return r.Create
+}
+
+// template looks up the template for meta, migrates meta to the current
+// version, and validates its params. Returns the migrated meta.
+func (r *EffectRegistry[T, A]) template(meta EffectMeta) (EffectTemplate[T, A], EffectMeta, error) {
+	r.mu.RLock()
+	tmpl, ok := r.templates[meta.Type]
+	r.mu.RUnlock()
+	if !ok {
+		return tmpl, meta, fmt.Errorf("statediff: unknown effect type %q", meta.Type)
+	}
+	meta, err := migrateMeta(meta, tmpl)
+	if err != nil {
+		return tmpl, meta, err
+	}
+	if tmpl.Validate != nil {
+		if errs := tmpl.Validate(meta.Params); len(errs) > 0 {
+			return tmpl, meta, &EffectParamsError{Type: meta.Type, ID: meta.ID, Errors: errs}
+		}
+	}
+	return tmpl, meta, nil
+}
@@ -2,10 +2,14 @@ package statediff
 
 import (
 	"encoding/json"
+	"errors"
 	"sync"
 	"time"
 )
 
+// ErrSessionFull is returned by TryConnect when the session has reached its client limit
+var ErrSessionFull = errors.New("statediff: session is full")
+
 // Session manages multiple client connections.
 // T is the state type, A is the activator type, ID is the client identifier type.
 // Each client has a projection function that determines what they see.
@@ -14,6 +18,26 @@ type Session[T, A any, ID comparable] struct {
 	state   *State[T, A]
 	clients map[ID]func(T) T // ID -> projection function
 
+	// Projection groups: clients sharing a projection key see the same view,
+	// so their diff is computed once per group and reused.
+	groups      map[string]*projGroup[T, ID]
+	clientGroup map[ID]string
+	groupMu     sync.Mutex // Protects per-group diff caches and fullCache
+	maxClients  int        // 0 means unlimited
+
+	// Full payloads by projection key and encoder, nil when disabled
+	fullCache map[encodingKey]cachedFull
+
+	transforms map[ID]func(T) T // Per-client post-projection transforms
+	encoders   map[ID]Encoder   // Per-client payload formats (JSON Patch if absent)
+	connected  map[ID]time.Time // Time of each client's last Connect
+	versioned  bool             // Payloads wrapped in a VersionedPayload
+
+	// tickMu serializes the cleanup -> broadcast -> clear cycle so concurrent
+	// callers cannot interleave and drop each other's diffs.
+	tickMu sync.Mutex
+	frames sync.Pool // *Frame[ID] for TickFrame
+
 	// Debounce support
 	debounceMu    sync.Mutex
 	debounce      time.Duration
@@ -24,26 +48,342 @@ type Session[T, A any, ID comparable] struct {
 // NewSession creates a session manager for the given state
 func NewSession[T, A any, ID comparable](state *State[T, A]) *Session[T, A, ID] {
 	return &Session[T, A, ID]{
-		state:   state,
-		clients: make(map[ID]func(T) T),
+		state:       state,
+		clients:     make(map[ID]func(T) T),
+		groups:      make(map[string]*projGroup[T, ID]),
+		clientGroup: make(map[ID]string),
+		transforms:  make(map[ID]func(T) T),
+		encoders:    make(map[ID]Encoder),
+		connected:   make(map[ID]time.Time),
+	}
+}
+
+// ClientOption configures a client at Connect time
+type ClientOption[T any] func(*clientOptions[T])
+
+type clientOptions[T any] struct {
+	transform func(T) T
+	encoder   *Encoder
+}
+
+// WithTransform sets a per-client transform applied to the client's projected
+// view before diffing and full sync, e.g. unit conversion, localisation, or
+// per-user redaction. Unlike projections, transforms are never shared, so
+// shared projections (nil projection, ConnectGroup) are still computed once
+// and only the transform runs per client. The transform receives a private
+// copy and may modify it freely.
+func WithTransform[T any](fn func(T) T) ClientOption[T] {
+	return func(o *clientOptions[T]) { o.transform = fn }
+}
+
+// setClientOptions applies client options. Caller must hold mu.
+func (s *Session[T, A, ID]) setClientOptions(id ID, opts []ClientOption[T]) {
+	var o clientOptions[T]
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.transform != nil {
+		s.transforms[id] = o.transform
+	} else {
+		delete(s.transforms, id)
+	}
+	if o.encoder != nil {
+		s.encoders[id] = *o.encoder
+	} else {
+		delete(s.encoders, id)
+	}
+}
+
+// encoderFor returns the client's encode function, or def for clients using
+// the default format. Caller must hold mu.
+func (s *Session[T, A, ID]) encoderFor(id ID, def func(Patch) []byte) func(Patch) []byte {
+	enc, ok := s.encoders[id]
+	if !ok {
+		return def
+	}
+	return func(p Patch) []byte {
+		data, err := enc.Encode(p)
+		if err != nil {
+			return nil
+		}
+		return data
+	}
+}
+
+// view returns the function producing a client's final view (projection and
+// transform). Caller must hold mu.
+func (s *Session[T, A, ID]) view(id ID) func(T) T {
+	project := s.clients[id]
+	transform, ok := s.transforms[id]
+	if !ok {
+		return project
+	}
+	return func(state T) T {
+		if project != nil {
+			state = project(state)
+		}
+		return transform(s.state.cloneValue(state))
 	}
 }
 
+// projGroup is a set of clients sharing one projection
+type projGroup[T any, ID comparable] struct {
+	project func(T) T
+	members map[ID]struct{}
+
+	// Diff cache, valid while the state generation equals gen
+	cached bool
+	gen    uint64
+	data   []byte // nil when the group has no visible changes
+	patch  Patch  // Source of data, for members with their own encoder
+
+	// Projected views cache for members with transforms, valid while the
+	// state generation equals viewsGen
+	viewsCached bool
+	viewsGen    uint64
+	viewsOK     bool // False when there is no previous state
+	prevView    T
+	curView     T
+}
+
 // Connect registers a client with their projection function.
 // Projection can be nil if client sees full state.
-func (s *Session[T, A, ID]) Connect(id ID, project func(T) T) {
+func (s *Session[T, A, ID]) Connect(id ID, project func(T) T, opts ...ClientOption[T]) {
 	s.mu.Lock()
+	s.leaveGroup(id)
 	s.clients[id] = project
+	s.connected[id] = time.Now()
+	s.setClientOptions(id, opts)
 	s.mu.Unlock()
 }
 
+// cachedFull is a Full payload valid while the state generation equals gen
+type cachedFull struct {
+	gen     uint64
+	version uint64
+	data    []byte
+}
+
+// SetFullCache enables caching of Full payloads, for many clients joining
+// at once (e.g. a tournament start). Clients sharing a view - members of a
+// projection group, or ungrouped clients with a nil projection - and an
+// encoder get the same payload, computed once per state change instead of
+// once per joiner. Clients with a transform or their own projection function
+// are not cached, nor is anything while effects with a time window are
+// active. Cached payloads are shared between callers and must not be
+// modified. Disabled by default.
+func (s *Session[T, A, ID]) SetFullCache(enabled bool) {
+	s.groupMu.Lock()
+	defer s.groupMu.Unlock()
+	if !enabled {
+		s.fullCache = nil
+	} else if s.fullCache == nil {
+		s.fullCache = make(map[encodingKey]cachedFull)
+	}
+}
+
+// fullCacheKey returns the Full cache key for a client, or false if caching
+// is disabled or its payload is its own. Caller must hold mu.
+func (s *Session[T, A, ID]) fullCacheKey(id ID) (encodingKey, bool) {
+	s.groupMu.Lock()
+	enabled := s.fullCache != nil
+	s.groupMu.Unlock()
+	if !enabled {
+		return encodingKey{}, false
+	}
+	if _, ok := s.transforms[id]; ok {
+		return encodingKey{}, false
+	}
+	key := encodingKey{encoder: s.encoders[id].Name}
+	if group, ok := s.clientGroup[id]; ok {
+		key.source, key.grouped = group, true
+	} else if s.clients[id] != nil {
+		return encodingKey{}, false
+	}
+	return key, true
+}
+
+// SetMaxClients limits the number of clients TryConnect will accept.
+// Set to 0 to disable the limit (default). Already connected clients are
+// never dropped when lowering the limit. To bound what slow clients buffer,
+// queue payloads in an Outbox.
+func (s *Session[T, A, ID]) SetMaxClients(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxClients = n
+}
+
+// TryConnect registers a client like Connect, but returns ErrSessionFull if
+// the client limit set via SetMaxClients has been reached.
+// Reconnecting an already registered client always succeeds.
+func (s *Session[T, A, ID]) TryConnect(id ID, project func(T) T, opts ...ClientOption[T]) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.clients[id]; !exists && s.maxClients > 0 && len(s.clients) >= s.maxClients {
+		return ErrSessionFull
+	}
+	s.leaveGroup(id)
+	s.clients[id] = project
+	s.connected[id] = time.Now()
+	s.setClientOptions(id, opts)
+	return nil
+}
+
+// ConnectGroup registers a client as a member of a projection group.
+// All clients with the same key must see the same view (e.g. "team:red",
+// "spectator"); the projection of the first member is used for the whole group.
+// Broadcast computes one diff per group and skips groups whose view did not
+// change, so changes invisible to most views cost one diff, not one per client.
+func (s *Session[T, A, ID]) ConnectGroup(id ID, key string, project func(T) T, opts ...ClientOption[T]) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leaveGroup(id)
+
+	g, ok := s.groups[key]
+	if !ok {
+		g = &projGroup[T, ID]{project: project, members: make(map[ID]struct{})}
+		s.groups[key] = g
+	}
+	g.members[id] = struct{}{}
+	s.clientGroup[id] = key
+	s.clients[id] = g.project
+	s.connected[id] = time.Now()
+	s.setClientOptions(id, opts)
+}
+
+// leaveGroup removes a client from its projection group. Caller must hold mu.
+func (s *Session[T, A, ID]) leaveGroup(id ID) {
+	key, ok := s.clientGroup[id]
+	if !ok {
+		return
+	}
+	delete(s.clientGroup, id)
+	if g := s.groups[key]; g != nil {
+		delete(g.members, id)
+		if len(g.members) == 0 {
+			delete(s.groups, key)
+			s.groupMu.Lock()
+			for k := range s.fullCache {
+				if k.grouped && k.source == key {
+					delete(s.fullCache, k)
+				}
+			}
+			s.groupMu.Unlock()
+		}
+	}
+}
+
+// groupViews returns the group's projected previous and current views,
+// computing them at most once per state generation. Caller must hold mu.
+func (s *Session[T, A, ID]) groupViews(g *projGroup[T, ID]) (prev, cur T, ok bool) {
+	gen := s.state.generation()
+
+	s.groupMu.Lock()
+	if g.viewsCached && g.viewsGen == gen {
+		prev, cur, ok = g.prevView, g.curView, g.viewsOK
+		s.groupMu.Unlock()
+		return prev, cur, ok
+	}
+	s.groupMu.Unlock()
+
+	prev, cur, ok = s.state.views(g.project)
+
+	s.groupMu.Lock()
+	g.viewsCached, g.viewsGen = true, gen
+	g.prevView, g.curView, g.viewsOK = prev, cur, ok
+	s.groupMu.Unlock()
+	return prev, cur, ok
+}
+
+// lazyViews loads the unprojected views once per Broadcast
+type lazyViews[T any] struct {
+	loaded, ok bool
+	prev, cur  T
+}
+
+func (v *lazyViews[T]) get(state interface {
+	views(func(T) T) (T, T, bool)
+}) (prev, cur T, ok bool) {
+	if !v.loaded {
+		v.prev, v.cur, v.ok = state.views(nil)
+		v.loaded = true
+	}
+	return v.prev, v.cur, v.ok
+}
+
+// transformedDiff diffs shared views through a client transform
+func (s *Session[T, A, ID]) transformedDiff(prev, cur T, transform func(T) T, encode func(Patch) []byte) []byte {
+	oldView := transform(s.state.cloneValue(prev))
+	newView := transform(s.state.cloneValue(cur))
+	patch, err := s.state.diffViews(oldView, newView)
+	if err != nil || patch.Empty() {
+		return nil
+	}
+	return encode(patch)
+}
+
 // Disconnect removes a client
 func (s *Session[T, A, ID]) Disconnect(id ID) {
 	s.mu.Lock()
+	s.leaveGroup(id)
 	delete(s.clients, id)
+	delete(s.transforms, id)
+	delete(s.encoders, id)
+	delete(s.connected, id)
 	s.mu.Unlock()
 }
 
+// HasChangesFor reports whether the projection group with the given key has
+// changes visible to it. Returns false for unknown keys.
+// The computed diff is cached and reused by the next Broadcast.
+func (s *Session[T, A, ID]) HasChangesFor(key string) bool {
+	if !s.state.HasChanges() {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	g, ok := s.groups[key]
+	if !ok {
+		return false
+	}
+	return s.groupDiff(g) != nil
+}
+
+// groupDiff returns the encoded diff for a group, computing it at most once
+// per state generation. Caller must hold mu (read or write).
+func (s *Session[T, A, ID]) groupDiff(g *projGroup[T, ID]) []byte {
+	data, _ := s.groupPatch(g)
+	return data
+}
+
+// groupPatch returns the group's diff both encoded as JSON and as a patch
+// (nil when there are no visible changes), cached like groupDiff.
+// Caller must hold mu (read or write).
+func (s *Session[T, A, ID]) groupPatch(g *projGroup[T, ID]) ([]byte, Patch) {
+	gen := s.state.generation()
+
+	s.groupMu.Lock()
+	if g.cached && g.gen == gen {
+		data, patch := g.data, g.patch
+		s.groupMu.Unlock()
+		return data, patch
+	}
+	s.groupMu.Unlock()
+
+	var data []byte
+	patch, err := s.state.Diff(g.project)
+	if err != nil || patch.Empty() {
+		patch = nil
+	} else {
+		data, _ = patch.JSON()
+	}
+
+	s.groupMu.Lock()
+	g.cached, g.gen, g.data, g.patch = true, gen, data, patch
+	s.groupMu.Unlock()
+	return data, patch
+}
+
 // IsConnected checks if a client is registered
 func (s *Session[T, A, ID]) IsConnected(id ID) bool {
 	s.mu.RLock()
@@ -70,75 +410,260 @@ func (s *Session[T, A, ID]) IDs() []ID {
 	return ids
 }
 
+// ClientMeta describes a connected client
+type ClientMeta struct {
+	Group       string    // Projection group key, "" if not grouped
+	Projected   bool      // Has a projection (own or group)
+	Transformed bool      // Has a WithTransform transform
+	Encoder     string    // Encoder name, "" for the default JSON Patch
+	ConnectedAt time.Time // Time of the last Connect
+}
+
+// ForEach calls fn for every connected client until fn returns false.
+// The client set is snapshotted once before the first call, so fn sees a
+// consistent set and may call back into the Session (including Disconnect)
+// without deadlocking. Order is unspecified.
+func (s *Session[T, A, ID]) ForEach(fn func(id ID, meta ClientMeta) bool) {
+	type entry struct {
+		id   ID
+		meta ClientMeta
+	}
+	s.mu.RLock()
+	entries := make([]entry, 0, len(s.clients))
+	for id, project := range s.clients {
+		_, transformed := s.transforms[id]
+		entries = append(entries, entry{id, ClientMeta{
+			Group:       s.clientGroup[id],
+			Projected:   project != nil,
+			Transformed: transformed,
+			Encoder:     s.encoders[id].Name,
+			ConnectedAt: s.connected[id],
+		}})
+	}
+	s.mu.RUnlock()
+
+	for _, e := range entries {
+		if !fn(e.id, e.meta) {
+			return
+		}
+	}
+}
+
 // Full returns the full state for a client (for initial sync).
 // Thread-safe: holds lock during state access to prevent races.
 func (s *Session[T, A, ID]) Full(id ID) ([]byte, error) {
 	s.mu.RLock()
-	project := s.clients[id]
-	state := s.state.FullState(project)
-	s.mu.RUnlock()
+	defer s.mu.RUnlock()
+	enc, hasEncoder := s.encoders[id]
+
+	key, cacheable := s.fullCacheKey(id)
+	var gen uint64
+	if cacheable {
+		gen, cacheable = s.state.cacheGeneration()
+	}
+	if cacheable {
+		s.groupMu.Lock()
+		entry, ok := s.fullCache[key]
+		s.groupMu.Unlock()
+		if ok && entry.gen == gen {
+			return s.wrapVersion(entry.version, entry.version, entry.data), nil
+		}
+	}
+
+	state, version, err := s.state.fullDocument(s.view(id))
+	if err != nil {
+		return nil, err
+	}
 
 	// Wrap as replace operation
-	patch := Patch{{Op: "replace", Path: "", Value: state}}
-	return json.Marshal(patch)
+	patch := s.state.arrayCfg.opts.explicitNulls(Patch{{Op: "replace", Path: "", Value: state}})
+	var data []byte
+	if hasEncoder {
+		data, err = enc.Encode(patch)
+	} else {
+		data, err = json.Marshal(patch)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !cacheable {
+		return s.wrapVersion(version, version, data), nil
+	}
+	// Only cache if no change happened while the document was built
+	if now, ok := s.state.cacheGeneration(); ok && now == gen {
+		s.groupMu.Lock()
+		if s.fullCache != nil {
+			s.fullCache[key] = cachedFull{gen: gen, version: version, data: data}
+		}
+		s.groupMu.Unlock()
+	}
+	return s.wrapVersion(version, version, data), nil
+}
+
+// wrapVersion wraps a payload when payloads are versioned. Caller must hold mu.
+func (s *Session[T, A, ID]) wrapVersion(from, version uint64, data []byte) []byte {
+	if !s.versioned {
+		return data
+	}
+	return versionPayload(from, version, data)
 }
 
 // Diff returns the diff for a client since last change.
 // Thread-safe: holds lock during diff calculation to prevent races.
 func (s *Session[T, A, ID]) Diff(id ID) ([]byte, error) {
 	s.mu.RLock()
-	project := s.clients[id]
+	defer s.mu.RUnlock()
+	project := s.view(id)
+	enc, hasEncoder := s.encoders[id]
+	from, version := s.state.diffVersions()
 	patch, err := s.state.Diff(project)
-	s.mu.RUnlock()
-
 	if err != nil {
 		return nil, err
 	}
-	if patch == nil || patch.Empty() {
-		return []byte("[]"), nil
+
+	var data []byte
+	switch {
+	case hasEncoder:
+		if patch == nil {
+			patch = Patch{}
+		}
+		data, err = enc.Encode(patch)
+	case patch == nil || patch.Empty():
+		data = []byte("[]")
+	default:
+		data, err = patch.JSON()
 	}
-	return patch.JSON()
+	if err != nil {
+		return nil, err
+	}
+	return s.wrapVersion(from, version, data), nil
 }
 
 // Broadcast returns diffs for all connected clients.
 // Only includes clients with actual changes.
 // Optimized: caches the diff for clients with nil projection (full state view).
+// Each client's payload is encoded with its Encoder (see WithEncoder); clients
+// sharing a projection and encoder share one encoding.
 func (s *Session[T, A, ID]) Broadcast() map[ID][]byte {
+	return s.broadcast(nil, encodePatch)
+}
+
+// encodePatch is the default payload encoder
+func encodePatch(p Patch) []byte {
+	data, _ := p.JSON()
+	return data
+}
+
+// broadcast implements Broadcast, adding payloads to result (allocated if
+// nil) and encoding ungrouped client patches without an Encoder with encode.
+func (s *Session[T, A, ID]) broadcast(result map[ID][]byte, encode func(Patch) []byte) map[ID][]byte {
 	if !s.state.HasChanges() {
-		return nil
+		return result
 	}
 
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	result := make(map[ID][]byte, len(s.clients))
+	if result == nil {
+		result = make(map[ID][]byte, len(s.clients))
+	}
+	if s.versioned {
+		defer func(from, version uint64) {
+			for id, data := range result {
+				result[id] = versionPayload(from, version, data)
+			}
+		}(s.state.diffVersions())
+	}
+
+	// Encodings of shared diffs for clients with their own encoder
+	var encodings encoderCache
+
+	// Projection groups: one diff per group, unchanged groups skipped entirely
+	for key, g := range s.groups {
+		var data []byte
+		var shared bool
+		for id := range g.members {
+			if transform, ok := s.transforms[id]; ok {
+				// Shared projection, private transform
+				if prev, cur, ok := s.groupViews(g); ok {
+					if d := s.transformedDiff(prev, cur, transform, s.encoderFor(id, encode)); d != nil {
+						result[id] = d
+					}
+				}
+				continue
+			}
+			if enc, ok := s.encoders[id]; ok {
+				if _, patch := s.groupPatch(g); patch != nil {
+					k := encodingKey{source: key, grouped: true, encoder: enc.Name}
+					if d := encodings.encode(k, patch, enc); d != nil {
+						result[id] = d
+					}
+				}
+				continue
+			}
+			if !shared {
+				data, shared = s.groupDiff(g), true
+			}
+			if data != nil {
+				result[id] = data
+			}
+		}
+	}
 
 	// Cache for nil projection (full state view) - computed once, reused for all
 	var fullDiff []byte
+	var fullPatch Patch
 	var fullDiffComputed bool
 
+	// Unprojected views for transformed clients without projection
+	var fullViews lazyViews[T]
+
 	for id, project := range s.clients {
+		if _, grouped := s.clientGroup[id]; grouped {
+			continue // Handled above
+		}
+
 		var data []byte
 
-		if project == nil {
+		if transform, ok := s.transforms[id]; ok {
+			// Projection is shared (or nil), transform is per client
+			if project == nil {
+				if prev, cur, ok := fullViews.get(s.state); ok {
+					data = s.transformedDiff(prev, cur, transform, s.encoderFor(id, encode))
+				}
+			} else {
+				patch, err := s.state.Diff(s.view(id))
+				if err != nil || patch.Empty() {
+					continue
+				}
+				data = s.encoderFor(id, encode)(patch)
+			}
+		} else if project == nil {
 			// Use cached full diff
 			if !fullDiffComputed {
-				patch, err := s.state.Diff(nil)
-				if err != nil || patch.Empty() {
-					fullDiff = nil
-				} else {
-					fullDiff, _ = patch.JSON()
+				if patch, err := s.state.Diff(nil); err == nil && !patch.Empty() {
+					fullPatch = patch
 				}
 				fullDiffComputed = true
 			}
-			data = fullDiff
+			if fullPatch == nil {
+				continue
+			}
+			if enc, ok := s.encoders[id]; ok {
+				data = encodings.encode(encodingKey{encoder: enc.Name}, fullPatch, enc)
+			} else {
+				if fullDiff == nil {
+					fullDiff = encode(fullPatch)
+				}
+				data = fullDiff
+			}
 		} else {
 			// Compute individual diff for custom projection
 			patch, err := s.state.Diff(project)
 			if err != nil || patch.Empty() {
 				continue
 			}
-			data, _ = patch.JSON()
+			data = s.encoderFor(id, encode)(patch)
 		}
 
 		if data != nil {
@@ -152,10 +677,42 @@ func (s *Session[T, A, ID]) Broadcast() map[ID][]byte {
 // Tick cleans up expired effects, broadcasts changes, and clears previous state.
 // This is the recommended way to use the library - just call Tick() after state updates.
 // Typical game loop: Update state -> Tick -> Send to clients
+//
+// Concurrent Tick calls are serialized: each cycle runs to completion before
+// the next one starts, so two goroutines can never broadcast the same change
+// twice or clear a change the other has not broadcast yet.
 func (s *Session[T, A, ID]) Tick() map[ID][]byte {
+	s.tickMu.Lock()
+	defer s.tickMu.Unlock()
+	return s.tick()
+}
+
+// TrySingleTick runs a tick only if no other tick is in progress.
+// Returns the diffs and true if this call performed the tick, or nil and false
+// if another goroutine is currently ticking (its cycle will pick up any pending
+// changes, so the caller can simply skip).
+//
+// Useful when several goroutines (game loop, expiration callbacks, command
+// handlers) may all trigger a broadcast and only one of them should win.
+func (s *Session[T, A, ID]) TrySingleTick() (map[ID][]byte, bool) {
+	if !s.tickMu.TryLock() {
+		return nil, false
+	}
+	defer s.tickMu.Unlock()
+	return s.tick(), true
+}
+
+// tick performs one cleanup -> broadcast -> clear cycle. Caller must hold tickMu.
+func (s *Session[T, A, ID]) tick() map[ID][]byte {
+	return s.tickInto(nil, encodePatch)
+}
+
+// tickInto runs one tick, adding payloads to result (see broadcast)
+func (s *Session[T, A, ID]) tickInto(result map[ID][]byte, encode func(Patch) []byte) map[ID][]byte {
 	s.state.CleanupExpired() // Automatically handle expired effects
-	result := s.Broadcast()
-	s.state.ClearPrevious()
+	c := s.state.beginCycle()
+	result = s.broadcast(result, encode)
+	s.state.endCycle(c)
 	return result
 }
 
@@ -175,6 +732,12 @@ func (tx *Tx[T, A]) Update(fn func(*T)) {
 	tx.state.Update(fn)
 }
 
+// UpdateE modifies the state within the transaction, leaving it unchanged
+// if fn returns an error (see State.UpdateE)
+func (tx *Tx[T, A]) UpdateE(fn func(*T) error) error {
+	return tx.state.UpdateE(fn)
+}
+
 // Set replaces the entire state within the transaction
 func (tx *Tx[T, A]) Set(newState T) {
 	tx.state.Set(newState)
@@ -192,7 +755,9 @@ func (tx *Tx[T, A]) GetBase() T {
 
 // Transaction executes a function with batched state updates and automatically broadcasts changes.
 // This is the recommended way to modify state - it ensures all updates are broadcast together
-// and makes it impossible to forget the broadcast.
+// and makes it impossible to forget the broadcast. The diffs cover every
+// update made in fn (and any pending before it), from the state clients
+// last received.
 //
 // Example:
 //
@@ -0,0 +1,114 @@
+package statediff
+
+import (
+	"sort"
+	"time"
+)
+
+// SlicedDiff is a diff computed incrementally, one top-level subtree at a time,
+// so a scheduler can interleave it with other work on giant states.
+// The views are captured when the SlicedDiff is created; later state changes
+// do not affect it. Not safe for concurrent use.
+type SlicedDiff struct {
+	old, new map[string]any
+	cfg      ArrayConfig
+	keys     []string // Remaining work: old keys (removed/changed), then added keys
+	added    int      // Index in keys where added keys start
+	pos      int
+	patch    Patch
+}
+
+// DiffSliced prepares a diff between previous and current state for a viewer
+// that is computed by calling Step until it reports done. Returns nil if
+// there is no previous state. Converting both views to documents happens
+// here, in one go; only the comparison is sliced.
+func (s *State[T, A]) DiffSliced(project func(T) T) (*SlicedDiff, error) {
+	s.mu.RLock()
+	prev, cur, ok, keyframe := s.pending()
+	s.mu.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	if project != nil {
+		prev, cur = project(prev), project(cur)
+	}
+	if keyframe {
+		patch, err := s.keyframePatch(cur)
+		if err != nil {
+			return nil, err
+		}
+		return &SlicedDiff{patch: patch}, nil
+	}
+
+	oldDoc, err := toDocument(prev, s.arrayCfg)
+	if err != nil {
+		return nil, err
+	}
+	newDoc, err := toDocument(cur, s.arrayCfg)
+	if err != nil {
+		return nil, err
+	}
+	d := &SlicedDiff{cfg: s.arrayCfg}
+	var oldObj, newObj bool
+	d.old, oldObj = objectRoot(oldDoc)
+	d.new, newObj = objectRoot(newDoc)
+	if !oldObj || !newObj {
+		// Array and scalar roots have no subtrees to slice by
+		d.patch = d.cfg.opts.capSize(d.cfg.opts.finish(diffRoot(oldDoc, newDoc, d.cfg)), newDoc)
+		d.patch = d.cfg.opts.withOld(d.patch, oldDoc)
+		return d, nil
+	}
+
+	// Same order as diffMaps: removed/changed by sorted old key, then added
+	for k := range d.old {
+		d.keys = append(d.keys, k)
+	}
+	sort.Strings(d.keys)
+	d.added = len(d.keys)
+	var added []string
+	for k := range d.new {
+		if _, exists := d.old[k]; !exists {
+			added = append(added, k)
+		}
+	}
+	sort.Strings(added)
+	d.keys = append(d.keys, added...)
+	return d, nil
+}
+
+// Step diffs top-level subtrees until budget is used up, always making
+// progress by at least one subtree. Returns true when the diff is complete.
+func (d *SlicedDiff) Step(budget time.Duration) bool {
+	start := time.Now()
+	for d.pos < len(d.keys) {
+		k := d.keys[d.pos]
+		path := "/" + escapePtr(k)
+		if d.pos >= d.added {
+			d.patch = append(d.patch, Op{Op: "add", Path: path, Value: d.new[k]})
+		} else if newV, exists := d.new[k]; !exists {
+			d.patch = append(d.patch, Op{Op: "remove", Path: path})
+		} else {
+			d.patch = append(d.patch, diffValues(path, d.old[k], newV, d.cfg)...)
+		}
+		d.pos++
+		if d.Done() {
+			d.patch = d.cfg.opts.finish(d.cfg.opts.memberMoves("", d.old, d.new, d.patch))
+			d.patch = d.cfg.opts.capSize(d.patch, d.new)
+			d.patch = d.cfg.opts.withOld(d.patch, d.old)
+		}
+		if time.Since(start) >= budget {
+			break
+		}
+	}
+	return d.Done()
+}
+
+// Done reports whether all subtrees have been diffed
+func (d *SlicedDiff) Done() bool {
+	return d.pos >= len(d.keys)
+}
+
+// Patch returns the diff computed so far; complete once Done is true
+func (d *SlicedDiff) Patch() Patch {
+	return d.patch
+}
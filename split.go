@@ -0,0 +1,37 @@
+package statediff
+
+import "encoding/json"
+
+// Split breaks the patch into consecutive chunks whose JSON (as Patch.JSON
+// encodes it) is at most maxBytes long, e.g. to fit transport frames.
+// Applying the chunks in order is the same as applying the patch, and each
+// chunk applies to the document the previous ones produced. An op that is
+// larger than maxBytes on its own is sent alone in an oversized chunk, as
+// is an op whose value does not encode. maxBytes <= 0 returns the patch as
+// one chunk.
+func (p Patch) Split(maxBytes int) []Patch {
+	if len(p) == 0 {
+		return nil
+	}
+	if maxBytes <= 0 {
+		return []Patch{p}
+	}
+	var chunks []Patch
+	start, size := 0, 2 // "[" and "]"
+	for i, op := range p {
+		n := maxBytes + 1 // Unencodable: alone
+		if data, err := json.Marshal(op); err == nil {
+			n = len(data)
+		}
+		if i > start {
+			n++ // Separating comma
+		}
+		if i > start && size+n > maxBytes {
+			chunks = append(chunks, p[start:i:i])
+			start, size = i, 2
+			n--
+		}
+		size += n
+	}
+	return append(chunks, p[start:])
+}
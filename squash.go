@@ -0,0 +1,117 @@
+package statediff
+
+import "strconv"
+
+// Squash concatenates patches, e.g. several ticks buffered for a client
+// that reconnects, and drops ops whose effect a later replace or remove
+// overwrites: earlier writes to the same path or below it. An add followed
+// by a replace of the same path becomes a single add of the final value, at
+// the add's position.
+//
+// Squash works on the ops alone, without the document, so it is
+// conservative: ops are only dropped when array inserts and removes between
+// them cannot have shifted the overwritten path, and test, move and copy ops
+// are never dropped or reordered around. Applying the result in order (see Patch)
+// gives the same document as applying the patches one after another.
+func Squash(patches ...Patch) Patch {
+	var ops Patch
+	for _, p := range patches {
+		ops = append(ops, p...)
+	}
+	segs := make([][]string, len(ops))
+	valid := make([]bool, len(ops))
+	for i, op := range ops {
+		s, err := parsePtr(op.Path)
+		segs[i], valid[i] = s, err == nil
+	}
+
+	keep := make([]bool, len(ops))
+	for i := range keep {
+		keep[i] = true
+	}
+	for l := range ops {
+		if !valid[l] || (ops[l].Op != "replace" && ops[l].Op != "remove") {
+			continue
+		}
+	scan:
+		for e := l - 1; e >= 0; e-- {
+			if !keep[e] {
+				continue
+			}
+			if !valid[e] || shiftsPath(ops[e], segs[e], segs[l]) {
+				break
+			}
+			if !hasPathPrefix(segs[e], segs[l]) {
+				continue
+			}
+			if len(segs[e]) == len(segs[l]) {
+				switch ops[e].Op {
+				case "add":
+					if ops[l].Op == "remove" {
+						break scan // Insert then remove may not cancel out for objects
+					}
+					// The add stays in place, as ops since may rely on the
+					// elements it shifted; earlier ops at this path refer to
+					// what it shifted
+					ops[e].Value = ops[l].Value
+					keep[l] = false
+					break scan
+				case "remove":
+					break scan // Later ops at this path refer to what moved into it
+				case "replace", "inc":
+					ops[l].Old = ops[e].Old // The value before both
+				}
+			}
+			keep[e] = false
+		}
+	}
+
+	out := make(Patch, 0, len(ops))
+	for i, op := range ops {
+		if keep[i] {
+			out = append(out, op)
+		}
+	}
+	return out
+}
+
+// shiftsPath reports whether op, placed between an earlier op and a later
+// one at target, stops the later op from overwriting the earlier: it is a
+// test (which must see the earlier write), is not understood, or may insert
+// into or remove from an array that target passes through.
+func shiftsPath(op Op, segs, target []string) bool {
+	switch op.Op {
+	case "replace", "inc":
+		return false
+	case "add", "remove":
+		if len(segs) == 0 || !isIndexSeg(segs[len(segs)-1]) || hasPathPrefix(segs, target) {
+			return false // Object members and ops inside target do not shift it
+		}
+		parent := segs[:len(segs)-1]
+		return len(parent) < len(target) && hasPathPrefix(target, parent)
+	default: // test, move, copy, or ops Squash does not know
+		return true
+	}
+}
+
+// isIndexSeg reports whether a segment may be an array index
+func isIndexSeg(s string) bool {
+	if s == "-" {
+		return true
+	}
+	_, err := strconv.ParseUint(s, 10, 0)
+	return err == nil
+}
+
+// hasPathPrefix reports whether path starts with prefix (or equals it)
+func hasPathPrefix(path, prefix []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i, s := range prefix {
+		if path[i] != s {
+			return false
+		}
+	}
+	return true
+}
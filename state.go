@@ -11,7 +11,13 @@ package statediff
 import (
 	"encoding/json"
 	"fmt"
+	"log"
+	"maps"
+	"math"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // State manages game state with effects and projections.
@@ -25,7 +31,95 @@ type State[T, A any] struct {
 	hasPrevi bool // Whether previous is valid
 	effects  []Effect[T, A]
 	cloner   func(T) T
+	codec    Codec // Config.Codec, nil for encoding/json
 	arrayCfg ArrayConfig
+
+	// gen changes whenever current, effects, or previous change.
+	// Used to invalidate caches derived from a change cycle.
+	gen uint64
+	// version counts changes to current and effects (see Version), and
+	// prevVersion is the version of previous
+	version     uint64
+	prevVersion uint64
+	commits     uint64      // Change cycles committed, for RollbackTo
+	history     *history[T] // States sent by recent ticks, nil unless HistorySize is set
+	undo        *undoStack  // Changes Undo reverts, nil unless UndoDepth is set
+
+	registry   *EffectRegistry[T, A]
+	effectMeta map[string]EffectMeta // Metadata of registry-created effects, by ID
+
+	cloneWarn   time.Duration // Report JSON clones slower than this (0 = off)
+	onSlowClone func(SlowClone)
+
+	updateBudget time.Duration // Report Update closures slower than this (0 = off)
+	onSlowUpdate func(SlowUpdate)
+
+	flaps  *flapDetector // Nil unless FlapLimit is set
+	onFlap func(FlapReport)
+
+	elementListeners []func(ElementEvent)
+	watchers         []*watcher
+	changeListeners  []func(old, new T, patch Patch)
+
+	limits  Limits
+	onLimit func(*LimitError)
+
+	refs RefResolver // Validates references in diffs, nil disables
+
+	prevDoc     atomic.Pointer[docCache] // Document of the unprojected previous state
+	noPrevCache bool
+	held        []heldNumber // Numbers FloatEpsilon held back from clients, replaced on commit
+
+	cfg Config[T] // As last applied, for Reconfigure
+
+	onPanic   func(CrashDump)
+	lastPatch atomic.Pointer[Patch] // Recorded for crash dumps when onPanic is set
+
+	policy    ConflictPolicy
+	cyc       *cycle[T]  // Open broadcast cycle, nil outside Session ticks
+	cycBuf    cycle[T]   // Storage for cyc, reused so idle ticks do not allocate
+	cycleDone *sync.Cond // Signaled on mu when a cycle commits or a freeze ends
+	frozen    bool       // Writers wait, e.g. during a Handoff
+	keyframe  bool       // Next diff replaces the whole document
+}
+
+// ConflictPolicy decides what happens to changes made while a Session tick is
+// broadcasting, i.e. between computing the diffs and committing them.
+// Clients always receive a consistent chain of patches: every diff in a tick
+// is computed from the same snapshot, and late changes are never dropped.
+type ConflictPolicy int
+
+const (
+	// ConflictRebase keeps late changes pending, diffed against the state the
+	// clients just received. They go out with the next tick.
+	ConflictRebase ConflictPolicy = iota
+	// ConflictQueue blocks writers until the tick commits. Writers must not
+	// run on the goroutine that is ticking (e.g. inside projections).
+	ConflictQueue
+	// ConflictKeyframe sends the next tick after a late change as a single
+	// root "replace" op carrying the full state, instead of a diff.
+	ConflictKeyframe
+)
+
+// cycle is a snapshot of the pending change taken when a tick starts
+type cycle[T any] struct {
+	gen      uint64
+	from     uint64 // Versions of prev and cur
+	version  uint64
+	prev     T
+	cur      T // With effects
+	has      bool
+	keyframe bool
+}
+
+// LargeStateSize is the JSON size above which Config.RequireCloner rejects
+// states without a custom Cloner.
+const LargeStateSize = 64 * 1024
+
+// SlowClone describes a JSON-based clone that exceeded Config.CloneWarnThreshold
+type SlowClone struct {
+	Duration time.Duration // Time spent marshaling and unmarshaling
+	Bytes    int           // Size of the JSON representation
 }
 
 // Config for State initialization
@@ -33,11 +127,340 @@ type Config[T any] struct {
 	// Cloner for deep copies. If nil, uses JSON marshal/unmarshal.
 	// Implementing a manual cloner is ~40x faster.
 	Cloner func(T) T
+	// Codec replaces encoding/json for cloning states without a Cloner and
+	// for the values diffs encode as JSON (types with MarshalJSON or
+	// MarshalText methods), e.g. a goccy/go-json or jsoniter adapter.
+	// Nil uses StdCodec. Patch payloads are encoded by the Session's
+	// Encoder, and snapshots by Save, with their own formats.
+	Codec Codec
 
 	// ArrayStrategy configures how array diffs are calculated
 	ArrayStrategy ArrayStrategy
-	// ArrayKeyField is the field name used as ID when ArrayStrategy is ByKey
+	// ArrayIndexedAdds makes ArrayByIndex detect elements inserted or
+	// removed in the middle of an array: unchanged leading and trailing
+	// elements are matched, and the difference is sent as adds and removes
+	// at their real index instead of rewriting every element after it.
+	ArrayIndexedAdds bool
+	// ArrayAutoRatio is the share of changed elements (0 to 1) above which
+	// ArrayAuto replaces an array whole instead of sending per-element ops.
+	// 0 uses DefaultArrayAutoRatio.
+	ArrayAutoRatio float64
+	// ArrayKeyField is the field name used as ID when ArrayStrategy is ByKey.
+	// Keys in nested objects are given as a dotted path ("meta.id") or a
+	// JSON Pointer into the element ("/meta/id"). Comma-separated fields
+	// ("team,slot") form a composite key; elements missing a part are unkeyed.
 	ArrayKeyField string
+	// ArrayKeyFields sets the key field per array path when arrays are keyed
+	// differently (e.g. {"/players": "id", "/cards": "uid"}). Paths are JSON
+	// Pointers where "*" matches any segment; the most specific match wins
+	// (see ArrayConfig.KeyFields). Arrays without a match use
+	// ArrayKeyField, or are replaced whole if that is empty.
+	ArrayKeyFields map[string]string
+	// ArrayKeyFunc computes the key of an element of the keyed array at path
+	// (a concrete JSON Pointer), for keys a field name cannot express, such
+	// as case-folded or prefix-stripped IDs. It returns false to fall back to
+	// the key field; arrays where an element has no key are replaced whole.
+	// Elements are decoded JSON objects as emitted (after PathMapper).
+	ArrayKeyFunc func(path string, elem map[string]any) (string, bool)
+	// ArrayIdentity returns a secondary identity for an element of the keyed
+	// array at path (a concrete JSON Pointer), or "" if it has none. When an
+	// element's key changes (a renamed id alias, a new uid on promotion), the
+	// removed and added elements with the same identity are diffed as one:
+	// a replace of the key plus field ops instead of a remove and an add.
+	// Elements are decoded JSON objects as emitted (after PathMapper).
+	ArrayIdentity func(path string, elem map[string]any) string
+	// KeyedArraysAsObjects sends arrays diffed with ArrayByKey as objects
+	// keyed by element key, in patches and full states: a change is
+	// "/players/alice/score" instead of "/players/3/score", for clients that
+	// sort or filter locally. Element order is not sent. Path patterns
+	// (ArrayKeyFields, FloatPrecision, IgnorePaths, ...) and the paths given
+	// to ArrayKeyFunc and ArrayIdentity refer to the object form. Arrays
+	// with an unkeyed or duplicate element stay arrays.
+	KeyedArraysAsObjects bool
+	// DetectMoves emits RFC 6902 move and copy ops instead of full values
+	// where an object or array value is relocated: a member renamed within
+	// its object becomes a move, and a new member equal to an unchanged
+	// sibling a copy. Reordered ArrayByKey elements are moved (as few as
+	// possible) instead of replacing the array. Off by default since some
+	// clients only apply add, remove and replace.
+	DetectMoves bool
+
+	// MaxPatchOps and MaxPatchBytes cap diffs (0 = no limit). A patch with
+	// more ops, or more bytes of JSON, is collapsed: each top-level member
+	// touched by several ops is sent whole, and if that is still over, the
+	// document is sent as one root replace. Past some size, resending the
+	// values is cheaper to encode and apply than hundreds of small ops.
+	MaxPatchOps   int
+	MaxPatchBytes int
+	// RootReplaceRatio sends the whole document as one root replace when a
+	// diff touches more than this share (0 to 1) of the top-level members,
+	// e.g. after loading a new level, instead of an op per change. 0 never
+	// collapses by share.
+	RootReplaceRatio float64
+	// MaxDiffDepth stops the differ from recursing past a nesting depth
+	// (0 = no limit): a changed object or array whose path has that many
+	// segments is replaced whole, e.g. 2 diffs "/players/3" as one value.
+	// Bounds patch length and CPU for deeply nested states.
+	MaxDiffDepth int
+	// DiffWorkers diffs the members of large objects (ParallelDiffMin
+	// members or more, such as entity maps) on up to this many goroutines,
+	// for states where a single-threaded diff is the bottleneck. The patch
+	// is the same as a sequential diff's. ArrayKeyFunc and ArrayIdentity
+	// may then be called concurrently. 0 or 1 diffs sequentially.
+	DiffWorkers int
+	// FloatEpsilon treats numbers that differ by at most this much as
+	// unchanged, so float jitter (physics, interpolation) sends no ops.
+	// Values are compared with what clients last received, so a value
+	// creeping by less than FloatEpsilon per change is sent once it has
+	// drifted further than that in total (for projections, where they keep
+	// the value's path). Costs one more diff per commit.
+	FloatEpsilon float64
+	// UseNumber decodes documents with json.Decoder.UseNumber while
+	// diffing, so integers above 2^53 (int64 IDs, snowflakes) are compared
+	// and sent exactly instead of as rounded float64s. Op values then hold
+	// json.Number rather than float64 for numbers.
+	UseNumber bool
+	// IncludeOld adds the overwritten value to replace and remove ops as
+	// "old", e.g. for clients tweening from the old to the new value without
+	// keeping a shadow copy. Null old values are omitted.
+	IncludeOld bool
+	// StrictRFC6902 guarantees diffs any spec-compliant RFC 6902 applier
+	// accepts: add and replace ops of null values carry "value": null (as
+	// with Patch.Normalize) instead of omitting it, and extensions emitting
+	// other ops (NumericDeltas) are rejected by New. Op order already
+	// follows the sequential contract documented on Patch.
+	StrictRFC6902 bool
+	// NonFinite selects how NaN and ±Inf floats are sent, since JSON has no
+	// encoding for them. By default New and Diff fail with a
+	// *NonFiniteError giving the path of the value; NonFiniteNull and
+	// NonFiniteClamp send null or a clamped number instead. Floats encoded
+	// by a MarshalJSON or MarshalText method are not covered.
+	NonFinite NonFinitePolicy
+	// NumericDeltas sends a whole number that changed as a non-standard
+	// "inc" op adding the difference, {"op":"inc","path":"/score","value":50},
+	// instead of a replace: counters changing every tick (scores, currency)
+	// then compress far better. Apply handles inc ops; connect clients that
+	// only apply RFC 6902 with WithEncoder(StandardOps(...)), or convert
+	// patches with Patch.Standard.
+	NumericDeltas bool
+
+	// PathMapper renames every object key (as produced by the json tags) in
+	// emitted patches and full-state payloads, e.g. SnakeCase when clients
+	// expect snake_case paths but the struct tags are camelCase.
+	// Applied consistently to diffs and Session.Full. Nil keeps json names.
+	PathMapper func(name string) string
+
+	// FloatPrecision rounds numbers in emitted patches and full-state payloads
+	// to a number of decimals, keyed by JSON Pointer (as emitted, after
+	// PathMapper). A "*" segment matches any key or index, and a rule applies
+	// to the whole subtree below its path; the most specific rule wins.
+	// Changes smaller than the precision produce no ops. The authoritative
+	// state is never rounded.
+	//
+	//	FloatPrecision: map[string]int{"/players/*/pos": 2}
+	FloatPrecision map[string]int
+
+	// DerivedPaths trims values clients compute themselves. Each key is a
+	// derived path and its value the source path it is computed from, both
+	// as emitted (after PathMapper). When a patch changes the source, ops on
+	// the derived path are dropped. "*" segments of the source take the
+	// values of the derived path's wildcards in order:
+	//
+	//	DerivedPaths: map[string]string{"/players/*/hpPercent": "/players/*/hp"}
+	DerivedPaths map[string]string
+
+	// EncryptPaths lists JSON Pointers (as emitted, after PathMapper; "*"
+	// matches any segment) whose values are sent encrypted in patches and
+	// full-state payloads, e.g. emails or payment tokens. The JSON encoding of
+	// each value is passed to Encrypt and replaced by the returned string.
+	// The authoritative state stays plaintext, and unchanged values produce
+	// no ops even though ciphertexts differ.
+	EncryptPaths []string
+
+	// NullPaths lists JSON Pointers (as emitted, after PathMapper; "*"
+	// matches any segment) of nullable object members, typically pointer
+	// fields tagged omitempty. Absent members are sent as explicit nulls, so
+	// clearing such a field is a replace to null instead of a remove, and
+	// setting it again a replace instead of an add. With NullPaths set, all
+	// add and replace ops of null values carry "value": null.
+	NullPaths []string
+	// OmitEmpty selects which fields tagged omitempty are left out of
+	// patches and full states. With the default, OmitEmptyTags, a field set
+	// to its zero value disappears as a remove, as in encoding/json.
+	// OmitEmptyNil sends zero values (a replace to 0 instead of a remove)
+	// and still leaves out nil pointers, so clients can tell them apart;
+	// OmitEmptyNever sends every field, nil as null. Structs with fields
+	// tagged ",string" and types with a MarshalJSON method keep their JSON.
+	OmitEmpty OmitEmptyPolicy
+	// IgnorePaths lists JSON Pointers (as emitted, after PathMapper; "*"
+	// matches any segment) of values left out of diffs and full states, with
+	// everything below them, e.g. server-only bookkeeping. Ignored array
+	// elements are dropped, so later elements shift down in the document.
+	IgnorePaths []string
+	// Encrypt seals a value for the configured path it matched. Required
+	// with EncryptPaths; see AESGCM for a key-provider based implementation.
+	Encrypt func(path string, plaintext []byte) (string, error)
+	// BlobPaths lists JSON Pointers (as emitted, after PathMapper; "*"
+	// matches any segment) of large values, such as embedded map chunks,
+	// sent by reference: a value whose JSON is at least BlobMinBytes long
+	// is replaced in patches and full states by {"$blob":"sha256:<hex>"},
+	// the hash of its JSON, which clients fetch out of band (see
+	// Patch.ResolveBlobs). A changed value is a replace of the reference,
+	// so it no longer dwarfs the other ops of its patch.
+	BlobPaths []string
+	// BlobMinBytes is the JSON size from which BlobPaths values are sent by
+	// reference; smaller values are sent inline. 0 references all of them.
+	BlobMinBytes int
+	// BlobStore receives the JSON of each referenced value, keyed by its
+	// reference, whenever a payload referencing it is encoded, and makes it
+	// available to clients (an HTTP endpoint, a CDN). It should skip
+	// references it already has. Required with BlobPaths.
+	BlobStore func(ref string, data []byte) error
+
+	// Limits caps the size, depth and array lengths of the state document.
+	// Update and Set that would exceed them are rolled back, and Diff
+	// returns the *LimitError (e.g. when effects balloon the state).
+	Limits Limits
+	// OnLimitExceeded is called with every violation, e.g. to log or alert.
+	// Called after the state lock is released.
+	OnLimitExceeded func(*LimitError)
+
+	// Refs validates references at diff time: every {"$ref"} an add or
+	// replace op sends must resolve, or Diff returns a *RefError. Typically
+	// a RefTargets of the states of a Hub. See Ref.
+	Refs RefResolver
+
+	// OnPanic enables crash dumps: a panic inside Update, Set or Diff
+	// (including clones, effects and projections) is recovered, a CrashDump
+	// of the base state, effects and last patch is passed to OnPanic, and the
+	// panic is re-raised. Persist the dump; do not call back into the State.
+	OnPanic func(CrashDump)
+
+	// ConflictPolicy handles changes made while a Session tick is
+	// broadcasting. Default ConflictRebase.
+	ConflictPolicy ConflictPolicy
+
+	// CloneWarnThreshold enables clone diagnostics when Cloner is nil: every
+	// JSON-based clone slower than this is reported to OnSlowClone (or logged
+	// with a suggestion to use clonegen if OnSlowClone is nil). 0 disables.
+	CloneWarnThreshold time.Duration
+	// OnSlowClone receives slow clone reports, e.g. to feed metrics.
+	// Called synchronously while the state lock is held; keep it cheap.
+	OnSlowClone func(SlowClone)
+	// UpdateBudget enables the Update watchdog: a closure passed to Update
+	// (or Tx.Update) that holds the state lock longer than this is reported
+	// to OnSlowUpdate with a stack trace, or logged if OnSlowUpdate is nil.
+	// A slow closure stalls Get and Diff for every client. 0 disables.
+	UpdateBudget time.Duration
+	// OnSlowUpdate receives slow update reports. The running report is
+	// delivered from another goroutine while the lock is still held, the
+	// final one from Update itself; do not call back into the State.
+	OnSlowUpdate func(SlowUpdate)
+	// FlapLimit enables flap detection: a path changed by more than this
+	// many committed ticks (Session ticks or ClearPrevious) within
+	// FlapWindow is reported to OnFlap, or logged if OnFlap is nil, to catch
+	// bandwidth regressions such as a field an effect flips every tick.
+	// Costs one extra diff per tick. 0 disables.
+	FlapLimit int
+	// FlapWindow is the counting window of FlapLimit. Default DefaultFlapWindow.
+	FlapWindow time.Duration
+	// OnFlap receives flap reports, e.g. to feed metrics. Called after the
+	// state lock is released.
+	OnFlap func(FlapReport)
+	// RequireCloner makes New fail if Cloner is nil and the initial state is
+	// larger than LargeStateSize bytes of JSON, where JSON cloning gets costly.
+	RequireCloner bool
+	// DisablePreviousCache stops unprojected diffs from keeping the decoded
+	// document of the previous state between Diff calls. The cache saves
+	// rebuilding it for every Diff(nil) until the next change, at the cost
+	// of holding one extra copy of the state as a generic document.
+	DisablePreviousCache bool
+
+	// UndoDepth records the last UndoDepth changes Update and Set make to
+	// the base state, as patches that State.Undo and State.Redo apply, e.g.
+	// for editors and admin tools. Each change is diffed twice when made.
+	// 0 records none.
+	UndoDepth int
+
+	// HistorySize keeps the states (with effects) committed by the last
+	// HistorySize Session ticks or ClearPrevious calls, by version, so
+	// reconnecting clients that kept their state catch up with
+	// State.DiffSince or Session.Resume instead of a full resync. Each entry
+	// is a copy of the state. 0 keeps none.
+	HistorySize int
+}
+
+// validate checks the configuration for inconsistent settings
+func (c *Config[T]) validate() error {
+	if c.ArrayStrategy == ArrayByKey && c.ArrayKeyField == "" && len(c.ArrayKeyFields) == 0 && c.ArrayKeyFunc == nil {
+		return fmt.Errorf("statediff: ArrayByKey strategy requires ArrayKeyField, ArrayKeyFields or ArrayKeyFunc to be set")
+	}
+	if c.ArrayAutoRatio < 0 || c.ArrayAutoRatio > 1 || math.IsNaN(c.ArrayAutoRatio) {
+		return fmt.Errorf("statediff: ArrayAutoRatio must be between 0 and 1")
+	}
+	if c.StrictRFC6902 && c.NumericDeltas {
+		return fmt.Errorf("statediff: NumericDeltas emits non-standard inc ops and cannot be used with StrictRFC6902")
+	}
+	if c.KeyedArraysAsObjects && c.ArrayStrategy != ArrayByKey {
+		return fmt.Errorf("statediff: KeyedArraysAsObjects requires the ArrayByKey strategy")
+	}
+	if c.MaxPatchOps < 0 || c.MaxPatchBytes < 0 {
+		return fmt.Errorf("statediff: MaxPatchOps and MaxPatchBytes must not be negative")
+	}
+	if c.HistorySize < 0 || c.UndoDepth < 0 {
+		return fmt.Errorf("statediff: HistorySize and UndoDepth must not be negative")
+	}
+	if c.RootReplaceRatio < 0 || c.RootReplaceRatio > 1 || math.IsNaN(c.RootReplaceRatio) {
+		return fmt.Errorf("statediff: RootReplaceRatio must be between 0 and 1")
+	}
+	if c.FloatEpsilon < 0 || math.IsNaN(c.FloatEpsilon) {
+		return fmt.Errorf("statediff: FloatEpsilon must not be negative")
+	}
+	if c.MaxDiffDepth < 0 {
+		return fmt.Errorf("statediff: MaxDiffDepth must not be negative")
+	}
+	if c.DiffWorkers < 0 {
+		return fmt.Errorf("statediff: DiffWorkers must not be negative")
+	}
+	if err := validateDerivedPaths(c.DerivedPaths); err != nil {
+		return err
+	}
+	if err := validateNullPaths(c.NullPaths); err != nil {
+		return err
+	}
+	if err := validateIgnorePaths(c.IgnorePaths); err != nil {
+		return err
+	}
+	if len(c.BlobPaths) > 0 && c.BlobStore == nil {
+		return fmt.Errorf("statediff: BlobPaths requires BlobStore to be set")
+	}
+	if c.BlobMinBytes < 0 {
+		return fmt.Errorf("statediff: BlobMinBytes must not be negative")
+	}
+	if len(c.EncryptPaths) > 0 && c.Encrypt == nil {
+		return fmt.Errorf("statediff: EncryptPaths requires Encrypt to be set")
+	}
+	if c.ConflictPolicy < ConflictRebase || c.ConflictPolicy > ConflictKeyframe {
+		return fmt.Errorf("statediff: unknown ConflictPolicy %d", c.ConflictPolicy)
+	}
+	for path, decimals := range c.FloatPrecision {
+		if decimals < 0 {
+			return fmt.Errorf("statediff: FloatPrecision for %q must not be negative", path)
+		}
+	}
+	return nil
+}
+
+// copy returns c with its maps and slices copied
+func (c Config[T]) copy() Config[T] {
+	c.ArrayKeyFields = maps.Clone(c.ArrayKeyFields)
+	c.FloatPrecision = maps.Clone(c.FloatPrecision)
+	c.DerivedPaths = maps.Clone(c.DerivedPaths)
+	c.EncryptPaths = slices.Clone(c.EncryptPaths)
+	c.BlobPaths = slices.Clone(c.BlobPaths)
+	c.NullPaths = slices.Clone(c.NullPaths)
+	c.IgnorePaths = slices.Clone(c.IgnorePaths)
+	return c
 }
 
 // New creates a new State with the given initial value.
@@ -45,25 +468,37 @@ type Config[T any] struct {
 func New[T, A any](initial T, cfg *Config[T]) (*State[T, A], error) {
 	s := &State[T, A]{current: initial}
 	if cfg != nil {
-		s.cloner = cfg.Cloner
-		s.arrayCfg = ArrayConfig{Strategy: cfg.ArrayStrategy, KeyField: cfg.ArrayKeyField}
-
-		// Validate ArrayConfig
-		if cfg.ArrayStrategy == ArrayByKey && cfg.ArrayKeyField == "" {
-			return nil, fmt.Errorf("statediff: ArrayByKey strategy requires ArrayKeyField to be set")
+		if err := cfg.validate(); err != nil {
+			return nil, err
 		}
+		s.applyConfig(cfg)
+	}
+	if s.history != nil {
+		s.history.record(0, s.clone(initial))
+	}
+
+	// Report non-finite floats with their path rather than on the first diff
+	doc, err := s.arrayCfg.opts.document(initial)
+	if _, ok := err.(*NonFiniteError); ok {
+		return nil, err
 	}
 
 	// Validate that state type can be JSON serialized (only if no custom cloner)
 	if s.cloner == nil {
-		data, err := json.Marshal(initial)
+		data, err := s.jsonCodec().Marshal(initial)
+		if isNonFiniteMarshal(err) && doc != nil {
+			data, err = json.Marshal(doc) // NaN or ±Inf allowed by Config.NonFinite
+		}
 		if err != nil {
 			return nil, fmt.Errorf("statediff: state type cannot be JSON marshaled: %w", err)
 		}
 		var test T
-		if err := json.Unmarshal(data, &test); err != nil {
+		if err := s.jsonCodec().Unmarshal(data, &test); err != nil {
 			return nil, fmt.Errorf("statediff: state type cannot be JSON unmarshaled: %w", err)
 		}
+		if cfg != nil && cfg.RequireCloner && len(data) > LargeStateSize {
+			return nil, fmt.Errorf("statediff: state is %d bytes of JSON and RequireCloner is set; provide Config.Cloner (see clonegen)", len(data))
+		}
 	}
 
 	return s, nil
@@ -79,6 +514,104 @@ func MustNew[T, A any](initial T, cfg *Config[T]) *State[T, A] {
 	return s
 }
 
+// Reconfigure changes the configuration of a live state, e.g. array key
+// fields or limits, without recreating it and resyncing every client. fn
+// edits a copy of the current config; the result is validated as in New
+// and applied atomically, or the error is returned and nothing changes.
+// An open Session tick completes first. If the emitted document can change
+// shape (PathMapper, FloatPrecision, EncryptPaths, NullPaths or
+// DerivedPaths were or are set), the next diff is a keyframe replacing the
+// whole document.
+func (s *State[T, A]) Reconfigure(fn func(cfg *Config[T])) error {
+	s.mu.Lock()
+	for s.cyc != nil {
+		s.cycleDone.Wait()
+	}
+	cfg := s.cfg.copy()
+	fn(&cfg)
+	if err := cfg.validate(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	reshape := s.arrayCfg.opts.needsTransform() || len(s.cfg.DerivedPaths) > 0
+	s.applyConfig(&cfg)
+	if reshape || s.arrayCfg.opts.needsTransform() || len(cfg.DerivedPaths) > 0 {
+		if !s.hasPrevi {
+			s.previous = s.withEffects(s.current)
+			s.prevVersion = s.version
+			s.hasPrevi = true
+		}
+		s.keyframe = true
+	}
+	s.gen++
+	s.mu.Unlock()
+	return nil
+}
+
+// applyConfig installs a validated config. Caller must hold mu or own s.
+func (s *State[T, A]) applyConfig(cfg *Config[T]) {
+	s.cfg = cfg.copy()
+	cfg = &s.cfg // Maps and slices below are not shared with the caller
+	s.cloner = cfg.Cloner
+	s.codec = cfg.Codec
+	s.cloneWarn = cfg.CloneWarnThreshold
+	s.onSlowClone = cfg.OnSlowClone
+	s.updateBudget = cfg.UpdateBudget
+	s.onSlowUpdate = cfg.OnSlowUpdate
+	if s.flaps == nil || s.flaps.limit != cfg.FlapLimit || s.flaps.window != flapWindow(cfg.FlapWindow) {
+		s.flaps = newFlapDetector(cfg.FlapLimit, cfg.FlapWindow) // Keeps counts unless changed
+	}
+	s.onFlap = cfg.OnFlap
+	s.history = s.history.resized(cfg.HistorySize)
+	s.undo = s.undo.resized(cfg.UndoDepth)
+	s.policy = cfg.ConflictPolicy
+	s.limits = cfg.Limits
+	s.onLimit = cfg.OnLimitExceeded
+	s.refs = cfg.Refs
+	s.onPanic = cfg.OnPanic
+	s.noPrevCache = cfg.DisablePreviousCache
+	s.prevDoc.Store(nil) // Built with the old diff options
+	s.held = nil
+	s.arrayCfg = ArrayConfig{Strategy: cfg.ArrayStrategy, IndexedAdds: cfg.ArrayIndexedAdds, AutoRatio: cfg.ArrayAutoRatio, KeyField: cfg.ArrayKeyField, KeyFields: cfg.ArrayKeyFields, keyRules: newKeyRules(cfg.ArrayKeyFields), Identity: cfg.ArrayIdentity, KeyFunc: cfg.ArrayKeyFunc}
+	if cfg.PathMapper != nil || len(cfg.FloatPrecision) > 0 || len(cfg.EncryptPaths) > 0 || len(cfg.DerivedPaths) > 0 || len(cfg.NullPaths) > 0 || cfg.DetectMoves || cfg.MaxPatchOps > 0 || cfg.MaxPatchBytes > 0 || cfg.RootReplaceRatio > 0 || cfg.MaxDiffDepth > 0 || cfg.FloatEpsilon > 0 || cfg.UseNumber || len(cfg.IgnorePaths) > 0 || cfg.IncludeOld || cfg.DiffWorkers > 1 || cfg.KeyedArraysAsObjects || cfg.NumericDeltas || cfg.NonFinite != NonFiniteReject || cfg.OmitEmpty != OmitEmptyTags || cfg.Codec != nil || len(cfg.BlobPaths) > 0 || cfg.StrictRFC6902 {
+		s.arrayCfg.opts = &diffOptions{
+			mapKey:    cfg.PathMapper,
+			precision: newPrecisionRules(cfg.FloatPrecision),
+			derived:   newDerivedRules(cfg.DerivedPaths),
+			moves:     cfg.DetectMoves,
+			maxOps:    cfg.MaxPatchOps,
+			maxBytes:  cfg.MaxPatchBytes,
+			rootRatio: cfg.RootReplaceRatio,
+			maxDepth:  cfg.MaxDiffDepth,
+			epsilon:   cfg.FloatEpsilon,
+			numbers:   cfg.UseNumber,
+			old:       cfg.IncludeOld,
+			workers:   newWorkerPool(cfg.DiffWorkers),
+			deltas:    cfg.NumericDeltas,
+			floats:    cfg.NonFinite,
+			omit:      cfg.OmitEmpty,
+			codec:     cfg.Codec,
+			strict:    cfg.StrictRFC6902,
+		}
+		for _, p := range cfg.NullPaths {
+			s.arrayCfg.opts.nulls = append(s.arrayCfg.opts.nulls, splitPtr(p))
+		}
+		for _, p := range cfg.IgnorePaths {
+			s.arrayCfg.opts.ignore = append(s.arrayCfg.opts.ignore, splitPtr(p))
+		}
+		if len(cfg.BlobPaths) > 0 {
+			s.arrayCfg.opts.blobs = newBlobber(cfg.BlobPaths, cfg.BlobMinBytes, cfg.BlobStore)
+		}
+		if len(cfg.EncryptPaths) > 0 {
+			s.arrayCfg.opts.encrypt = newEncryptor(cfg.EncryptPaths, cfg.Encrypt)
+		}
+		if cfg.KeyedArraysAsObjects {
+			keyed := s.arrayCfg
+			s.arrayCfg.opts.arrays = &keyed
+		}
+	}
+}
+
 // clone creates a deep copy.
 // If no custom cloner is set, uses JSON marshal/unmarshal (slower but universal).
 // Note: New() validates that the type can be serialized, so errors here indicate
@@ -87,23 +620,51 @@ func (s *State[T, A]) clone(src T) T {
 	if s.cloner != nil {
 		return s.cloner(src)
 	}
+	var start time.Time
+	if s.cloneWarn > 0 {
+		start = time.Now()
+	}
 	var dst T
-	data, err := json.Marshal(src)
+	codec := s.jsonCodec()
+	data, err := codec.Marshal(src)
+	if isNonFiniteMarshal(err) {
+		// JSON cannot hold NaN or ±Inf; copy them exactly and let the diff
+		// apply Config.NonFinite
+		return DeepClone(src)
+	}
 	if err != nil {
 		// This shouldn't happen if New() validated the type correctly.
 		// Panic because silent failure would cause diff corruption.
 		panic(fmt.Sprintf("statediff: clone marshal failed (type changed after New?): %v", err))
 	}
-	if err := json.Unmarshal(data, &dst); err != nil {
+	if err := codec.Unmarshal(data, &dst); err != nil {
 		panic(fmt.Sprintf("statediff: clone unmarshal failed: %v", err))
 	}
+	if s.cloneWarn > 0 {
+		if d := time.Since(start); d > s.cloneWarn {
+			s.reportSlowClone(SlowClone{Duration: d, Bytes: len(data)})
+		}
+	}
 	return dst
 }
 
+// reportSlowClone delivers a slow clone report to the hook or the log
+func (s *State[T, A]) reportSlowClone(r SlowClone) {
+	if s.onSlowClone != nil {
+		s.onSlowClone(r)
+		return
+	}
+	log.Printf("statediff: JSON clone of %d bytes took %v; set Config.Cloner (e.g. generated by clonegen) for ~40x faster clones", r.Bytes, r.Duration)
+}
+
 // withEffects returns state with all effects applied
 func (s *State[T, A]) withEffects(state T) T {
 	result := s.clone(state)
 	for _, e := range s.effects {
+		if q, ok := e.(baseQuery[T, A]); ok {
+			result = q.applyWithBase(s.gen, state, result, e.Activator())
+			continue
+		}
 		result = e.Apply(result, e.Activator())
 	}
 	return result
@@ -123,22 +684,121 @@ func (s *State[T, A]) GetBase() T {
 	return s.clone(s.current)
 }
 
-// Update modifies the state. Saves previous for diff calculation.
+// Update modifies the state. The first change after a broadcast (a
+// Session tick or ClearPrevious) saves the state clients have as previous;
+// later updates keep it, so the next diff covers all of them and its
+// versions run from the one clients last received.
+// If Config.Limits are exceeded, the update is rolled back.
 func (s *State[T, A]) Update(fn func(*T)) {
+	s.reportLimit(s.update(fn))
+}
+
+// update applies fn and enforces limits
+func (s *State[T, A]) update(fn func(*T)) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.previous = s.withEffects(s.current)
-	s.hasPrevi = true
-	fn(&s.current)
+	defer s.recoverCrash("update")
+	s.waitCycle()
+
+	if !s.limits.enabled() && s.undo == nil {
+		s.markChanged()
+		s.runUpdate(fn, &s.current)
+		return nil
+	}
+
+	next := s.clone(s.current)
+	s.runUpdate(fn, &next)
+	return s.replaceChecked(next)
+}
+
+// UpdateE is Update for changes that can fail partway, e.g. validation:
+// fn edits a copy of the state, and if it returns an error the copy is
+// discarded and the state is left as it was. Returns fn's error, or the
+// *LimitError if Config.Limits reject the result.
+func (s *State[T, A]) UpdateE(fn func(*T) error) error {
+	err := s.updateE(fn)
+	s.reportLimit(err)
+	return err
+}
+
+// updateE implements UpdateE
+func (s *State[T, A]) updateE(fn func(*T) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.recoverCrash("update")
+	s.waitCycle()
+	return s.updateCopy(fn)
+}
+
+// updateCopy applies fn to a copy of the state and installs it unless fn
+// fails or limits reject it. Caller must hold mu.
+func (s *State[T, A]) updateCopy(fn func(*T) error) (err error) {
+	next := s.clone(s.current)
+	s.runUpdate(func(v *T) { err = fn(v) }, &next)
+	if err != nil {
+		return err
+	}
+	return s.replaceChecked(next)
+}
+
+// runUpdate calls an Update closure under the watchdog. Caller must hold mu.
+func (s *State[T, A]) runUpdate(fn func(*T), v *T) {
+	if stop := s.watchUpdate(); stop != nil {
+		defer stop()
+	}
+	fn(v)
 }
 
-// Set replaces the entire state
+// Set replaces the entire state, keeping a pending previous like Update.
+// If Config.Limits are exceeded, the state is left unchanged.
 func (s *State[T, A]) Set(newState T) {
+	s.reportLimit(s.set(newState))
+}
+
+// set replaces the state and enforces limits
+func (s *State[T, A]) set(newState T) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.previous = s.withEffects(s.current)
-	s.hasPrevi = true
+	defer s.recoverCrash("set")
+	s.waitCycle()
+	if s.limits.enabled() || s.undo != nil {
+		return s.replaceChecked(s.clone(newState))
+	}
+	s.markChanged()
 	s.current = s.clone(newState)
+	return nil
+}
+
+// replaceChecked installs next as the current state if it is within limits,
+// recording the change for Undo. Caller must hold mu.
+func (s *State[T, A]) replaceChecked(next T) error {
+	if s.limits.enabled() {
+		if err := s.limits.check(next, s.arrayCfg.opts); err != nil {
+			return err
+		}
+	}
+	recordUndo(s.undo, s.current, next)
+	s.replace(next)
+	return nil
+}
+
+// replace installs next as the current state. Caller must hold mu.
+func (s *State[T, A]) replace(next T) {
+	s.markChanged()
+	s.current = next
+}
+
+// markChanged records a change to the state or its effects. A pending
+// previous is kept: it is what clients last received, so the next diff
+// covers every change made since. Caller must hold mu.
+func (s *State[T, A]) markChanged() {
+	if !s.hasPrevi {
+		s.previous = s.withEffects(s.current)
+		s.prevVersion = s.version
+		s.hasPrevi = true
+	}
+	s.gen++
+	s.version++
 }
 
 // AddEffect adds a reversible effect with an activator.
@@ -147,6 +807,7 @@ func (s *State[T, A]) Set(newState T) {
 func (s *State[T, A]) AddEffect(e Effect[T, A], activator A) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.waitCycle()
 
 	// Check for duplicate ID
 	for _, existing := range s.effects {
@@ -158,25 +819,174 @@ func (s *State[T, A]) AddEffect(e Effect[T, A], activator A) error {
 	// Set the activator on the effect
 	e.SetActivator(activator)
 
-	s.previous = s.withEffects(s.current)
-	s.hasPrevi = true
+	s.markChanged()
 	s.effects = append(s.effects, e)
+	delete(s.effectMeta, e.ID()) // Re-set by AddEffectByName if registry-created
+	return nil
+}
+
+// SetEffectRegistry sets the registry used by AddEffectByName. Metadata of
+// effects restored before is upgraded to the registry's template versions.
+func (s *State[T, A]) SetEffectRegistry(reg *EffectRegistry[T, A]) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.registry = reg
+	if reg == nil {
+		return
+	}
+	for id, meta := range s.effectMeta {
+		if m, err := reg.Migrate(meta); err == nil {
+			s.effectMeta[id] = m
+		}
+	}
+}
+
+// AddEffectByName creates an effect from the registry template for typ and adds it.
+// Params are marshaled to JSON and validated against the template before the
+// effect is created, so malformed content fails here with an *EffectParamsError
+// instead of panicking inside Apply later.
+// The effect's metadata is remembered and returned by EffectMetas for saving.
+func (s *State[T, A]) AddEffectByName(typ, id string, params any, activator A) error {
+	s.mu.RLock()
+	reg := s.registry
+	s.mu.RUnlock()
+	if reg == nil {
+		return fmt.Errorf("statediff: no effect registry set")
+	}
+
+	meta, err := reg.Meta(id, typ, params)
+	if err != nil {
+		return err
+	}
+	e, err := reg.Create(meta)
+	if err != nil {
+		return err
+	}
+	if err := s.AddEffect(e, activator); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rememberMeta(meta)
 	return nil
 }
 
+// EffectSpec declares an effect to create from the registry, e.g. one entry
+// of a character loadout or scenario file.
+type EffectSpec[A any] struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	Params    any    `json:"params,omitempty"`
+	Activator A      `json:"activator"`
+}
+
+// AddEffects creates effects from the registry and adds them in declared
+// order as a single change (one previous snapshot). All-or-nothing: if any
+// spec fails to validate or create, or an ID is duplicated, no effect is added.
+func (s *State[T, A]) AddEffects(specs []EffectSpec[A]) error {
+	s.mu.RLock()
+	reg := s.registry
+	s.mu.RUnlock()
+	if reg == nil {
+		return fmt.Errorf("statediff: no effect registry set")
+	}
+
+	created := make([]Effect[T, A], len(specs))
+	metas := make([]EffectMeta, len(specs))
+	seen := make(map[string]bool, len(specs))
+	for i, spec := range specs {
+		if seen[spec.ID] {
+			return fmt.Errorf("statediff: effect with ID %q declared twice", spec.ID)
+		}
+		seen[spec.ID] = true
+		meta, err := reg.Meta(spec.ID, spec.Type, spec.Params)
+		if err != nil {
+			return err
+		}
+		e, err := reg.Create(meta)
+		if err != nil {
+			return err
+		}
+		created[i], metas[i] = e, meta
+	}
+	if len(created) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.waitCycle()
+
+	for _, existing := range s.effects {
+		if seen[existing.ID()] {
+			return fmt.Errorf("statediff: effect with ID %q already exists", existing.ID())
+		}
+	}
+
+	s.markChanged()
+	for i, e := range created {
+		e.SetActivator(specs[i].Activator)
+		s.effects = append(s.effects, e)
+	}
+	for _, meta := range metas {
+		s.rememberMeta(meta)
+	}
+	return nil
+}
+
+// rememberMeta records metadata for a registry-created effect and drops
+// entries for effects that are no longer active. Caller must hold mu.
+func (s *State[T, A]) rememberMeta(meta EffectMeta) {
+	if s.effectMeta == nil {
+		s.effectMeta = make(map[string]EffectMeta)
+	}
+	for id := range s.effectMeta {
+		if s.findEffect(id) == nil {
+			delete(s.effectMeta, id)
+		}
+	}
+	s.effectMeta[meta.ID] = meta
+}
+
+// findEffect returns the active effect with the given ID. Caller must hold mu.
+func (s *State[T, A]) findEffect(id string) Effect[T, A] {
+	for _, e := range s.effects {
+		if e.ID() == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// EffectMetas returns the metadata of active effects that were created via
+// AddEffectByName, in effect order. Pass the result to Save.
+func (s *State[T, A]) EffectMetas() []EffectMeta {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var metas []EffectMeta
+	for _, e := range s.effects {
+		if meta, ok := s.effectMeta[e.ID()]; ok {
+			meta.Timing = captureTiming(e)
+			metas = append(metas, meta)
+		}
+	}
+	return metas
+}
+
 // RemoveEffect removes an effect by ID.
 // If the effect has a scheduled expiration timer, it is cancelled.
 func (s *State[T, A]) RemoveEffect(id string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.waitCycle()
 	for i, e := range s.effects {
 		if e.ID() == id {
 			// Cancel any scheduled expiration timer
 			if sched, ok := any(e).(Schedulable); ok {
 				sched.CancelScheduledExpiration()
 			}
-			s.previous = s.withEffects(s.current)
-			s.hasPrevi = true
+			s.markChanged()
 			s.effects = append(s.effects[:i], s.effects[i+1:]...)
 			return true
 		}
@@ -184,6 +994,194 @@ func (s *State[T, A]) RemoveEffect(id string) bool {
 	return false
 }
 
+// Fork returns an independent copy of the state: base state, effects, and
+// configuration. Effects implementing CloneableEffect (all built-in types)
+// are deep-copied; other effects are shared between both states.
+// The fork starts with no pending changes, so its clients need a full sync,
+// and no expiration timers are scheduled on its effects.
+func (s *State[T, A]) Fork() *State[T, A] {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	f := &State[T, A]{
+		current:     s.clone(s.current),
+		version:     s.version,
+		cloner:      s.cloner,
+		codec:       s.codec,
+		arrayCfg:    s.arrayCfg,
+		registry:    s.registry,
+		cloneWarn:   s.cloneWarn,
+		onSlowClone: s.onSlowClone,
+		policy:      s.policy,
+		limits:      s.limits,
+		onLimit:     s.onLimit,
+		refs:        s.refs,
+		noPrevCache: s.noPrevCache,
+		cfg:         s.cfg.copy(),
+		onPanic:     s.onPanic,
+
+		updateBudget: s.updateBudget,
+		onSlowUpdate: s.onSlowUpdate,
+
+		onFlap: s.onFlap,
+	}
+	if s.flaps != nil {
+		f.flaps = newFlapDetector(s.flaps.limit, s.flaps.window)
+	}
+	f.effects = cloneEffects(s.effects)
+	if len(s.effectMeta) > 0 {
+		f.effectMeta = make(map[string]EffectMeta, len(s.effectMeta))
+		for id, meta := range s.effectMeta {
+			f.effectMeta[id] = meta
+		}
+	}
+	f.undo = f.undo.resized(f.cfg.UndoDepth)
+	if f.history = f.history.resized(f.cfg.HistorySize); f.history != nil {
+		f.history.record(f.version, f.withEffects(f.current))
+	}
+	return f
+}
+
+// cloneEffects deep-copies effects that support it
+func cloneEffects[T, A any](effects []Effect[T, A]) []Effect[T, A] {
+	if len(effects) == 0 {
+		return nil
+	}
+	out := make([]Effect[T, A], len(effects))
+	for i, e := range effects {
+		if c, ok := e.(CloneableEffect[T, A]); ok {
+			out[i] = c.CloneEffect()
+		} else {
+			out[i] = e
+		}
+	}
+	return out
+}
+
+// EffectBatch collects effect changes applied atomically by State.WithEffects
+type EffectBatch[T, A any] struct {
+	effects []Effect[T, A]
+	removed []Effect[T, A]
+	changed bool
+	err     error
+}
+
+// Add adds an effect with an activator.
+// Fails the batch if an effect with the same ID already exists.
+func (b *EffectBatch[T, A]) Add(e Effect[T, A], activator A) error {
+	if b.err != nil {
+		return b.err
+	}
+	for _, existing := range b.effects {
+		if existing.ID() == e.ID() {
+			b.err = fmt.Errorf("statediff: effect with ID %q already exists", e.ID())
+			return b.err
+		}
+	}
+	e.SetActivator(activator)
+	b.effects = append(b.effects, e)
+	b.changed = true
+	return nil
+}
+
+// Remove removes an effect by ID. Returns false if no such effect exists.
+func (b *EffectBatch[T, A]) Remove(id string) bool {
+	if b.err != nil {
+		return false
+	}
+	for i, e := range b.effects {
+		if e.ID() == id {
+			b.removed = append(b.removed, e)
+			b.effects = append(b.effects[:i], b.effects[i+1:]...)
+			b.changed = true
+			return true
+		}
+	}
+	return false
+}
+
+// Replace adds an effect, replacing any existing effect with the same ID
+// in place (keeping its position in the application order).
+func (b *EffectBatch[T, A]) Replace(e Effect[T, A], activator A) {
+	if b.err != nil {
+		return
+	}
+	e.SetActivator(activator)
+	for i, existing := range b.effects {
+		if existing.ID() == e.ID() {
+			b.removed = append(b.removed, existing)
+			b.effects[i] = e
+			b.changed = true
+			return
+		}
+	}
+	b.effects = append(b.effects, e)
+	b.changed = true
+}
+
+// Has reports whether the batch currently contains an effect with the ID
+func (b *EffectBatch[T, A]) Has(id string) bool {
+	for _, e := range b.effects {
+		if e.ID() == id {
+			return true
+		}
+	}
+	return false
+}
+
+// WithEffects adds, removes, and replaces several effects as one change:
+// a single previous snapshot is taken, so the next diff covers all of them
+// together (e.g. equipping an item that grants three effects).
+//
+// The batch is atomic: if any Add fails, none of the changes are applied and
+// the error is returned. fn runs while the state is locked and must not call
+// other State methods.
+//
+//	err := state.WithEffects(func(eb *statediff.EffectBatch[Game, string]) {
+//	    eb.Add(strength, player)
+//	    eb.Add(speed, player)
+//	    eb.Remove("unarmed")
+//	})
+func (s *State[T, A]) WithEffects(fn func(eb *EffectBatch[T, A])) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.waitCycle()
+
+	b := &EffectBatch[T, A]{effects: append([]Effect[T, A]{}, s.effects...)}
+	fn(b)
+	if b.err != nil {
+		return b.err
+	}
+	if !b.changed {
+		return nil
+	}
+
+	// Keep a pending previous: it already reflects what clients last saw
+	if !s.hasPrevi {
+		s.previous = s.withEffects(s.current)
+		s.prevVersion = s.version
+		s.hasPrevi = true
+	}
+	s.gen++
+	s.version++
+
+	for _, e := range b.removed {
+		if containsEffect(b.effects, e) {
+			continue
+		}
+		if sched, ok := any(e).(Schedulable); ok {
+			sched.CancelScheduledExpiration()
+		}
+	}
+	for _, e := range b.effects {
+		if !containsEffect(s.effects, e) {
+			delete(s.effectMeta, e.ID())
+		}
+	}
+	s.effects = b.effects
+	return nil
+}
+
 // HasEffect checks if an effect is active
 func (s *State[T, A]) HasEffect(id string) bool {
 	s.mu.RLock()
@@ -201,6 +1199,7 @@ func (s *State[T, A]) HasEffect(id string) bool {
 func (s *State[T, A]) ClearEffects() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.waitCycle()
 	if len(s.effects) > 0 {
 		// Cancel all scheduled expiration timers
 		for _, e := range s.effects {
@@ -208,59 +1207,506 @@ func (s *State[T, A]) ClearEffects() {
 				sched.CancelScheduledExpiration()
 			}
 		}
-		s.previous = s.withEffects(s.current)
-		s.hasPrevi = true
+		s.markChanged()
 		s.effects = nil
 	}
 }
 
+// Checkpoint is a saved point in a State's history, created by State.Checkpoint
+// and consumed by State.RollbackTo.
+type Checkpoint[T, A any] struct {
+	owner       *State[T, A]
+	current     T
+	previous    T
+	hasPrevi    bool
+	prevVersion uint64
+	commits     uint64 // State.commits when taken
+	effects     []Effect[T, A]
+}
+
+// Checkpoint captures the base state, the active effect list, and the pending
+// change tracking so that a later RollbackTo can undo everything done since.
+//
+// Intended for command handlers that perform several mutations and need to
+// abort cleanly when a later step fails validation:
+//
+//	cp := state.Checkpoint()
+//	state.Update(func(g *Game) { g.Gold -= cost })
+//	if err := state.AddEffect(buff, player); err != nil {
+//	    state.RollbackTo(cp)
+//	    return err
+//	}
+//
+// Effects are captured by reference: internal effect state (e.g. StackEffect
+// values, TimedEffect times) is not restored.
+func (s *State[T, A]) Checkpoint() *Checkpoint[T, A] {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cp := &Checkpoint[T, A]{
+		owner:       s,
+		current:     s.clone(s.current),
+		hasPrevi:    s.hasPrevi,
+		prevVersion: s.prevVersion,
+		commits:     s.commits,
+		effects:     append([]Effect[T, A]{}, s.effects...),
+	}
+	if s.hasPrevi {
+		cp.previous = s.clone(s.previous)
+	}
+	return cp
+}
+
+// RollbackTo restores the state to a checkpoint taken with Checkpoint.
+// Effects added after the checkpoint are dropped (their expiration timers are
+// cancelled); effects removed after the checkpoint are restored without
+// rescheduling their timers. The checkpoint can be reused for further rollbacks.
+// If a change cycle was committed since the checkpoint (e.g. by a Session
+// tick), clients already have the later state and the rollback is sent to
+// them as a change.
+// Returns an error if the checkpoint belongs to a different State.
+func (s *State[T, A]) RollbackTo(cp *Checkpoint[T, A]) error {
+	if cp == nil || cp.owner != s {
+		return fmt.Errorf("statediff: checkpoint does not belong to this state")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.waitCycle()
+
+	// Cancel timers of effects that were added after the checkpoint
+	for _, e := range s.effects {
+		if !containsEffect(cp.effects, e) {
+			if sched, ok := any(e).(Schedulable); ok {
+				sched.CancelScheduledExpiration()
+			}
+		}
+	}
+
+	switch {
+	case s.commits != cp.commits:
+		// Clients received changes made since the checkpoint: the rollback
+		// is a change to send them, diffed from what they have
+		if !s.hasPrevi {
+			s.previous, s.prevVersion = s.withEffects(s.current), s.version
+			s.hasPrevi = true
+		}
+	case cp.hasPrevi:
+		s.previous, s.prevVersion = s.clone(cp.previous), cp.prevVersion
+		s.hasPrevi = true
+	default:
+		s.hasPrevi = false
+	}
+	s.current = s.clone(cp.current)
+	s.effects = append([]Effect[T, A]{}, cp.effects...)
+	s.gen++
+	s.version++
+	s.undo.reset() // Recorded patches no longer match the base state
+	return nil
+}
+
+// containsEffect reports whether list holds e (by identity)
+func containsEffect[T, A any](list []Effect[T, A], e Effect[T, A]) bool {
+	for _, x := range list {
+		if x == e {
+			return true
+		}
+	}
+	return false
+}
+
 // Diff calculates diff between previous and current state for a viewer.
 // If no previous state exists, returns nil (caller should send full state).
 func (s *State[T, A]) Diff(project func(T) T) (Patch, error) {
+	patch, err := s.diff(project)
+	s.reportLimit(err)
+	if err == nil {
+		err = s.checkRefs(patch)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return patch, nil
+}
+
+// diff implements Diff without reporting limit violations
+func (s *State[T, A]) diff(project func(T) T) (patch Patch, err error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
+	defer s.recoverCrash("diff")
+	if s.onPanic != nil {
+		defer func() {
+			if err == nil && patch != nil {
+				s.lastPatch.Store(&patch)
+			}
+		}()
+	}
 
-	if !s.hasPrevi {
+	previous, current, ok, keyframe := s.pending()
+	if !ok {
 		return nil, nil
 	}
 
-	current := s.withEffects(s.current)
-
-	oldProj := s.previous
+	oldProj := previous
 	newProj := current
 	if project != nil {
-		oldProj = project(s.previous)
+		oldProj = project(previous)
 		newProj = project(current)
 	}
 
-	return calcDiff(oldProj, newProj, s.arrayCfg)
+	if s.limits.enabled() {
+		if err := s.limits.check(current, s.arrayCfg.opts); err != nil {
+			return nil, err
+		}
+	}
+	if keyframe {
+		return s.keyframePatch(newProj)
+	}
+	if project == nil && !s.noPrevCache && !s.arrayCfg.opts.includeOld() {
+		gen, _, _ := s.pendingFlags()
+		oldDoc, err := s.previousDocument(gen, previous)
+		if err != nil {
+			return nil, err
+		}
+		return diffDocument(oldDoc, current, s.arrayCfg)
+	}
+	oldDoc, err := s.baseDocument(oldProj, s.held)
+	if err != nil {
+		return nil, err
+	}
+	return diffDocument(oldDoc, newProj, s.arrayCfg)
+}
+
+// DiffConfig returns the state's diff configuration for DiffValues,
+// including the options that are not array specific
+func (s *State[T, A]) DiffConfig() ArrayConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.arrayCfg
+}
+
+// docCache is a document built for a state generation
+type docCache struct {
+	gen uint64
+	doc any
+}
+
+// previousDocument returns the document of prev, the unprojected previous
+// state of generation gen. Since previous only changes with the generation,
+// the document is built once and shared by the diffs until then; diffs do
+// not modify it. Caller must hold mu (read or write).
+func (s *State[T, A]) previousDocument(gen uint64, prev T) (any, error) {
+	if c := s.prevDoc.Load(); c != nil && c.gen == gen {
+		return c.doc, nil
+	}
+	doc, err := s.baseDocument(prev, s.held)
+	if err != nil {
+		return nil, err
+	}
+	s.prevDoc.Store(&docCache{gen: gen, doc: doc})
+	return doc, nil
+}
+
+// baseDocument returns the document a view of the previous state is diffed
+// from: with FloatEpsilon, numbers held back are the values clients have.
+func (s *State[T, A]) baseDocument(prev T, held []heldNumber) (any, error) {
+	doc, err := toDocument(prev, s.arrayCfg)
+	if err != nil || len(held) == 0 {
+		return doc, err
+	}
+	return restoreHeld(doc, held), nil
+}
+
+// settle records the numbers FloatEpsilon held back in a committed change,
+// so later diffs compare them with what clients have instead of creeping
+// past the epsilon unsent. Values an op of the patch covers were sent as
+// they are. Caller must hold mu.
+func (s *State[T, A]) settle(prev, cur T) {
+	if s.arrayCfg.opts == nil || s.arrayCfg.opts.epsilon == 0 {
+		return
+	}
+	oldDoc, err := s.baseDocument(prev, s.held)
+	if err != nil {
+		s.held = nil
+		return
+	}
+	newDoc, err := toDocument(cur, s.arrayCfg)
+	if err != nil {
+		s.held = nil
+		return
+	}
+	cfg := s.arrayCfg
+	cfg.held = &heldLog{}
+	patch := diffDocuments(oldDoc, newDoc, cfg)
+	s.held = s.held[:0:0]
+	for _, h := range cfg.held.nums {
+		if !patchCovers(patch, h.path) {
+			s.held = append(s.held, h)
+		}
+	}
 }
 
 // FullState returns the complete state for a viewer (for initial sync)
 func (s *State[T, A]) FullState(project func(T) T) T {
+	state, _ := s.fullState(project)
+	return state
+}
+
+// fullState is FullState with the version of the state it returns
+func (s *State[T, A]) fullState(project func(T) T) (T, uint64) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	current := s.withEffects(s.current)
+	current, version := s.withEffects(s.current), s.version
+	if s.cyc != nil {
+		// Match the diffs of the running tick
+		current, version = s.clone(s.cyc.cur), s.cyc.version
+	}
+	if project != nil {
+		return project(current), version
+	}
+	return current, version
+}
+
+// views returns the previous and current (with effects) state as seen through
+// project, for callers that diff several variants of the same views.
+// ok is false if there is no previous state.
+func (s *State[T, A]) views(project func(T) T) (prev, cur T, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	prev, cur, ok, _ = s.pending()
+	if !ok {
+		return prev, cur, false
+	}
 	if project != nil {
-		return project(current)
+		prev, cur = project(prev), project(cur)
+	}
+	return prev, cur, true
+}
+
+// diffViews diffs two views with the state's diff configuration
+func (s *State[T, A]) diffViews(old, new T) (Patch, error) {
+	s.mu.RLock()
+	_, _, keyframe := s.pendingFlags()
+	held := s.held
+	s.mu.RUnlock()
+	var patch Patch
+	var err error
+	if keyframe {
+		patch, err = s.keyframePatch(new)
+	} else {
+		var oldDoc any
+		if oldDoc, err = s.baseDocument(old, held); err == nil {
+			patch, err = diffDocument(oldDoc, new, s.arrayCfg)
+		}
+	}
+	if err == nil {
+		err = s.checkRefs(patch)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return patch, nil
+}
+
+// pending returns the change to broadcast: the snapshot of the running tick,
+// or the live previous and current state. Caller must hold mu.
+func (s *State[T, A]) pending() (prev, cur T, ok, keyframe bool) {
+	if c := s.cyc; c != nil {
+		if !c.has {
+			return prev, cur, false, false
+		}
+		return c.prev, s.clone(c.cur), true, c.keyframe
+	}
+	if !s.hasPrevi {
+		return prev, cur, false, false
+	}
+	return s.previous, s.withEffects(s.current), true, s.keyframe
+}
+
+// pendingFlags is pending without materializing the views. Caller must hold mu.
+func (s *State[T, A]) pendingFlags() (gen uint64, ok, keyframe bool) {
+	if c := s.cyc; c != nil {
+		return c.gen, c.has, c.keyframe
+	}
+	return s.gen, s.hasPrevi, s.keyframe
+}
+
+// keyframePatch replaces the whole document with v
+func (s *State[T, A]) keyframePatch(v T) (Patch, error) {
+	var doc any = v
+	if s.arrayCfg.opts.needsTransform() {
+		d, err := toDocument(v, s.arrayCfg)
+		if err != nil {
+			return nil, err
+		}
+		doc = d
+	}
+	return s.arrayCfg.opts.explicitNulls(Patch{{Op: "replace", Path: "", Value: doc}}), nil
+}
+
+// beginCycle snapshots the pending change for a tick. Until endCycle, diffs
+// and full states are computed from the snapshot, and writers follow the
+// ConflictPolicy. Returns nil if another cycle is already open.
+func (s *State[T, A]) beginCycle() *cycle[T] {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cyc != nil {
+		return nil
+	}
+	if s.cycleDone == nil {
+		s.cycleDone = sync.NewCond(&s.mu)
+	}
+	c := &s.cycBuf
+	*c = cycle[T]{gen: s.gen, from: s.prevVersion, version: s.version, has: s.hasPrevi, keyframe: s.keyframe}
+	if s.hasPrevi {
+		// Without a pending change there is nothing to snapshot: the first
+		// late writer saves the state clients have as previous itself
+		c.prev, c.cur = s.previous, s.withEffects(s.current)
 	}
-	return current
+	s.cyc = c
+	return c
+}
+
+// endCycle commits a tick: the snapshot becomes the state clients have seen.
+// Changes made since beginCycle stay pending according to the ConflictPolicy.
+// A nil cycle falls back to ClearPrevious.
+func (s *State[T, A]) endCycle(c *cycle[T]) {
+	if c == nil {
+		s.ClearPrevious()
+		return
+	}
+
+	s.mu.Lock()
+	var events []ElementEvent
+	var flaps flapNotice
+	var notice *changeNotice[T]
+	listeners := s.elementListeners
+	if c.has {
+		var patch Patch
+		events, patch = s.committedDiff(c.prev, c.cur)
+		flaps = s.observeFlaps(patch)
+		s.history.record(c.version, c.cur)
+		notice = s.committed(c.prev, c.cur, patch)
+		s.settle(c.prev, c.cur)
+	}
+
+	s.cyc = nil
+	s.cycleDone.Broadcast()
+	if s.gen == c.gen {
+		s.hasPrevi = false
+		s.keyframe = false
+	} else {
+		// Late change: diff it against what the clients just received
+		if c.has {
+			s.previous, s.prevVersion = c.cur, c.version
+		}
+		s.hasPrevi = true
+		s.keyframe = s.policy == ConflictKeyframe
+	}
+	s.gen++
+	s.commits++
+	*c = cycle[T]{} // Drop references to the snapshot
+	s.mu.Unlock()
+
+	flaps.deliver()
+	notice.deliver()
+
+	for _, ev := range events {
+		for _, fn := range listeners {
+			fn(ev)
+		}
+	}
+}
+
+// waitCycle blocks while a tick is open under ConflictQueue, or the state is
+// frozen. Caller must hold mu (write); it is released while waiting.
+func (s *State[T, A]) waitCycle() {
+	for (s.cyc != nil && s.policy == ConflictQueue) || s.frozen {
+		s.cycleDone.Wait()
+	}
+}
+
+// cloneValue deep-copies a value with the state's cloner
+func (s *State[T, A]) cloneValue(v T) T {
+	return s.clone(v)
+}
+
+// fullDocument returns the full state for a viewer in its wire form, and
+// its version.
+// When no document transforms are configured this is the typed value itself.
+func (s *State[T, A]) fullDocument(project func(T) T) (any, uint64, error) {
+	state, version := s.fullState(project)
+	if !s.arrayCfg.opts.needsTransform() {
+		return state, version, nil
+	}
+	doc, err := toDocument(state, s.arrayCfg)
+	return doc, version, err
 }
 
 // ClearPrevious clears the previous state.
 // Call after broadcasting to all clients.
 func (s *State[T, A]) ClearPrevious() {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	var events []ElementEvent
+	var flaps flapNotice
+	var notice *changeNotice[T]
+	listeners := s.elementListeners
+	if s.hasPrevi && (len(listeners) > 0 || s.flaps != nil || s.history != nil || len(s.watchers) > 0 || len(s.changeListeners) > 0) {
+		cur := s.withEffects(s.current)
+		var patch Patch
+		events, patch = s.committedDiff(s.previous, cur)
+		flaps = s.observeFlaps(patch)
+		s.history.record(s.version, cur)
+		notice = s.committed(s.previous, cur, patch)
+	}
+	if s.hasPrevi {
+		s.settle(s.previous, s.withEffects(s.current))
+	}
 	s.hasPrevi = false
+	s.keyframe = false
+	s.gen++
+	s.commits++
+	s.mu.Unlock()
+
+	flaps.deliver()
+	notice.deliver()
+
+	for _, ev := range events {
+		for _, fn := range listeners {
+			fn(ev)
+		}
+	}
+}
+
+// generation returns the current change-cycle token
+func (s *State[T, A]) generation() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	gen, _, _ := s.pendingFlags()
+	return gen
+}
+
+// cacheGeneration returns the generation for caching full-state payloads.
+// ok is false while effects with a time window are active, since those can
+// change the state as time passes without a new generation.
+func (s *State[T, A]) cacheGeneration() (gen uint64, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, e := range s.effects {
+		if _, timed := any(e).(windowed); timed {
+			return 0, false
+		}
+	}
+	gen, _, _ = s.pendingFlags()
+	return gen, true
 }
 
 // HasChanges returns true if there are changes to broadcast
 func (s *State[T, A]) HasChanges() bool {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.hasPrevi
+	_, ok, _ := s.pendingFlags()
+	return ok
 }
 
 // GetEffect returns an effect by ID, or nil if not found
@@ -285,6 +1731,43 @@ func (s *State[T, A]) Effects() []Effect[T, A] {
 	return append([]Effect[T, A]{}, s.effects...)
 }
 
+// EffectStep describes the result of applying a single effect, as reported by
+// ExplainEffects.
+type EffectStep[T any] struct {
+	EffectID string // ID of the applied effect
+	State    T      // State after this effect was applied
+	Patch    Patch  // Changes made by this effect alone
+}
+
+// ExplainEffects applies the active effects to sample one at a time, in order,
+// and reports the intermediate state and the diff produced by each effect.
+// Useful for debugging stacked effects (e.g. why multipliers compound to an
+// unexpected number) without instrumenting every effect function.
+// Pass GetBase() as sample to explain the current state; Query effects
+// select their params from sample, as from the base state.
+func (s *State[T, A]) ExplainEffects(sample T) ([]EffectStep[T], error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	steps := make([]EffectStep[T], 0, len(s.effects))
+	prev := s.clone(sample)
+	for _, e := range s.effects {
+		var next T
+		if q, ok := e.(baseQuery[T, A]); ok {
+			next = q.applyFromBase(sample, s.clone(prev), e.Activator())
+		} else {
+			next = e.Apply(s.clone(prev), e.Activator())
+		}
+		patch, err := calcDiff(prev, next, s.arrayCfg)
+		if err != nil {
+			return nil, fmt.Errorf("statediff: explain effect %q: %w", e.ID(), err)
+		}
+		steps = append(steps, EffectStep[T]{EffectID: e.ID(), State: next, Patch: patch})
+		prev = next
+	}
+	return steps, nil
+}
+
 // Expirable interface for effects that can expire
 type Expirable interface {
 	Expired() bool
@@ -295,6 +1778,7 @@ type Expirable interface {
 func (s *State[T, A]) CleanupExpired() int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.waitCycle()
 
 	if len(s.effects) == 0 {
 		return 0
@@ -319,10 +1803,8 @@ func (s *State[T, A]) CleanupExpired() int {
 		// Apply ALL effects (including expired ones) to get the "before" state.
 		// This is needed because expired effects are still "visible" to clients
 		// until CleanupExpired runs and broadcasts the removal.
-		s.previous = s.clone(s.current)
-		for _, e := range s.effects {
-			s.previous = e.Apply(s.previous, e.Activator())
-		}
+		s.previous = s.withEffects(s.current)
+		s.prevVersion = s.version
 		s.hasPrevi = true
 	}
 
@@ -341,6 +1823,8 @@ func (s *State[T, A]) CleanupExpired() int {
 		active = append(active, e)
 	}
 	s.effects = active
+	s.gen++
+	s.version++
 
 	return removed
 }
@@ -1,10 +1,22 @@
 package statediff
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"os"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -25,6 +37,7 @@ type Item struct {
 type Activator = *string
 
 func strPtr(s string) *string { return &s }
+func intPtr(n int) *int       { return &n }
 
 func TestStateBasic(t *testing.T) {
 	s := MustNew[TestState, Activator](TestState{Value: 1, Name: "test"}, nil)
@@ -2369,14 +2382,24 @@ func TestTransactionWithEffects(t *testing.T) {
 		})
 	})
 
-	if len(diffs) != 1 {
-		t.Errorf("Expected 1 diff, got %d", len(diffs))
+	// The effect was never broadcast, so the pending change runs from the
+	// initial 100 (no effect) to 100 (50*2): clients holding the initial
+	// state need nothing (see State.Update)
+	if len(diffs) != 0 {
+		t.Errorf("Expected no diff, got %s", diffs["user1"])
 	}
 
 	// Final state with effect
 	if s.Get().Value != 100 {
 		t.Errorf("Final value with effect = %d, want 100 (50*2)", s.Get().Value)
 	}
+
+	diffs = sess.Transaction(func(tx *Tx[TestState, Activator]) {
+		tx.Update(func(ts *TestState) { ts.Value = 60 })
+	})
+	if len(diffs) != 1 || !strings.Contains(string(diffs["user1"]), "120") {
+		t.Errorf("Expected the effected value 120, got %s", diffs["user1"])
+	}
 }
 
 // ===== Scheduled Expiration Tests =====
@@ -3042,3 +3065,5867 @@ func TestSetDebounceToZero(t *testing.T) {
 		t.Errorf("Expected immediate broadcast when debounce is 0, got %d calls", callCount)
 	}
 }
+
+// ===== Tick Serialization Tests =====
+
+func TestTrySingleTick(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 1}, nil)
+	sess := NewSession[TestState, Activator, string](s)
+	sess.Connect("user1", nil)
+
+	s.Update(func(ts *TestState) { ts.Value = 2 })
+
+	diffs, ok := sess.TrySingleTick()
+	if !ok {
+		t.Fatal("TrySingleTick should run when no tick is in progress")
+	}
+	if _, ok := diffs["user1"]; !ok {
+		t.Error("Expected user1 to receive diff")
+	}
+	if s.HasChanges() {
+		t.Error("Tick should clear pending changes")
+	}
+}
+
+func TestTrySingleTickWhileTicking(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 1}, nil)
+	sess := NewSession[TestState, Activator, string](s)
+	sess.Connect("user1", nil)
+
+	s.Update(func(ts *TestState) { ts.Value = 2 })
+
+	// Simulate a tick in progress on another goroutine
+	sess.tickMu.Lock()
+	diffs, ok := sess.TrySingleTick()
+	sess.tickMu.Unlock()
+
+	if ok || diffs != nil {
+		t.Error("TrySingleTick should skip while another tick is running")
+	}
+	if !s.HasChanges() {
+		t.Error("Skipped tick must not clear pending changes")
+	}
+
+	// The pending change is still delivered by the next tick
+	if diffs := sess.Tick(); len(diffs) != 1 {
+		t.Errorf("Expected pending change to be broadcast, got %d diffs", len(diffs))
+	}
+}
+
+func TestConcurrentTicksDeliverEachChangeOnce(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 0}, nil)
+	sess := NewSession[TestState, Activator, string](s)
+	sess.Connect("user1", nil)
+
+	s.Update(func(ts *TestState) { ts.Value = 1 })
+
+	var mu sync.Mutex
+	delivered := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if diffs := sess.Tick(); len(diffs) > 0 {
+				mu.Lock()
+				delivered++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if delivered != 1 {
+		t.Errorf("Change should be delivered exactly once, got %d", delivered)
+	}
+}
+
+// ===== Checkpoint Tests =====
+
+func TestCheckpointRollback(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 1, Name: "start"}, nil)
+
+	cp := s.Checkpoint()
+
+	s.Update(func(ts *TestState) {
+		ts.Value = 2
+		ts.Name = "changed"
+	})
+	s.AddEffect(Func[TestState, Activator]("double", func(ts TestState, a Activator) TestState {
+		ts.Value *= 2
+		return ts
+	}), nil)
+
+	if err := s.RollbackTo(cp); err != nil {
+		t.Fatalf("RollbackTo: %v", err)
+	}
+
+	if got := s.Get(); got.Value != 1 || got.Name != "start" {
+		t.Errorf("After rollback got %+v, want Value=1 Name=start", got)
+	}
+	if s.HasEffect("double") {
+		t.Error("Effect added after checkpoint should be dropped")
+	}
+	if s.HasChanges() {
+		t.Error("Rollback to a clean checkpoint should leave no pending changes")
+	}
+}
+
+func TestCheckpointPreservesPendingChanges(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 1}, nil)
+
+	s.Update(func(ts *TestState) { ts.Value = 2 })
+	cp := s.Checkpoint()
+
+	s.Update(func(ts *TestState) { ts.Value = 3 })
+	s.RollbackTo(cp)
+
+	// The change made before the checkpoint must still be broadcast
+	diff, err := s.Diff(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := diff.JSON()
+	if !strings.Contains(string(data), `"value":2`) {
+		t.Errorf("Expected pending diff to value 2, got %s", data)
+	}
+}
+
+func TestCheckpointRestoresRemovedEffects(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 10}, nil)
+	s.AddEffect(Func[TestState, Activator]("plus", func(ts TestState, a Activator) TestState {
+		ts.Value++
+		return ts
+	}), nil)
+	s.ClearPrevious()
+
+	cp := s.Checkpoint()
+	s.ClearEffects()
+	s.RollbackTo(cp)
+
+	if got := s.Get().Value; got != 11 {
+		t.Errorf("Effect should be restored, got %d want 11", got)
+	}
+}
+
+func TestRollbackForeignCheckpoint(t *testing.T) {
+	a := MustNew[TestState, Activator](TestState{}, nil)
+	b := MustNew[TestState, Activator](TestState{}, nil)
+
+	if err := b.RollbackTo(a.Checkpoint()); err == nil {
+		t.Error("Expected error for checkpoint from another state")
+	}
+	if err := b.RollbackTo(nil); err == nil {
+		t.Error("Expected error for nil checkpoint")
+	}
+}
+
+func TestRollbackAfterTick(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 1}, nil)
+	session := NewSession[TestState, Activator, string](s)
+	session.Connect("c", nil)
+	client, _ := json.Marshal(TestState{Value: 1})
+
+	cp := s.Checkpoint()
+	s.Update(func(ts *TestState) { ts.Value = 2 })
+	for _, step := range []func(){nil, func() { s.RollbackTo(cp) }} {
+		if step != nil {
+			step()
+		}
+		var patch Patch
+		if err := json.Unmarshal(session.Tick()["c"], &patch); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		if client, err = patch.ApplyToJSON(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got TestState
+	json.Unmarshal(client, &got)
+	if got.Value != 1 || s.Get().Value != 1 {
+		t.Errorf("client has %d, server %d; want both 1", got.Value, s.Get().Value)
+	}
+}
+
+// ===== ExplainEffects Tests =====
+
+func TestExplainEffects(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 10}, nil)
+	s.AddEffect(Func[TestState, Activator]("double", func(ts TestState, a Activator) TestState {
+		ts.Value *= 2
+		return ts
+	}), nil)
+	s.AddEffect(Func[TestState, Activator]("rename", func(ts TestState, a Activator) TestState {
+		ts.Name = "buffed"
+		return ts
+	}), nil)
+	s.AddEffect(Func[TestState, Activator]("noop", func(ts TestState, a Activator) TestState {
+		return ts
+	}), nil)
+
+	steps, err := s.ExplainEffects(s.GetBase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 3 {
+		t.Fatalf("Expected 3 steps, got %d", len(steps))
+	}
+
+	if steps[0].EffectID != "double" || steps[0].State.Value != 20 {
+		t.Errorf("Step 0 = %s %+v, want double with Value=20", steps[0].EffectID, steps[0].State)
+	}
+	if len(steps[0].Patch) != 1 || steps[0].Patch[0].Path != "/value" {
+		t.Errorf("Step 0 patch should only touch /value: %+v", steps[0].Patch)
+	}
+	if steps[1].State.Value != 20 || steps[1].State.Name != "buffed" {
+		t.Errorf("Step 1 should build on step 0: %+v", steps[1].State)
+	}
+	if len(steps[1].Patch) != 1 || steps[1].Patch[0].Path != "/name" {
+		t.Errorf("Step 1 patch should only touch /name: %+v", steps[1].Patch)
+	}
+	if !steps[2].Patch.Empty() {
+		t.Errorf("No-op effect should produce empty patch: %+v", steps[2].Patch)
+	}
+
+	// Base state is untouched
+	if s.GetBase().Value != 10 {
+		t.Error("ExplainEffects must not mutate base state")
+	}
+}
+
+func TestExplainEffectsNoEffects(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 1}, nil)
+	steps, err := s.ExplainEffects(s.GetBase())
+	if err != nil || len(steps) != 0 {
+		t.Errorf("Expected no steps, got %d (err %v)", len(steps), err)
+	}
+}
+
+// ===== PathMapper Tests =====
+
+type CamelState struct {
+	PlayerName string      `json:"playerName"`
+	TurnOrder  []CamelItem `json:"turnOrder"`
+}
+
+type CamelItem struct {
+	ItemID    string `json:"itemID"`
+	HitPoints int    `json:"hitPoints"`
+}
+
+func TestSnakeCase(t *testing.T) {
+	tests := map[string]string{
+		"playerName": "player_name",
+		"PlayerName": "player_name",
+		"userID":     "user_id",
+		"HTTPServer": "http_server",
+		"already_ok": "already_ok",
+		"x":          "x",
+		"":           "",
+	}
+	for in, want := range tests {
+		if got := SnakeCase(in); got != want {
+			t.Errorf("SnakeCase(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestPathMapperDiff(t *testing.T) {
+	s := MustNew[CamelState, Activator](CamelState{
+		PlayerName: "alice",
+		TurnOrder:  []CamelItem{{ItemID: "a", HitPoints: 10}},
+	}, &Config[CamelState]{
+		ArrayStrategy: ArrayByKey,
+		ArrayKeyField: "itemID",
+		PathMapper:    SnakeCase,
+	})
+
+	s.Update(func(cs *CamelState) {
+		cs.PlayerName = "bob"
+		cs.TurnOrder[0].HitPoints = 5
+	})
+
+	diff, err := s.Diff(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := map[string]bool{}
+	for _, op := range diff {
+		paths[op.Path] = true
+	}
+	if !paths["/player_name"] || !paths["/turn_order/0/hit_points"] {
+		t.Errorf("Expected snake_case paths with keyed element diff, got %+v", diff)
+	}
+}
+
+func TestPathMapperFull(t *testing.T) {
+	s := MustNew[CamelState, Activator](CamelState{
+		PlayerName: "alice",
+		TurnOrder:  []CamelItem{{ItemID: "a", HitPoints: 10}},
+	}, &Config[CamelState]{PathMapper: SnakeCase})
+	sess := NewSession[CamelState, Activator, string](s)
+	sess.Connect("user1", nil)
+
+	data, err := sess.Full("user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	str := string(data)
+	if !strings.Contains(str, `"player_name":"alice"`) || !strings.Contains(str, `"hit_points":10`) {
+		t.Errorf("Full should use mapped names: %s", str)
+	}
+	if strings.Contains(str, "playerName") {
+		t.Errorf("Full should not contain original names: %s", str)
+	}
+}
+
+// ===== Projection Group Tests =====
+
+func hideSecret(ts TestState) TestState {
+	ts.Secret = ""
+	return ts
+}
+
+func TestConnectGroupBroadcast(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 1, Secret: "a"}, nil)
+	sess := NewSession[TestState, Activator, string](s)
+	sess.ConnectGroup("p1", "players", hideSecret)
+	sess.ConnectGroup("p2", "players", hideSecret)
+	sess.Connect("admin", nil)
+
+	// Change invisible to the players group
+	s.Update(func(ts *TestState) { ts.Secret = "b" })
+
+	if sess.HasChangesFor("players") {
+		t.Error("Secret change should not be visible to players group")
+	}
+	diffs := sess.Tick()
+	if _, ok := diffs["p1"]; ok {
+		t.Error("Players group should be skipped")
+	}
+	if _, ok := diffs["admin"]; !ok {
+		t.Error("Admin should receive secret change")
+	}
+
+	// Change visible to everyone
+	s.Update(func(ts *TestState) { ts.Value = 2 })
+	if !sess.HasChangesFor("players") {
+		t.Error("Value change should be visible to players group")
+	}
+	diffs = sess.Tick()
+	if len(diffs) != 3 {
+		t.Fatalf("Expected 3 diffs, got %d", len(diffs))
+	}
+	if string(diffs["p1"]) != string(diffs["p2"]) {
+		t.Error("Group members should receive identical diffs")
+	}
+}
+
+func TestConnectGroupDiffComputedOnce(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 1}, nil)
+	sess := NewSession[TestState, Activator, string](s)
+
+	calls := 0
+	project := func(ts TestState) TestState {
+		calls++
+		return ts
+	}
+	for i := 0; i < 10; i++ {
+		sess.ConnectGroup(fmt.Sprintf("c%d", i), "all", project)
+	}
+
+	s.Update(func(ts *TestState) { ts.Value = 2 })
+	sess.HasChangesFor("all")
+	diffs := sess.Tick()
+
+	if len(diffs) != 10 {
+		t.Errorf("Expected 10 diffs, got %d", len(diffs))
+	}
+	// One diff projects previous and current once
+	if calls != 2 {
+		t.Errorf("Projection should run once per side for the group, ran %d times", calls)
+	}
+}
+
+func TestConnectGroupDisconnect(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 1}, nil)
+	sess := NewSession[TestState, Activator, string](s)
+	sess.ConnectGroup("p1", "players", nil)
+	sess.Disconnect("p1")
+
+	if sess.IsConnected("p1") {
+		t.Error("p1 should be disconnected")
+	}
+	s.Update(func(ts *TestState) { ts.Value = 2 })
+	if sess.HasChangesFor("players") {
+		t.Error("Empty group should be removed")
+	}
+
+	// Reconnecting without a group leaves no stale membership
+	sess.ConnectGroup("p2", "players", nil)
+	sess.Connect("p2", hideSecret)
+	if _, ok := sess.groups["players"]; ok {
+		t.Error("Group should be removed when its last member switches to Connect")
+	}
+}
+
+// ===== Hub Tests =====
+
+type ChatState struct {
+	Messages []string `json:"messages"`
+}
+
+func TestHubTick(t *testing.T) {
+	chat := MustNew[ChatState, Activator](ChatState{}, nil)
+	match := MustNew[TestState, Activator](TestState{Value: 1}, nil)
+	chatSess := NewSession[ChatState, Activator, string](chat)
+	matchSess := NewSession[TestState, Activator, string](match)
+
+	hub := NewHub[string]()
+	if err := hub.Register("global", chatSess); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.Register("match:1", matchSess); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.Register("global", chatSess); err == nil {
+		t.Error("Expected error for duplicate channel")
+	}
+
+	chatSess.Connect("alice", nil)
+	chatSess.Connect("bob", nil)
+	matchSess.Connect("alice", nil)
+
+	chat.Update(func(c *ChatState) { c.Messages = append(c.Messages, "hi") })
+	match.Update(func(ts *TestState) { ts.Value = 2 })
+
+	out := hub.Tick()
+
+	var alice []Envelope
+	if err := json.Unmarshal(out["alice"], &alice); err != nil {
+		t.Fatal(err)
+	}
+	if len(alice) != 2 || alice[0].Channel != "global" || alice[1].Channel != "match:1" {
+		t.Errorf("Alice should get both channels in name order: %s", out["alice"])
+	}
+
+	var bob []Envelope
+	json.Unmarshal(out["bob"], &bob)
+	if len(bob) != 1 || bob[0].Channel != "global" {
+		t.Errorf("Bob should only get global channel: %s", out["bob"])
+	}
+
+	if got := hub.ChannelsOf("alice"); len(got) != 2 {
+		t.Errorf("ChannelsOf(alice) = %v", got)
+	}
+}
+
+func TestHubFullAndDisconnect(t *testing.T) {
+	chat := MustNew[ChatState, Activator](ChatState{Messages: []string{"welcome"}}, nil)
+	chatSess := NewSession[ChatState, Activator, string](chat)
+	matchSess := NewSession[TestState, Activator, string](MustNew[TestState, Activator](TestState{}, nil))
+
+	hub := NewHub[string]()
+	hub.Register("global", chatSess)
+	hub.Register("match", matchSess)
+	chatSess.Connect("alice", nil)
+
+	data, err := hub.Full("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envs []Envelope
+	json.Unmarshal(data, &envs)
+	if len(envs) != 1 || !strings.Contains(string(envs[0].Data), "welcome") {
+		t.Errorf("Full should contain only global channel: %s", data)
+	}
+
+	hub.Disconnect("alice")
+	if chatSess.IsConnected("alice") {
+		t.Error("Disconnect should remove client from all channels")
+	}
+
+	if !hub.Unregister("match") || hub.Unregister("match") {
+		t.Error("Unregister should succeed once")
+	}
+	if hub.Channel("match") != nil || len(hub.Channels()) != 1 {
+		t.Error("Unregistered channel should be gone")
+	}
+}
+
+func TestHubBinaryPayloads(t *testing.T) {
+	state := MustNew[TestState, Activator](TestState{Value: 1}, nil)
+	sess := NewSession[TestState, Activator, string](state)
+	hub := NewHub[string]()
+	hub.Register("match", sess)
+	sess.Connect("alice", nil, WithEncoder[TestState](Gzip(JSONPatchEncoder)))
+
+	unzip := func(out []byte) string {
+		t.Helper()
+		var envs []Envelope
+		if err := json.Unmarshal(out, &envs); err != nil || len(envs) != 1 {
+			t.Fatalf("Envelopes %s: %v", out, err)
+		}
+		var raw []byte // Base64 string
+		if err := json.Unmarshal(envs[0].Data, &raw); err != nil {
+			t.Fatalf("Data %s: %v", envs[0].Data, err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(plain)
+	}
+
+	state.Update(func(ts *TestState) { ts.Value = 2 })
+	out := hub.Tick()
+	if _, ok := out["alice"]; !ok {
+		t.Fatal("Gzip client's tick was dropped")
+	}
+	if got := unzip(out["alice"]); !strings.Contains(got, `"value":2`) {
+		t.Errorf("Tick payload = %s", got)
+	}
+
+	full, err := hub.Full("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := unzip(full); !strings.Contains(got, `"value":2`) {
+		t.Errorf("Full payload = %s", got)
+	}
+}
+
+// ===== Client Limit Tests =====
+
+func TestTryConnectMaxClients(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{}, nil)
+	sess := NewSession[TestState, Activator, string](s)
+	sess.SetMaxClients(2)
+
+	if err := sess.TryConnect("a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.TryConnect("b", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.TryConnect("c", nil); err != ErrSessionFull {
+		t.Errorf("Expected ErrSessionFull, got %v", err)
+	}
+	// Reconnect of an existing client is allowed
+	if err := sess.TryConnect("a", hideSecret); err != nil {
+		t.Errorf("Reconnect should succeed: %v", err)
+	}
+
+	sess.Disconnect("b")
+	if err := sess.TryConnect("c", nil); err != nil {
+		t.Errorf("Slot should be free after disconnect: %v", err)
+	}
+
+	sess.SetMaxClients(0)
+	if err := sess.TryConnect("d", nil); err != nil {
+		t.Errorf("No limit after SetMaxClients(0): %v", err)
+	}
+}
+
+// ===== Outbox Tests =====
+
+// outboxClient applies every queued payload of a client to its JSON document
+func outboxClient(t *testing.T, out *Outbox[string], id string, doc []byte) []byte {
+	t.Helper()
+	for {
+		data, ok := out.Next(id)
+		if !ok {
+			return doc
+		}
+		var p Patch
+		if err := json.Unmarshal(data, &p); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		if doc, err = p.ApplyToJSON(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOutboxCoalesce(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{}, nil)
+	sess := NewSession[TestState, Activator, string](s)
+	sess.Connect("slow", nil)
+	full, _ := sess.Full("slow")
+	out := NewOutbox[string](sess, 3, BackpressureCoalesce)
+	out.Push(map[string][]byte{"slow": full}) // Initial sync through the queue
+
+	for i := 1; i <= 10; i++ {
+		s.Update(func(ts *TestState) {
+			ts.Value = i
+			ts.Items = append(ts.Items, Item{ID: fmt.Sprint(i), Data: i})
+		})
+		if dropped := out.Tick(); len(dropped) != 0 {
+			t.Fatalf("tick %d dropped %v", i, dropped)
+		}
+		if n := out.Len("slow"); n > 3 {
+			t.Fatalf("tick %d: %d payloads queued, limit 3", i, n)
+		}
+	}
+	var got TestState
+	json.Unmarshal(outboxClient(t, out, "slow", []byte("null")), &got)
+	if want := s.Get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("client = %+v, want %+v", got, want)
+	}
+}
+
+func TestOutboxKeyframe(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{}, nil)
+	sess := NewSession[TestState, Activator, string](s)
+	sess.Connect("slow", nil)
+	sess.Connect("fast", nil, WithEncoder[TestState](Gzip(JSONPatchEncoder)))
+	out := NewOutbox[string](sess, 2, BackpressureCoalesce)
+
+	for i := 1; i <= 5; i++ {
+		s.Update(func(ts *TestState) { ts.Value = i })
+		out.Tick()
+		out.Next("fast")
+	}
+	// Gzip payloads cannot be merged: the overflowing queue is replaced by a keyframe
+	if n := out.Len("fast"); n != 0 {
+		t.Errorf("fast client has %d queued", n)
+	}
+	if n := out.Len("slow"); n != 1 {
+		t.Fatalf("slow client has %d queued, want 1", n)
+	}
+
+	kf := NewOutbox[string](sess, 1, BackpressureKeyframe)
+	s.Update(func(ts *TestState) { ts.Value = 6 })
+	kf.Tick()
+	s.Update(func(ts *TestState) { ts.Value = 7 })
+	kf.Tick()
+	data, _ := kf.Next("slow")
+	if want, _ := sess.Full("slow"); !bytes.Equal(data, want) {
+		t.Errorf("keyframe = %s, want %s", data, want)
+	}
+}
+
+func TestOutboxDisconnect(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{}, nil)
+	sess := NewSession[TestState, Activator, string](s)
+	sess.Connect("slow", nil)
+	sess.Connect("fast", nil)
+	out := NewOutbox[string](sess, 2, BackpressureDisconnect)
+
+	var dropped []string
+	for i := 1; i <= 3; i++ {
+		s.Update(func(ts *TestState) { ts.Value = i })
+		dropped = append(dropped, out.Tick()...)
+		out.Next("fast")
+	}
+	if len(dropped) != 1 || dropped[0] != "slow" {
+		t.Fatalf("dropped = %v, want [slow]", dropped)
+	}
+	if sess.IsConnected("slow") || out.Len("slow") != 0 {
+		t.Error("slow client should be disconnected with an empty queue")
+	}
+	if !sess.IsConnected("fast") {
+		t.Error("fast client should stay connected")
+	}
+
+	// No limit
+	unbounded := NewOutbox[string](sess, 0, BackpressureDisconnect)
+	for i := 0; i < 5; i++ {
+		unbounded.Push(map[string][]byte{"fast": []byte(`[]`)})
+	}
+	if n := unbounded.Len("fast"); n != 5 {
+		t.Errorf("unbounded queue = %d, want 5", n)
+	}
+	unbounded.Remove("fast")
+	if _, ok := unbounded.Next("fast"); ok {
+		t.Error("Next after Remove should be empty")
+	}
+}
+
+// ===== Float Precision Tests =====
+
+type PosState struct {
+	Players []PosPlayer `json:"players"`
+	Speed   float64     `json:"speed"`
+}
+
+type PosPlayer struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+func TestFloatPrecisionDiff(t *testing.T) {
+	s := MustNew[PosState, Activator](PosState{
+		Players: []PosPlayer{{X: 1.0, Y: 2.0}},
+		Speed:   0.123456,
+	}, &Config[PosState]{
+		ArrayStrategy:  ArrayByIndex,
+		FloatPrecision: map[string]int{"/players/*": 2},
+	})
+
+	// Jitter below precision produces no ops
+	s.Update(func(ps *PosState) { ps.Players[0].X = 1.001 })
+	diff, _ := s.Diff(nil)
+	if !diff.Empty() {
+		t.Errorf("Sub-precision change should not produce ops: %+v", diff)
+	}
+	s.ClearPrevious()
+
+	// Larger change is emitted rounded
+	s.Update(func(ps *PosState) {
+		ps.Players[0].Y = 2.34567
+		ps.Speed = 0.654321
+	})
+	diff, _ = s.Diff(nil)
+	data, _ := diff.JSON()
+	if !strings.Contains(string(data), `"value":2.35`) {
+		t.Errorf("Expected rounded value 2.35: %s", data)
+	}
+	// Paths without a rule are untouched
+	if !strings.Contains(string(data), `"value":0.654321`) {
+		t.Errorf("Speed should keep full precision: %s", data)
+	}
+
+	// Authoritative state is not rounded
+	if got := s.Get().Players[0].Y; got != 2.34567 {
+		t.Errorf("State should keep full precision, got %v", got)
+	}
+}
+
+func TestFloatPrecisionFull(t *testing.T) {
+	s := MustNew[PosState, Activator](PosState{Speed: 1.23456}, &Config[PosState]{
+		FloatPrecision: map[string]int{"/speed": 1},
+	})
+	sess := NewSession[PosState, Activator, string](s)
+	sess.Connect("a", nil)
+
+	data, _ := sess.Full("a")
+	if !strings.Contains(string(data), `"speed":1.2`) || strings.Contains(string(data), "1.23456") {
+		t.Errorf("Full should be rounded: %s", data)
+	}
+}
+
+func TestFloatPrecisionMostSpecificWins(t *testing.T) {
+	rules := newPrecisionRules(map[string]int{"": 0, "/players/*/x": 3})
+	o := &diffOptions{precision: rules}
+	doc := map[string]any{
+		"speed":   1.6,
+		"players": []any{map[string]any{"x": 1.23456, "y": 1.6}},
+	}
+	out := o.transform(doc).(map[string]any)
+	p := out["players"].([]any)[0].(map[string]any)
+	if out["speed"] != 2.0 || p["y"] != 2.0 || p["x"] != 1.235 {
+		t.Errorf("Unexpected rounding: %+v", out)
+	}
+}
+
+// ===== Effect Registry Tests =====
+
+type bonusParams struct {
+	Amount *int `json:"amount"`
+}
+
+func newTestRegistry(t *testing.T) *EffectRegistry[TestState, Activator] {
+	reg := NewEffectRegistry[TestState, Activator]()
+	err := reg.Register("bonus", EffectTemplate[TestState, Activator]{
+		Validate: RequireFields("amount"),
+		Create: func(id string, params json.RawMessage) (Effect[TestState, Activator], error) {
+			var p bonusParams
+			if err := json.Unmarshal(params, &p); err != nil {
+				return nil, err
+			}
+			amount := *p.Amount // Safe: validated above
+			return Func[TestState, Activator](id, func(ts TestState, a Activator) TestState {
+				ts.Value += amount
+				return ts
+			}), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reg
+}
+
+func TestAddEffectByName(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 10}, nil)
+	s.SetEffectRegistry(newTestRegistry(t))
+
+	if err := s.AddEffectByName("bonus", "b1", map[string]any{"amount": 5}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Get().Value; got != 15 {
+		t.Errorf("Get() = %d, want 15", got)
+	}
+
+	metas := s.EffectMetas()
+	if len(metas) != 1 || metas[0].ID != "b1" || metas[0].Type != "bonus" {
+		t.Errorf("EffectMetas = %+v", metas)
+	}
+
+	s.RemoveEffect("b1")
+	if len(s.EffectMetas()) != 0 {
+		t.Error("Removed effect should not be reported")
+	}
+}
+
+func TestAddEffectByNameValidation(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 10}, nil)
+	s.SetEffectRegistry(newTestRegistry(t))
+
+	err := s.AddEffectByName("bonus", "b1", map[string]any{"amnt": 5}, nil)
+	var perr *EffectParamsError
+	if !errors.As(err, &perr) {
+		t.Fatalf("Expected *EffectParamsError, got %v", err)
+	}
+	if len(perr.Errors) != 1 || perr.Errors[0].Field != "amount" {
+		t.Errorf("Unexpected param errors: %+v", perr.Errors)
+	}
+	if s.HasEffect("b1") {
+		t.Error("Invalid effect must not be added")
+	}
+
+	if err := s.AddEffectByName("bonus", "b2", nil, nil); !errors.As(err, &perr) {
+		t.Errorf("Nil params should fail validation, got %v", err)
+	}
+	if err := s.AddEffectByName("missing", "m", nil, nil); err == nil {
+		t.Error("Expected error for unknown type")
+	}
+}
+
+func TestAddEffectByNameNoRegistry(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{}, nil)
+	if err := s.AddEffectByName("bonus", "b", nil, nil); err == nil {
+		t.Error("Expected error without registry")
+	}
+}
+
+func TestEffectRegistryRegister(t *testing.T) {
+	reg := newTestRegistry(t)
+	if err := reg.Register("bonus", EffectTemplate[TestState, Activator]{
+		Create: func(string, json.RawMessage) (Effect[TestState, Activator], error) { return nil, nil },
+	}); err == nil {
+		t.Error("Expected error for duplicate type")
+	}
+	if err := reg.Register("empty", EffectTemplate[TestState, Activator]{}); err == nil {
+		t.Error("Expected error for missing Create")
+	}
+	if types := reg.Types(); len(types) != 1 || types[0] != "bonus" {
+		t.Errorf("Types() = %v", types)
+	}
+}
+
+func TestEffectRegistryRestore(t *testing.T) {
+	reg := newTestRegistry(t)
+	s := MustNew[TestState, Activator](TestState{Value: 1}, nil)
+	s.SetEffectRegistry(reg)
+	s.AddEffectByName("bonus", "b1", map[string]any{"amount": 2}, nil)
+
+	path := t.TempDir() + "/state.json"
+	if err := Save(path, s, s.EffectMetas(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Restore[TestState, Activator](path, nil, reg.Factory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.EffectErrors) != 0 {
+		t.Fatalf("Effect errors: %v", result.EffectErrors)
+	}
+	if got := result.State.Get().Value; got != 3 {
+		t.Errorf("Restored Get() = %d, want 3", got)
+	}
+}
+
+// ===== Effect Batch Tests =====
+
+func addEffect(n int) func(TestState, Activator) TestState {
+	return func(ts TestState, a Activator) TestState {
+		ts.Value += n
+		return ts
+	}
+}
+
+func TestWithEffectsSingleDiff(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 0}, nil)
+	s.AddEffect(Func[TestState, Activator]("old", addEffect(1)), nil)
+	s.ClearPrevious()
+
+	err := s.WithEffects(func(eb *EffectBatch[TestState, Activator]) {
+		eb.Add(Func[TestState, Activator]("a", addEffect(10)), nil)
+		eb.Add(Func[TestState, Activator]("b", addEffect(100)), nil)
+		eb.Remove("old")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := s.Get().Value; got != 110 {
+		t.Errorf("Get() = %d, want 110", got)
+	}
+
+	// One diff covering all changes: 1 -> 110
+	diff, _ := s.Diff(nil)
+	if len(diff) != 1 || diff[0].Value != float64(110) {
+		t.Errorf("Expected single replace to 110, got %+v", diff)
+	}
+}
+
+func TestWithEffectsAtomic(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 0}, nil)
+	s.AddEffect(Func[TestState, Activator]("a", addEffect(1)), nil)
+	s.ClearPrevious()
+
+	err := s.WithEffects(func(eb *EffectBatch[TestState, Activator]) {
+		eb.Add(Func[TestState, Activator]("b", addEffect(10)), nil)
+		eb.Add(Func[TestState, Activator]("a", addEffect(100)), nil) // Duplicate
+	})
+	if err == nil {
+		t.Fatal("Expected duplicate ID error")
+	}
+	if s.HasEffect("b") || s.HasChanges() {
+		t.Error("Failed batch must not apply any change")
+	}
+}
+
+func TestWithEffectsReplace(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 0}, nil)
+	s.AddEffect(Func[TestState, Activator]("a", addEffect(1)), nil)
+	s.AddEffect(Func[TestState, Activator]("b", func(ts TestState, a Activator) TestState {
+		ts.Value *= 2
+		return ts
+	}), nil)
+
+	s.WithEffects(func(eb *EffectBatch[TestState, Activator]) {
+		eb.Replace(Func[TestState, Activator]("a", addEffect(5)), nil)
+		if !eb.Has("a") || eb.Has("zzz") {
+			t.Error("Has() mismatch inside batch")
+		}
+	})
+
+	// Replacement keeps position: (0+5)*2
+	if got := s.Get().Value; got != 10 {
+		t.Errorf("Get() = %d, want 10", got)
+	}
+	if len(s.Effects()) != 2 {
+		t.Errorf("Expected 2 effects, got %d", len(s.Effects()))
+	}
+}
+
+func TestWithEffectsKeepsPendingUpdate(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 1, Name: "a"}, nil)
+	s.Update(func(ts *TestState) { ts.Name = "b" })
+	s.WithEffects(func(eb *EffectBatch[TestState, Activator]) {
+		eb.Add(Func[TestState, Activator]("x", addEffect(1)), nil)
+	})
+
+	diff, _ := s.Diff(nil)
+	if len(diff) != 2 {
+		t.Errorf("Diff should include both the update and the effect: %+v", diff)
+	}
+}
+
+func TestWithEffectsNoChange(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{}, nil)
+	s.WithEffects(func(eb *EffectBatch[TestState, Activator]) {
+		eb.Remove("missing")
+	})
+	if s.HasChanges() {
+		t.Error("Empty batch should not create a change")
+	}
+}
+
+// ===== Per-Path Array Key Tests =====
+
+type KeyedState struct {
+	Players []KeyedPlayer `json:"players"`
+	Zones   []KeyedZone   `json:"zones"`
+}
+
+type KeyedPlayer struct {
+	ID    string      `json:"id"`
+	Score int         `json:"score"`
+	Cards []KeyedCard `json:"cards"`
+}
+
+type KeyedCard struct {
+	UID  string `json:"uid"`
+	Name string `json:"name"`
+}
+
+type KeyedZone struct {
+	Name  string `json:"name"`
+	Owner string `json:"owner"`
+}
+
+func TestArrayKeyFieldsPerPath(t *testing.T) {
+	s := MustNew[KeyedState, Activator](KeyedState{
+		Players: []KeyedPlayer{
+			{ID: "a", Cards: []KeyedCard{{UID: "c1", Name: "x"}, {UID: "c2", Name: "y"}}},
+			{ID: "b"},
+		},
+		Zones: []KeyedZone{{Name: "north"}, {Name: "south"}},
+	}, &Config[KeyedState]{
+		ArrayStrategy: ArrayByKey,
+		ArrayKeyFields: map[string]string{
+			"/players":         "id",
+			"/players/*/cards": "uid",
+			"/zones":           "name",
+		},
+	})
+
+	s.Update(func(ks *KeyedState) {
+		ks.Players[0].Cards = ks.Players[0].Cards[1:] // remove c1
+		ks.Players[1].Score = 5
+		ks.Zones[1].Owner = "a"
+	})
+
+	diff, err := s.Diff(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/players/0/cards/0": "remove",
+		"/players/1/score":   "replace",
+		"/zones/1/owner":     "replace",
+	}
+	if len(diff) != len(want) {
+		t.Fatalf("Expected %d ops, got %+v", len(want), diff)
+	}
+	for _, op := range diff {
+		if want[op.Path] != op.Op {
+			t.Errorf("Unexpected op %s %s", op.Op, op.Path)
+		}
+	}
+}
+
+func TestArrayKeyFieldsFallback(t *testing.T) {
+	cfg := ArrayConfig{Strategy: ArrayByKey, KeyField: "id", KeyFields: map[string]string{"/zones": "name"}}
+	if got := cfg.keyField("/players"); got != "id" {
+		t.Errorf("Unmatched path should use KeyField, got %q", got)
+	}
+	if got := cfg.keyField("/zones"); got != "name" {
+		t.Errorf("Matched path should use override, got %q", got)
+	}
+
+	cfg = ArrayConfig{Strategy: ArrayByKey, KeyFields: map[string]string{"/*/items": "a", "/shop/items": "b"}}
+	if got := cfg.keyField("/shop/items"); got != "b" {
+		t.Errorf("Literal pattern should beat wildcard, got %q", got)
+	}
+	if got := cfg.keyField("/other"); got != "" {
+		t.Errorf("No key field expected, got %q", got)
+	}
+}
+
+func TestArrayKeyFieldsTie(t *testing.T) {
+	keys := map[string]string{"/*/items": "a", "/shop/*": "b", "/*/*": "c"}
+	for i := 0; i < 20; i++ {
+		cfg := ArrayConfig{Strategy: ArrayByKey, KeyFields: keys, keyRules: newKeyRules(keys)}
+		// Equally specific: the earlier literal segment wins, every time
+		if got := cfg.keyField("/shop/items"); got != "b" {
+			t.Fatalf("Tie resolved to %q, want b", got)
+		}
+		if got := (ArrayConfig{KeyFields: keys}).keyField("/shop/items"); got != "b" {
+			t.Fatalf("Unbuilt rules resolved tie to %q, want b", got)
+		}
+	}
+}
+
+func TestArrayKeyFieldsValidation(t *testing.T) {
+	_, err := New[KeyedState, Activator](KeyedState{}, &Config[KeyedState]{
+		ArrayStrategy:  ArrayByKey,
+		ArrayKeyFields: map[string]string{"/players": "id"},
+	})
+	if err != nil {
+		t.Errorf("ArrayKeyFields alone should be valid: %v", err)
+	}
+}
+
+// ===== Effect Versioning Tests =====
+
+// v0 params: {"bonus": N}; v1 params: {"amount": N}
+func newVersionedRegistry(t *testing.T) *EffectRegistry[TestState, Activator] {
+	reg := NewEffectRegistry[TestState, Activator]()
+	err := reg.Register("bonus", EffectTemplate[TestState, Activator]{
+		Version:  1,
+		Validate: RequireFields("amount"),
+		Migrate: func(from int, params json.RawMessage) (json.RawMessage, error) {
+			var old struct {
+				Bonus int `json:"bonus"`
+			}
+			if err := json.Unmarshal(params, &old); err != nil {
+				return nil, err
+			}
+			return json.Marshal(map[string]int{"amount": old.Bonus})
+		},
+		Create: func(id string, params json.RawMessage) (Effect[TestState, Activator], error) {
+			p, err := ParseParams[bonusParams](EffectMeta{Params: params})
+			if err != nil {
+				return nil, err
+			}
+			return Func[TestState, Activator](id, addEffect(*p.Amount)), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reg
+}
+
+func TestEffectMetaMigrationOnRestore(t *testing.T) {
+	reg := newVersionedRegistry(t)
+
+	// Snapshot written by an older deployment (unversioned params)
+	old, _ := MakeEffectMeta("b1", "bonus", map[string]int{"bonus": 7})
+	s := MustNew[TestState, Activator](TestState{Value: 1}, nil)
+	path := t.TempDir() + "/state.json"
+	if err := Save(path, s, []EffectMeta{old}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Restore[TestState, Activator](path, nil, reg.Factory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.EffectErrors) != 0 {
+		t.Fatalf("Effect errors: %v", result.EffectErrors)
+	}
+	if got := result.State.Get().Value; got != 8 {
+		t.Errorf("Migrated effect Get() = %d, want 8", got)
+	}
+
+	migrated, err := reg.Migrate(old)
+	if err != nil || migrated.Version != 1 || !strings.Contains(string(migrated.Params), "amount") {
+		t.Errorf("Migrate() = %+v, %v", migrated, err)
+	}
+}
+
+func TestEffectMetaSurvivesRestore(t *testing.T) {
+	reg := newVersionedRegistry(t)
+	old, _ := MakeEffectMeta("b1", "bonus", map[string]int{"bonus": 7})
+	s := MustNew[TestState, Activator](TestState{Value: 1}, nil)
+	path := t.TempDir() + "/state.json"
+	if err := Save(path, s, []EffectMeta{old}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Save -> Restore -> Save -> Restore keeps the effect
+	for round := 1; round <= 2; round++ {
+		result, err := Restore[TestState, Activator](path, nil, reg.Factory())
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored := result.State
+		if restored.Get().Value != 8 {
+			t.Fatalf("Round %d: Get() = %d, want 8", round, restored.Get().Value)
+		}
+		metas := restored.EffectMetas()
+		if len(metas) != 1 || metas[0].ID != "b1" {
+			t.Fatalf("Round %d: EffectMetas() = %+v", round, metas)
+		}
+		if err := Save(path, restored, metas, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Metadata is upgraded once the registry is known
+	result, _ := Restore[TestState, Activator](path, nil, reg.Factory())
+	result.State.SetEffectRegistry(reg)
+	if metas := result.State.EffectMetas(); len(metas) != 1 || metas[0].Version != 1 ||
+		!strings.Contains(string(metas[0].Params), "amount") {
+		t.Errorf("Meta should be migrated: %+v", metas)
+	}
+}
+
+func TestEffectMetaVersionStamped(t *testing.T) {
+	reg := newVersionedRegistry(t)
+	s := MustNew[TestState, Activator](TestState{}, nil)
+	s.SetEffectRegistry(reg)
+	if err := s.AddEffectByName("bonus", "b1", map[string]int{"amount": 1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if metas := s.EffectMetas(); len(metas) != 1 || metas[0].Version != 1 {
+		t.Errorf("Meta should carry template version: %+v", metas)
+	}
+}
+
+func TestEffectMetaVersionErrors(t *testing.T) {
+	reg := newVersionedRegistry(t)
+
+	future := EffectMeta{ID: "b", Type: "bonus", Version: 2, Params: json.RawMessage(`{"amount":1}`)}
+	if _, err := reg.Create(future); err == nil {
+		t.Error("Expected error for version newer than template")
+	}
+
+	noMigrate := NewEffectRegistry[TestState, Activator]()
+	noMigrate.Register("x", EffectTemplate[TestState, Activator]{
+		Version: 2,
+		Create: func(id string, _ json.RawMessage) (Effect[TestState, Activator], error) {
+			return Func[TestState, Activator](id, addEffect(0)), nil
+		},
+	})
+	if _, err := noMigrate.Create(EffectMeta{ID: "x", Type: "x"}); err == nil {
+		t.Error("Expected error for old version without Migrate")
+	}
+	if _, err := noMigrate.Migrate(EffectMeta{Type: "unknown"}); err == nil {
+		t.Error("Expected error for unknown type")
+	}
+}
+
+// ===== Config Builder Tests =====
+
+func TestConfigBuilder(t *testing.T) {
+	b := Configure[KeyedState]().
+		ArraysByKey("id").
+		KeyFieldFor("/players/*/cards", "uid").
+		FloatPrecision("/pos", 2).
+		PathMapper(SnakeCase)
+	cfg, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ArrayStrategy != ArrayByKey || cfg.ArrayKeyField != "id" ||
+		cfg.ArrayKeyFields["/players/*/cards"] != "uid" || cfg.FloatPrecision["/pos"] != 2 || cfg.PathMapper == nil {
+		t.Errorf("Unexpected config: %+v", cfg)
+	}
+
+	// Further builder calls don't leak into built configs
+	b.KeyFieldFor("/zones", "name")
+	if _, ok := cfg.ArrayKeyFields["/zones"]; ok {
+		t.Error("Built config should not share maps with the builder")
+	}
+	b.Ignore("/a", "/b")
+	ignored := b.MustBuild()
+	ignored.IgnorePaths[0] = "/changed"
+	if again := b.MustBuild(); again.IgnorePaths[0] != "/a" {
+		t.Error("Built config should not share IgnorePaths with the builder")
+	}
+
+	if _, err := New[KeyedState, Activator](KeyedState{}, cfg); err != nil {
+		t.Errorf("Built config should be accepted by New: %v", err)
+	}
+}
+
+func TestConfigBuilderPreset(t *testing.T) {
+	cfg := Configure[TestState]().
+		Preset(RealtimeGame).
+		WithCloner(func(ts TestState) TestState { return ts }).
+		MustBuild()
+	if cfg.ArrayStrategy != ArrayByIndex || cfg.FloatPrecision[""] != 3 || cfg.Cloner == nil {
+		t.Errorf("RealtimeGame preset not applied: %+v", cfg)
+	}
+
+	// Later calls override preset values
+	cfg = Configure[TestState]().Preset(TurnBasedGame).ArraysByKey("uid").MustBuild()
+	if cfg.ArrayKeyField != "uid" {
+		t.Errorf("Override failed: %+v", cfg)
+	}
+
+	for _, p := range []Preset{TurnBasedGame, RealtimeGame, CollaborativeDoc} {
+		if _, err := Configure[TestState]().Preset(p).Build(); err != nil {
+			t.Errorf("Preset %s should build: %v", p.Name, err)
+		}
+	}
+}
+
+func TestConfigBuilderValidation(t *testing.T) {
+	if _, err := Configure[TestState]().ArraysByKey("").Build(); err == nil {
+		t.Error("Expected error for ByKey without key field")
+	}
+	if _, err := Configure[TestState]().FloatPrecision("/x", -1).Build(); err == nil {
+		t.Error("Expected error for negative precision")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("MustBuild should panic on invalid config")
+		}
+	}()
+	Configure[TestState]().ArraysByKey("").MustBuild()
+}
+
+// ===== Fork Tests =====
+
+func TestForkIndependentEffects(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 10}, nil)
+	stack := Stack[TestState, Activator, int]("add", func(ts TestState, vals []int, a Activator) TestState {
+		for _, v := range vals {
+			ts.Value += v
+		}
+		return ts
+	})
+	toggle := Toggle[TestState, Activator]("double", func(ts TestState, a Activator) TestState {
+		ts.Value *= 2
+		return ts
+	})
+	s.AddEffect(stack, strPtr("alice"))
+	s.AddEffect(toggle, nil)
+	stack.Push(1)
+
+	f := s.Fork()
+
+	// Mutate the original's effects and base state
+	stack.Push(100)
+	toggle.Disable()
+	s.Update(func(ts *TestState) { ts.Value = 0 })
+
+	if got := f.Get().Value; got != 22 {
+		t.Errorf("Fork Get() = %d, want 22 ((10+1)*2)", got)
+	}
+	if f.HasChanges() {
+		t.Error("Fork should start without pending changes")
+	}
+
+	fs := f.GetEffect("add").(*StackEffect[TestState, Activator, int])
+	if fs.Count() != 1 || *fs.Activator() != "alice" {
+		t.Error("Forked stack should keep its own values and activator")
+	}
+}
+
+func TestForkSharesNonCloneableEffects(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{}, nil)
+	custom := &customEffect{id: "c"}
+	s.AddEffect(custom, nil)
+
+	f := s.Fork()
+	if f.GetEffect("c") != Effect[TestState, Activator](custom) {
+		t.Error("Non-cloneable effects are shared")
+	}
+}
+
+func TestCloneEffectTimed(t *testing.T) {
+	now := time.Now()
+	e := TimedWindow[TestState, Activator]("t", now, now.Add(time.Hour), addEffect(1))
+	c := e.CloneEffect().(*TimedEffect[TestState, Activator])
+	e.Extend(time.Hour)
+	if !c.ExpiresAt().Equal(now.Add(time.Hour)) || !c.StartsAt().Equal(now) {
+		t.Error("Cloned timed effect should keep its own times")
+	}
+
+	cond := Conditional[TestState, Activator]("c", func(TestState, Activator) bool { return true }, addEffect(1))
+	if cond.CloneEffect().ID() != "c" {
+		t.Error("Cloned conditional effect should keep ID")
+	}
+}
+
+type customEffect struct {
+	id        string
+	activator Activator
+}
+
+func (e *customEffect) ID() string                               { return e.id }
+func (e *customEffect) Apply(s TestState, a Activator) TestState { return s }
+func (e *customEffect) Activator() Activator                     { return e.activator }
+func (e *customEffect) SetActivator(a Activator)                 { e.activator = a }
+
+// ===== Clone Diagnostics Tests =====
+
+func TestCloneWarnThreshold(t *testing.T) {
+	var reports []SlowClone
+	s := MustNew[TestState, Activator](TestState{Value: 1, Name: "x"}, &Config[TestState]{
+		CloneWarnThreshold: time.Nanosecond, // Every JSON clone is "slow"
+		OnSlowClone:        func(r SlowClone) { reports = append(reports, r) },
+	})
+
+	s.Update(func(ts *TestState) { ts.Value = 2 })
+	if len(reports) == 0 {
+		t.Fatal("Expected slow clone reports")
+	}
+	if reports[0].Bytes == 0 || reports[0].Duration <= 0 {
+		t.Errorf("Report should carry size and duration: %+v", reports[0])
+	}
+}
+
+func TestCloneWarnSkippedWithCloner(t *testing.T) {
+	called := false
+	s := MustNew[TestState, Activator](TestState{}, &Config[TestState]{
+		Cloner:             func(ts TestState) TestState { return ts },
+		CloneWarnThreshold: time.Nanosecond,
+		OnSlowClone:        func(SlowClone) { called = true },
+	})
+	s.Update(func(ts *TestState) { ts.Value = 2 })
+	if called {
+		t.Error("Custom cloner should not be measured")
+	}
+}
+
+func TestRequireCloner(t *testing.T) {
+	big := TestState{Name: strings.Repeat("x", LargeStateSize)}
+	if _, err := New[TestState, Activator](big, &Config[TestState]{RequireCloner: true}); err == nil {
+		t.Error("Expected error for large state without cloner")
+	}
+	if _, err := New[TestState, Activator](TestState{}, &Config[TestState]{RequireCloner: true}); err != nil {
+		t.Errorf("Small state should be accepted: %v", err)
+	}
+	if _, err := New[TestState, Activator](big, &Config[TestState]{
+		RequireCloner: true,
+		Cloner:        func(ts TestState) TestState { return ts },
+	}); err != nil {
+		t.Errorf("Large state with cloner should be accepted: %v", err)
+	}
+}
+
+// ===== Client Transform Tests =====
+
+func TestConnectWithTransform(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 1, Name: "alice"}, nil)
+	sess := NewSession[TestState, Activator, string](s)
+	sess.Connect("plain", nil)
+	sess.Connect("scaled", nil, WithTransform(func(ts TestState) TestState {
+		ts.Value *= 100
+		return ts
+	}))
+
+	data, _ := sess.Full("scaled")
+	if !strings.Contains(string(data), `"value":100`) {
+		t.Errorf("Full should apply transform: %s", data)
+	}
+
+	s.Update(func(ts *TestState) { ts.Value = 2 })
+	diffs := sess.Tick()
+	if !strings.Contains(string(diffs["scaled"]), `"value":200`) {
+		t.Errorf("Scaled client diff: %s", diffs["scaled"])
+	}
+	if !strings.Contains(string(diffs["plain"]), `"value":2`) {
+		t.Errorf("Plain client diff: %s", diffs["plain"])
+	}
+
+	// Reconnecting without options removes the transform
+	sess.Connect("scaled", nil)
+	data, _ = sess.Full("scaled")
+	if !strings.Contains(string(data), `"value":2`) {
+		t.Errorf("Transform should be removed: %s", data)
+	}
+}
+
+func TestGroupTransformSharesProjection(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 1, Name: "x", Secret: "s"}, nil)
+	sess := NewSession[TestState, Activator, string](s)
+
+	projections := 0
+	project := func(ts TestState) TestState {
+		projections++
+		ts.Secret = ""
+		return ts
+	}
+	redact := WithTransform(func(ts TestState) TestState {
+		ts.Name = "***"
+		return ts
+	})
+	sess.ConnectGroup("a", "players", project)
+	sess.ConnectGroup("b", "players", project, redact)
+	sess.ConnectGroup("c", "players", project, redact)
+
+	s.Update(func(ts *TestState) {
+		ts.Value = 2
+		ts.Name = "y"
+	})
+	projections = 0
+	diffs := sess.Tick()
+
+	if !strings.Contains(string(diffs["a"]), `"y"`) {
+		t.Errorf("Untransformed member should see name change: %s", diffs["a"])
+	}
+	if strings.Contains(string(diffs["b"]), `"y"`) || !strings.Contains(string(diffs["b"]), `"value":2`) {
+		t.Errorf("Redacted member should only see value change: %s", diffs["b"])
+	}
+	// Group diff projects both sides once, transformed members reuse one more
+	// pair of projected views
+	if projections != 4 {
+		t.Errorf("Expected 4 projection calls, got %d", projections)
+	}
+}
+
+func TestTransformDoesNotMutateSharedState(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Items: []Item{{ID: "a", Data: 1}}}, nil)
+	sess := NewSession[TestState, Activator, string](s)
+	sess.Connect("t", nil, WithTransform(func(ts TestState) TestState {
+		ts.Items[0].Data = 999 // Writes into the slice
+		return ts
+	}))
+	sess.Connect("plain", nil)
+
+	s.Update(func(ts *TestState) { ts.Value = 1 })
+	diffs := sess.Tick()
+	if strings.Contains(string(diffs["plain"]), "999") {
+		t.Errorf("Transform leaked into shared views: %s", diffs["plain"])
+	}
+	if s.Get().Items[0].Data != 1 {
+		t.Error("Transform must not modify state")
+	}
+}
+
+// ===== Client Encoder Tests =====
+
+func TestConnectWithEncoder(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 1}, nil)
+	sess := NewSession[TestState, Activator, string](s)
+
+	encodes := 0
+	upper := Encoder{Name: "upper", Encode: func(p Patch) ([]byte, error) {
+		encodes++
+		data, err := p.JSON()
+		return bytes.ToUpper(data), err
+	}}
+	sess.Connect("plain", nil)
+	sess.Connect("u1", nil, WithEncoder[TestState](upper))
+	sess.Connect("u2", nil, WithEncoder[TestState](upper))
+	sess.Connect("gz", nil, WithEncoder[TestState](Gzip(JSONPatchEncoder)))
+	sess.ConnectGroup("g1", "team", hideSecret, WithEncoder[TestState](upper))
+	sess.ConnectGroup("g2", "team", hideSecret, WithEncoder[TestState](upper))
+
+	s.Update(func(ts *TestState) { ts.Name = "bob" })
+	diffs := sess.Tick()
+
+	if string(diffs["plain"]) != `[{"op":"replace","path":"/name","value":"bob"}]` {
+		t.Errorf("Plain client: %s", diffs["plain"])
+	}
+	for _, id := range []string{"u1", "u2", "g1", "g2"} {
+		if !strings.Contains(string(diffs[id]), `"BOB"`) {
+			t.Errorf("Client %s should use its encoder: %s", id, diffs[id])
+		}
+	}
+	// One encoding for the unprojected view, one for the group
+	if encodes != 2 {
+		t.Errorf("Expected 2 encodings, got %d", encodes)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(diffs["gz"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(zr)
+	if string(data) != string(diffs["plain"]) {
+		t.Errorf("Gzip payload: %s", data)
+	}
+
+	full, _ := sess.Full("u1")
+	if !strings.HasPrefix(string(full), `[{"OP":"REPLACE"`) {
+		t.Errorf("Full should use the encoder: %s", full)
+	}
+}
+
+// ===== Element Event Tests =====
+
+func newKeyedEventState() *State[KeyedState, Activator] {
+	return MustNew[KeyedState, Activator](KeyedState{}, &Config[KeyedState]{
+		ArrayStrategy: ArrayByKey,
+		ArrayKeyFields: map[string]string{
+			"/players":         "id",
+			"/players/*/cards": "uid",
+		},
+	})
+}
+
+func TestElementEvents(t *testing.T) {
+	s := newKeyedEventState()
+	s.Set(KeyedState{Players: []KeyedPlayer{{ID: "a"}, {ID: "b"}, {ID: "c"}}})
+	s.ClearPrevious()
+
+	s.Update(func(ks *KeyedState) {
+		ks.Players = []KeyedPlayer{ks.Players[2], ks.Players[0], {ID: "d"}}
+	})
+	events, err := s.ElementEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ElementEvent{
+		{Kind: ElementRemoved, Path: "/players", Key: "b", From: 1, To: -1},
+		{Kind: ElementAdded, Path: "/players", Key: "d", From: -1, To: 2},
+		{Kind: ElementMoved, Path: "/players", Key: "c", From: 2, To: 0},
+		{Kind: ElementMoved, Path: "/players", Key: "a", From: 0, To: 1},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("Expected %d events, got %+v", len(want), events)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("Event %d: expected %+v, got %+v", i, want[i], events[i])
+		}
+	}
+}
+
+func TestElementEventsNested(t *testing.T) {
+	s := newKeyedEventState()
+	s.Set(KeyedState{Players: []KeyedPlayer{{ID: "a", Cards: []KeyedCard{{UID: "c1"}}}}})
+	s.ClearPrevious()
+
+	s.Update(func(ks *KeyedState) {
+		ks.Players[0].Cards = append(ks.Players[0].Cards, KeyedCard{UID: "c2"})
+	})
+	events, _ := s.ElementEvents()
+	if len(events) != 1 || events[0].Kind != ElementAdded || events[0].Path != "/players/0/cards" || events[0].Key != "c2" {
+		t.Errorf("Expected nested add of c2, got %+v", events)
+	}
+}
+
+func TestOnElementEventFiresOnClearPrevious(t *testing.T) {
+	s := newKeyedEventState()
+	var got []ElementEvent
+	s.OnElementEvent(func(ev ElementEvent) {
+		got = append(got, ev)
+		s.Get() // Listeners run outside the lock
+	})
+
+	s.Update(func(ks *KeyedState) { ks.Players = []KeyedPlayer{{ID: "a"}} })
+	if len(got) != 0 {
+		t.Fatal("Events must not fire before the change is committed")
+	}
+	s.ClearPrevious()
+	if len(got) != 1 || got[0].Kind != ElementAdded || got[0].Key != "a" {
+		t.Errorf("Expected add of a, got %+v", got)
+	}
+
+	s.ClearPrevious()
+	if len(got) != 1 {
+		t.Errorf("No pending change must not fire events, got %+v", got)
+	}
+}
+
+// ===== Conflict Policy Tests =====
+
+// lateWriteTick runs one tick by hand, calling write between snapshot and broadcast
+func lateWriteTick(s *State[TestState, Activator], sess *Session[TestState, Activator, string], write func()) map[string][]byte {
+	c := s.beginCycle()
+	write()
+	result := sess.Broadcast()
+	s.endCycle(c)
+	return result
+}
+
+func newConflictSession(policy ConflictPolicy) (*State[TestState, Activator], *Session[TestState, Activator, string]) {
+	s := MustNew[TestState, Activator](TestState{}, &Config[TestState]{ConflictPolicy: policy})
+	sess := NewSession[TestState, Activator, string](s)
+	sess.Connect("p", nil)
+	sess.Connect("proj", func(ts TestState) TestState { return ts })
+	return s, sess
+}
+
+func TestConflictRebaseKeepsLateChange(t *testing.T) {
+	s, sess := newConflictSession(ConflictRebase)
+	s.Update(func(ts *TestState) { ts.Value = 1 })
+
+	first := lateWriteTick(s, sess, func() {
+		s.Update(func(ts *TestState) { ts.Name = "late" })
+	})
+	for _, id := range []string{"p", "proj"} {
+		if !strings.Contains(string(first[id]), `"value":1`) || strings.Contains(string(first[id]), "late") {
+			t.Errorf("First tick should only carry the snapshot: %s", first[id])
+		}
+	}
+	if !s.HasChanges() {
+		t.Fatal("Late change must stay pending")
+	}
+	second := sess.Tick()
+	if !strings.Contains(string(second["p"]), `"late"`) || strings.Contains(string(second["p"]), "/value") {
+		t.Errorf("Second tick should carry only the late change: %s", second["p"])
+	}
+}
+
+func TestConflictQueueBlocksWriters(t *testing.T) {
+	s, sess := newConflictSession(ConflictQueue)
+	s.Update(func(ts *TestState) { ts.Value = 1 })
+
+	done := make(chan struct{})
+	first := lateWriteTick(s, sess, func() {
+		go func() {
+			s.Update(func(ts *TestState) { ts.Name = "late" })
+			close(done)
+		}()
+		time.Sleep(10 * time.Millisecond)
+		if s.GetBase().Name == "late" {
+			t.Error("Writer should wait for the tick to commit")
+		}
+	})
+	<-done
+	if strings.Contains(string(first["p"]), "late") {
+		t.Errorf("Queued write leaked into the tick: %s", first["p"])
+	}
+	second := sess.Tick()
+	if !strings.Contains(string(second["p"]), `"late"`) {
+		t.Errorf("Queued write should be broadcast next: %s", second["p"])
+	}
+}
+
+func TestConflictKeyframe(t *testing.T) {
+	s, sess := newConflictSession(ConflictKeyframe)
+	s.Update(func(ts *TestState) { ts.Value = 1 })
+
+	lateWriteTick(s, sess, func() {
+		s.Update(func(ts *TestState) { ts.Name = "late" })
+	})
+	second := sess.Tick()
+	var patch Patch
+	if err := json.Unmarshal(second["p"], &patch); err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) != 1 || patch[0].Op != "replace" || patch[0].Path != "" {
+		t.Fatalf("Expected root replace keyframe, got %s", second["p"])
+	}
+	if !strings.Contains(string(second["p"]), `"name":"late"`) || !strings.Contains(string(second["p"]), `"value":1`) {
+		t.Errorf("Keyframe should carry the full state: %s", second["p"])
+	}
+	if string(second["proj"]) != string(second["p"]) {
+		t.Errorf("Projected clients should get the same keyframe: %s", second["proj"])
+	}
+
+	s.Update(func(ts *TestState) { ts.Value = 2 })
+	third := sess.Tick()
+	if strings.Contains(string(third["p"]), `"path":""`) {
+		t.Errorf("Keyframe should be sent once: %s", third["p"])
+	}
+}
+
+func TestConflictPolicyValidation(t *testing.T) {
+	if _, err := New[TestState, Activator](TestState{}, &Config[TestState]{ConflictPolicy: 99}); err == nil {
+		t.Error("Expected error for unknown ConflictPolicy")
+	}
+}
+
+// ===== Batch Effect Tests =====
+
+func TestAddEffects(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 10}, nil)
+	s.SetEffectRegistry(newTestRegistry(t))
+
+	err := s.AddEffects([]EffectSpec[Activator]{
+		{Type: "bonus", ID: "b2", Params: map[string]any{"amount": 5}, Activator: strPtr("p1")},
+		{Type: "bonus", ID: "b1", Params: map[string]any{"amount": 3}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	effects := s.Effects()
+	if len(effects) != 2 || effects[0].ID() != "b2" || effects[1].ID() != "b1" {
+		t.Fatalf("Effects should keep declared order, got %v", effects)
+	}
+	if a := effects[0].Activator(); a == nil || *a != "p1" {
+		t.Error("Activator should be set from the spec")
+	}
+	if got := s.Get().Value; got != 18 {
+		t.Errorf("Get() = %d, want 18", got)
+	}
+	patch, _ := s.Diff(nil)
+	if len(patch) != 1 || patch[0].Value != float64(18) {
+		t.Errorf("Expected one diff against the pre-batch state, got %v", patch)
+	}
+	if len(s.EffectMetas()) != 2 {
+		t.Error("Expected metadata for both effects")
+	}
+}
+
+func TestAddEffectsAllOrNothing(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{}, nil)
+	s.SetEffectRegistry(newTestRegistry(t))
+	s.AddEffectByName("bonus", "existing", map[string]any{"amount": 1}, nil)
+	s.ClearPrevious()
+
+	cases := map[string][]EffectSpec[Activator]{
+		"invalid params": {
+			{Type: "bonus", ID: "a", Params: map[string]any{"amount": 1}},
+			{Type: "bonus", ID: "b", Params: map[string]any{}},
+		},
+		"unknown type": {{Type: "nope", ID: "a"}},
+		"duplicate":    {{Type: "bonus", ID: "a", Params: map[string]any{"amount": 1}}, {Type: "bonus", ID: "a", Params: map[string]any{"amount": 1}}},
+		"existing":     {{Type: "bonus", ID: "a", Params: map[string]any{"amount": 1}}, {Type: "bonus", ID: "existing", Params: map[string]any{"amount": 1}}},
+	}
+	for name, specs := range cases {
+		if err := s.AddEffects(specs); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+		if len(s.Effects()) != 1 || s.HasChanges() {
+			t.Errorf("%s: no effect should be added", name)
+		}
+	}
+}
+
+// ===== Encryption Tests =====
+
+func openAESGCM(t *testing.T, key []byte, ct string) string {
+	t.Helper()
+	data, err := base64.StdEncoding.DecodeString(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCM(block)
+	n := gcm.NonceSize()
+	plain, err := gcm.Open(nil, data[:n], data[n:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(plain)
+}
+
+func TestEncryptPaths(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	var paths []string
+	s := MustNew[TestState, Activator](TestState{Secret: "tok_1"}, &Config[TestState]{
+		EncryptPaths: []string{"/secret"},
+		Encrypt: AESGCM(func(path string) ([]byte, error) {
+			paths = append(paths, path)
+			return key, nil
+		}),
+	})
+	sess := NewSession[TestState, Activator, string](s)
+	sess.Connect("c", nil)
+
+	full, err := sess.Full("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(full), "tok_1") {
+		t.Errorf("Full state leaks plaintext: %s", full)
+	}
+	var fullPatch []Op
+	json.Unmarshal(full, &fullPatch)
+	doc := fullPatch[0].Value.(map[string]any)
+	if got := openAESGCM(t, key, doc["secret"].(string)); got != `"tok_1"` {
+		t.Errorf("Decrypted %s, want \"tok_1\"", got)
+	}
+
+	s.Update(func(ts *TestState) { ts.Value = 1 })
+	if diff := sess.Tick()["c"]; strings.Contains(string(diff), "/secret") {
+		t.Errorf("Unchanged encrypted field must not produce ops: %s", diff)
+	}
+
+	s.Update(func(ts *TestState) { ts.Secret = "tok_2" })
+	var patch []Op
+	json.Unmarshal(sess.Tick()["c"], &patch)
+	if len(patch) != 1 || patch[0].Path != "/secret" {
+		t.Fatalf("Expected one op for /secret, got %v", patch)
+	}
+	if got := openAESGCM(t, key, patch[0].Value.(string)); got != `"tok_2"` {
+		t.Errorf("Decrypted %s, want \"tok_2\"", got)
+	}
+	if s.Get().Secret != "tok_2" {
+		t.Error("State must stay plaintext")
+	}
+	for _, p := range paths {
+		if p != "/secret" {
+			t.Errorf("Key provider called with %q", p)
+		}
+	}
+}
+
+func TestEncryptPathsRequiresEncrypt(t *testing.T) {
+	_, err := New[TestState, Activator](TestState{}, &Config[TestState]{EncryptPaths: []string{"/secret"}})
+	if err == nil {
+		t.Error("Expected error without Encrypt")
+	}
+}
+
+// ===== Sliced Diff Tests =====
+
+func TestDiffSliced(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 1, Name: "a", Secret: "x"}, nil)
+	s.Update(func(ts *TestState) {
+		ts.Value = 2
+		ts.Secret = ""
+		ts.Items = []Item{{ID: "i", Data: 1}}
+	})
+
+	d, err := s.DiffSliced(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := 0
+	for !d.Step(0) { // Zero budget: one subtree per step
+		steps++
+	}
+	steps++
+	if steps != 4 {
+		t.Errorf("Expected 4 steps (name, secret, value, items), got %d", steps)
+	}
+
+	want, _ := s.Diff(nil)
+	gotJSON, _ := d.Patch().JSON()
+	wantJSON, _ := want.JSON()
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("Sliced diff %s differs from Diff %s", gotJSON, wantJSON)
+	}
+
+	// Later changes do not affect a prepared diff
+	d, _ = s.DiffSliced(nil)
+	s.Update(func(ts *TestState) { ts.Name = "b" })
+	d.Step(time.Hour)
+	data, _ := d.Patch().JSON()
+	if !d.Done() || strings.Contains(string(data), `"b"`) {
+		t.Errorf("Sliced diff should use the views captured at creation: %s", data)
+	}
+}
+
+func TestDiffSlicedNoChanges(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{}, nil)
+	if d, err := s.DiffSliced(nil); d != nil || err != nil {
+		t.Errorf("Expected nil without previous state, got %v, %v", d, err)
+	}
+}
+
+// ===== Limit Tests =====
+
+func TestLimitsRollBackUpdate(t *testing.T) {
+	var reported []*LimitError
+	s := MustNew[TestState, Activator](TestState{Value: 1}, &Config[TestState]{
+		Limits:          Limits{MaxArrayLen: 2},
+		OnLimitExceeded: func(e *LimitError) { reported = append(reported, e) },
+	})
+
+	s.Update(func(ts *TestState) {
+		ts.Value = 2
+		ts.Items = []Item{{ID: "a"}, {ID: "b"}, {ID: "c"}}
+	})
+	if got := s.Get(); got.Value != 1 || len(got.Items) != 0 {
+		t.Errorf("Update over the limit should be rolled back, got %+v", got)
+	}
+	if s.HasChanges() {
+		t.Error("Rolled back update must not leave pending changes")
+	}
+	if len(reported) != 1 {
+		t.Fatalf("Expected one report, got %d", len(reported))
+	}
+	want := LimitError{Limit: LimitArrayLen, Path: "/items", Value: 3, Max: 2}
+	if *reported[0] != want {
+		t.Errorf("Reported %+v, want %+v", *reported[0], want)
+	}
+
+	s.Update(func(ts *TestState) { ts.Items = []Item{{ID: "a"}} })
+	if len(s.Get().Items) != 1 || len(reported) != 1 {
+		t.Error("Update within limits should apply")
+	}
+}
+
+func TestLimitsSetAndDepth(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{}, &Config[TestState]{Limits: Limits{MaxDepth: 2, MaxBytes: 1000}})
+	s.Set(TestState{Items: []Item{{ID: "a"}}}) // Root object, items array, item object = depth 3
+	if len(s.Get().Items) != 0 {
+		t.Error("Set over the depth limit should be rejected")
+	}
+
+	s = MustNew[TestState, Activator](TestState{}, &Config[TestState]{Limits: Limits{MaxBytes: 40}})
+	s.Set(TestState{Name: strings.Repeat("x", 50)})
+	if s.Get().Name != "" {
+		t.Error("Set over the size limit should be rejected")
+	}
+}
+
+func TestLimitsDiffWithEffects(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{}, &Config[TestState]{Limits: Limits{MaxBytes: 40}})
+	s.AddEffect(Func[TestState, Activator]("grow", func(ts TestState, a Activator) TestState {
+		ts.Name = strings.Repeat("x", 50)
+		return ts
+	}), nil)
+
+	_, err := s.Diff(nil)
+	var le *LimitError
+	if !errors.As(err, &le) || le.Limit != LimitBytes {
+		t.Errorf("Expected bytes LimitError from Diff, got %v", err)
+	}
+}
+
+// ===== Crash Dump Tests =====
+
+func TestCrashDumpOnUpdatePanic(t *testing.T) {
+	var dumps []CrashDump
+	s := MustNew[TestState, Activator](TestState{Value: 7}, &Config[TestState]{
+		OnPanic: func(d CrashDump) { dumps = append(dumps, d) },
+	})
+	s.AddEffect(Func[TestState, Activator]("plus", addEffect(1)), nil)
+	s.Update(func(ts *TestState) { ts.Value = 8 })
+	if _, err := s.Diff(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("Panic should be re-raised, got %v", r)
+			}
+		}()
+		s.Update(func(ts *TestState) { panic("boom") })
+	}()
+
+	if len(dumps) != 1 {
+		t.Fatalf("Expected one dump, got %d", len(dumps))
+	}
+	d := dumps[0]
+	if d.Op != "update" || d.Panic != "boom" || !strings.Contains(d.Stack, "TestCrashDumpOnUpdatePanic") {
+		t.Errorf("Unexpected dump header: %+v", d)
+	}
+	if !strings.Contains(string(d.Base), `"value":8`) {
+		t.Errorf("Dump should hold the base state: %s", d.Base)
+	}
+	if len(d.Effects) != 1 || len(d.LastPatch) != 1 {
+		t.Errorf("Dump should list effects and the last patch: %+v", d)
+	}
+	if _, err := json.Marshal(d); err != nil {
+		t.Errorf("Dump should be serializable: %v", err)
+	}
+
+	// The state stays usable after the panic
+	s.Update(func(ts *TestState) { ts.Value = 9 })
+	if s.GetBase().Value != 9 {
+		t.Error("State should be unlocked after a recovered panic")
+	}
+}
+
+func TestCrashDumpOnDiffPanic(t *testing.T) {
+	var got *CrashDump
+	s := MustNew[TestState, Activator](TestState{}, &Config[TestState]{
+		OnPanic: func(d CrashDump) { got = &d },
+	})
+	s.Update(func(ts *TestState) { ts.Value = 1 })
+
+	func() {
+		defer func() { recover() }()
+		s.Diff(func(ts TestState) TestState { panic("bad projection") })
+	}()
+	if got == nil || got.Op != "diff" || got.Panic != "bad projection" {
+		t.Errorf("Expected diff crash dump, got %+v", got)
+	}
+}
+
+// ===== Frame Tests =====
+
+func TestTickFrameMatchesTick(t *testing.T) {
+	setup := func() (*State[TestState, Activator], *Session[TestState, Activator, string]) {
+		s := MustNew[TestState, Activator](TestState{}, nil)
+		sess := NewSession[TestState, Activator, string](s)
+		sess.Connect("all", nil)
+		sess.Connect("hidden", hideSecret)
+		sess.ConnectGroup("g1", "team", hideSecret)
+		sess.Connect("t", nil, WithTransform(func(ts TestState) TestState { ts.Name = "x"; return ts }))
+		s.Update(func(ts *TestState) { ts.Value = 1; ts.Secret = "<s>" })
+		return s, sess
+	}
+	_, a := setup()
+	_, b := setup()
+
+	want := a.Tick()
+	f := b.TickFrame()
+	if len(f.Payloads) != len(want) {
+		t.Fatalf("Expected %d payloads, got %d", len(want), len(f.Payloads))
+	}
+	for id, data := range want {
+		if string(f.Payloads[id]) != string(data) {
+			t.Errorf("%s: frame %s, tick %s", id, f.Payloads[id], data)
+		}
+	}
+	f.Release()
+}
+
+func TestTickFrameReusesBuffers(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{}, nil)
+	sess := NewSession[TestState, Activator, string](s)
+	sess.Connect("c", nil)
+
+	s.Update(func(ts *TestState) { ts.Value = 1 })
+	f := sess.TickFrame()
+	if string(f.Payloads["c"]) != `[{"op":"replace","path":"/value","value":1}]` {
+		t.Errorf("Unexpected payload %s", f.Payloads["c"])
+	}
+	f.Release()
+
+	// Idle ticks allocate nothing once the frame is warm
+	allocs := testing.AllocsPerRun(100, func() {
+		sess.TickFrame().Release()
+	})
+	if allocs != 0 {
+		t.Errorf("Idle TickFrame allocated %.1f times per run", allocs)
+	}
+}
+
+// ===== Derived Path Tests =====
+
+type HPState struct {
+	Players []HPPlayer `json:"players"`
+}
+
+type HPPlayer struct {
+	Name      string `json:"name"`
+	HP        int    `json:"hp"`
+	HPPercent int    `json:"hpPercent"`
+}
+
+func TestDerivedPathsSuppressOps(t *testing.T) {
+	s := MustNew[HPState, Activator](HPState{Players: []HPPlayer{
+		{Name: "a", HP: 100, HPPercent: 100},
+		{Name: "b", HP: 50, HPPercent: 50},
+	}}, &Config[HPState]{
+		ArrayStrategy: ArrayByIndex,
+		DerivedPaths:  map[string]string{"/players/*/hpPercent": "/players/*/hp"},
+	})
+
+	s.Update(func(hs *HPState) {
+		hs.Players[0].HP, hs.Players[0].HPPercent = 80, 80 // Derived from a changed source
+		hs.Players[1].HPPercent = 49                       // Source unchanged: keep
+	})
+	patch, err := s.Diff(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, op := range patch {
+		paths = append(paths, op.Path)
+	}
+	want := []string{"/players/0/hp", "/players/1/hpPercent"}
+	if strings.Join(paths, ",") != strings.Join(want, ",") {
+		t.Errorf("Got ops %v, want %v", paths, want)
+	}
+
+	if s.Get().Players[0].HPPercent != 80 {
+		t.Error("State must keep derived values")
+	}
+}
+
+func TestDerivedPathsValidation(t *testing.T) {
+	_, err := New[HPState, Activator](HPState{}, &Config[HPState]{
+		DerivedPaths: map[string]string{"/total": "/players/*/hp"},
+	})
+	if err == nil {
+		t.Error("Expected error for unbound source wildcard")
+	}
+}
+
+// ===== Patch Contract Tests =====
+
+// applySequential applies array ops of a patch to a keyed item list in order,
+// following the contract documented on Patch
+func applySequential(t *testing.T, items []any, patch Patch) []any {
+	t.Helper()
+	for _, op := range patch {
+		if op.Path == "/items" && op.Op == "replace" {
+			return op.Value.([]any)
+		}
+		rest := strings.TrimPrefix(op.Path, "/items/")
+		idxStr, field, _ := strings.Cut(rest, "/")
+		switch {
+		case op.Op == "add" && idxStr == "-":
+			items = append(items, op.Value)
+		case op.Op == "add" && field == "":
+			var i int
+			fmt.Sscan(idxStr, &i)
+			items = append(items[:i], append([]any{op.Value}, items[i:]...)...)
+		case op.Op == "remove" && field == "":
+			var i int
+			fmt.Sscan(idxStr, &i)
+			items = append(items[:i], items[i+1:]...)
+		case op.Op == "replace" && field != "":
+			var i int
+			fmt.Sscan(idxStr, &i)
+			items[i].(map[string]any)[field] = op.Value
+		default:
+			t.Fatalf("Unexpected op %+v", op)
+		}
+	}
+	return items
+}
+
+func TestArrayByKeySequentialApply(t *testing.T) {
+	cases := map[string]struct{ old, new []Item }{
+		"insert in middle": {
+			old: []Item{{ID: "a", Data: 1}, {ID: "b", Data: 2}},
+			new: []Item{{ID: "a", Data: 1}, {ID: "x", Data: 9}, {ID: "b", Data: 3}},
+		},
+		"remove and append": {
+			old: []Item{{ID: "a", Data: 1}, {ID: "b", Data: 2}, {ID: "c", Data: 3}},
+			new: []Item{{ID: "a", Data: 5}, {ID: "c", Data: 3}, {ID: "d", Data: 4}},
+		},
+		"reorder": {
+			old: []Item{{ID: "a", Data: 1}, {ID: "b", Data: 2}},
+			new: []Item{{ID: "b", Data: 7}, {ID: "a", Data: 1}},
+		},
+	}
+	for name, tc := range cases {
+		s := MustNew[TestState, Activator](TestState{Items: tc.old}, &Config[TestState]{
+			ArrayStrategy: ArrayByKey, ArrayKeyField: "id",
+		})
+		s.Set(TestState{Items: tc.new})
+		patch, _ := s.Diff(nil)
+
+		oldDoc, _ := toDocument(TestState{Items: tc.old}, ArrayConfig{})
+		newDoc, _ := toDocument(TestState{Items: tc.new}, ArrayConfig{})
+		got := applySequential(t, oldDoc.(map[string]any)["items"].([]any), patch)
+		want := newDoc.(map[string]any)["items"]
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: applying %v gave %v, want %v", name, patch, got, want)
+		}
+	}
+}
+
+func TestPatchNormalize(t *testing.T) {
+	p := Patch{
+		{Op: "replace", Path: "/a"},
+		{Op: "remove", Path: "/b"},
+		{Op: "add", Path: "/c", Value: 1},
+	}
+	data, _ := p.Normalize().JSON()
+	want := `[{"op":"replace","path":"/a","value":null},{"op":"remove","path":"/b"},{"op":"add","path":"/c","value":1}]`
+	if string(data) != want {
+		t.Errorf("Normalize() = %s, want %s", data, want)
+	}
+	if p[0].Value != nil {
+		t.Error("Normalize must not modify the receiver")
+	}
+}
+
+// ===== Effect Timing Tests =====
+
+func TestRestoreEffectTiming(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := t0
+	clock := func() time.Time { return now }
+
+	reg := NewEffectRegistry[TestState, Activator]()
+	reg.Register("buff", EffectTemplate[TestState, Activator]{
+		Create: func(id string, params json.RawMessage) (Effect[TestState, Activator], error) {
+			e := TimedWindow[TestState, Activator](id, clock(), clock().Add(10*time.Second), addEffect(1))
+			e.TimeFunc = clock
+			return e, nil
+		},
+	})
+	s := MustNew[TestState, Activator](TestState{}, nil)
+	s.SetEffectRegistry(reg)
+	if err := s.AddEffectByName("buff", "b", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	now = t0.Add(7 * time.Second)
+	metas := s.EffectMetas()
+	if metas[0].Timing == nil || metas[0].Timing.Remaining != 3*time.Second {
+		t.Fatalf("Expected 3s remaining in metadata, got %+v", metas[0].Timing)
+	}
+	path := t.TempDir() + "/state.json"
+	if err := Save(path, s, metas, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	now = t0.Add(time.Hour) // Downtime
+	atNow := func(o *restoreOptions) { o.now = clock }
+	cases := []struct {
+		mode       TimerMode
+		wantExpiry time.Time
+	}{
+		{TimersResume, now.Add(3 * time.Second)},
+		{TimersWallClock, t0.Add(10 * time.Second)},
+		{TimersAsCreated, now.Add(10 * time.Second)},
+	}
+	for _, tc := range cases {
+		result, err := Restore(path, nil, reg.Factory(), WithTimerMode(tc.mode), atNow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := result.State.GetEffect("b").(*TimedEffect[TestState, Activator])
+		if !e.ExpiresAt().Equal(tc.wantExpiry) {
+			t.Errorf("Mode %d: expires at %v, want %v", tc.mode, e.ExpiresAt(), tc.wantExpiry)
+		}
+	}
+}
+
+// ===== Patch Apply Tests =====
+
+func TestPatchApplyRoundTrip(t *testing.T) {
+	strategies := map[string]*Config[TestState]{
+		"replace": nil,
+		"index":   {ArrayStrategy: ArrayByIndex},
+		"key":     {ArrayStrategy: ArrayByKey, ArrayKeyField: "id"},
+	}
+	old := TestState{Value: 1, Name: "a", Secret: "s", Items: []Item{{ID: "a", Data: 1}, {ID: "b", Data: 2}, {ID: "c", Data: 3}}}
+	updates := []TestState{
+		{Value: 2, Name: "a", Items: []Item{{ID: "c", Data: 3}, {ID: "x", Data: 9}}},
+		{Value: 1, Name: "b", Secret: "t", Items: []Item{{ID: "a", Data: 1}, {ID: "x", Data: 0}, {ID: "b", Data: 2}, {ID: "c", Data: 4}}},
+		{},
+	}
+	for name, cfg := range strategies {
+		for i, upd := range updates {
+			s := MustNew[TestState, Activator](old, cfg)
+			s.Set(upd)
+			patch, _ := s.Diff(nil)
+
+			got := old
+			got.Items = append([]Item(nil), old.Items...)
+			if err := patch.Apply(&got); err != nil {
+				t.Fatalf("%s/%d: %v", name, i, err)
+			}
+			if !reflect.DeepEqual(got, upd) {
+				t.Errorf("%s/%d: applying %v gave %+v, want %+v", name, i, patch, got, upd)
+			}
+		}
+	}
+}
+
+func TestPatchApplyErrors(t *testing.T) {
+	target := TestState{Value: 1, Items: []Item{{ID: "a"}}}
+	orig := target
+	cases := []Patch{
+		{{Op: "replace", Path: "/missing", Value: 1}},
+		{{Op: "add", Path: "/items/2", Value: Item{}}},
+		{{Op: "remove", Path: "/items/01"}},
+		{{Op: "replace", Path: "/value", Value: 5}, {Op: "test", Path: "/value", Value: 6}},
+		{{Op: "bogus", Path: "/value"}},
+	}
+	for i, p := range cases {
+		if err := p.Apply(&target); err == nil {
+			t.Errorf("Case %d: expected error", i)
+		}
+		if !reflect.DeepEqual(target, orig) {
+			t.Errorf("Case %d: failed apply modified target: %+v", i, target)
+		}
+	}
+
+	err := Patch{{Op: "test", Path: "/value", Value: 2}}.Apply(&target)
+	if !errors.Is(err, ErrPatchTest) {
+		t.Errorf("Expected ErrPatchTest, got %v", err)
+	}
+	if err := (Patch{}).Apply(target); err == nil {
+		t.Error("Non-pointer target should fail")
+	}
+}
+
+func TestPatchTestNumbers(t *testing.T) {
+	doc := []byte(`{"a":1,"b":100,"c":[0.5,{"d":2}],"e":"1"}`)
+	equal := Patch{
+		{Op: "test", Path: "/a", Value: json.Number("1.0")},
+		{Op: "test", Path: "/b", Value: json.Number("1e2")},
+		{Op: "test", Path: "/b", Value: 100.0},
+		{Op: "test", Path: "/c", Value: []any{json.Number("5e-1"), map[string]any{"d": json.Number("2.00")}}},
+	}
+	if _, err := equal.ApplyToJSON(doc); err != nil {
+		t.Errorf("Equal numbers: %v", err)
+	}
+	for i, p := range []Patch{
+		{{Op: "test", Path: "/a", Value: json.Number("1.0000000000000000001")}},
+		{{Op: "test", Path: "/e", Value: 1}},
+		{{Op: "test", Path: "/c", Value: []any{0.5}}},
+	} {
+		if _, err := p.ApplyToJSON(doc); !errors.Is(err, ErrPatchTest) {
+			t.Errorf("Case %d: expected ErrPatchTest, got %v", i, err)
+		}
+	}
+}
+
+// ===== Root Type Tests =====
+
+func TestRootArrayState(t *testing.T) {
+	old := []Item{{ID: "a", Data: 1}, {ID: "b", Data: 2}}
+	next := []Item{{ID: "a", Data: 5}, {ID: "b", Data: 2}, {ID: "c", Data: 3}}
+	cases := map[string]struct {
+		cfg  *Config[[]Item]
+		want string
+	}{
+		"replace": {nil, `[{"op":"replace","path":"","value":[{"data":5,"id":"a"},{"data":2,"id":"b"},{"data":3,"id":"c"}]}]`},
+		"index":   {&Config[[]Item]{ArrayStrategy: ArrayByIndex}, `[{"op":"replace","path":"/0/data","value":5},{"op":"add","path":"/-","value":{"data":3,"id":"c"}}]`},
+		"key":     {&Config[[]Item]{ArrayStrategy: ArrayByKey, ArrayKeyField: "id"}, `[{"op":"replace","path":"/0/data","value":5},{"op":"add","path":"/-","value":{"data":3,"id":"c"}}]`},
+	}
+	for name, tc := range cases {
+		s := MustNew[[]Item, Activator](old, tc.cfg)
+		s.Set(next)
+		patch, err := s.Diff(nil)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if data, _ := patch.JSON(); string(data) != tc.want {
+			t.Errorf("%s: got %s, want %s", name, data, tc.want)
+		}
+
+		got := append([]Item(nil), old...)
+		if err := patch.Apply(&got); err != nil || !reflect.DeepEqual(got, next) {
+			t.Errorf("%s: apply gave %+v (%v)", name, got, err)
+		}
+	}
+}
+
+func TestRootScalarState(t *testing.T) {
+	s := MustNew[int, Activator](1, nil)
+	s.Set(2)
+	patch, err := s.Diff(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := patch.JSON(); string(data) != `[{"op":"replace","path":"","value":2}]` {
+		t.Errorf("Scalar root diff: %s", data)
+	}
+
+	s.ClearPrevious()
+	s.Set(2)
+	if patch, _ := s.Diff(nil); !patch.Empty() {
+		t.Errorf("Unchanged scalar should produce no ops: %v", patch)
+	}
+
+	sliced, _ := s.DiffSliced(nil)
+	if !sliced.Step(time.Second) || !sliced.Patch().Empty() {
+		t.Errorf("Sliced scalar diff: %v", sliced.Patch())
+	}
+}
+
+// ===== Null Path Tests =====
+
+type NullableState struct {
+	Target *string            `json:"target,omitempty"`
+	Marks  map[string]*string `json:"marks,omitempty"`
+}
+
+func TestNullPaths(t *testing.T) {
+	cfg := &Config[NullableState]{NullPaths: []string{"/target"}}
+	s := MustNew[NullableState, Activator](NullableState{}, cfg)
+	sess := NewSession[NullableState, Activator, string](s)
+	sess.Connect("c", nil)
+
+	full, _ := sess.Full("c")
+	if string(full) != `[{"op":"replace","path":"","value":{"target":null}}]` {
+		t.Errorf("Full should include explicit null: %s", full)
+	}
+
+	s.Set(NullableState{Target: strPtr("x")})
+	if diffs := sess.Tick(); string(diffs["c"]) != `[{"op":"replace","path":"/target","value":"x"}]` {
+		t.Errorf("Setting a null member should replace: %s", diffs["c"])
+	}
+	s.Set(NullableState{})
+	if diffs := sess.Tick(); string(diffs["c"]) != `[{"op":"replace","path":"/target","value":null}]` {
+		t.Errorf("Clearing should replace with null: %s", diffs["c"])
+	}
+
+	// Map entries not listed keep add/remove semantics
+	s.Set(NullableState{Marks: map[string]*string{"a": nil}})
+	if diffs := sess.Tick(); string(diffs["c"]) != `[{"op":"add","path":"/marks","value":{"a":null}}]` {
+		t.Errorf("Unlisted members: %s", diffs["c"])
+	}
+
+	if _, err := New[NullableState, Activator](NullableState{}, &Config[NullableState]{NullPaths: []string{"/marks/*"}}); err == nil {
+		t.Error("NullPaths ending in a wildcard should be rejected")
+	}
+}
+
+func TestPatchApplyToJSON(t *testing.T) {
+	doc := []byte(`{"n":12345678901234567890,"list":[1,2,3],"obj":{"a~b":1,"c/d":2}}`)
+	patch := Patch{
+		{Op: "remove", Path: "/list/2"},
+		{Op: "remove", Path: "/list/0"},
+		{Op: "add", Path: "/list/0", Value: "x"},
+		{Op: "add", Path: "/list/-", Value: []int{4}},
+		{Op: "replace", Path: "/obj/a~0b", Value: nil},
+		{Op: "remove", Path: "/obj/c~1d"},
+		{Op: "test", Path: "/list/1", Value: 2},
+	}
+	got, err := patch.ApplyToJSON(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"list":["x",2,[4]],"n":12345678901234567890,"obj":{"a~b":null}}`
+	if string(got) != want {
+		t.Errorf("ApplyToJSON = %s, want %s", got, want)
+	}
+
+	if _, err := (Patch{{Op: "remove", Path: "/list/3"}}).ApplyToJSON(doc); !errors.Is(err, ErrPatchPath) {
+		t.Errorf("Expected ErrPatchPath, got %v", err)
+	}
+	root, _ := Patch{{Op: "replace", Path: "", Value: []int{1}}}.ApplyToJSON([]byte(`{}`))
+	if string(root) != `[1]` {
+		t.Errorf("Root replace: %s", root)
+	}
+}
+
+// ===== Pointer Field Tests =====
+
+type PtrInner struct {
+	Level *int     `json:"level,omitempty"`
+	Tags  []string `json:"tags"`
+}
+
+type PtrState struct {
+	HP      *int                 `json:"hp,omitempty"`
+	Title   *string              `json:"title"`
+	Inner   *PtrInner            `json:"inner,omitempty"`
+	List    []*PtrInner          `json:"list"`
+	ByName  map[string]*PtrInner `json:"byName"`
+	Cache   *PtrInner            `json:"-"`
+	private *int
+}
+
+func TestDeepClonePointers(t *testing.T) {
+	shared := &PtrInner{Level: intPtr(1), Tags: []string{}}
+	src := PtrState{
+		HP:     intPtr(0),
+		Inner:  shared,
+		List:   []*PtrInner{shared, nil},
+		ByName: map[string]*PtrInner{"a": shared},
+		Cache:  &PtrInner{},
+	}
+	dst := DeepClone(src)
+
+	if !reflect.DeepEqual(src, dst) {
+		t.Fatalf("Clone differs: %+v vs %+v", src, dst)
+	}
+	*dst.HP = 5
+	*dst.Inner.Level = 7
+	if *src.HP != 0 || *src.Inner.Level != 1 {
+		t.Error("Clone shares pointers with the source")
+	}
+	if dst.List[0] != dst.Inner || dst.ByName["a"] != dst.Inner {
+		t.Error("Aliasing within the value should be preserved")
+	}
+	if dst.Inner.Tags == nil || dst.Title != nil || dst.Cache == nil {
+		t.Error("nil/empty distinction and untagged fields should be kept")
+	}
+
+	type node struct{ Next *node }
+	n := &node{}
+	n.Next = n
+	if c := DeepClone(n); c.Next != c || c == n {
+		t.Error("Cycles should be cloned as cycles")
+	}
+	var iface any = []int{1}
+	if c := DeepClone(iface).([]int); &c[0] == &iface.([]int)[0] {
+		t.Error("Interface values should be deep-copied")
+	}
+	if DeepClone[any](nil) != nil {
+		t.Error("Nil interface should clone to nil")
+	}
+}
+
+func TestPointerFieldDiffs(t *testing.T) {
+	s := MustNew[PtrState, Activator](PtrState{}, &Config[PtrState]{Cloner: DeepClone[PtrState]})
+	steps := []struct {
+		update func(*PtrState)
+		want   string
+	}{
+		{func(p *PtrState) { p.HP = intPtr(0) }, `[{"op":"add","path":"/hp","value":0}]`},
+		{func(p *PtrState) { *p.HP = 3 }, `[{"op":"replace","path":"/hp","value":3}]`},
+		{func(p *PtrState) { p.HP = intPtr(3) }, `[]`}, // New pointer, same value
+		{func(p *PtrState) { p.Title = strPtr("x") }, `[{"op":"replace","path":"/title","value":"x"}]`},
+		{func(p *PtrState) { p.HP = nil }, `[{"op":"remove","path":"/hp"}]`},
+	}
+	for i, step := range steps {
+		s.Update(step.update)
+		patch, _ := s.Diff(nil)
+		if data, _ := patch.JSON(); string(data) != step.want {
+			t.Errorf("Step %d: got %s, want %s", i, data, step.want)
+		}
+		s.ClearPrevious()
+	}
+}
+
+// ===== Squash Tests =====
+
+func TestSquash(t *testing.T) {
+	cases := []struct {
+		name    string
+		patches []Patch
+		want    string
+	}{
+		{"repeated replace", []Patch{
+			{{Op: "replace", Path: "/value", Value: 1}},
+			{{Op: "replace", Path: "/value", Value: 2}},
+		}, `[{"op":"replace","path":"/value","value":2}]`},
+		{"add then replace", []Patch{
+			{{Op: "add", Path: "/name", Value: "a"}},
+			{{Op: "replace", Path: "/name", Value: "b"}},
+		}, `[{"op":"add","path":"/name","value":"b"}]`},
+		{"subtree overwritten", []Patch{
+			{{Op: "replace", Path: "/items/0/data", Value: 1}, {Op: "add", Path: "/items/-", Value: 2}},
+			{{Op: "replace", Path: "/items", Value: []int{}}},
+		}, `[{"op":"replace","path":"/items","value":[]}]`},
+		{"array shift is a barrier", []Patch{
+			{{Op: "replace", Path: "/items/1/data", Value: 1}},
+			{{Op: "remove", Path: "/items/0"}},
+			{{Op: "replace", Path: "/items/1/data", Value: 2}},
+		}, `[{"op":"replace","path":"/items/1/data","value":1},{"op":"remove","path":"/items/0"},{"op":"replace","path":"/items/1/data","value":2}]`},
+		{"add keeps its position", []Patch{
+			{{Op: "add", Path: "/a/0", Value: "x"}, {Op: "replace", Path: "/a/2", Value: "y"}},
+			{{Op: "replace", Path: "/a/0", Value: "z"}},
+		}, `[{"op":"add","path":"/a/0","value":"z"},{"op":"replace","path":"/a/2","value":"y"}]`},
+		{"test is kept", []Patch{
+			{{Op: "replace", Path: "/value", Value: 1}, {Op: "test", Path: "/value", Value: 1}},
+			{{Op: "replace", Path: "/value", Value: 2}},
+		}, `[{"op":"replace","path":"/value","value":1},{"op":"test","path":"/value","value":1},{"op":"replace","path":"/value","value":2}]`},
+	}
+	for _, tc := range cases {
+		data, _ := Squash(tc.patches...).JSON()
+		if string(data) != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, data, tc.want)
+		}
+	}
+}
+
+func TestSquashMatchesSequentialApply(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{}, &Config[TestState]{
+		ArrayStrategy: ArrayByKey, ArrayKeyField: "id",
+	})
+	start, _ := json.Marshal(s.Get())
+	var patches []Patch
+	updates := []func(*TestState){
+		func(ts *TestState) { ts.Items = []Item{{ID: "a", Data: 1}, {ID: "b", Data: 2}} },
+		func(ts *TestState) { ts.Items[1].Data = 3; ts.Value = 1 },
+		func(ts *TestState) { ts.Items = append([]Item{{ID: "x"}}, ts.Items[1:]...) },
+		func(ts *TestState) { ts.Items[1].Data = 4; ts.Name = "n" },
+		func(ts *TestState) { ts.Items = ts.Items[:1]; ts.Value = 2 },
+		func(ts *TestState) { ts.Name = "" },
+	}
+	for _, fn := range updates {
+		s.Update(fn)
+		p, _ := s.Diff(nil)
+		patches = append(patches, p)
+		s.ClearPrevious()
+	}
+
+	want, _ := json.Marshal(s.Get())
+	squashed := Squash(patches...)
+	got, err := squashed.ApplyToJSON(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotDoc, wantDoc any
+	json.Unmarshal(got, &gotDoc)
+	json.Unmarshal(want, &wantDoc)
+	if !reflect.DeepEqual(gotDoc, wantDoc) {
+		t.Errorf("Squashed patch gave %s, want %s", got, want)
+	}
+	total := 0
+	for _, p := range patches {
+		total += len(p)
+	}
+	if len(squashed) >= total {
+		t.Errorf("Expected fewer ops than %d, got %v", total, squashed)
+	}
+}
+
+func TestSquashRandomDiffs(t *testing.T) {
+	type Doc struct {
+		List []int          `json:"list"`
+		Rows []Item         `json:"rows"`
+		M    map[string]int `json:"m"`
+	}
+	rng := rand.New(rand.NewSource(1))
+	mutate := func(d *Doc) {
+		for n := rng.Intn(4) + 1; n > 0; n-- {
+			switch k := rng.Intn(6); {
+			case k == 0 || len(d.List) == 0:
+				i := rng.Intn(len(d.List) + 1)
+				d.List = append(d.List[:i], append([]int{rng.Intn(9)}, d.List[i:]...)...)
+			case k == 1:
+				i := rng.Intn(len(d.List))
+				d.List = append(d.List[:i], d.List[i+1:]...)
+			case k == 2:
+				d.List[rng.Intn(len(d.List))] = rng.Intn(9)
+			case k == 3:
+				i := rng.Intn(len(d.Rows) + 1)
+				d.Rows = append(d.Rows[:i], append([]Item{{ID: fmt.Sprint(rng.Intn(99)), Data: rng.Intn(9)}}, d.Rows[i:]...)...)
+			case k == 4 && len(d.Rows) > 0:
+				d.Rows[rng.Intn(len(d.Rows))].Data = rng.Intn(9)
+			default:
+				key := fmt.Sprint(rng.Intn(3))
+				if rng.Intn(2) == 0 {
+					delete(d.M, key)
+				} else {
+					d.M[key] = rng.Intn(9)
+				}
+			}
+		}
+	}
+	configs := []*Config[Doc]{
+		{ArrayStrategy: ArrayByIndex},
+		{ArrayStrategy: ArrayByIndex, ArrayIndexedAdds: true},
+		{ArrayStrategy: ArrayLCS},
+	}
+	for c, cfg := range configs {
+		for trial := 0; trial < 2000; trial++ {
+			s := MustNew[Doc, Activator](Doc{List: []int{1, 2}, M: map[string]int{}}, cfg)
+			s.Update(mutate)
+			s.ClearPrevious()
+			s0, _ := json.Marshal(s.Get())
+			var diffs []Patch
+			for i := 0; i < 2; i++ {
+				s.Update(mutate)
+				d, err := s.Diff(nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				diffs = append(diffs, d)
+				s.ClearPrevious()
+			}
+			s2, _ := json.Marshal(s.Get())
+
+			squashed := Squash(diffs...)
+			got, err := squashed.ApplyToJSON(s0)
+			var gotDoc, wantDoc any
+			json.Unmarshal(got, &gotDoc)
+			json.Unmarshal(s2, &wantDoc)
+			if err != nil || !reflect.DeepEqual(gotDoc, wantDoc) {
+				t.Fatalf("Config %d: Squash(%v, %v) = %v on %s gave %s (%v), want %s", c, diffs[0], diffs[1], squashed, s0, got, err, s2)
+			}
+		}
+	}
+}
+
+// ===== Client Iteration Tests =====
+
+func TestSessionForEach(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{}, nil)
+	sess := NewSession[TestState, Activator, string](s)
+	before := time.Now()
+	sess.Connect("plain", nil)
+	sess.Connect("custom", hideSecret, WithEncoder[TestState](Gzip(JSONPatchEncoder)))
+	sess.ConnectGroup("member", "team", hideSecret, WithTransform(func(ts TestState) TestState { return ts }))
+
+	seen := map[string]ClientMeta{}
+	sess.ForEach(func(id string, meta ClientMeta) bool {
+		seen[id] = meta
+		sess.Disconnect(id) // Must not deadlock or disturb the iteration
+		return true
+	})
+	if len(seen) != 3 || sess.Count() != 0 {
+		t.Fatalf("Expected 3 clients visited and disconnected, got %v", seen)
+	}
+	if m := seen["plain"]; m.Projected || m.Group != "" || m.Encoder != "" || m.ConnectedAt.Before(before) {
+		t.Errorf("plain: %+v", m)
+	}
+	if m := seen["custom"]; !m.Projected || m.Encoder != "json-patch+gzip" {
+		t.Errorf("custom: %+v", m)
+	}
+	if m := seen["member"]; m.Group != "team" || !m.Transformed {
+		t.Errorf("member: %+v", m)
+	}
+
+	sess.Connect("a", nil)
+	sess.Connect("b", nil)
+	calls := 0
+	sess.ForEach(func(string, ClientMeta) bool {
+		calls++
+		return false
+	})
+	if calls != 1 {
+		t.Errorf("Returning false should stop iteration, got %d calls", calls)
+	}
+}
+
+// ===== Query Effect Tests =====
+
+func TestQueryEffect(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Items: []Item{{ID: "a", Data: 1}, {ID: "b", Data: 0}}}, nil)
+	calls := 0
+	alive := func(ts TestState) int {
+		calls++
+		n := 0
+		for _, it := range ts.Items {
+			if it.Data > 0 {
+				n++
+			}
+		}
+		return n
+	}
+	s.AddEffect(Query("allies", alive, func(ts TestState, n int, _ Activator) TestState {
+		ts.Value *= n
+		return ts
+	}), nil)
+	s.Update(func(ts *TestState) { ts.Value = 10 })
+
+	if got := s.Get().Value; got != 10 {
+		t.Fatalf("Expected multiplier 1, got value %d", got)
+	}
+	calls = 0
+	s.Get()
+	s.Get()
+	if calls != 0 {
+		t.Errorf("Selector should be memoized until the state changes, ran %d times", calls)
+	}
+
+	s.Update(func(ts *TestState) { ts.Items[1].Data = 5 })
+	if got := s.Get().Value; got != 20 {
+		t.Errorf("Expected params recomputed from the new state, got value %d", got)
+	}
+	patch, _ := s.Diff(nil)
+	if len(patch) != 2 || patch[1].Path != "/value" || fmt.Sprint(patch[1].Value) != "20" {
+		t.Errorf("Unexpected diff: %v", patch)
+	}
+
+	// Selector sees the base state, not the output of earlier effects
+	s.AddEffect(Func("zero", func(ts TestState, _ Activator) TestState {
+		ts.Items = nil
+		return ts
+	}), nil)
+	s.RemoveEffect("allies")
+	s.AddEffect(Query("allies", alive, func(ts TestState, n int, _ Activator) TestState {
+		ts.Value *= n
+		return ts
+	}), nil)
+	if got := s.Get().Value; got != 20 {
+		t.Errorf("Expected selector to read base state, got value %d", got)
+	}
+
+	// Forks do not share memoized params
+	fork := s.Fork()
+	fork.Update(func(ts *TestState) { ts.Items[0].Data = 0 })
+	if fork.Get().Value != 10 || s.Get().Value != 20 {
+		t.Errorf("Fork: got %d and %d", fork.Get().Value, s.Get().Value)
+	}
+}
+
+func TestQueryEffectAfterEffect(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 10, Items: []Item{{ID: "a", Data: 1}, {ID: "b", Data: 1}}}, nil)
+	alive := func(ts TestState) int { return len(ts.Items) }
+	s.AddEffect(Func("clear", func(ts TestState, _ Activator) TestState {
+		ts.Items = nil
+		return ts
+	}), nil)
+	s.AddEffect(Query("allies", alive, func(ts TestState, n int, _ Activator) TestState {
+		ts.Value *= n
+		return ts
+	}), nil)
+	now := time.Now().Add(time.Second) // Within the buff's minute
+	buff := Timed("buff", time.Minute, func(ts TestState, _ Activator) TestState {
+		ts.Name = "buffed"
+		return ts
+	})
+	buff.TimeFunc = func() time.Time { return now }
+	s.AddEffect(buff, nil)
+	s.ClearPrevious()
+	if got := s.Get().Value; got != 20 {
+		t.Fatalf("Get().Value = %d, want 20", got)
+	}
+
+	// ExplainEffects selects from the base state, as Get does
+	steps, err := s.ExplainEffects(s.GetBase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 3 || steps[1].State.Value != 20 {
+		t.Errorf("Explained value = %+v, want 20", steps)
+	}
+
+	// The rebuilt previous state matches what clients received
+	now = now.Add(time.Hour)
+	if s.CleanupExpired() != 1 {
+		t.Fatal("Timed effect should expire")
+	}
+	patch, _ := s.Diff(nil)
+	for _, op := range patch {
+		if op.Path == "/value" {
+			t.Errorf("Value did not change for clients: %v", patch)
+		}
+	}
+}
+
+// ===== Move Detection Tests =====
+
+type MoveState struct {
+	Slots map[string]Item `json:"slots"`
+	Count int             `json:"count"`
+}
+
+func TestDetectMoves(t *testing.T) {
+	initial := MoveState{Slots: map[string]Item{"a": {ID: "x", Data: 1}, "b": {ID: "y", Data: 2}}}
+	s := MustNew[MoveState, Activator](initial, &Config[MoveState]{DetectMoves: true})
+	s.Update(func(ms *MoveState) {
+		ms.Slots = map[string]Item{"b": {ID: "y", Data: 2}, "c": {ID: "x", Data: 1}, "d": {ID: "y", Data: 2}}
+		ms.Count = 3
+	})
+	patch, err := s.Diff(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := patch.JSON()
+	want := `[{"op":"replace","path":"/count","value":3},` +
+		`{"op":"move","path":"/slots/c","from":"/slots/a"},` +
+		`{"op":"copy","path":"/slots/d","from":"/slots/b"}]`
+	if string(data) != want {
+		t.Errorf("Expected\n%s\ngot\n%s", want, data)
+	}
+
+	old := MoveState{Slots: map[string]Item{"a": {ID: "x", Data: 1}, "b": {ID: "y", Data: 2}}}
+	if err := patch.Apply(&old); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(old, s.GetBase()) {
+		t.Errorf("Applied patch gives %+v, want %+v", old, s.GetBase())
+	}
+
+	// Without DetectMoves, values are sent in full
+	plain := MustNew[MoveState, Activator](initial, nil)
+	plain.Update(func(ms *MoveState) { ms.Slots = map[string]Item{"c": {ID: "x", Data: 1}} })
+	patch, _ = plain.Diff(nil)
+	for _, op := range patch {
+		if op.Op == "move" || op.Op == "copy" {
+			t.Errorf("Unexpected %s op without DetectMoves", op.Op)
+		}
+	}
+}
+
+func TestDetectMovesSliced(t *testing.T) {
+	s := MustNew[map[string]Item, Activator](map[string]Item{"a": {ID: "x", Data: 1}}, &Config[map[string]Item]{DetectMoves: true})
+	s.Set(map[string]Item{"b": {ID: "x", Data: 1}})
+	d, err := s.DiffSliced(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for !d.Step(0) {
+	}
+	want, _ := s.Diff(nil)
+	if !reflect.DeepEqual(d.Patch(), want) || len(want) != 1 || want[0].Op != "move" {
+		t.Errorf("Sliced diff %v, Diff %v", d.Patch(), want)
+	}
+}
+
+func TestPatchApplyMoveCopy(t *testing.T) {
+	doc := []byte(`{"a":[1,2,3],"b":{"c":{"d":1}}}`)
+	patch := Patch{
+		{Op: "move", From: "/a/0", Path: "/a/-"},
+		{Op: "copy", From: "/b/c", Path: "/e"},
+		{Op: "replace", Path: "/e/d", Value: 2},
+		{Op: "move", From: "/b", Path: "/f"},
+	}
+	got, err := patch.ApplyToJSON(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"a":[2,3,1],"e":{"d":2},"f":{"c":{"d":1}}}`; string(got) != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	if _, err := (Patch{{Op: "move", From: "/b", Path: "/b/c/x"}}).ApplyToJSON(doc); err == nil {
+		t.Error("Expected error moving a value into itself")
+	}
+	if _, err := (Patch{{Op: "copy", From: "/x", Path: "/y"}}).ApplyToJSON(doc); !errors.Is(err, ErrPatchPath) {
+		t.Errorf("Expected ErrPatchPath for a missing source, got %v", err)
+	}
+}
+
+// ===== Full Cache Tests =====
+
+func TestSessionFullCache(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 1, Secret: "s"}, nil)
+	sess := NewSession[TestState, Activator, string](s)
+	sess.SetFullCache(true)
+
+	projections := 0
+	project := func(ts TestState) TestState {
+		projections++
+		return hideSecret(ts)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		sess.ConnectGroup(id, "team", project)
+	}
+	sess.Connect("own", project)
+
+	first, _ := sess.Full("a")
+	second, _ := sess.Full("b")
+	if string(first) != string(second) || strings.Contains(string(first), `"s"`) {
+		t.Errorf("Group members should share the projected payload: %s / %s", first, second)
+	}
+	if projections != 1 {
+		t.Errorf("Expected 1 projection for the group, got %d", projections)
+	}
+	sess.Full("own")
+	sess.Full("own")
+	if projections != 3 {
+		t.Errorf("Own projections must not be cached, got %d calls", projections)
+	}
+
+	s.Update(func(ts *TestState) { ts.Value = 2 })
+	data, _ := sess.Full("c")
+	if !strings.Contains(string(data), `"value":2`) || projections != 4 {
+		t.Errorf("Change should invalidate the cache: %s (%d projections)", data, projections)
+	}
+
+	// Time-windowed effects bypass the cache
+	s.AddEffect(Timed[TestState, Activator]("t", time.Hour, addEffect(1)), nil)
+	sess.Full("a")
+	sess.Full("a")
+	if projections != 6 {
+		t.Errorf("Timed effects should disable caching, got %d projections", projections)
+	}
+}
+
+// ===== LCS Array Tests =====
+
+func TestArrayLCS(t *testing.T) {
+	type Doc struct {
+		List []any `json:"list"`
+	}
+	long := make([]any, 50)
+	for i := range long {
+		long[i] = float64(i)
+	}
+	cases := []struct {
+		name     string
+		old, new []any
+		want     string
+	}{
+		{"insert at front", long, append([]any{-1.0}, long...), `[{"op":"add","path":"/list/0","value":-1}]`},
+		{"remove in middle", []any{1.0, 2.0, 3.0}, []any{1.0, 3.0}, `[{"op":"remove","path":"/list/1"}]`},
+		{"append", []any{1.0}, []any{1.0, 2.0}, `[{"op":"add","path":"/list/-","value":2}]`},
+		{"edit object in place", []any{"a", map[string]any{"n": 1.0, "x": true}, "b"}, []any{"a", map[string]any{"n": 2.0, "x": true}, "b"},
+			`[{"op":"replace","path":"/list/1/n","value":2}]`},
+		{"mixed", []any{"a", "b", "c", "d", "e"}, []any{"x", "b", "d", "y", "z", "e"}, ""},
+		{"reverse", []any{1.0, 2.0, 3.0, 4.0}, []any{4.0, 3.0, 2.0, 1.0}, ""},
+	}
+	for _, tc := range cases {
+		s := MustNew[Doc, Activator](Doc{List: tc.old}, Configure[Doc]().ArraysLCS().MustBuild())
+		s.Set(Doc{List: tc.new})
+		patch, err := s.Diff(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := patch.JSON()
+		if tc.want != "" && string(data) != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, data, tc.want)
+		}
+
+		start, _ := json.Marshal(Doc{List: tc.old})
+		got, err := patch.ApplyToJSON(start)
+		if err != nil {
+			t.Fatalf("%s: %v (%s)", tc.name, err, data)
+		}
+		var gotDoc, wantDoc any
+		json.Unmarshal(got, &gotDoc)
+		end, _ := json.Marshal(Doc{List: tc.new})
+		json.Unmarshal(end, &wantDoc)
+		if !reflect.DeepEqual(gotDoc, wantDoc) {
+			t.Errorf("%s: applying %s gave %s", tc.name, data, got)
+		}
+	}
+}
+
+// ===== Update Watchdog Tests =====
+
+func TestUpdateWatchdog(t *testing.T) {
+	var mu sync.Mutex
+	var reports []SlowUpdate
+	s := MustNew[TestState, Activator](TestState{}, &Config[TestState]{
+		UpdateBudget: 10 * time.Millisecond,
+		OnSlowUpdate: func(r SlowUpdate) {
+			mu.Lock()
+			reports = append(reports, r)
+			mu.Unlock()
+		},
+	})
+
+	s.Update(func(ts *TestState) { ts.Value = 1 })
+	mu.Lock()
+	if len(reports) != 0 {
+		t.Errorf("Fast update should not be reported: %+v", reports)
+	}
+	mu.Unlock()
+
+	s.Update(func(ts *TestState) { time.Sleep(50 * time.Millisecond) })
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reports) != 2 {
+		t.Fatalf("Expected running and done reports, got %d", len(reports))
+	}
+	if reports[0].Done || !strings.Contains(string(reports[0].Stack), "TestUpdateWatchdog") {
+		t.Errorf("Running report should include the stuck goroutine: %s", reports[0].Stack)
+	}
+	if !reports[1].Done || reports[1].Held < 50*time.Millisecond {
+		t.Errorf("Done report: %+v", reports[1])
+	}
+}
+
+func TestDetectMovesByKey(t *testing.T) {
+	items := func(spec string) []Item {
+		var out []Item
+		for _, f := range strings.Fields(spec) {
+			out = append(out, Item{ID: f[:1], Data: len(f)})
+		}
+		return out
+	}
+	cfg := &Config[TestState]{ArrayStrategy: ArrayByKey, ArrayKeyField: "id", DetectMoves: true}
+
+	s := MustNew[TestState, Activator](TestState{Items: items("a b c d")}, cfg)
+	s.Update(func(ts *TestState) { ts.Items = items("b c d a") })
+	patch, _ := s.Diff(nil)
+	data, _ := patch.JSON()
+	if want := `[{"op":"move","path":"/items/-","from":"/items/0"}]`; string(data) != want {
+		t.Errorf("Rotation: expected %s, got %s", want, data)
+	}
+
+	cases := []struct{ from, to string }{
+		{"a b c d e", "e d c b a"},
+		{"a b c d e", "c a e b"},
+		{"a b c", "x c yy a b z"},
+		{"a b c d", "d bb x a"},
+		{"a b c d e f", "b a d c f e"},
+	}
+	for _, c := range cases {
+		s := MustNew[TestState, Activator](TestState{Items: items(c.from)}, cfg)
+		s.Update(func(ts *TestState) { ts.Items = items(c.to) })
+		patch, err := s.Diff(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := TestState{Items: items(c.from)}
+		if err := patch.Apply(&got); err != nil {
+			t.Fatalf("%s -> %s: %v", c.from, c.to, err)
+		}
+		if !reflect.DeepEqual(got, s.GetBase()) {
+			t.Errorf("%s -> %s: applying %v gives %+v", c.from, c.to, patch, got.Items)
+		}
+		for _, op := range patch {
+			if op.Op == "replace" && op.Path == "/items" {
+				t.Errorf("%s -> %s: array replaced whole", c.from, c.to)
+			}
+		}
+	}
+
+	// Without DetectMoves a reorder still replaces the array
+	cfg.DetectMoves = false
+	s = MustNew[TestState, Activator](TestState{Items: items("a b")}, cfg)
+	s.Update(func(ts *TestState) { ts.Items = items("b a") })
+	if patch, _ := s.Diff(nil); len(patch) != 1 || patch[0].Op != "replace" {
+		t.Errorf("Expected whole replace, got %v", patch)
+	}
+}
+
+// ===== Array Identity Tests =====
+
+func TestArrayIdentity(t *testing.T) {
+	cfg := &Config[TestState]{
+		ArrayStrategy: ArrayByKey,
+		ArrayKeyField: "id",
+		ArrayIdentity: func(path string, elem map[string]any) string {
+			if path != "/items" {
+				t.Errorf("Unexpected array path %q", path)
+			}
+			return fmt.Sprint(elem["data"])
+		},
+	}
+	s := MustNew[TestState, Activator](TestState{Items: []Item{{ID: "a", Data: 1}, {ID: "b", Data: 2}}}, cfg)
+	s.Update(func(ts *TestState) { ts.Items[0].ID = "z" })
+	patch, _ := s.Diff(nil)
+	data, _ := patch.JSON()
+	if want := `[{"op":"replace","path":"/items/0/id","value":"z"}]`; string(data) != want {
+		t.Errorf("Expected %s, got %s", want, data)
+	}
+
+	// Ambiguous identities fall back to remove and add
+	s = MustNew[TestState, Activator](TestState{Items: []Item{{ID: "a", Data: 1}, {ID: "b", Data: 1}}}, cfg)
+	s.Update(func(ts *TestState) { ts.Items = []Item{{ID: "y", Data: 1}, {ID: "z", Data: 1}} })
+	patch, _ = s.Diff(nil)
+	got := TestState{Items: []Item{{ID: "a", Data: 1}, {ID: "b", Data: 1}}}
+	if err := patch.Apply(&got); err != nil || !reflect.DeepEqual(got, s.GetBase()) {
+		t.Errorf("Patch %v gives %+v (%v)", patch, got, err)
+	}
+	for _, op := range patch {
+		if op.Op == "replace" {
+			t.Errorf("Ambiguous identity should not pair elements: %v", patch)
+		}
+	}
+}
+
+// ===== Describe Tests =====
+
+type DescBase struct {
+	Version int `json:"version"`
+}
+
+type DescNode struct {
+	Name     string      `json:"name"`
+	Children []*DescNode `json:"children,omitempty"`
+}
+
+type DescState struct {
+	DescBase
+	Players []HPPlayer     `json:"players" visibility:"public"`
+	Email   string         `json:"email" visibility:"owner"`
+	Target  *string        `json:"target,omitempty"`
+	Scores  map[string]int `json:"scores"`
+	Tree    DescNode       `json:"tree"`
+	At      time.Time      `json:"at"`
+	Hidden  int            `json:"-"`
+	private int
+}
+
+func TestDescribe(t *testing.T) {
+	desc := Describe(&Config[DescState]{
+		ArrayStrategy: ArrayByKey,
+		ArrayKeyField: "name",
+		PathMapper:    SnakeCase,
+		EncryptPaths:  []string{"/email"},
+	})
+	if desc.Kind != "object" {
+		t.Fatalf("Expected object, got %+v", desc)
+	}
+	fields := map[string]FieldDesc{}
+	var names []string
+	for _, f := range desc.Fields {
+		fields[f.JSONName] = f
+		names = append(names, f.JSONName)
+	}
+	if got := strings.Join(names, ","); got != "version,players,email,target,scores,tree,at" {
+		t.Errorf("Unexpected fields %s", got)
+	}
+
+	players := fields["players"]
+	if players.Type.Kind != "array" || players.Type.KeyField != "name" || players.Tag.Get("visibility") != "public" {
+		t.Errorf("players: %+v", players)
+	}
+	if hp := players.Type.Elem.Fields[2]; hp.JSONName != "hp_percent" || hp.Path != "/players/*/hp_percent" || hp.Type.Kind != "number" {
+		t.Errorf("players elem field: %+v", hp)
+	}
+	if e := fields["email"]; !e.Encrypted || e.Tag.Get("visibility") != "owner" {
+		t.Errorf("email: %+v", e)
+	}
+	if tg := fields["target"]; !tg.OmitEmpty || !tg.Type.Nullable || tg.Type.Kind != "string" {
+		t.Errorf("target: %+v", tg)
+	}
+	if sc := fields["scores"]; sc.Type.Kind != "map" || sc.Type.Elem.Kind != "number" {
+		t.Errorf("scores: %+v", sc)
+	}
+	if fields["at"].Type.Kind != "any" {
+		t.Errorf("at: %+v", fields["at"].Type)
+	}
+	child := fields["tree"].Type.Fields[1].Type.Elem
+	if child.Ref != "statediff.DescNode" || child.Fields != nil || !child.Nullable {
+		t.Errorf("Recursive type should be a ref: %+v", child)
+	}
+	if _, err := json.Marshal(desc); err != nil {
+		t.Errorf("TypeDesc should marshal: %v", err)
+	}
+
+	if d := Describe[[]int](nil); d.Kind != "array" || d.Elem.Kind != "number" || d.KeyField != "" {
+		t.Errorf("[]int: %+v", d)
+	}
+}
+
+// ===== Nested Key Field Tests =====
+
+type MetaEntity struct {
+	Meta struct {
+		EntityID string `json:"entityId"`
+	} `json:"meta"`
+	HP int `json:"hp"`
+}
+
+type MetaState struct {
+	Entities []MetaEntity `json:"entities"`
+}
+
+func TestNestedKeyField(t *testing.T) {
+	entity := func(id string, hp int) MetaEntity {
+		var e MetaEntity
+		e.Meta.EntityID, e.HP = id, hp
+		return e
+	}
+	for _, field := range []string{"meta.entityId", "/meta/entityId"} {
+		s := MustNew[MetaState, Activator](MetaState{Entities: []MetaEntity{entity("a", 1), entity("b", 2)}},
+			&Config[MetaState]{ArrayStrategy: ArrayByKey, ArrayKeyField: field})
+		s.Update(func(ms *MetaState) {
+			ms.Entities = []MetaEntity{entity("b", 5), entity("c", 3)}
+		})
+		patch, _ := s.Diff(nil)
+		data, _ := patch.JSON()
+		want := `[{"op":"remove","path":"/entities/0"},{"op":"replace","path":"/entities/0/hp","value":5},` +
+			`{"op":"add","path":"/entities/-","value":{"hp":3,"meta":{"entityId":"c"}}}]`
+		if string(data) != want {
+			t.Errorf("%s: expected\n%s\ngot\n%s", field, want, data)
+		}
+	}
+
+	// Mapped names apply to every segment
+	s := MustNew[MetaState, Activator](MetaState{Entities: []MetaEntity{entity("a", 1)}},
+		&Config[MetaState]{ArrayStrategy: ArrayByKey, ArrayKeyField: "meta.entityId", PathMapper: SnakeCase})
+	s.Update(func(ms *MetaState) { ms.Entities[0].HP = 2 })
+	if patch, _ := s.Diff(nil); len(patch) != 1 || patch[0].Path != "/entities/0/hp" {
+		t.Errorf("Expected a field op with PathMapper, got %v", patch)
+	}
+}
+
+// ===== Composite Key Tests =====
+
+type Seat struct {
+	Team  string `json:"team"`
+	Slot  int    `json:"slot"`
+	Ready bool   `json:"ready"`
+}
+
+type SeatState struct {
+	Seats []Seat `json:"seats"`
+}
+
+func TestCompositeKey(t *testing.T) {
+	cfg := &Config[SeatState]{ArrayStrategy: ArrayByKey, ArrayKeyField: "team,slot"}
+	s := MustNew[SeatState, Activator](SeatState{Seats: []Seat{{"red", 1, false}, {"blue", 1, false}, {"red", 2, false}}}, cfg)
+	s.Update(func(ss *SeatState) {
+		ss.Seats = []Seat{{"red", 1, false}, {"blue", 1, true}, {"blue", 2, false}}
+	})
+	patch, _ := s.Diff(nil)
+	data, _ := patch.JSON()
+	want := `[{"op":"remove","path":"/seats/2"},{"op":"replace","path":"/seats/1/ready","value":true},` +
+		`{"op":"add","path":"/seats/-","value":{"ready":false,"slot":2,"team":"blue"}}]`
+	if string(data) != want {
+		t.Errorf("Expected\n%s\ngot\n%s", want, data)
+	}
+
+	// A single part is not unique: the same diff keyed by team alone is a replace
+	cfg.ArrayKeyField = "team"
+	s = MustNew[SeatState, Activator](SeatState{Seats: []Seat{{"red", 1, false}, {"red", 2, false}}}, cfg)
+	s.Update(func(ss *SeatState) { ss.Seats[1].Ready = true })
+	if patch, _ := s.Diff(nil); len(patch) != 1 || patch[0].Path != "/seats" {
+		t.Errorf("Expected whole replace for ambiguous keys, got %v", patch)
+	}
+}
+
+// ===== Flap Detection Tests =====
+
+func TestFlapDetection(t *testing.T) {
+	var reports []FlapReport
+	s := MustNew[TestState, Activator](TestState{}, &Config[TestState]{
+		FlapLimit:  2,
+		FlapWindow: time.Minute,
+		OnFlap:     func(r FlapReport) { reports = append(reports, r) },
+	})
+	sess := NewSession[TestState, Activator, string](s)
+	sess.Connect("c", nil)
+
+	s.Update(func(ts *TestState) { ts.Name = "once" })
+	sess.Tick()
+	for i := 1; i <= 5; i++ {
+		s.Update(func(ts *TestState) { ts.Value = i % 2 })
+		if i%2 == 0 {
+			sess.Tick()
+		} else {
+			s.ClearPrevious()
+		}
+	}
+	if len(reports) != 1 || reports[0].Path != "/value" || reports[0].Changes != 3 || reports[0].Window != time.Minute {
+		t.Errorf("Expected one report for /value, got %+v", reports)
+	}
+
+	// Disabled by default
+	plain := MustNew[TestState, Activator](TestState{}, nil)
+	if plain.flaps != nil {
+		t.Error("Flap detection should be off without FlapLimit")
+	}
+}
+
+func TestFlapHandlerReconfigure(t *testing.T) {
+	// Run with -race: reports are delivered while OnFlap is replaced
+	type Counts struct {
+		M map[string]int `json:"m"`
+	}
+	var mu sync.Mutex
+	reports := 0
+	onFlap := func(FlapReport) {
+		mu.Lock()
+		reports++
+		mu.Unlock()
+	}
+	cfg := &Config[Counts]{FlapLimit: 1, FlapWindow: time.Hour, OnFlap: onFlap}
+	s := MustNew[Counts, Activator](Counts{M: map[string]int{}}, cfg)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.Reconfigure(func(cfg *Config[Counts]) { cfg.OnFlap = onFlap })
+		}
+	}()
+	for i := 1; i <= 100; i++ {
+		s.Update(func(c *Counts) {
+			c.M[fmt.Sprint(i)] = 1
+			c.M[fmt.Sprint(i-1)] = 2 // Second change of the previous key flaps
+		})
+		s.ClearPrevious()
+	}
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if reports != 99 {
+		t.Errorf("reports = %d, want 99", reports)
+	}
+}
+
+// ===== Ref Tests =====
+
+type RefWorld struct {
+	Entities map[string]RefEntity `json:"entities"`
+}
+
+type RefEntity struct {
+	Name string `json:"name"`
+	HP   int    `json:"hp"`
+}
+
+type RefMatch struct {
+	Target Ref   `json:"target"`
+	Allies []Ref `json:"allies,omitempty"`
+}
+
+func TestRefs(t *testing.T) {
+	world, err := New[RefWorld, Activator](RefWorld{Entities: map[string]RefEntity{
+		"42": {Name: "dragon", HP: 100},
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := RefTargets{"world": world}
+	match, err := New[RefMatch, Activator](RefMatch{Target: "/world/entities/42"}, &Config[RefMatch]{Refs: targets})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := json.Marshal(match.Get())
+	if string(data) != `{"target":{"$ref":"/world/entities/42"}}` {
+		t.Fatalf("marshal = %s", data)
+	}
+	var back RefMatch
+	if err := json.Unmarshal(data, &back); err != nil || back.Target != "/world/entities/42" {
+		t.Fatalf("unmarshal = %+v, %v", back, err)
+	}
+
+	v, ok := targets.Resolve("/world/entities/42/name")
+	if !ok || v != "dragon" {
+		t.Fatalf("Resolve = %v, %v", v, ok)
+	}
+	if _, ok := targets.Resolve("/lobby/x"); ok {
+		t.Fatal("unknown target resolved")
+	}
+
+	resolved, err := ResolveRefs(match.Get(), targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"target": map[string]any{"name": "dragon", "hp": float64(100)}}
+	if !reflect.DeepEqual(resolved, want) {
+		t.Fatalf("ResolveRefs = %#v", resolved)
+	}
+
+	// A valid ref passes at diff time
+	match.Update(func(m *RefMatch) { m.Allies = []Ref{"/world/entities/42"} })
+	if _, err := match.Diff(nil); err != nil {
+		t.Fatalf("valid ref: %v", err)
+	}
+	match.ClearPrevious()
+
+	// A dangling ref fails the diff
+	match.Update(func(m *RefMatch) { m.Target = "/world/entities/7" })
+	_, err = match.Diff(nil)
+	var re *RefError
+	if !errors.As(err, &re) || re.Ref != "/world/entities/7" || re.Path != "/target" {
+		t.Fatalf("dangling ref: %v", err)
+	}
+
+	// Until the target exists
+	world.Update(func(w *RefWorld) { w.Entities["7"] = RefEntity{Name: "imp", HP: 5} })
+	if _, err := match.Diff(nil); err != nil {
+		t.Fatalf("after target added: %v", err)
+	}
+
+	if err := ValidateRefs(RefMatch{Target: "/world/entities/9"}, targets); err == nil {
+		t.Fatal("ValidateRefs accepted a dangling ref")
+	}
+}
+
+// ===== ArrayKeyFunc Tests =====
+
+type KeyFuncState struct {
+	Users []KeyFuncUser `json:"users"`
+}
+
+type KeyFuncUser struct {
+	Handle string `json:"handle"`
+	Score  int    `json:"score"`
+}
+
+func TestArrayKeyFunc(t *testing.T) {
+	var paths []string
+	cfg := &Config[KeyFuncState]{
+		ArrayStrategy: ArrayByKey,
+		ArrayKeyFunc: func(path string, el map[string]any) (string, bool) {
+			paths = append(paths, path)
+			h, ok := el["handle"].(string)
+			return strings.TrimPrefix(strings.ToLower(h), "@"), ok
+		},
+	}
+	s, err := New[KeyFuncState, Activator](KeyFuncState{Users: []KeyFuncUser{
+		{Handle: "@Ann", Score: 1}, {Handle: "bob", Score: 2},
+	}}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The handle is normalized by the client: same keys, field-level ops
+	s.Update(func(st *KeyFuncState) {
+		st.Users[0] = KeyFuncUser{Handle: "ann", Score: 5}
+	})
+	patch, err := s.Diff(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Patch{
+		{Op: "replace", Path: "/users/0/handle", Value: "ann"},
+		{Op: "replace", Path: "/users/0/score", Value: float64(5)},
+	}
+	if !reflect.DeepEqual(patch, want) {
+		t.Fatalf("patch = %+v", patch)
+	}
+	if len(paths) == 0 || paths[0] != "/users" {
+		t.Fatalf("KeyFunc paths = %v", paths)
+	}
+	s.ClearPrevious()
+
+	// Removing a differently spelled user is a keyed remove
+	s.Update(func(st *KeyFuncState) {
+		st.Users = []KeyFuncUser{{Handle: "BOB", Score: 2}}
+	})
+	patch, _ = s.Diff(nil)
+	want = Patch{
+		{Op: "remove", Path: "/users/0"},
+		{Op: "replace", Path: "/users/0/handle", Value: "BOB"},
+	}
+	if !reflect.DeepEqual(patch, want) {
+		t.Fatalf("patch = %+v", patch)
+	}
+}
+
+// ===== Reconfigure Tests =====
+
+func TestReconfigure(t *testing.T) {
+	keys := map[string]string{"/items": "id"}
+	s, err := New[TestState, Activator](TestState{Items: []Item{{ID: "a", Data: 1}, {ID: "b", Data: 2}}}, &Config[TestState]{
+		ArrayStrategy:  ArrayByKey,
+		ArrayKeyFields: keys,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys["/items"] = "data" // The state keeps its own copy
+
+	// Invalid configs are rejected and change nothing
+	err = s.Reconfigure(func(c *Config[TestState]) {
+		c.ArrayKeyFields = nil
+	})
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+
+	s.Update(func(st *TestState) { st.Items = st.Items[1:] })
+	patch, _ := s.Diff(nil)
+	if len(patch) != 1 || patch[0].Op != "remove" || patch[0].Path != "/items/0" {
+		t.Fatalf("keyed patch = %+v", patch)
+	}
+	s.ClearPrevious()
+
+	// Switch arrays to whole replaces: no resync needed
+	if err := s.Reconfigure(func(c *Config[TestState]) { c.ArrayStrategy = ArrayReplace }); err != nil {
+		t.Fatal(err)
+	}
+	if s.HasChanges() {
+		t.Fatal("array strategy change should not force a keyframe")
+	}
+	s.Update(func(st *TestState) { st.Items = append(st.Items, Item{ID: "c"}) })
+	patch, _ = s.Diff(nil)
+	if len(patch) != 1 || patch[0].Op != "replace" || patch[0].Path != "/items" {
+		t.Fatalf("replace patch = %+v", patch)
+	}
+	s.ClearPrevious()
+
+	// Renaming keys changes the document: the next diff is a keyframe
+	if err := s.Reconfigure(func(c *Config[TestState]) { c.PathMapper = strings.ToUpper }); err != nil {
+		t.Fatal(err)
+	}
+	patch, _ = s.Diff(nil)
+	if len(patch) != 1 || patch[0].Path != "" {
+		t.Fatalf("keyframe = %+v", patch)
+	}
+	if doc, ok := patch[0].Value.(map[string]any); !ok || doc["ITEMS"] == nil {
+		t.Fatalf("keyframe value = %#v", patch[0].Value)
+	}
+}
+
+// ===== Patch Size Threshold Tests =====
+
+type SizeState struct {
+	Name  string         `json:"name"`
+	Grid  []int          `json:"grid"`
+	Stats map[string]int `json:"stats"`
+}
+
+func TestMaxPatchOps(t *testing.T) {
+	initial := SizeState{Name: "a", Grid: make([]int, 10), Stats: map[string]int{"x": 1}}
+	s, err := New[SizeState, Activator](initial, &Config[SizeState]{ArrayStrategy: ArrayByIndex, MaxPatchOps: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Small patches pass through
+	s.Update(func(st *SizeState) { st.Name = "b"; st.Grid[0] = 1 })
+	patch, _ := s.Diff(nil)
+	if len(patch) != 2 || patch[0].Path != "/grid/0" {
+		t.Fatalf("small patch = %+v", patch)
+	}
+	s.ClearPrevious()
+
+	// Many grid changes collapse into one op for the grid
+	s.Update(func(st *SizeState) {
+		st.Name = "c"
+		for i := range st.Grid {
+			st.Grid[i] = i + 2
+		}
+	})
+	patch, _ = s.Diff(nil)
+	if len(patch) != 2 || patch[0].Path != "/grid" || patch[0].Op != "add" || patch[1].Path != "/name" {
+		t.Fatalf("collapsed patch = %+v", patch)
+	}
+	assertPatchApplies(t, s, patch)
+	s.ClearPrevious()
+
+	// Too many members changed: root replace
+	s2, _ := New[SizeState, Activator](initial, &Config[SizeState]{MaxPatchOps: 1})
+	s2.Update(func(st *SizeState) { st.Name = "z"; st.Stats["y"] = 2 })
+	patch, _ = s2.Diff(nil)
+	if len(patch) != 1 || patch[0].Path != "" || patch[0].Op != "replace" {
+		t.Fatalf("root patch = %+v", patch)
+	}
+	assertPatchApplies(t, s2, patch)
+
+	// Bytes threshold
+	s3, _ := New[SizeState, Activator](initial, &Config[SizeState]{ArrayStrategy: ArrayByIndex, MaxPatchBytes: 100})
+	s3.Update(func(st *SizeState) {
+		for i := range st.Grid {
+			st.Grid[i] = 7
+		}
+	})
+	patch, _ = s3.Diff(nil)
+	if len(patch) != 1 || patch[0].Path != "/grid" {
+		t.Fatalf("bytes patch = %+v", patch)
+	}
+
+	if _, err := New[SizeState, Activator](initial, &Config[SizeState]{MaxPatchOps: -1}); err == nil {
+		t.Fatal("negative MaxPatchOps accepted")
+	}
+}
+
+// assertPatchApplies checks that patch turns the previous state into the current one
+func assertPatchApplies(t *testing.T, s *State[SizeState, Activator], patch Patch) {
+	t.Helper()
+	prev := s.previous
+	data, _ := json.Marshal(prev)
+	out, err := patch.ApplyToJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := json.Marshal(s.Get())
+	var a, b any
+	json.Unmarshal(out, &a)
+	json.Unmarshal(want, &b)
+	if !reflect.DeepEqual(a, b) {
+		t.Fatalf("applied = %s, want %s", out, want)
+	}
+}
+
+// ===== MaxDiffDepth Tests =====
+
+type DepthState struct {
+	Players []DepthPlayer `json:"players"`
+	Round   int           `json:"round"`
+}
+
+type DepthPlayer struct {
+	ID    string         `json:"id"`
+	Stats map[string]int `json:"stats"`
+}
+
+func TestMaxDiffDepth(t *testing.T) {
+	initial := DepthState{Players: []DepthPlayer{
+		{ID: "a", Stats: map[string]int{"hp": 10, "mp": 5}},
+		{ID: "b", Stats: map[string]int{"hp": 8}},
+	}}
+	cfg := &Config[DepthState]{ArrayStrategy: ArrayByKey, ArrayKeyField: "id", MaxDiffDepth: 2}
+	s, err := New[DepthState, Activator](initial, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Update(func(st *DepthState) {
+		st.Players[0].Stats["hp"] = 9
+		st.Players = append(st.Players, DepthPlayer{ID: "c"})
+		st.Round = 1
+	})
+	patch, err := s.Diff(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Elements are keyed but replaced whole; depth-1 scalars as usual
+	if len(patch) != 3 ||
+		patch[0].Op != "replace" || patch[0].Path != "/players/0" ||
+		patch[1].Op != "add" || patch[1].Path != "/players/-" ||
+		patch[2].Path != "/round" {
+		t.Fatalf("patch = %+v", patch)
+	}
+	if el, ok := patch[0].Value.(map[string]any); !ok || el["id"] != "a" {
+		t.Fatalf("replaced element = %#v", patch[0].Value)
+	}
+
+	if _, err := New[DepthState, Activator](initial, &Config[DepthState]{MaxDiffDepth: -1}); err == nil {
+		t.Fatal("negative MaxDiffDepth accepted")
+	}
+}
+
+func TestMaxDiffDepthLeaves(t *testing.T) {
+	type Doc struct {
+		X float64 `json:"x"`
+		N int     `json:"n"`
+	}
+	// Leaves past the limit still honor FloatEpsilon and NumericDeltas
+	cfg := &Config[Doc]{MaxDiffDepth: 1, FloatEpsilon: 0.1, NumericDeltas: true}
+	s, err := New[Doc, Activator](Doc{X: 1, N: 2}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Update(func(d *Doc) { d.X = 1.01; d.N = 5 })
+	patch, err := s.Diff(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) != 1 || patch[0].Op != "inc" || patch[0].Path != "/n" {
+		t.Fatalf("patch = %+v", patch)
+	}
+}
+
+// ===== Handoff Tests =====
+
+func TestHandoff(t *testing.T) {
+	state, _ := New[TestState, Activator](TestState{Value: 1}, nil)
+	session := NewSession[TestState, Activator, string](state)
+	session.Connect("alice", nil)
+	session.Connect("bob", nil)
+	state.Update(func(s *TestState) { s.Value = 2 })
+
+	var bundle []byte
+	written := make(chan struct{})
+	result, err := session.Handoff(context.Background(), map[string]string{"match": "42"}, func(ctx context.Context, data []byte) (string, error) {
+		bundle = data
+		// Writers wait until the handoff is over
+		go func() {
+			state.Update(func(s *TestState) { s.Value = 99 })
+			close(written)
+		}()
+		select {
+		case <-written:
+			t.Error("update ran during the handoff")
+		case <-time.After(20 * time.Millisecond):
+		}
+		return "wss://b.example/match/42", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-written
+
+	if len(result.Final) != 2 || !strings.Contains(string(result.Final["alice"]), `"value":2`) {
+		t.Fatalf("final = %s", result.Final["alice"])
+	}
+	if string(result.Redirect) != `{"redirect":"wss://b.example/match/42"}` {
+		t.Fatalf("redirect = %s", result.Redirect)
+	}
+
+	restored, clients, err := ResumeHandoff[TestState, Activator, string](bundle, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.State.Get().Value != 2 {
+		t.Fatalf("restored value = %d", restored.State.Get().Value)
+	}
+	if !reflect.DeepEqual(clients, []string{"alice", "bob"}) && !reflect.DeepEqual(clients, []string{"bob", "alice"}) {
+		t.Fatalf("clients = %v", clients)
+	}
+
+	// A failed transfer leaves the session running
+	_, err = session.Handoff(context.Background(), nil, func(context.Context, []byte) (string, error) {
+		return "", errors.New("target down")
+	})
+	if err == nil {
+		t.Fatal("expected transfer error")
+	}
+	state.Update(func(s *TestState) { s.Value = 3 })
+	if state.Get().Value != 3 {
+		t.Fatal("state stayed frozen")
+	}
+}
+
+// ===== FloatEpsilon Tests =====
+
+type EpsState struct {
+	X     float64 `json:"x"`
+	Count int     `json:"count"`
+}
+
+func TestFloatEpsilon(t *testing.T) {
+	s, err := New[EpsState, Activator](EpsState{X: 1.0}, &Config[EpsState]{FloatEpsilon: 0.01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Update(func(st *EpsState) { st.X = 1.004 })
+	if patch, _ := s.Diff(nil); len(patch) != 0 {
+		t.Fatalf("jitter patch = %+v", patch)
+	}
+	s.ClearPrevious()
+
+	s.Update(func(st *EpsState) { st.X = 1.5; st.Count = 1 })
+	patch, _ := s.Diff(nil)
+	if len(patch) != 2 || patch[1].Path != "/x" || patch[1].Value != 1.5 {
+		t.Fatalf("patch = %+v", patch)
+	}
+	s.ClearPrevious()
+
+	// Drift is measured from the value last sent
+	for i, want := range []int{0, 0, 1} {
+		s.Update(func(st *EpsState) { st.X += 0.004 })
+		if patch, _ := s.Diff(nil); len(patch) != want {
+			t.Fatalf("step %d: patch = %+v", i, patch)
+		}
+		s.ClearPrevious()
+	}
+
+	if _, err := New[EpsState, Activator](EpsState{}, &Config[EpsState]{FloatEpsilon: -1}); err == nil {
+		t.Fatal("negative FloatEpsilon accepted")
+	}
+}
+
+func TestFloatEpsilonDrift(t *testing.T) {
+	type Body struct {
+		Pos float64 `json:"pos"`
+	}
+	type World struct {
+		X      float64 `json:"x"`
+		Bodies []Body  `json:"bodies"`
+	}
+	const eps = 0.01
+	s := MustNew[World, Activator](World{Bodies: []Body{{}, {}}}, &Config[World]{FloatEpsilon: eps, ArrayStrategy: ArrayByIndex})
+	sess := NewSession[World, Activator, string](s)
+	sess.Connect("all", nil)
+	sess.Connect("proj", func(w World) World {
+		w.Bodies = append([]Body(nil), w.Bodies...)
+		w.Bodies[0].Pos = 0 // Hidden
+		return w
+	})
+	clients := map[string][]byte{}
+	for id := range map[string]bool{"all": true, "proj": true} {
+		full, _ := sess.Full(id)
+		var p Patch
+		json.Unmarshal(full, &p)
+		clients[id], _ = p.ApplyToJSON([]byte("null"))
+	}
+
+	var sent int
+	for i := 1; i <= 100; i++ {
+		s.Update(func(w *World) {
+			w.X += eps / 2
+			w.Bodies[1].Pos -= eps / 2
+		})
+		for id, data := range sess.Tick() {
+			var p Patch
+			if err := json.Unmarshal(data, &p); err != nil {
+				t.Fatal(err)
+			}
+			var err error
+			if clients[id], err = p.ApplyToJSON(clients[id]); err != nil {
+				t.Fatal(err)
+			}
+			sent++
+		}
+		server := s.Get()
+		for id, doc := range clients {
+			var got World
+			json.Unmarshal(doc, &got)
+			pos := got.Bodies[1].Pos
+			if math.Abs(got.X-server.X) > eps || math.Abs(pos-server.Bodies[1].Pos) > eps {
+				t.Fatalf("tick %d: %s has x=%v pos=%v, server x=%v pos=%v", i, id, got.X, pos, server.X, server.Bodies[1].Pos)
+			}
+		}
+	}
+	if sent == 0 || sent > 2*60 {
+		t.Errorf("%d payloads for 100 half-epsilon steps", sent)
+	}
+}
+
+// ===== UseNumber Tests =====
+
+type BigIntState struct {
+	IDs   []int64 `json:"ids"`
+	Owner int64   `json:"owner"`
+	Pos   float64 `json:"pos"`
+}
+
+func TestUseNumber(t *testing.T) {
+	const big = int64(1<<53 + 1)
+	s, err := New[BigIntState, Activator](BigIntState{Owner: big}, &Config[BigIntState]{
+		UseNumber:      true,
+		FloatPrecision: map[string]int{"/owner": 0, "/pos": 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2^53+1 and 2^53+2 are the same float64: without UseNumber no op is sent
+	s.Update(func(st *BigIntState) { st.Owner = big + 1; st.Pos = 1.26 })
+	patch, err := s.Diff(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Patch{
+		{Op: "replace", Path: "/owner", Value: json.Number("9007199254740994")},
+		{Op: "replace", Path: "/pos", Value: json.Number("1.3")},
+	}
+	if !reflect.DeepEqual(patch, want) {
+		t.Fatalf("patch = %+v", patch)
+	}
+	data, _ := patch.JSON()
+	if !strings.Contains(string(data), `"value":9007199254740994`) {
+		t.Fatalf("json = %s", data)
+	}
+}
+
+// ===== IgnorePaths Tests =====
+
+type IgnoreState struct {
+	Round   int            `json:"round"`
+	Tick    int            `json:"tick"` // Server bookkeeping
+	Players []IgnorePlayer `json:"players"`
+}
+
+type IgnorePlayer struct {
+	ID        string `json:"id"`
+	Score     int    `json:"score"`
+	LastInput int64  `json:"lastInput"`
+}
+
+func TestIgnorePaths(t *testing.T) {
+	cfg, err := Configure[IgnoreState]().
+		ArraysByKey("id").
+		Ignore("/tick", "/players/*/lastInput").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New[IgnoreState, Activator](IgnoreState{Players: []IgnorePlayer{{ID: "a"}}}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Update(func(st *IgnoreState) {
+		st.Tick++
+		st.Players[0].LastInput = 123
+	})
+	if patch, _ := s.Diff(nil); len(patch) != 0 {
+		t.Fatalf("ignored changes sent: %+v", patch)
+	}
+	s.ClearPrevious()
+
+	s.Update(func(st *IgnoreState) {
+		st.Tick++
+		st.Players[0].Score = 5
+		st.Players = append(st.Players, IgnorePlayer{ID: "b", LastInput: 9})
+	})
+	patch, _ := s.Diff(nil)
+	want := Patch{
+		{Op: "replace", Path: "/players/0/score", Value: float64(5)},
+		{Op: "add", Path: "/players/-", Value: map[string]any{"id": "b", "score": float64(0)}},
+	}
+	if !reflect.DeepEqual(patch, want) {
+		t.Fatalf("patch = %+v", patch)
+	}
+
+	session := NewSession[IgnoreState, Activator, string](s)
+	session.Connect("c", nil)
+	full, _ := session.Full("c")
+	if strings.Contains(string(full), "tick") || strings.Contains(string(full), "lastInput") {
+		t.Fatalf("full state leaks ignored paths: %s", full)
+	}
+
+	desc := Describe(cfg)
+	for _, f := range desc.Fields {
+		if f.JSONName == "tick" {
+			t.Fatal("Describe lists an ignored field")
+		}
+	}
+
+	if _, err := New[IgnoreState, Activator](IgnoreState{}, &Config[IgnoreState]{IgnorePaths: []string{""}}); err == nil {
+		t.Fatal("root IgnorePaths accepted")
+	}
+}
+
+// ===== IncludeOld Tests =====
+
+func TestIncludeOld(t *testing.T) {
+	s, err := New[TestState, Activator](TestState{Value: 1, Name: "a", Items: []Item{{ID: "x", Data: 1}, {ID: "y", Data: 2}}},
+		&Config[TestState]{IncludeOld: true, ArrayStrategy: ArrayByKey, ArrayKeyField: "id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Update(func(st *TestState) {
+		st.Value = 2
+		st.Items = []Item{{ID: "y", Data: 3}}
+	})
+	patch, _ := s.Diff(nil)
+	want := Patch{
+		{Op: "remove", Path: "/items/0", Old: map[string]any{"id": "x", "data": float64(1)}},
+		{Op: "replace", Path: "/items/0/data", Value: float64(3), Old: float64(2)},
+		{Op: "replace", Path: "/value", Value: float64(2), Old: float64(1)},
+	}
+	if !reflect.DeepEqual(patch, want) {
+		t.Fatalf("patch = %+v", patch)
+	}
+	data, _ := patch.JSON()
+	if !strings.Contains(string(data), `{"op":"replace","path":"/value","value":2,"old":1}`) {
+		t.Fatalf("json = %s", data)
+	}
+
+	// Squashing two replaces keeps the first old value
+	sq := Squash(Patch{{Op: "replace", Path: "/value", Value: 2, Old: 1}}, Patch{{Op: "replace", Path: "/value", Value: 3, Old: 2}})
+	if len(sq) != 1 || sq[0].Old != 1 || sq[0].Value != 3 {
+		t.Fatalf("squash = %+v", sq)
+	}
+}
+
+// ===== MessagePack Tests =====
+
+func TestPatchMsgPack(t *testing.T) {
+	patch := Patch{
+		{Op: "replace", Path: "/hp", Value: float64(5)},
+		{Op: "remove", Path: "/x"},
+		{Op: "add", Path: "/f", Value: map[string]any{"b": 1.5, "a": json.Number("-300")}},
+	}
+	got, err := patch.MsgPack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	str := func(s string) []byte { return append([]byte{0xa0 | byte(len(s))}, s...) }
+	var want []byte
+	want = append(want, 0x93)
+	want = append(want, 0x83)
+	want = append(append(append(want, str("op")...), str("replace")...), str("path")...)
+	want = append(append(append(want, str("/hp")...), str("value")...), 0x05)
+	want = append(want, 0x82)
+	want = append(append(append(append(want, str("op")...), str("remove")...), str("path")...), str("/x")...)
+	want = append(want, 0x83)
+	want = append(append(append(want, str("op")...), str("add")...), str("path")...)
+	want = append(append(append(want, str("/f")...), str("value")...), 0x82)
+	want = append(append(want, str("a")...), 0xd1, 0xfe, 0xd4) // int16 -300
+	want = append(append(want, str("b")...), 0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("msgpack = % x\nwant      % x", got, want)
+	}
+
+	// Sessions send it to clients that asked for it
+	state, _ := New[TestState, Activator](TestState{Value: 1}, nil)
+	session := NewSession[TestState, Activator, string](state)
+	session.Connect("m", nil, WithEncoder[TestState](MsgPackEncoder))
+	state.Update(func(s *TestState) { s.Value = 2 })
+	out := session.Tick()["m"]
+	if len(out) == 0 || out[0] != 0x91 {
+		t.Fatalf("tick payload = % x", out)
+	}
+	full, err := session.Full("m")
+	if err != nil || len(full) == 0 || full[0] != 0x91 {
+		t.Fatalf("full payload = % x, %v", full, err)
+	}
+}
+
+// ===== CBOR Tests =====
+
+type BlobState struct {
+	Name    string            `json:"name"`
+	Texture []byte            `json:"texture"`
+	Count   int64             `json:"count,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+}
+
+func TestCBOR(t *testing.T) {
+	patch := Patch{{Op: "replace", Path: "/n", Value: float64(-2)}, {Op: "remove", Path: "/x"}}
+	got, err := patch.CBOR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0x82,
+		0xa3, 0x62, 'o', 'p', 0x67, 'r', 'e', 'p', 'l', 'a', 'c', 'e', 0x64, 'p', 'a', 't', 'h', 0x62, '/', 'n', 0x65, 'v', 'a', 'l', 'u', 'e', 0x21,
+		0xa2, 0x62, 'o', 'p', 0x66, 'r', 'e', 'm', 'o', 'v', 'e', 0x64, 'p', 'a', 't', 'h', 0x62, '/', 'x'}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("cbor = % x\nwant   % x", got, want)
+	}
+
+	// Blobs in typed values are byte strings
+	blob := BlobState{Name: "tex", Texture: []byte{1, 2, 3, 4}, Count: 1 << 40}
+	data, err := MarshalCBOR(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte{0x44, 1, 2, 3, 4}) {
+		t.Fatalf("texture not a byte string: % x", data)
+	}
+	var back BlobState
+	if err := UnmarshalCBOR(data, &back); err != nil || !reflect.DeepEqual(back, blob) {
+		t.Fatalf("round trip = %+v, %v", back, err)
+	}
+
+	// Full states through the session encoder
+	state, _ := New[BlobState, Activator](blob, nil)
+	session := NewSession[BlobState, Activator, string](state)
+	session.Connect("c", nil, WithEncoder[BlobState](CBOREncoder))
+	full, err := session.Full("c")
+	if err != nil || !bytes.Contains(full, []byte{0x44, 1, 2, 3, 4}) {
+		t.Fatalf("full = % x, %v", full, err)
+	}
+
+	// Snapshots
+	path := t.TempDir() + "/state.cbor"
+	if err := SaveCBOR(path, state, nil, map[string]int{"round": 3}); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := Load[BlobState](path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(snap.State, blob) || string(snap.Extra) != `{"round":3}` {
+		t.Fatalf("snapshot = %+v extra %s", snap.State, snap.Extra)
+	}
+	if err := UnmarshalCBOR([]byte{0x82, 0x01}, new(any)); err == nil {
+		t.Fatal("truncated input accepted")
+	}
+}
+
+// ===== Compact Patch Tests =====
+
+func TestCompactPatch(t *testing.T) {
+	patch := Patch{
+		{Op: "replace", Path: "/entities/42/hp", Value: float64(90)},
+		{Op: "replace", Path: "/entities/42/mp", Value: float64(12)},
+		{Op: "move", Path: "/entities/7/slot", From: "/entities/42/slot"},
+		{Op: "remove", Path: "/round"},
+	}
+	data, err := patch.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"paths":["/entities/42"],"ops":[{"op":"replace","path":"0/hp","value":90},` +
+		`{"op":"replace","path":"0/mp","value":12},{"op":"move","path":"/entities/7/slot","from":"0/slot"},` +
+		`{"op":"remove","path":"/round"}]}`
+	if string(data) != want {
+		t.Fatalf("compact = %s\nwant      %s", data, want)
+	}
+	back, err := ParseCompact(data)
+	if err != nil || !reflect.DeepEqual(back, patch) {
+		t.Fatalf("parse = %+v, %v", back, err)
+	}
+
+	if data, _ := (Patch{}).Compact(); string(data) != `{"ops":[]}` {
+		t.Errorf("empty = %s", data)
+	}
+	if _, err := ParseCompact([]byte(`{"ops":[{"op":"remove","path":"3/x"}]}`)); err == nil {
+		t.Error("dangling reference accepted")
+	}
+}
+
+// ===== Document Walk Tests =====
+
+type walkEmbedded struct {
+	Level int    `json:"level"`
+	Skin  string `json:"skin,omitempty"`
+}
+
+type walkLabel string
+
+func (l walkLabel) MarshalText() ([]byte, error) { return []byte("label:" + l), nil }
+
+type WalkState struct {
+	walkEmbedded
+	*PtrState
+	Name    string             `json:"name"`
+	F32     float32            `json:"f32"`
+	Tiny    float64            `json:"tiny"`
+	Big     uint64             `json:"big"`
+	Blob    []byte             `json:"blob"`
+	Grid    [2][2]int8         `json:"grid"`
+	ByID    map[int]string     `json:"byId"`
+	Labels  map[walkLabel]bool `json:"labels"`
+	Label   walkLabel          `json:"label"`
+	Any     any                `json:"any"`
+	At      time.Time          `json:"at"`
+	Raw     json.RawMessage    `json:"raw"`
+	Bad     string             `json:"bad"`
+	Skipped int                `json:"-"`
+	hidden  int
+}
+
+func TestDocumentWalk(t *testing.T) {
+	v := WalkState{
+		walkEmbedded: walkEmbedded{Level: 3},
+		Name:         "<a&b>",
+		F32:          0.1,
+		Tiny:         1e-9,
+		Big:          1<<63 + 1,
+		Blob:         []byte{0, 1, 2},
+		Grid:         [2][2]int8{{1, -2}, {3, 4}},
+		ByID:         map[int]string{7: "x"},
+		Labels:       map[walkLabel]bool{"a": true},
+		Label:        "l",
+		Any:          map[string]any{"n": []any{1, "s", nil, 2.5}},
+		At:           time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Raw:          json.RawMessage(`{"k":[1,2]}`),
+		Bad:          "\xff",
+		Skipped:      1,
+		hidden:       2,
+	}
+	if _, ok := walkableFields(reflect.TypeOf(v)); !ok {
+		t.Fatal("WalkState not walked")
+	}
+	type quoted struct {
+		N int `json:"n,string"`
+	}
+	for _, numbers := range []bool{false, true} {
+		o := &diffOptions{numbers: numbers}
+		if doc, _ := o.document(quoted{N: 4}); !reflect.DeepEqual(doc, map[string]any{"n": "4"}) {
+			t.Errorf("quoted = %#v", doc)
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := o.decode(data)
+		want.(map[string]any)["raw"] = v.Raw // Kept verbatim
+		got, err := o.document(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("numbers=%v:\ngot  %#v\nwant %#v", numbers, got, want)
+		}
+		v.PtrState = &PtrState{HP: intPtr(5)}
+	}
+
+	if _, err := (*diffOptions)(nil).document(map[string]any{"f": func() {}}); err == nil {
+		t.Error("unsupported value accepted")
+	}
+}
+
+// ===== Previous Cache Tests =====
+
+var countedMarshals int
+
+type counted int
+
+func (c counted) MarshalJSON() ([]byte, error) {
+	countedMarshals++
+	return json.Marshal(int(c))
+}
+
+type CountedState struct {
+	N counted `json:"n"`
+	M int     `json:"m"`
+}
+
+func TestPreviousCache(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		s, _ := New[CountedState, Activator](CountedState{}, &Config[CountedState]{
+			Cloner:               func(c CountedState) CountedState { return c },
+			DisablePreviousCache: disable,
+		})
+		s.Update(func(c *CountedState) { c.N = 1 })
+		countedMarshals = 0
+		for i := 0; i < 3; i++ {
+			patch, err := s.Diff(nil)
+			if err != nil || len(patch) != 1 || patch[0].Path != "/n" {
+				t.Fatalf("diff %d = %v, %v", i, patch, err)
+			}
+		}
+		want := 4 // The previous state once, the current one per diff
+		if disable {
+			want = 6
+		}
+		if countedMarshals != want {
+			t.Errorf("disable=%v: %d marshals, want %d", disable, countedMarshals, want)
+		}
+
+		// A new change invalidates the cached document
+		s.ClearPrevious()
+		s.Update(func(c *CountedState) { c.M = 2 })
+		if patch, _ := s.Diff(nil); len(patch) != 1 || patch[0].Path != "/m" {
+			t.Errorf("after update = %v", patch)
+		}
+		s.Update(func(c *CountedState) { c.N = 3 }) // Keeps the pending previous
+		if patch, _ := s.Diff(nil); len(patch) != 2 || patch[0].Path != "/m" || patch[1].Path != "/n" {
+			t.Errorf("after second update = %v", patch)
+		}
+	}
+}
+
+// ===== Parallel Diff Tests =====
+
+type Entity struct {
+	HP   int      `json:"hp"`
+	Pos  [2]int   `json:"pos"`
+	Tags []string `json:"tags"`
+}
+
+type WorldState struct {
+	Entities map[string]Entity `json:"entities"`
+	Tick     int               `json:"tick"`
+}
+
+func TestDiffWorkers(t *testing.T) {
+	world := func(seed int) WorldState {
+		w := WorldState{Entities: make(map[string]Entity), Tick: seed}
+		for i := 0; i < 300; i++ {
+			if (i+seed)%7 == 0 {
+				continue // Removed or added between the two worlds
+			}
+			w.Entities[fmt.Sprint("e", i)] = Entity{HP: i * (1 + seed%3*(i%2)), Pos: [2]int{i, i % 5}, Tags: []string{"a", fmt.Sprint(i % (seed + 2))}}
+		}
+		return w
+	}
+	old, new := world(1), world(2)
+
+	want, err := calcDiff(old, new, ArrayConfig{})
+	if err != nil || len(want) < 100 {
+		t.Fatalf("sequential = %d ops, %v", len(want), err)
+	}
+	for i := 0; i < 5; i++ {
+		s, err := New[WorldState, Activator](old, &Config[WorldState]{DiffWorkers: 8})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Set(new)
+		got, err := s.Diff(nil)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("parallel diff differs: %d ops vs %d, %v", len(got), len(want), err)
+		}
+	}
+
+	if _, err := New[WorldState, Activator](old, &Config[WorldState]{DiffWorkers: -1}); err == nil {
+		t.Error("negative DiffWorkers accepted")
+	}
+}
+
+// ===== Streaming Writer Tests =====
+
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+	fail   bool
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.fail {
+		return 0, errors.New("closed")
+	}
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestPatchWriteTo(t *testing.T) {
+	patch := Patch{
+		{Op: "replace", Path: "/a<b>", Value: map[string]any{"x": []any{1.5, "&"}}},
+		{Op: "remove", Path: "/gone", Old: json.RawMessage(` { "k" : 1 } `)},
+		{Op: "move", Path: "/to", From: "/from"},
+	}
+	for i := 0; i < 5000; i++ {
+		patch = append(patch, Op{Op: "add", Path: fmt.Sprintf("/entities/%d", i), Value: Item{ID: fmt.Sprint(i), Data: i}})
+	}
+	for _, p := range []Patch{nil, patch[:3], patch} {
+		want, _ := p.JSON()
+		var w countingWriter
+		n, err := p.WriteTo(&w)
+		if err != nil || n != int64(len(want)) || w.String() != string(want) {
+			t.Fatalf("%d ops: wrote %d bytes, %v; differs from JSON: %v", len(p), n, err, w.String() != string(want))
+		}
+		if len(p) == len(patch) && w.writes < 2 {
+			t.Errorf("large patch written in %d writes", w.writes)
+		}
+	}
+
+	if _, err := patch.WriteTo(&countingWriter{fail: true}); err == nil {
+		t.Error("write error not returned")
+	}
+	bad := Patch{{Op: "add", Path: "/f", Value: func() {}}}
+	if _, err := bad.WriteTo(io.Discard); err == nil {
+		t.Error("unsupported value accepted")
+	}
+}
+
+// ===== Canonicalize Tests =====
+
+func TestCanonicalize(t *testing.T) {
+	a := Patch{
+		{Op: "replace", Path: "/z", Value: Item{ID: "x", Data: 1}},
+		{Op: "remove", Path: "/items/3"},
+		{Op: "remove", Path: "/items/1"},
+		{Op: "add", Path: "/b", Value: nil},
+		{Op: "add", Path: "/items/-", Value: 5},
+	}
+	b := Patch{
+		{Op: "add", Path: "/b", Value: json.RawMessage("null")},
+		{Op: "remove", Path: "/items/3"},
+		{Op: "replace", Path: "/z", Value: map[string]any{"data": 1, "id": "x"}},
+		{Op: "remove", Path: "/items/1"},
+		{Op: "add", Path: "/items/-", Value: 5.0},
+	}
+	ca, err := a.Canonicalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb, _ := b.Canonicalize()
+	ja, _ := ca.JSON()
+	jb, _ := cb.JSON()
+	want := `[{"op":"add","path":"/b","value":null},{"op":"remove","path":"/items/3"},{"op":"remove","path":"/items/1"},` +
+		`{"op":"add","path":"/items/-","value":5},{"op":"replace","path":"/z","value":{"data":1,"id":"x"}}]`
+	if string(ja) != want || string(jb) != want {
+		t.Fatalf("canonical:\n%s\n%s\nwant %s", ja, jb, want)
+	}
+
+	// Applies like the original
+	doc := []byte(`{"items":[0,1,2,3,4],"z":null}`)
+	r1, err1 := a.ApplyToJSON(doc)
+	r2, err2 := ca.ApplyToJSON(doc)
+	if err1 != nil || err2 != nil || string(r1) != string(r2) {
+		t.Errorf("apply: %s (%v) vs %s (%v)", r1, err1, r2, err2)
+	}
+
+	if _, err := (Patch{{Op: "add", Path: "/f", Value: func() {}}}).Canonicalize(); err == nil {
+		t.Error("unsupported value accepted")
+	}
+}
+
+func TestCanonicalizeShiftedElements(t *testing.T) {
+	doc := []byte(`{"a":[{"x":0},{"x":1},{"x":2},{"x":3},{"x":4},{"x":5},{"x":6},{"x":7},{"x":8},{"x":9},{"x":10},{"x":11}],"b":0}`)
+	patches := []Patch{
+		{{Op: "remove", Path: "/a/3"}, {Op: "replace", Path: "/a/10/x", Value: "new"}},
+		{{Op: "add", Path: "/a/0", Value: map[string]any{"x": -1}}, {Op: "remove", Path: "/a/10/x"}},
+		{{Op: "replace", Path: "/b", Value: 1}, {Op: "add", Path: "/a/-", Value: 1}, {Op: "move", From: "/a/11/x", Path: "/b"}},
+	}
+	for i, p := range patches {
+		c, err := p.Canonicalize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err1 := p.ApplyToJSON(doc)
+		got, err2 := c.ApplyToJSON(doc)
+		if err1 != nil || err2 != nil || string(got) != string(want) {
+			t.Errorf("Case %d: canonical %v gives %s (%v), want %s (%v)", i, c, got, err2, want, err1)
+		}
+	}
+}
+
+// ===== Patch Validation Tests =====
+
+func TestPatchValidate(t *testing.T) {
+	bad := []struct {
+		patch Patch
+		index int
+		want  string
+	}{
+		{Patch{{Op: "merge", Path: "/a"}}, 0, "unknown op"},
+		{Patch{{Op: "add", Path: "a"}}, 0, "start with /"},
+		{Patch{{Op: "remove", Path: "/a~2b"}}, 0, "~ must be followed"},
+		{Patch{{Op: "replace", Path: "/a", From: "/b"}}, 0, "from is only allowed"},
+		{Patch{{Op: "move", Path: "/a/b", From: "/a"}}, 0, "own child"},
+		{Patch{{Op: "copy", Path: "/a", From: "b"}}, 0, "from: invalid"},
+		{Patch{{Op: "replace", Path: "/a", Value: 1}, {Op: "remove", Path: "/a"}}, 1, "already written"},
+		{Patch{{Op: "remove", Path: "/l/1"}, {Op: "remove", Path: "/l/3"}}, 1, "descending"},
+		{Patch{{Op: "replace", Path: "/l/0/x", Value: 1}, {Op: "remove", Path: "/l/0"}}, 1, "shifts an element"},
+		{Patch{{Op: "add", Path: "/l/-", Value: 1}, {Op: "remove", Path: "/l/3"}}, 1, "shifts an element"},
+		{Patch{{Op: "add", Path: "/l/4", Value: 1}, {Op: "replace", Path: "/l/2", Value: 1}}, 1, "ascending"},
+	}
+	for _, tc := range bad {
+		err := tc.patch.Validate()
+		var pe *PatchError
+		if !errors.As(err, &pe) || pe.Index != tc.index || !strings.Contains(pe.Reason, tc.want) {
+			t.Errorf("%v: got %v, want op %d %q", tc.patch, err, tc.index, tc.want)
+		}
+	}
+
+	good := Patch{
+		{Op: "remove", Path: "/l/5"},
+		{Op: "remove", Path: "/l/2"},
+		{Op: "replace", Path: "/l/0/name", Value: "x"},
+		{Op: "add", Path: "/l/3", Value: 1},
+		{Op: "add", Path: "/l/-", Value: 2},
+		{Op: "replace", Path: "/name", Value: "n"},
+		{Op: "test", Path: "/name", Value: "n"},
+		{Op: "add", Path: "/a~1b", Value: 1},
+	}
+	if err := good.Validate(); err != nil {
+		t.Errorf("valid patch rejected: %v", err)
+	}
+
+	// Numeric object keys need the document
+	byID := Patch{{Op: "replace", Path: "/byId/10/hp", Value: 1}, {Op: "remove", Path: "/byId/9"}}
+	doc := map[string]any{"byId": map[string]any{"10": map[string]any{"hp": 2}, "9": 1}}
+	if byID.Validate() == nil {
+		t.Error("numeric keys taken for object members without the document")
+	}
+	if err := byID.ValidateAgainst(doc); err != nil {
+		t.Errorf("ValidateAgainst: %v", err)
+	}
+	if err := (Patch{{Op: "remove", Path: "/missing"}}).ValidateAgainst(doc); err == nil {
+		t.Error("missing path accepted")
+	}
+
+	// Diffs pass, whatever the array strategy
+	old := TestState{Name: "a", Items: []Item{{"a", 1}, {"b", 2}, {"c", 3}, {"d", 4}, {"e", 5}}}
+	new := TestState{Name: "b", Items: []Item{{"e", 50}, {"b", 2}, {"f", 6}, {"a", 1}, {"g", 7}, {"d", 4}, {"h", 8}}}
+	for _, cfg := range []*Config[TestState]{
+		{ArrayStrategy: ArrayByIndex},
+		{ArrayStrategy: ArrayLCS},
+		{ArrayStrategy: ArrayByKey, ArrayKeyField: "id"},
+		{ArrayStrategy: ArrayByKey, ArrayKeyField: "id", DetectMoves: true},
+	} {
+		for _, pair := range [][2]TestState{{old, new}, {new, old}} {
+			s, _ := New[TestState, Activator](pair[0], cfg)
+			s.Set(pair[1])
+			patch, _ := s.Diff(nil)
+			if err := patch.ValidateAgainst(pair[0]); err != nil {
+				t.Errorf("%+v: %v\n%v", cfg, err, patch)
+			}
+		}
+	}
+}
+
+// ===== DiffValues Tests =====
+
+func TestDiffValues(t *testing.T) {
+	old := TestState{Value: 1, Items: []Item{{"a", 1}, {"b", 2}}}
+	new := TestState{Value: 2, Items: []Item{{"b", 3}}}
+
+	patch, err := DiffValues(old, new, ArrayConfig{Strategy: ArrayByKey, KeyField: "id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := patch.JSON()
+	want := `[{"op":"remove","path":"/items/0"},{"op":"replace","path":"/items/0/data","value":3},{"op":"replace","path":"/value","value":2}]`
+	if string(data) != want {
+		t.Errorf("patch = %s\nwant    %s", data, want)
+	}
+
+	// With a state's full configuration
+	s, _ := New[TestState, Activator](old, &Config[TestState]{PathMapper: strings.ToUpper})
+	patch, _ = DiffValues(old, new, s.DiffConfig())
+	if len(patch) != 2 || patch[1].Path != "/VALUE" {
+		t.Errorf("with state config = %v", patch)
+	}
+}
+
+// ===== Indexed Adds Tests =====
+
+func TestArrayIndexedAdds(t *testing.T) {
+	items := func(ids ...string) []Item {
+		out := make([]Item, len(ids))
+		for i, id := range ids {
+			out[i] = Item{ID: id, Data: 1}
+		}
+		return out
+	}
+	tests := []struct {
+		name     string
+		old, new []Item
+		want     string
+	}{
+		{"insert", items("a", "b", "c", "d"), items("a", "b", "x", "c", "d"),
+			`[{"op":"add","path":"/items/2","value":{"data":1,"id":"x"}}]`},
+		{"remove", items("a", "b", "c", "d"), items("a", "c", "d"),
+			`[{"op":"remove","path":"/items/1"}]`},
+		{"append", items("a"), items("a", "b"),
+			`[{"op":"add","path":"/items/-","value":{"data":1,"id":"b"}}]`},
+		{"change and insert", items("a", "b", "c"), items("a", "B", "x", "c"),
+			`[{"op":"replace","path":"/items/1/id","value":"B"},{"op":"add","path":"/items/2","value":{"data":1,"id":"x"}}]`},
+		{"shrink in middle", items("a", "b", "c", "d", "e"), items("a", "X", "e"),
+			`[{"op":"remove","path":"/items/3"},{"op":"remove","path":"/items/2"},{"op":"replace","path":"/items/1/id","value":"X"}]`},
+	}
+	for _, tc := range tests {
+		old := TestState{Items: tc.old}
+		s, _ := New[TestState, Activator](old, &Config[TestState]{ArrayStrategy: ArrayByIndex, ArrayIndexedAdds: true})
+		s.Update(func(ts *TestState) { ts.Items = tc.new })
+		patch, _ := s.Diff(nil)
+		if data, _ := patch.JSON(); string(data) != tc.want {
+			t.Errorf("%s: patch = %s\nwant %s", tc.name, data, tc.want)
+		}
+		if err := patch.ValidateAgainst(old); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		var got TestState
+		got.Items = tc.old
+		if err := patch.Apply(&got); err != nil || !reflect.DeepEqual(got.Items, tc.new) {
+			t.Errorf("%s: applied = %v, %v", tc.name, got.Items, err)
+		}
+	}
+}
+
+// ===== Keyed Arrays As Objects Tests =====
+
+type TableCard struct {
+	UID  string `json:"uid"`
+	Cost int    `json:"cost"`
+}
+
+type TableSeat struct {
+	Name  string      `json:"name"`
+	Score int         `json:"score"`
+	Hand  []TableCard `json:"hand"`
+}
+
+type TableState struct {
+	Players []TableSeat `json:"players"`
+}
+
+func TestKeyedArraysAsObjects(t *testing.T) {
+	initial := TableState{Players: []TableSeat{
+		{Name: "alice", Score: 1, Hand: []TableCard{{"c1", 3}}},
+		{Name: "bob", Score: 2},
+	}}
+	cfg := &Config[TableState]{
+		ArrayStrategy:        ArrayByKey,
+		ArrayKeyFields:       map[string]string{"/players": "name", "/players/*/hand": "uid"},
+		KeyedArraysAsObjects: true,
+	}
+	s, err := New[TableState, Activator](initial, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []ElementEvent
+	s.OnElementEvent(func(ev ElementEvent) { events = append(events, ev) })
+
+	s.Update(func(ts *TableState) {
+		ts.Players[0], ts.Players[1] = ts.Players[1], ts.Players[0] // Order is not sent
+		ts.Players[1].Score = 5
+		ts.Players[1].Hand[0].Cost = 4
+		ts.Players = append(ts.Players, TableSeat{Name: "carol"})
+	})
+	patch, _ := s.Diff(nil)
+	data, _ := patch.JSON()
+	want := `[{"op":"replace","path":"/players/alice/hand/c1/cost","value":4},{"op":"replace","path":"/players/alice/score","value":5},` +
+		`{"op":"add","path":"/players/carol","value":{"hand":null,"name":"carol","score":0}}]`
+	if string(data) != want {
+		t.Errorf("patch = %s\nwant    %s", data, want)
+	}
+	s.ClearPrevious()
+	if len(events) != 3 || events[0].Key != "carol" { // Events still see the arrays
+		t.Errorf("events = %+v", events)
+	}
+
+	session := NewSession[TableState, Activator, string](s)
+	session.Connect("c", nil)
+	full, _ := session.Full("c")
+	if !strings.Contains(string(full), `"players":{"alice":{`) {
+		t.Errorf("full = %s", full)
+	}
+
+	if desc := Describe(cfg); desc.Fields[0].Type.Kind != "map" || desc.Fields[0].Type.KeyField != "name" {
+		t.Errorf("describe = %+v", desc.Fields[0].Type)
+	}
+	if _, err := New[TableState, Activator](initial, &Config[TableState]{KeyedArraysAsObjects: true}); err == nil {
+		t.Error("KeyedArraysAsObjects without ArrayByKey accepted")
+	}
+}
+
+// ===== Numeric Delta Tests =====
+
+type CounterState struct {
+	Score int     `json:"score"`
+	Gold  int64   `json:"gold"`
+	Speed float64 `json:"speed"`
+	Name  string  `json:"name"`
+}
+
+func TestNumericDeltas(t *testing.T) {
+	initial := CounterState{Score: 100, Gold: 7, Speed: 1.5, Name: "a"}
+	for _, useNumber := range []bool{false, true} {
+		s, err := New[CounterState, Activator](initial, &Config[CounterState]{NumericDeltas: true, UseNumber: useNumber})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Update(func(c *CounterState) {
+			c.Score += 50
+			c.Gold -= 10
+			c.Speed = 2.25
+			c.Name = "b"
+		})
+		patch, _ := s.Diff(nil)
+		data, _ := patch.JSON()
+		want := `[{"op":"inc","path":"/gold","value":-10},{"op":"replace","path":"/name","value":"b"},` +
+			`{"op":"inc","path":"/score","value":50},{"op":"replace","path":"/speed","value":2.25}]`
+		if string(data) != want {
+			t.Errorf("UseNumber=%v: patch = %s\nwant    %s", useNumber, data, want)
+		}
+		if err := patch.Validate(); err != nil {
+			t.Errorf("Validate: %v", err)
+		}
+
+		got := initial
+		if err := patch.Apply(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != s.Get() {
+			t.Errorf("applied = %+v, want %+v", got, s.Get())
+		}
+
+		std, err := patch.Standard()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ = std.JSON()
+		want = `[{"op":"replace","path":"/gold","value":-3},{"op":"replace","path":"/name","value":"b"},` +
+			`{"op":"replace","path":"/score","value":150},{"op":"replace","path":"/speed","value":2.25}]`
+		if string(data) != want {
+			t.Errorf("standard = %s\nwant       %s", data, want)
+		}
+		s.ClearPrevious()
+	}
+}
+
+func TestNumericDeltasFallback(t *testing.T) {
+	s, _ := New[CounterState, Activator](CounterState{Score: 1}, &Config[CounterState]{NumericDeltas: true})
+	session := NewSession[CounterState, Activator, string](s)
+	session.Connect("new", nil)
+	session.Connect("legacy", nil, WithEncoder[CounterState](StandardOps(JSONPatchEncoder)))
+	s.Update(func(c *CounterState) { c.Score = 3 })
+	out := session.Broadcast()
+	if string(out["new"]) != `[{"op":"inc","path":"/score","value":2}]` {
+		t.Errorf("new = %s", out["new"])
+	}
+	if string(out["legacy"]) != `[{"op":"replace","path":"/score","value":3}]` {
+		t.Errorf("legacy = %s", out["legacy"])
+	}
+
+	var decoded Patch
+	json.Unmarshal(out["new"], &decoded)
+	if _, err := decoded.Standard(); err == nil {
+		t.Error("Standard of a decoded inc op succeeded")
+	}
+	var doc any = map[string]any{"name": "x"}
+	if _, err := applyOp(doc, Op{Op: "inc", Path: "/name", Value: 1}); err == nil {
+		t.Error("inc of a string succeeded")
+	}
+}
+
+// ===== Non-Finite Float Tests =====
+
+type PhysicsState struct {
+	Pos   []float64          `json:"pos"`
+	Mass  float32            `json:"mass"`
+	Drag  map[string]float64 `json:"drag"`
+	Label string             `json:"label"`
+}
+
+func TestNonFiniteReject(t *testing.T) {
+	_, err := New[PhysicsState, Activator](PhysicsState{Pos: []float64{1, math.NaN()}}, nil)
+	var nf *NonFiniteError
+	if !errors.As(err, &nf) || nf.Path != "/pos/1" || !math.IsNaN(nf.Value) {
+		t.Fatalf("New error = %v", err)
+	}
+
+	s := MustNew[PhysicsState, Activator](PhysicsState{Pos: []float64{1, 2}}, nil)
+	s.Update(func(p *PhysicsState) { p.Drag = map[string]float64{"air": math.Inf(1)} })
+	if _, err := s.Diff(nil); !errors.As(err, &nf) || nf.Path != "/drag/air" {
+		t.Errorf("Diff error = %v", err)
+	}
+	s.Update(func(p *PhysicsState) { p.Drag = nil }) // Clones the state without panicking
+	if got := s.Get(); got.Drag != nil {
+		t.Errorf("state = %+v", got)
+	}
+}
+
+func TestNonFinitePolicies(t *testing.T) {
+	initial := PhysicsState{Pos: []float64{math.NaN(), 1}, Mass: float32(math.Inf(1))}
+	tests := []struct {
+		policy NonFinitePolicy
+		full   string
+		patch  string
+	}{
+		{NonFiniteNull, `{"drag":null,"label":"","mass":null,"pos":[null,1]}`,
+			`[{"op":"replace","path":"/pos","value":[null,null]}]`},
+		{NonFiniteClamp, `{"drag":null,"label":"","mass":3.4028235e+38,"pos":[0,1]}`,
+			`[{"op":"replace","path":"/pos","value":[0,-1.7976931348623157e+308]}]`},
+	}
+	for _, tt := range tests {
+		s, err := New[PhysicsState, Activator](initial, &Config[PhysicsState]{
+			NonFinite: tt.policy,
+			Limits:    Limits{MaxBytes: 1000},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		session := NewSession[PhysicsState, Activator, string](s)
+		session.Connect("c", nil)
+		full, err := session.Full("c")
+		if err != nil || !strings.Contains(string(full), tt.full) {
+			t.Errorf("policy %d: full = %s, %v\nwant   %s", tt.policy, full, err, tt.full)
+		}
+		s.Update(func(p *PhysicsState) { p.Pos[1] = math.Inf(-1) })
+		patch, err := s.Diff(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := patch.JSON()
+		if string(data) != tt.patch {
+			t.Errorf("policy %d: patch = %s\nwant    %s", tt.policy, data, tt.patch)
+		}
+	}
+}
+
+// ===== OmitEmpty Policy Tests =====
+
+type ProfileState struct {
+	Score  int      `json:"score,omitempty"`
+	Title  string   `json:"title,omitempty"`
+	Shield *int     `json:"shield,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
+}
+
+func TestOmitEmptyPolicies(t *testing.T) {
+	initial := ProfileState{Score: 5, Title: "x", Shield: intPtr(3), Tags: []string{"a"}}
+	tests := []struct {
+		policy OmitEmptyPolicy
+		want   string
+	}{
+		{OmitEmptyTags, `[{"op":"remove","path":"/score"},{"op":"remove","path":"/shield"},{"op":"remove","path":"/tags"},{"op":"remove","path":"/title"}]`},
+		{OmitEmptyNil, `[{"op":"replace","path":"/score","value":0},{"op":"remove","path":"/shield"},{"op":"remove","path":"/tags"},{"op":"replace","path":"/title","value":""}]`},
+		{OmitEmptyNever, `[{"op":"replace","path":"/score","value":0},{"op":"replace","path":"/shield"},{"op":"replace","path":"/tags"},{"op":"replace","path":"/title","value":""}]`},
+	}
+	for _, tt := range tests {
+		cfg := &Config[ProfileState]{OmitEmpty: tt.policy}
+		s := MustNew[ProfileState, Activator](initial, cfg)
+		s.Update(func(p *ProfileState) { *p = ProfileState{} })
+		patch, err := s.Diff(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := patch.JSON()
+		if string(data) != tt.want {
+			t.Errorf("policy %d: patch = %s\nwant    %s", tt.policy, data, tt.want)
+		}
+		s.ClearPrevious()
+
+		// A zero value behind a pointer is always sent
+		s.Update(func(p *ProfileState) { p.Shield = intPtr(0) })
+		patch, _ = s.Diff(nil)
+		if len(patch) != 1 || patch[0].Path != "/shield" || patch[0].Value != 0.0 {
+			t.Errorf("policy %d: pointer patch = %+v", tt.policy, patch)
+		}
+	}
+
+	session := NewSession[ProfileState, Activator, string](MustNew[ProfileState, Activator](ProfileState{}, &Config[ProfileState]{OmitEmpty: OmitEmptyNil}))
+	session.Connect("c", nil)
+	if full, _ := session.Full("c"); !strings.Contains(string(full), `{"score":0,"title":""}`) {
+		t.Errorf("full = %s", full)
+	}
+	desc := Describe(&Config[ProfileState]{OmitEmpty: OmitEmptyNil})
+	if desc.Fields[0].OmitEmpty || !desc.Fields[2].OmitEmpty {
+		t.Errorf("describe = %+v", desc.Fields)
+	}
+}
+
+// ===== Codec Tests =====
+
+type countingCodec struct {
+	marshals, unmarshals int
+}
+
+func (c *countingCodec) Marshal(v any) ([]byte, error) {
+	c.marshals++
+	return StdCodec.Marshal(v)
+}
+
+func (c *countingCodec) Unmarshal(data []byte, v any) error {
+	c.unmarshals++
+	return StdCodec.Unmarshal(data, v)
+}
+
+type Celsius float64
+
+func (c Celsius) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%.1fC"`, float64(c))), nil
+}
+
+func (c *Celsius) UnmarshalJSON(data []byte) error {
+	_, err := fmt.Sscanf(string(data), `"%fC"`, (*float64)(c))
+	return err
+}
+
+type WeatherState struct {
+	Temp Celsius `json:"temp"`
+	City string  `json:"city"`
+}
+
+func TestConfigCodec(t *testing.T) {
+	codec := &countingCodec{}
+	s, err := New[WeatherState, Activator](WeatherState{Temp: 20, City: "a"}, &Config[WeatherState]{Codec: codec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codec.marshals == 0 || codec.unmarshals == 0 { // Round-trip validation in New
+		t.Errorf("New: %d marshals, %d unmarshals", codec.marshals, codec.unmarshals)
+	}
+
+	s.Update(func(w *WeatherState) { w.Temp = 21.5 })
+	before := codec.marshals
+	patch, err := s.Diff(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) != 1 || patch[0].Value != "21.5C" {
+		t.Errorf("patch = %+v", patch)
+	}
+	if codec.marshals == before {
+		t.Error("diff did not encode the marshaler through the codec")
+	}
+
+	before = codec.marshals
+	s.Get()
+	if codec.marshals != before+1 {
+		t.Error("clone did not use the codec")
+	}
+	if s.Fork().codec != codec {
+		t.Error("Fork dropped the codec")
+	}
+}
+
+// ===== Patch Stats Tests =====
+
+func TestPatchStats(t *testing.T) {
+	patch := Patch{
+		{Op: "remove", Path: "/items/2"},
+		{Op: "replace", Path: "/players/0/pos/x", Value: 1.5},
+		{Op: "add", Path: "/a~1b", Value: "x"},
+		{Op: "move", Path: "/items/0", From: "/pending/3"},
+		{Op: "replace", Path: "/players/1/hp", Value: 90},
+	}
+	st := patch.Stats()
+	data, _ := patch.JSON()
+	if st.Ops != 5 || st.ByOp["replace"] != 2 || st.ByOp["move"] != 1 || st.Bytes != int64(len(data)) || st.MaxDepth != 4 || st.Root {
+		t.Errorf("stats = %+v", st)
+	}
+	if !reflect.DeepEqual(st.Keys, []string{"a/b", "items", "pending", "players"}) {
+		t.Errorf("keys = %v", st.Keys)
+	}
+
+	st = Patch{{Op: "replace", Path: "", Value: map[string]any{"f": func() {}}}}.Stats()
+	if !st.Root || st.Keys != nil || st.MaxDepth != 0 || st.Bytes != -1 {
+		t.Errorf("root stats = %+v", st)
+	}
+	if st := (Patch{}).Stats(); st.Ops != 0 || st.Bytes != 2 {
+		t.Errorf("empty stats = %+v", st)
+	}
+}
+
+// ===== JSON Pointer Tests =====
+
+func TestPointerHelpers(t *testing.T) {
+	if p := FormatPointer("players", "0", "a/b", "~x"); p != "/players/0/a~1b/~0x" {
+		t.Errorf("FormatPointer = %q", p)
+	}
+	segs, err := ParsePointer("/players/0/a~1b/~0x")
+	if err != nil || !reflect.DeepEqual(segs, []string{"players", "0", "a/b", "~x"}) {
+		t.Errorf("ParsePointer = %q, %v", segs, err)
+	}
+	if _, err := ParsePointer("/a~2"); err == nil {
+		t.Error("ParsePointer accepted ~2")
+	}
+	if EscapePointer("a/~b") != "a~1~0b" || UnescapePointer("a~1~0b") != "a/~b" {
+		t.Error("escape round trip")
+	}
+
+	var doc any
+	json.Unmarshal([]byte(`{"players":[{"name":"a"}],"m":{}}`), &doc)
+	if v, err := GetByPointer(doc, "/players/0/name"); err != nil || v != "a" {
+		t.Errorf("Get = %v, %v", v, err)
+	}
+	if _, err := GetByPointer(doc, "/players/1"); !errors.Is(err, ErrPatchPath) {
+		t.Errorf("Get missing = %v", err)
+	}
+	if v, err := GetByPointer(TestState{Name: "typed"}, "/name"); err != nil || v != "typed" {
+		t.Errorf("Get typed = %v, %v", v, err)
+	}
+
+	steps := []struct {
+		ptr   string
+		value any
+	}{
+		{"/players/0/name", "b"},
+		{"/players/-", map[string]string{"name": "c"}},
+		{"/m/k~1v", 1},
+	}
+	for _, st := range steps {
+		if doc, err = SetByPointer(doc, st.ptr, st.value); err != nil {
+			t.Fatalf("Set %s: %v", st.ptr, err)
+		}
+	}
+	data, _ := json.Marshal(doc)
+	if string(data) != `{"m":{"k/v":1},"players":[{"name":"b"},{"name":"c"}]}` {
+		t.Errorf("doc = %s", data)
+	}
+	if _, err := SetByPointer(doc, "/missing/x", 1); !errors.Is(err, ErrPatchPath) {
+		t.Errorf("Set under missing parent = %v", err)
+	}
+	if _, err := SetByPointer(doc, "/players/5", 1); !errors.Is(err, ErrPatchPath) {
+		t.Errorf("Set past array end = %v", err)
+	}
+}
+
+// ===== Blob Reference Tests =====
+
+type MapState struct {
+	Chunks map[string]string `json:"chunks"`
+	Tick   int               `json:"tick"`
+}
+
+func TestBlobPaths(t *testing.T) {
+	store := map[string][]byte{}
+	big := strings.Repeat("x", 100)
+	s, err := New[MapState, Activator](MapState{Chunks: map[string]string{"a": big, "b": "small"}}, &Config[MapState]{
+		BlobPaths:    []string{"/chunks/*"},
+		BlobMinBytes: 64,
+		BlobStore: func(ref string, data []byte) error {
+			store[ref] = data
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Update(func(m *MapState) { m.Tick++ }) // Unchanged blobs send nothing
+	patch, _ := s.Diff(nil)
+	if data, _ := patch.JSON(); string(data) != `[{"op":"replace","path":"/tick","value":1}]` {
+		t.Errorf("patch = %s", data)
+	}
+	s.ClearPrevious()
+
+	s.Update(func(m *MapState) { m.Chunks["a"] = big + "y"; m.Chunks["b"] = "tiny" })
+	patch, _ = s.Diff(nil)
+	data, _ := patch.JSON()
+	ref := blobRef([]byte(`"` + big + `y"`))
+	want := `[{"op":"replace","path":"/chunks/a","value":{"$blob":"` + ref + `"}},{"op":"replace","path":"/chunks/b","value":"tiny"}]`
+	if string(data) != want {
+		t.Errorf("patch = %s\nwant    %s", data, want)
+	}
+	if string(store[ref]) != `"`+big+`y"` {
+		t.Errorf("store = %q", store)
+	}
+
+	var received Patch
+	json.Unmarshal(data, &received)
+	resolved, err := received.ResolveBlobs(func(ref string) ([]byte, error) { return store[ref], nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := MapState{Chunks: map[string]string{"a": big, "b": "small"}}
+	if err := resolved.Apply(&client); err != nil || client.Chunks["a"] != big+"y" {
+		t.Errorf("client = %+v, %v", client, err)
+	}
+	if _, err := received.ResolveBlobs(func(string) ([]byte, error) { return []byte(`"forged"`), nil }); err == nil {
+		t.Error("ResolveBlobs accepted content not matching its ref")
+	}
+
+	if _, err := New[MapState, Activator](MapState{}, &Config[MapState]{BlobPaths: []string{"/chunks/*"}}); err == nil {
+		t.Error("BlobPaths without BlobStore accepted")
+	}
+}
+
+// ===== RFC 6902 Conformance Tests =====
+
+// conformanceKeys include pointer escapes and numeric-looking keys
+var conformanceKeys = []string{"a", "b", "c", "d/e", "f~g", "0", ""}
+
+func randomValue(r *rand.Rand, depth int) any {
+	switch n := r.Intn(9); {
+	case n == 0:
+		return nil
+	case n == 1:
+		return r.Intn(2) == 0
+	case n == 2:
+		return float64(r.Intn(100))
+	case n == 3:
+		return fmt.Sprintf("s%d", r.Intn(5))
+	case depth <= 0:
+		return float64(r.Intn(10))
+	case n <= 5:
+		return randomObject(r, depth-1)
+	case n == 6:
+		arr := make([]any, r.Intn(5))
+		for i := range arr {
+			arr[i] = float64(r.Intn(4))
+		}
+		return arr
+	default:
+		return randomKeyedArray(r, depth-1)
+	}
+}
+
+func randomObject(r *rand.Rand, depth int) map[string]any {
+	obj := make(map[string]any)
+	for _, k := range conformanceKeys {
+		if r.Intn(2) == 0 {
+			obj[k] = randomValue(r, depth)
+		}
+	}
+	return obj
+}
+
+func randomKeyedArray(r *rand.Rand, depth int) []any {
+	var arr []any
+	for _, id := range r.Perm(6)[:r.Intn(6)] {
+		arr = append(arr, map[string]any{"id": fmt.Sprint(id), "v": randomValue(r, depth)})
+	}
+	return arr
+}
+
+// mutate returns a changed deep copy of v
+func mutate(r *rand.Rand, v any, depth int) any {
+	switch x := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(x))
+		for k, val := range x {
+			switch r.Intn(6) {
+			case 0: // Removed
+			case 1:
+				out[k] = randomValue(r, depth)
+			default:
+				out[k] = mutate(r, val, depth-1)
+			}
+		}
+		if r.Intn(3) == 0 {
+			out[conformanceKeys[r.Intn(len(conformanceKeys))]] = randomValue(r, depth)
+		}
+		return out
+	case []any:
+		var out []any
+		for _, el := range x {
+			if r.Intn(5) > 0 {
+				out = append(out, mutate(r, el, depth-1))
+			}
+		}
+		r.Shuffle(len(out), func(i, j int) {
+			if r.Intn(3) == 0 {
+				out[i], out[j] = out[j], out[i]
+			}
+		})
+		if r.Intn(2) == 0 {
+			i := r.Intn(len(out) + 1)
+			el := randomValue(r, depth)
+			if len(x) > 0 {
+				if _, keyed := x[0].(map[string]any); keyed {
+					el = map[string]any{"id": fmt.Sprint(6 + r.Intn(4)), "v": randomValue(r, depth)}
+				}
+			}
+			out = append(out[:i], append([]any{el}, out[i:]...)...)
+		}
+		return out
+	case float64:
+		if r.Intn(2) == 0 {
+			return x + float64(r.Intn(3))
+		}
+	}
+	if r.Intn(4) == 0 {
+		return randomValue(r, depth)
+	}
+	return v
+}
+
+// TestRFC6902Conformance applies every generated patch to the old document
+// and checks that it yields the new one, for each array strategy and move
+// detection, with StrictRFC6902.
+func TestRFC6902Conformance(t *testing.T) {
+	type Doc = map[string]any
+	configs := map[string]Config[Doc]{
+		"replace":      {},
+		"index":        {ArrayStrategy: ArrayByIndex},
+		"indexed-adds": {ArrayStrategy: ArrayByIndex, ArrayIndexedAdds: true},
+		"key":          {ArrayStrategy: ArrayByKey, ArrayKeyField: "id"},
+		"key-moves":    {ArrayStrategy: ArrayByKey, ArrayKeyField: "id", DetectMoves: true},
+		"lcs":          {ArrayStrategy: ArrayLCS},
+		"lcs-moves":    {ArrayStrategy: ArrayLCS, DetectMoves: true},
+		"index-moves":  {ArrayStrategy: ArrayByIndex, DetectMoves: true},
+		"capped":       {ArrayStrategy: ArrayByKey, ArrayKeyField: "id", MaxPatchOps: 4},
+	}
+	standard := map[string]bool{"add": true, "remove": true, "replace": true, "move": true, "copy": true, "test": true}
+	r := rand.New(rand.NewSource(6902))
+	for i := 0; i < 200; i++ {
+		old := randomObject(r, 3)
+		new := mutate(r, old, 3).(Doc)
+		oldJSON, _ := json.Marshal(old)
+		newJSON, _ := json.Marshal(new)
+		var want any
+		json.Unmarshal(newJSON, &want)
+
+		for name, cfg := range configs {
+			cfg.StrictRFC6902 = true
+			s, err := New[Doc, Activator](old, &cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Set(new)
+			patch, err := s.Diff(nil)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			for _, op := range patch {
+				if !standard[op.Op] || (op.Value == nil && (op.Op == "add" || op.Op == "replace")) {
+					t.Fatalf("%s: non-standard op %+v", name, op)
+				}
+			}
+			if err := patch.ValidateAgainst(json.RawMessage(oldJSON)); err != nil {
+				t.Fatalf("%s: %v\nold   %s\nnew   %s\npatch %+v", name, err, oldJSON, newJSON, patch)
+			}
+			applied, err := patch.ApplyToJSON(oldJSON)
+			if err != nil {
+				t.Fatalf("%s: apply: %v\nold   %s\nnew   %s\npatch %+v", name, err, oldJSON, newJSON, patch)
+			}
+			var got any
+			json.Unmarshal(applied, &got)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s: applied %s\nwant    %s\nold     %s\npatch   %+v", name, applied, newJSON, oldJSON, patch)
+			}
+		}
+	}
+
+	if _, err := New[Doc, Activator](Doc{}, &Config[Doc]{StrictRFC6902: true, NumericDeltas: true}); err == nil {
+		t.Error("NumericDeltas accepted with StrictRFC6902")
+	}
+}
+
+// ===== Explain Tests =====
+
+func TestPatchExplain(t *testing.T) {
+	cfg := &Config[TableState]{ArrayStrategy: ArrayByKey, ArrayKeyFields: map[string]string{"/players": "name", "/players/*/hand": "uid"}}
+	initial := func() TableState {
+		return TableState{Players: []TableSeat{
+			{Name: "alice", Score: 100, Hand: []TableCard{{"c1", 3}}},
+			{Name: "bob", Score: 2},
+		}}
+	}
+	s := MustNew[TableState, Activator](initial(), cfg)
+	s.Update(func(ts *TableState) {
+		ts.Players[0].Score = 200
+		ts.Players[0].Hand[0].Cost = 4
+		ts.Players = append(ts.Players[:1], TableSeat{Name: "carol"})
+	})
+	patch, _ := s.Diff(nil)
+	got, err := patch.Explain(initial(), s.DiffConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "players[bob]: removed {\"hand\":null,\"name\":\"bob\",\"score\":2}\n" +
+		"players[alice].hand[c1].cost: 3 → 4\n" +
+		"players[alice].score: 100 → 200\n" +
+		"players[carol]: added {\"hand\":null,\"name\":\"carol\",\"score\":0}\n"
+	if got != want {
+		t.Errorf("Explain =\n%s\nwant\n%s", got, want)
+	}
+
+	got, err = Patch{
+		{Op: "inc", Path: "/value", Value: 5},
+		{Op: "add", Path: "/items/-", Value: map[string]any{"id": "x"}},
+		{Op: "replace", Path: "/name", Value: strings.Repeat("é", 60)},
+	}.Explain(TestState{Value: 1, Items: []Item{{ID: "a"}}}, ArrayConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "value: 1 → 6 (+5)\nitems[-]: added {\"id\":\"x\"}\nname: \"\" → \"" + strings.Repeat("é", 38) + "...\n"
+	if got != want {
+		t.Errorf("Explain =\n%s\nwant\n%s", got, want)
+	}
+	if _, err := (Patch{{Op: "remove", Path: "/missing"}}).Explain(TestState{}, ArrayConfig{}); err == nil {
+		t.Error("Explain of a patch that does not apply succeeded")
+	}
+}
+
+// ===== Patch Split Tests =====
+
+func TestPatchSplit(t *testing.T) {
+	var patch Patch
+	for i := 0; i < 40; i++ {
+		patch = append(patch, Op{Op: "add", Path: "/items/-", Value: map[string]any{"id": fmt.Sprint(i), "data": i}})
+	}
+	patch = append(patch, Op{Op: "replace", Path: "/name", Value: strings.Repeat("n", 300)}, Op{Op: "replace", Path: "/value", Value: 7})
+
+	chunks := patch.Split(200)
+	var joined Patch
+	doc := []byte(`{"items":[],"name":"","value":0}`)
+	for i, c := range chunks {
+		data, _ := c.JSON()
+		if len(data) > 200 && len(c) > 1 {
+			t.Errorf("chunk %d is %d bytes with %d ops", i, len(data), len(c))
+		}
+		var err error
+		if doc, err = c.ApplyToJSON(doc); err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+		joined = append(joined, c...)
+	}
+	if !reflect.DeepEqual(joined, patch) {
+		t.Error("chunks do not concatenate to the patch")
+	}
+	whole, _ := patch.ApplyToJSON([]byte(`{"items":[],"name":"","value":0}`))
+	if !bytes.Equal(doc, whole) {
+		t.Errorf("chunked apply = %s\nwant          %s", doc, whole)
+	}
+	if last := chunks[len(chunks)-2]; len(last) != 1 || last[0].Path != "/name" {
+		t.Errorf("oversized op not alone: %+v", last)
+	}
+
+	if got := patch.Split(0); len(got) != 1 || len(got[0]) != len(patch) {
+		t.Errorf("Split(0) = %d chunks", len(got))
+	}
+	if got := (Patch{}).Split(100); got != nil {
+		t.Errorf("empty Split = %v", got)
+	}
+}
+
+// ===== RawMessage Tests =====
+
+type PluginState struct {
+	Config json.RawMessage  `json:"config"`
+	Extra  *json.RawMessage `json:"extra,omitempty"`
+	Tick   int              `json:"tick"`
+}
+
+func TestRawMessageFields(t *testing.T) {
+	s := MustNew[PluginState, Activator](PluginState{Config: json.RawMessage(`{"b":1.0,"a":[1,2]}`)}, nil)
+	s.Update(func(p *PluginState) {
+		p.Config = json.RawMessage(`{ "a": [1, 2],
+			"b": 1.0 }`) // Same JSON, reformatted and reordered
+		p.Tick = 1
+	})
+	patch, _ := s.Diff(nil)
+	if data, _ := patch.JSON(); string(data) != `[{"op":"replace","path":"/tick","value":1}]` {
+		t.Errorf("patch = %s", data)
+	}
+	s.ClearPrevious()
+
+	extra := json.RawMessage(`[1.50, "x"]`)
+	s.Update(func(p *PluginState) {
+		p.Config = json.RawMessage(`{"b":2.0,"a":[1,2]}`)
+		p.Extra = &extra
+	})
+	patch, _ = s.Diff(nil)
+	want := `[{"op":"replace","path":"/config","value":{"b":2.0,"a":[1,2]}},{"op":"add","path":"/extra","value":[1.50,"x"]}]`
+	if data, _ := patch.JSON(); string(data) != want { // Passed through as encoded
+		t.Errorf("patch = %s\nwant    %s", data, want)
+	}
+}
+
+// ===== Array Auto Tests =====
+
+func TestArrayAuto(t *testing.T) {
+	type Doc struct {
+		Items []Item `json:"items"`
+		Tags  []any  `json:"tags"`
+	}
+	items := func(n int) []Item {
+		out := make([]Item, n)
+		for i := range out {
+			out[i] = Item{ID: fmt.Sprint(i), Data: 1}
+		}
+		return out
+	}
+	cases := []struct {
+		name   string
+		change func(d *Doc)
+		whole  string // Path expected to be replaced whole, "" for element ops
+	}{
+		{"one keyed element", func(d *Doc) { d.Items[3].Data = 2 }, ""},
+		{"most keyed elements", func(d *Doc) {
+			for i := 0; i < 7; i++ {
+				d.Items[i].Data = 2
+			}
+		}, "/items"},
+		{"keyed remove", func(d *Doc) { d.Items = append(d.Items[:2], d.Items[3:]...) }, ""},
+		{"unkeyed insert", func(d *Doc) { d.Tags = append([]any{"z"}, d.Tags...) }, ""},
+		{"unkeyed rewrite", func(d *Doc) { d.Tags = []any{"x", "y", "z", "c"} }, "/tags"},
+		{"many appends", func(d *Doc) { d.Tags = append(d.Tags, "e", "f", "g", "h", "i") }, "/tags"},
+	}
+	for _, tc := range cases {
+		initial := func() Doc { return Doc{Items: items(10), Tags: []any{"a", "b", "c", "d"}} }
+		s := MustNew[Doc, Activator](initial(), Configure[Doc]().ArraysAuto(0).KeyFieldFor("/items", "id").MustBuild())
+		s.Update(tc.change)
+		patch, err := s.Diff(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := patch.JSON()
+		whole := len(patch) == 1 && patch[0].Op == "replace" && patch[0].Path == tc.whole
+		if (tc.whole != "") != whole {
+			t.Errorf("%s: patch %s", tc.name, data)
+		}
+
+		start, _ := json.Marshal(initial())
+		got, err := patch.ApplyToJSON(start)
+		if err != nil {
+			t.Fatalf("%s: %v (%s)", tc.name, err, data)
+		}
+		var gotDoc, wantDoc any
+		json.Unmarshal(got, &gotDoc)
+		end, _ := json.Marshal(s.Get())
+		json.Unmarshal(end, &wantDoc)
+		if !reflect.DeepEqual(gotDoc, wantDoc) {
+			t.Errorf("%s: applying %s gave %s", tc.name, data, got)
+		}
+	}
+
+	// A ratio of 1 never replaces an array whole
+	s := MustNew[Doc, Activator](Doc{Tags: []any{"a", "b"}}, &Config[Doc]{ArrayStrategy: ArrayAuto, ArrayAutoRatio: 1})
+	s.Set(Doc{Tags: []any{"x", "y"}})
+	if patch, _ := s.Diff(nil); len(patch) < 2 {
+		t.Errorf("ratio 1 patch = %v", patch)
+	}
+	if _, err := New[Doc, Activator](Doc{}, &Config[Doc]{ArrayStrategy: ArrayAuto, ArrayAutoRatio: 1.5}); err == nil {
+		t.Error("ArrayAutoRatio above 1 should be rejected")
+	}
+}
+
+// ===== Root Replace Ratio Tests =====
+
+func TestRootReplaceRatio(t *testing.T) {
+	type Level struct {
+		Name  string         `json:"name"`
+		Tiles []int          `json:"tiles"`
+		Spawn map[string]int `json:"spawn"`
+		Music string         `json:"music"`
+		Tick  int            `json:"tick"`
+	}
+	start := Level{Name: "one", Tiles: []int{1, 2}, Spawn: map[string]int{"x": 1}, Music: "a"}
+	cfg := &Config[Level]{RootReplaceRatio: 0.6}
+
+	s := MustNew[Level, Activator](start, cfg)
+	s.Update(func(l *Level) { l.Tick = 1; l.Music = "b" }) // 2 of 5
+	patch, _ := s.Diff(nil)
+	if len(patch) != 2 {
+		t.Errorf("small change patch = %v", patch)
+	}
+	s.ClearPrevious()
+
+	next := Level{Name: "two", Tiles: []int{3}, Spawn: map[string]int{"y": 2}, Music: "c", Tick: 1} // 4 of 5
+	s.Set(next)
+	patch, _ = s.Diff(nil)
+	if len(patch) != 1 || patch[0].Op != "replace" || patch[0].Path != "" {
+		t.Fatalf("level load patch = %v", patch)
+	}
+	prev, _ := json.Marshal(Level{Name: "one", Tiles: []int{1, 2}, Spawn: map[string]int{"x": 1}, Music: "b", Tick: 1})
+	got, err := patch.ApplyToJSON(prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var applied Level
+	json.Unmarshal(got, &applied)
+	if !reflect.DeepEqual(applied, next) {
+		t.Errorf("applied %s, want %+v", got, next)
+	}
+
+	if _, err := New[Level, Activator](start, &Config[Level]{RootReplaceRatio: -0.1}); err == nil {
+		t.Error("negative RootReplaceRatio should be rejected")
+	}
+}
+
+// ===== State Version Tests =====
+
+func TestStateVersion(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{}, nil)
+	if v := s.Version(); v != 0 {
+		t.Fatalf("initial version = %d", v)
+	}
+	s.Update(func(ts *TestState) { ts.Value = 1 })
+	s.Set(TestState{Value: 2})
+	s.AddEffect(Func[TestState, Activator]("double", func(ts TestState, _ Activator) TestState {
+		ts.Value *= 2
+		return ts
+	}), nil)
+	s.RemoveEffect("double")
+	if v := s.Version(); v != 4 {
+		t.Errorf("version after 4 changes = %d", v)
+	}
+	s.ClearPrevious()
+	if v := s.Version(); v != 4 {
+		t.Errorf("ClearPrevious changed the version to %d", v)
+	}
+	if v := s.Fork().Version(); v != 4 {
+		t.Errorf("fork version = %d", v)
+	}
+
+	path := t.TempDir() + "/state.json"
+	if err := Save(path, s, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	result, err := Restore[TestState, Activator](path, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := result.State.Version(); v != 4 {
+		t.Errorf("restored version = %d", v)
+	}
+}
+
+func TestSessionVersioned(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{}, nil)
+	session := NewSession[TestState, Activator, string](s)
+	session.Connect("a", nil)
+	session.Connect("b", nil, WithEncoder[TestState](MsgPackEncoder))
+	session.SetVersioned(true)
+
+	full, _ := session.Full("a")
+	if want := `{"from":0,"version":0,"data":[{"op":"replace","path":"","value":{"value":0,"name":""}}]}`; string(full) != want {
+		t.Errorf("Full = %s\nwant   %s", full, want)
+	}
+
+	s.Update(func(ts *TestState) { ts.Value = 1 })
+	if d, _ := session.Diff("a"); !strings.HasPrefix(string(d), `{"from":0,"version":1,"data":[`) {
+		t.Errorf("Diff = %s", d)
+	}
+	out := session.Tick()
+	var env VersionedPayload
+	if err := json.Unmarshal(out["a"], &env); err != nil || env.From != 0 || env.Version != 1 {
+		t.Fatalf("Tick payload %s: %v", out["a"], err)
+	}
+	var patch Patch
+	if err := json.Unmarshal(env.Data, &patch); err != nil || len(patch) != 1 {
+		t.Errorf("data = %s", env.Data)
+	}
+	var binary struct {
+		Version uint64 `json:"version"`
+		Data    []byte `json:"data"`
+	}
+	if err := json.Unmarshal(out["b"], &binary); err != nil || binary.Version != 1 || len(binary.Data) == 0 {
+		t.Errorf("MsgPack payload %s: %v", out["b"], err)
+	}
+
+	// Two updates between ticks are sent together, from the version
+	// clients last received
+	s.Update(func(ts *TestState) { ts.Value = 2 })
+	s.Update(func(ts *TestState) { ts.Name = "x" })
+	json.Unmarshal(session.Tick()["a"], &env)
+	if env.From != 1 || env.Version != 3 {
+		t.Errorf("from %d to %d, want 1 to 3", env.From, env.Version)
+	}
+	if err := json.Unmarshal(env.Data, &patch); err != nil || len(patch) != 2 {
+		t.Errorf("data = %s", env.Data)
+	}
+}
+
+func TestVersionedTransaction(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{}, nil)
+	session := NewSession[TestState, Activator, string](s)
+	session.Connect("a", nil)
+	session.SetVersioned(true)
+
+	// A client at version 0 can apply a transaction of several updates
+	out := session.Transaction(func(tx *Tx[TestState, Activator]) {
+		tx.Update(func(ts *TestState) { ts.Value = 1 })
+		tx.Update(func(ts *TestState) { ts.Name = "x" })
+		tx.Set(TestState{Value: 2, Name: "x"})
+	})
+	var env VersionedPayload
+	if err := json.Unmarshal(out["a"], &env); err != nil || env.From != 0 || env.Version != 3 {
+		t.Fatalf("payload %s: %v", out["a"], err)
+	}
+	var patch Patch
+	if err := json.Unmarshal(env.Data, &patch); err != nil {
+		t.Fatal(err)
+	}
+	client, err := patch.ApplyToJSON([]byte(`{"value":0,"name":""}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(client) != `{"name":"x","value":2}` {
+		t.Errorf("client = %s", client)
+	}
+}
+
+// ===== History Tests =====
+
+func TestDiffSince(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{}, &Config[TestState]{HistorySize: 2})
+	session := NewSession[TestState, Activator, string](s)
+	session.Connect("a", nil)
+
+	for i := 1; i <= 3; i++ {
+		s.Update(func(ts *TestState) { ts.Value = i; ts.Name = fmt.Sprint("v", i) })
+		session.Tick()
+	}
+	s.Update(func(ts *TestState) { ts.Value = 4 }) // Pending, not yet sent
+
+	if _, _, err := s.DiffSince(1, nil); err != ErrVersionUnavailable {
+		t.Errorf("evicted version: err = %v", err)
+	}
+	patch, now, err := s.DiffSince(2, nil)
+	if err != nil || now != 4 {
+		t.Fatalf("DiffSince(2) = %v, %d, %v", patch, now, err)
+	}
+	start, _ := json.Marshal(TestState{Value: 2, Name: "v2"})
+	got, err := patch.ApplyToJSON(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"name":"v3","value":4}`; string(got) != want {
+		t.Errorf("applied %s, want %s", got, want)
+	}
+	if patch, now, _ := s.DiffSince(3, func(ts TestState) TestState { ts.Value = 0; return ts }); len(patch) != 0 || now != 4 {
+		t.Errorf("projected DiffSince(3) = %v, %d", patch, now)
+	}
+
+	session.SetVersioned(true)
+	data, err := session.Resume("a", 3)
+	if err != nil || string(data) != `{"from":3,"version":4,"data":[{"op":"replace","path":"/value","value":4}]}` {
+		t.Errorf("Resume = %s, %v", data, err)
+	}
+
+	plain := MustNew[TestState, Activator](TestState{}, nil)
+	if _, _, err := plain.DiffSince(0, nil); err != ErrVersionUnavailable {
+		t.Errorf("without history: err = %v", err)
+	}
+}
+
+// ===== Undo Tests =====
+
+func TestUndoRedo(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Name: "a"}, &Config[TestState]{UndoDepth: 2})
+	if err := s.Undo(); err != ErrNothingToUndo {
+		t.Fatalf("Undo on fresh state: %v", err)
+	}
+	s.Update(func(ts *TestState) { ts.Value = 1 })
+	s.Update(func(ts *TestState) { ts.Items = []Item{{ID: "x", Data: 1}} })
+	s.Set(TestState{Value: 3, Name: "b", Items: []Item{{ID: "x", Data: 1}, {ID: "y", Data: 2}}})
+	s.ClearPrevious()
+
+	if err := s.Undo(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.GetBase(); got.Value != 1 || got.Name != "a" || len(got.Items) != 1 {
+		t.Errorf("after Undo: %+v", got)
+	}
+	patch, _ := s.Diff(nil)
+	if len(patch) == 0 {
+		t.Error("Undo should produce a diff for clients")
+	}
+	if err := s.Undo(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.GetBase(); got.Value != 1 || len(got.Items) != 0 {
+		t.Errorf("after second Undo: %+v", got)
+	}
+	if err := s.Undo(); err != ErrNothingToUndo { // Depth 2: the first change was dropped
+		t.Errorf("third Undo: %v", err)
+	}
+
+	if err := s.Redo(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Redo(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.GetBase(); got.Value != 3 || got.Name != "b" || len(got.Items) != 2 {
+		t.Errorf("after Redo: %+v", got)
+	}
+	if s.CanRedo() {
+		t.Error("nothing should be left to redo")
+	}
+
+	s.Undo()
+	s.Update(func(ts *TestState) { ts.Value = 9 })
+	if err := s.Redo(); err != ErrNothingToRedo {
+		t.Errorf("Redo after a new change: %v", err)
+	}
+	if !s.CanUndo() {
+		t.Error("the new change should be undoable")
+	}
+}
+
+// ===== Watch Tests =====
+
+func TestWatch(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{}, &Config[TestState]{ArrayStrategy: ArrayByIndex})
+	items, cancelItems := s.Watch("/items")
+	name, cancelName := s.Watch("/name")
+	defer cancelName()
+
+	s.Update(func(ts *TestState) { ts.Value = 1; ts.Items = []Item{{ID: "a"}} })
+	s.ClearPrevious()
+	if got := <-items; len(got) != 1 || got[0].Path != "/items" {
+		t.Errorf("items watch = %v", got)
+	}
+	select {
+	case p := <-name:
+		t.Errorf("name watch got %v for an unrelated change", p)
+	default:
+	}
+
+	session := NewSession[TestState, Activator, string](s)
+	session.Connect("c", nil)
+	s.Update(func(ts *TestState) { ts.Items[0].Data = 5; ts.Name = "n" })
+	session.Tick()
+	if got := <-items; len(got) != 1 || got[0].Path != "/items/0/data" {
+		t.Errorf("items watch after tick = %v", got)
+	}
+	if got := <-name; len(got) != 1 || got[0].Path != "/name" {
+		t.Errorf("name watch after tick = %v", got)
+	}
+
+	s.Set(TestState{}) // Removes /items entirely
+	s.ClearPrevious()
+	if got := <-items; len(got) != 1 || got[0].Op != "remove" {
+		t.Errorf("items watch on removal = %v", got)
+	}
+
+	cancelItems()
+	cancelItems() // Idempotent
+	if _, ok := <-items; ok {
+		t.Error("channel should be closed after cancel")
+	}
+	s.Update(func(ts *TestState) { ts.Items = []Item{{ID: "b"}} })
+	s.ClearPrevious() // No send on the closed channel
+}
+
+// ===== OnChange Tests =====
+
+func TestOnChange(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{}, nil)
+	type call struct {
+		old, new TestState
+		patch    Patch
+	}
+	var calls []call
+	s.OnChange(func(old, new TestState, patch Patch) {
+		calls = append(calls, call{old, new, patch})
+		_ = s.Get() // Runs without the state lock held
+	})
+
+	s.Update(func(ts *TestState) { ts.Value = 1 })
+	s.ClearPrevious()
+	s.ClearPrevious() // Nothing pending
+	s.Update(func(ts *TestState) { ts.Value = 1 })
+	s.ClearPrevious() // Empty diff
+
+	session := NewSession[TestState, Activator, string](s)
+	s.Update(func(ts *TestState) { ts.Name = "x" })
+	session.Tick() // No clients needed
+
+	if len(calls) != 2 {
+		t.Fatalf("%d calls, want 2: %+v", len(calls), calls)
+	}
+	if c := calls[0]; c.old.Value != 0 || c.new.Value != 1 || len(c.patch) != 1 || c.patch[0].Path != "/value" {
+		t.Errorf("first call = %+v", c)
+	}
+	if c := calls[1]; c.old.Name != "" || c.new.Name != "x" || len(c.patch) != 1 || c.patch[0].Path != "/name" {
+		t.Errorf("second call = %+v", c)
+	}
+}
+
+func TestCommittedDiffShared(t *testing.T) {
+	// Documents built per commit: observers share one diff of the cycle
+	commit := func(all bool) int {
+		built := 0
+		cfg := &Config[TestState]{
+			ArrayStrategy: ArrayByKey,
+			ArrayKeyField: "id",
+			PathMapper: func(k string) string {
+				if k == "value" {
+					built++ // Once per document
+				}
+				return k
+			},
+		}
+		if all {
+			cfg.FlapLimit = 10
+		}
+		s := MustNew[TestState, Activator](TestState{Items: []Item{{ID: "a"}}}, cfg)
+		var changes, events int
+		s.OnChange(func(_, _ TestState, _ Patch) { changes++ })
+		var ch <-chan Patch
+		if all {
+			ch, _ = s.Watch("/items")
+			s.OnElementEvent(func(ElementEvent) { events++ })
+		}
+		s.Update(func(ts *TestState) { ts.Items = append(ts.Items, Item{ID: "b"}) })
+		built = 0
+		s.ClearPrevious()
+		if changes != 1 {
+			t.Fatalf("OnChange calls = %d", changes)
+		}
+		if all && (events != 1 || len(<-ch) != 1) {
+			t.Fatalf("events = %d", events)
+		}
+		return built
+	}
+	if one, all := commit(false), commit(true); all != one {
+		t.Errorf("Documents built with all observers = %d, with OnChange only = %d", all, one)
+	}
+}
+
+// ===== UpdateE Tests =====
+
+func TestUpdateE(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{Value: 1, Items: []Item{{ID: "a", Data: 1}}}, nil)
+	errInvalid := errors.New("invalid")
+	err := s.UpdateE(func(ts *TestState) error {
+		ts.Value = 2
+		ts.Items[0].Data = 99 // Shared with the state unless fn works on a copy
+		return errInvalid
+	})
+	if err != errInvalid {
+		t.Fatalf("err = %v", err)
+	}
+	if got := s.GetBase(); got.Value != 1 || got.Items[0].Data != 1 {
+		t.Errorf("failed UpdateE changed the state: %+v", got)
+	}
+	if s.HasChanges() {
+		t.Error("failed UpdateE should leave nothing to diff")
+	}
+
+	if err := s.UpdateE(func(ts *TestState) error { ts.Value = 3; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if patch, _ := s.Diff(nil); len(patch) != 1 || patch[0].Path != "/value" {
+		t.Errorf("patch = %v", patch)
+	}
+
+	limited := MustNew[TestState, Activator](TestState{}, &Config[TestState]{Limits: Limits{MaxBytes: 40}})
+	err = limited.UpdateE(func(ts *TestState) error { ts.Name = strings.Repeat("x", 100); return nil })
+	if _, ok := err.(*LimitError); !ok {
+		t.Errorf("over the limit: err = %v", err)
+	}
+}
+
+// ===== CompareAndUpdate Tests =====
+
+func TestCompareAndUpdate(t *testing.T) {
+	s := MustNew[TestState, Activator](TestState{}, nil)
+	base, v := s.GetBaseVersion()
+	if base.Value != 0 || v != 0 {
+		t.Fatalf("GetBaseVersion = %+v, %d", base, v)
+	}
+	if err := s.CompareAndUpdate(v, func(ts *TestState) { ts.Value = base.Value + 1 }); err != nil {
+		t.Fatal(err)
+	}
+	// A second writer that read the same version loses
+	if err := s.CompareAndUpdate(v, func(ts *TestState) { ts.Value = base.Value + 10 }); err != ErrVersionConflict {
+		t.Fatalf("stale write: err = %v", err)
+	}
+	if got := s.GetBase().Value; got != 1 {
+		t.Errorf("value = %d, want 1", got)
+	}
+
+	// Concurrent read-modify-write loops lose no increments
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 50; {
+				cur, v := s.GetBaseVersion()
+				if s.CompareAndUpdate(v, func(ts *TestState) { ts.Value = cur.Value + 1 }) == nil {
+					n++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got := s.GetBase().Value; got != 401 {
+		t.Errorf("value = %d, want 401", got)
+	}
+}
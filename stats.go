@@ -0,0 +1,48 @@
+package statediff
+
+import (
+	"io"
+	"sort"
+	"strings"
+)
+
+// PatchStats summarizes a patch, e.g. to log or alert on abnormal patch
+// sizes per tick
+type PatchStats struct {
+	Ops      int            `json:"ops"`
+	ByOp     map[string]int `json:"byOp"`     // Op count by op name
+	Bytes    int64          `json:"bytes"`    // Size of Patch.JSON, -1 if a value does not encode
+	MaxDepth int            `json:"maxDepth"` // Most segments in a path or from, 0 for root ops only
+	Keys     []string       `json:"keys"`     // Top-level members touched, sorted and unescaped
+	Root     bool           `json:"root"`     // An op addresses the whole document
+}
+
+// Stats returns op counts, encoded size, depth and touched top-level
+// members of the patch. The size is measured without buffering the JSON.
+func (p Patch) Stats() PatchStats {
+	st := PatchStats{Ops: len(p), ByOp: make(map[string]int)}
+	keys := make(map[string]bool)
+	for _, op := range p {
+		st.ByOp[op.Op]++
+		for _, ptr := range opPointers(op) {
+			if ptr == "" {
+				st.Root = true
+				continue
+			}
+			st.MaxDepth = max(st.MaxDepth, strings.Count(ptr, "/"))
+			if m, ok := topMember(ptr); ok {
+				keys[m] = true
+			}
+		}
+	}
+	for k := range keys {
+		st.Keys = append(st.Keys, k)
+	}
+	sort.Strings(st.Keys)
+
+	var err error
+	if st.Bytes, err = p.WriteTo(io.Discard); err != nil {
+		st.Bytes = -1
+	}
+	return st
+}
@@ -0,0 +1,45 @@
+package statediff
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// streamChunk is how much encoded JSON WriteTo buffers before writing
+const streamChunk = 32 << 10
+
+// WriteTo writes the patch to w as the same JSON that Patch.JSON returns,
+// encoding one op at a time and writing in chunks, so patches with tens of
+// thousands of ops never sit in memory a second time as one buffer.
+// Implements io.WriterTo; on error, w may have received part of the patch.
+func (p Patch) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	buf.Grow(min(streamChunk, 64*len(p)+2))
+	enc := json.NewEncoder(&buf)
+	var n int64
+	flush := func() error {
+		m, err := w.Write(buf.Bytes())
+		n += int64(m)
+		buf.Reset()
+		return err
+	}
+
+	buf.WriteByte('[')
+	for i, op := range p {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := enc.Encode(op); err != nil {
+			return n, err
+		}
+		buf.Truncate(buf.Len() - 1) // Encode appends a newline
+		if buf.Len() >= streamChunk {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	buf.WriteByte(']')
+	return n, flush()
+}
@@ -0,0 +1,120 @@
+package statediff
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// derivedRule drops ops on a derived path when its source changed
+type derivedRule struct {
+	derived []string // Pattern, "*" matches any segment
+	source  []string // Pattern, its "*" segments take the derived path's wildcard values in order
+}
+
+// newDerivedRules converts Config.DerivedPaths into rules in deterministic order
+func newDerivedRules(m map[string]string) []derivedRule {
+	rules := make([]derivedRule, 0, len(m))
+	for derived, source := range m {
+		rules = append(rules, derivedRule{derived: splitPtr(derived), source: splitPtr(source)})
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return strings.Join(rules[i].derived, "/") < strings.Join(rules[j].derived, "/")
+	})
+	return rules
+}
+
+// validateDerivedPaths checks that every source can be bound from its derived path
+func validateDerivedPaths(m map[string]string) error {
+	for derived, source := range m {
+		if wildcards(splitPtr(source)) > wildcards(splitPtr(derived)) {
+			return fmt.Errorf("statediff: DerivedPaths source %q has more wildcards than %q", source, derived)
+		}
+		if derived == source {
+			return fmt.Errorf("statediff: DerivedPaths %q derives from itself", derived)
+		}
+	}
+	return nil
+}
+
+func wildcards(pattern []string) int {
+	n := 0
+	for _, seg := range pattern {
+		if seg == "*" {
+			n++
+		}
+	}
+	return n
+}
+
+// sourceOf returns the source path for a concrete derived path, or false if
+// the rule does not apply to it
+func (r derivedRule) sourceOf(path []string) ([]string, bool) {
+	if !matchPattern(r.derived, path) {
+		return nil, false
+	}
+	var bound []string
+	for i, seg := range r.derived {
+		if seg == "*" {
+			bound = append(bound, path[i])
+		}
+	}
+	source := make([]string, len(r.source))
+	for i, seg := range r.source {
+		if seg == "*" {
+			seg, bound = bound[0], bound[1:]
+		}
+		source[i] = seg
+	}
+	return source, true
+}
+
+// suppressDerived removes ops on derived paths whose source is changed by an
+// op in the same patch (at the source or below it)
+func (o *diffOptions) suppressDerived(p Patch) Patch {
+	if o == nil || len(o.derived) == 0 || len(p) < 2 {
+		return p
+	}
+	changed := make(map[string]bool, len(p))
+	for _, op := range p {
+		changed[op.Path] = true
+	}
+	sourceChanged := func(source string) bool {
+		if changed[source] {
+			return true
+		}
+		for path := range changed {
+			if strings.HasPrefix(path, source+"/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	out := p[:0]
+	for _, op := range p {
+		if !o.isDerivedFromChange(op.Path, sourceChanged) {
+			out = append(out, op)
+		}
+	}
+	return out
+}
+
+// isDerivedFromChange reports whether path is a derived path whose source changed
+func (o *diffOptions) isDerivedFromChange(path string, sourceChanged func(string) bool) bool {
+	segs := splitPtr(path)
+	for _, r := range o.derived {
+		source, ok := r.sourceOf(segs)
+		if !ok {
+			continue
+		}
+		ptr := ""
+		for _, seg := range source {
+			ptr += "/" + escapePtr(seg)
+		}
+		if sourceChanged(ptr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package statediff
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNothingToUndo is returned by Undo when no change is recorded
+	ErrNothingToUndo = errors.New("statediff: nothing to undo")
+	// ErrNothingToRedo is returned by Redo when no undone change is left
+	ErrNothingToRedo = errors.New("statediff: nothing to redo")
+)
+
+// undoCfg diffs base states for undo: plain documents as encoding/json
+// produces them, so the patches apply with Patch.Apply
+var undoCfg = ArrayConfig{Strategy: ArrayLCS}
+
+// undoStack records the base state changes of Update and Set as pairs of
+// patches, for Config.UndoDepth
+type undoStack struct {
+	depth int
+	undo  []undoEntry // Oldest first
+	redo  []undoEntry // Most recently undone last
+}
+
+type undoEntry struct {
+	forward Patch // Before to after
+	inverse Patch // After to before
+}
+
+// resized returns u keeping at most depth changes, or nil if depth is 0
+func (u *undoStack) resized(depth int) *undoStack {
+	if depth <= 0 {
+		return nil
+	}
+	if u == nil {
+		return &undoStack{depth: depth}
+	}
+	u.depth = depth
+	u.undo = u.undo[max(0, len(u.undo)-depth):]
+	return u
+}
+
+// recordUndo adds the change from before to after and forgets undone changes.
+// A change that cannot be diffed ends the undo history.
+func recordUndo[T any](u *undoStack, before, after T) {
+	if u == nil {
+		return
+	}
+	u.redo = nil
+	forward, err := calcDiff(before, after, undoCfg)
+	if err != nil {
+		u.reset()
+		return
+	}
+	if len(forward) == 0 {
+		return
+	}
+	inverse, err := calcDiff(after, before, undoCfg)
+	if err != nil {
+		u.reset()
+		return
+	}
+	if len(u.undo) == u.depth {
+		u.undo[0] = undoEntry{} // Drop references before sliding
+		u.undo = u.undo[1:]
+	}
+	u.undo = append(u.undo, undoEntry{forward: forward, inverse: inverse})
+}
+
+// reset drops every recorded change
+func (u *undoStack) reset() {
+	if u != nil {
+		u.undo, u.redo = nil, nil
+	}
+}
+
+// Undo reverts the most recent change made by Update or Set (of the base
+// state; effects are not affected) that is still recorded, as a change
+// clients receive like any other. Up to Config.UndoDepth changes are
+// recorded; RollbackTo and Reconfigure to a depth of 0 forget them.
+// Returns ErrNothingToUndo when none is left, or the error of a change the
+// limits reject, in which case it stays recorded.
+func (s *State[T, A]) Undo() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.waitCycle()
+	if s.undo == nil || len(s.undo.undo) == 0 {
+		return ErrNothingToUndo
+	}
+	e := s.undo.undo[len(s.undo.undo)-1]
+	if err := s.replayUndo(e.inverse); err != nil {
+		return err
+	}
+	s.undo.undo = s.undo.undo[:len(s.undo.undo)-1]
+	s.undo.redo = append(s.undo.redo, e)
+	return nil
+}
+
+// Redo reapplies the change most recently reverted by Undo. Any Update or
+// Set after an Undo forgets the changes that could be redone.
+// Returns ErrNothingToRedo when none is left.
+func (s *State[T, A]) Redo() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.waitCycle()
+	if s.undo == nil || len(s.undo.redo) == 0 {
+		return ErrNothingToRedo
+	}
+	e := s.undo.redo[len(s.undo.redo)-1]
+	if err := s.replayUndo(e.forward); err != nil {
+		return err
+	}
+	s.undo.redo = s.undo.redo[:len(s.undo.redo)-1]
+	s.undo.undo = append(s.undo.undo, e)
+	return nil
+}
+
+// CanUndo and CanRedo report whether Undo and Redo have a change to apply
+func (s *State[T, A]) CanUndo() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.undo != nil && len(s.undo.undo) > 0
+}
+
+func (s *State[T, A]) CanRedo() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.undo != nil && len(s.undo.redo) > 0
+}
+
+// replayUndo applies a recorded patch to the base state. Caller must hold mu.
+func (s *State[T, A]) replayUndo(p Patch) error {
+	next := s.clone(s.current)
+	if err := p.Apply(&next); err != nil {
+		return fmt.Errorf("statediff: replay recorded change: %w", err)
+	}
+	if s.limits.enabled() {
+		if err := s.limits.check(next, s.arrayCfg.opts); err != nil {
+			return err
+		}
+	}
+	s.replace(next)
+	return nil
+}
@@ -0,0 +1,193 @@
+package statediff
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PatchError describes the first op Validate or ValidateAgainst rejects
+type PatchError struct {
+	Index  int // Position of the op in the patch
+	Op     Op
+	Reason string
+}
+
+func (e *PatchError) Error() string {
+	return fmt.Sprintf("statediff: op %d (%s %q): %s", e.Index, e.Op.Op, e.Op.Path, e.Reason)
+}
+
+// Validate checks that the patch is structurally sound, e.g. to assert in
+// CI that every patch a server generates is:
+//   - known op names (add, remove, replace, move, copy, test, and inc of
+//     Config.NumericDeltas), with "from"
+//     exactly on move and copy, and no move into its own child
+//   - valid JSON Pointers ("~" only in "~0" and "~1")
+//   - no object member written twice (add, replace or remove of the same
+//     path) without an array insertion or removal in between
+//   - array ops following the order documented on Patch: removes in
+//     descending index order, adds and changes in ascending order, and no
+//     remove shifting an element an earlier add or change addressed
+//
+// Without the document, numeric segments are taken to be array indexes, so
+// diffs of objects with numeric keys (such as map[int]T) may be reported;
+// use ValidateAgainst for those.
+func (p Patch) Validate() error {
+	return (&patchLinter{}).lint(p)
+}
+
+// ValidateAgainst is Validate with the document the patch applies to (any
+// value that marshals to JSON): the patch is applied op by op, so paths
+// must exist and only actual arrays are subject to the index rules.
+func (p Patch) ValidateAgainst(doc any) error {
+	v, err := toJSONValue(doc)
+	if err != nil {
+		return err
+	}
+	return (&patchLinter{doc: v, withDoc: true}).lint(p)
+}
+
+type patchLinter struct {
+	doc     any // Current document, with ValidateAgainst
+	withDoc bool
+	written map[string]bool // Object members written since the last shift
+	arrays  map[string]*arrayOrder
+}
+
+// arrayOrder tracks the ops on one array
+type arrayOrder struct {
+	appended   bool // An element was added at "-"
+	lastRemove int  // Index of the last remove, -1 if none
+	lastChange int  // Index of the last add or change, -1 if none
+}
+
+func (l *patchLinter) lint(p Patch) error {
+	l.written = make(map[string]bool)
+	l.arrays = make(map[string]*arrayOrder)
+	for i, op := range p {
+		if reason := l.check(op); reason != "" {
+			return &PatchError{Index: i, Op: op, Reason: reason}
+		}
+		if l.withDoc {
+			var err error
+			if l.doc, err = applyOp(l.doc, op); err != nil {
+				return &PatchError{Index: i, Op: op, Reason: err.Error()}
+			}
+		}
+	}
+	return nil
+}
+
+// check returns why op is rejected, or ""
+func (l *patchLinter) check(op Op) string {
+	switch op.Op {
+	case "add", "remove", "replace", "inc", "test":
+		if op.From != "" {
+			return "from is only allowed on move and copy"
+		}
+	case "move", "copy":
+		if reason := pointerSyntax(op.From); reason != "" {
+			return "from: " + reason
+		}
+		if op.Op == "move" && strings.HasPrefix(op.Path, op.From+"/") {
+			return "cannot move a value into its own child"
+		}
+	default:
+		return fmt.Sprintf("unknown op %q", op.Op)
+	}
+	if reason := pointerSyntax(op.Path); reason != "" {
+		return reason
+	}
+	if op.Op == "test" {
+		return ""
+	}
+
+	segs, _ := parsePtr(op.Path)
+	last := len(segs) - 1
+	shifts := false // Inserts or removes an array element
+	for k := range segs {
+		if !l.isIndex(segs, k) {
+			continue
+		}
+		array := joinPtr(segs[:k])
+		a := l.arrays[array]
+		if a == nil {
+			a = &arrayOrder{lastRemove: -1, lastChange: -1}
+			l.arrays[array] = a
+		}
+		idx, numeric := -1, segs[k] != "-"
+		if numeric {
+			idx, _ = strconv.Atoi(segs[k])
+		}
+		if k == last && op.Op == "remove" {
+			if a.appended || idx <= a.lastChange {
+				return fmt.Sprintf("remove from %s shifts an element an earlier op addressed", displayPtr(array))
+			}
+			if a.lastRemove >= 0 && idx >= a.lastRemove {
+				return fmt.Sprintf("removes from %s not in descending index order", displayPtr(array))
+			}
+			a.lastRemove = idx
+			shifts = true
+			continue
+		}
+		if k == last && !numeric {
+			a.appended = true
+		}
+		if k == last && op.Op != "replace" && op.Op != "inc" {
+			shifts = true // add, move and copy insert an element
+		}
+		if numeric && op.Op != "move" && op.Op != "copy" {
+			if idx < a.lastChange {
+				return fmt.Sprintf("adds and changes in %s not in ascending index order", displayPtr(array))
+			}
+			a.lastChange = idx
+		}
+	}
+	if op.Op == "move" || op.Op == "copy" {
+		shifts = true // Values relocate; member tracking starts over
+	}
+
+	if shifts {
+		clear(l.written)
+	} else if last >= 0 && !l.isIndex(segs, last) {
+		if l.written[op.Path] {
+			return "path already written by an earlier op"
+		}
+		l.written[op.Path] = true
+	}
+	return ""
+}
+
+// isIndex reports whether segs[k] addresses an array element
+func (l *patchLinter) isIndex(segs []string, k int) bool {
+	if !l.withDoc {
+		return isIndexSeg(segs[k])
+	}
+	parent, err := lookup(l.doc, segs[:k])
+	if err != nil {
+		return false
+	}
+	_, ok := parent.([]any)
+	return ok
+}
+
+// pointerSyntax returns why ptr is not a valid JSON Pointer, or ""
+func pointerSyntax(ptr string) string {
+	if ptr != "" && ptr[0] != '/' {
+		return fmt.Sprintf("invalid JSON pointer %q: must be empty or start with /", ptr)
+	}
+	for i := 0; i < len(ptr); i++ {
+		if ptr[i] == '~' && (i+1 == len(ptr) || (ptr[i+1] != '0' && ptr[i+1] != '1')) {
+			return fmt.Sprintf("invalid JSON pointer %q: ~ must be followed by 0 or 1", ptr)
+		}
+	}
+	return ""
+}
+
+// displayPtr names a pointer in messages
+func displayPtr(ptr string) string {
+	if ptr == "" {
+		return "the root"
+	}
+	return strconv.Quote(ptr)
+}
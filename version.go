@@ -0,0 +1,113 @@
+package statediff
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// ErrVersionConflict is returned by CompareAndUpdate when the state changed
+// after the expected version
+var ErrVersionConflict = errors.New("statediff: state changed since the expected version")
+
+// Version returns the number of changes made to the state so far: every
+// Update, Set, effect change, rollback and cleanup of expired effects adds
+// one. Versions only increase, and are kept by Save and Restore, so clients
+// can tell missed or reordered messages apart (see Session.SetVersioned).
+func (s *State[T, A]) Version() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.version
+}
+
+// GetBaseVersion returns GetBase together with the Version it was read at,
+// for a later CompareAndUpdate
+func (s *State[T, A]) GetBaseVersion() (T, uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.clone(s.current), s.version
+}
+
+// CompareAndUpdate is Update if the state is still at the expected version,
+// for optimistic concurrency between writers that read, decide and write
+// back, e.g. HTTP handlers: read with GetBaseVersion, then update with the
+// version read. Returns ErrVersionConflict, changing nothing, if any change
+// (including effect changes) was made since; the caller re-reads and
+// retries. Returns the *LimitError if Config.Limits reject the result.
+func (s *State[T, A]) CompareAndUpdate(expected uint64, fn func(*T)) error {
+	err := s.compareAndUpdate(expected, fn)
+	s.reportLimit(err)
+	return err
+}
+
+// compareAndUpdate implements CompareAndUpdate
+func (s *State[T, A]) compareAndUpdate(expected uint64, fn func(*T)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.recoverCrash("update")
+	s.waitCycle()
+	if s.version != expected {
+		return ErrVersionConflict
+	}
+	return s.updateCopy(func(v *T) error {
+		fn(v)
+		return nil
+	})
+}
+
+// diffVersions returns the versions the pending diffs lead from and to:
+// the snapshot's during a Session tick, else the current ones
+func (s *State[T, A]) diffVersions() (from, to uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if c := s.cyc; c != nil {
+		if !c.has {
+			return c.version, c.version
+		}
+		return c.from, c.version
+	}
+	if !s.hasPrevi {
+		return s.version, s.version
+	}
+	return s.prevVersion, s.version
+}
+
+// VersionedPayload is the payload of a Session with SetVersioned:
+//
+//	{"from":41,"version":42,"data":[{"op":"replace","path":"/score","value":7}]}
+//
+// Data is the payload the client's Encoder produced, or a base64 string if
+// that is not JSON (e.g. MsgPack or Gzip). A patch applies to the state of
+// version From and brings it to Version. A client drops payloads whose
+// Version is not above its own (already included, e.g. by a Full), and
+// requests Full when From is not its version (a message was missed or
+// reordered). Full payloads have From equal to Version.
+type VersionedPayload struct {
+	From    uint64          `json:"from"`
+	Version uint64          `json:"version"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// SetVersioned wraps every payload of Broadcast, Tick, TickFrame, Diff and
+// Full in a VersionedPayload carrying the state version it brings the client
+// to. Disabled by default.
+func (s *Session[T, A, ID]) SetVersioned(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.versioned = enabled
+}
+
+// versionPayload wraps data in a VersionedPayload
+func versionPayload(from, version uint64, data []byte) []byte {
+	if !json.Valid(data) {
+		data, _ = json.Marshal(data) // As base64
+	}
+	out := make([]byte, 0, len(data)+48)
+	out = append(out, `{"from":`...)
+	out = strconv.AppendUint(out, from, 10)
+	out = append(out, `,"version":`...)
+	out = strconv.AppendUint(out, version, 10)
+	out = append(out, `,"data":`...)
+	out = append(out, data...)
+	return append(out, '}')
+}
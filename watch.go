@@ -0,0 +1,171 @@
+package statediff
+
+import (
+	"strings"
+	"sync"
+)
+
+// WatchBuffer is how many patches a Watch channel holds for a receiver
+// that has fallen behind
+const WatchBuffer = 16
+
+// watcher is a Watch subscription
+type watcher struct {
+	prefix string
+
+	mu     sync.Mutex // Orders sends with cancel closing ch
+	ch     chan Patch
+	closed bool
+}
+
+// watchDelivery is a patch due to a watcher
+type watchDelivery struct {
+	w     *watcher
+	patch Patch
+}
+
+// Watch subscribes to the changes under a JSON Pointer, e.g. "/players" or
+// "/scores/alice", for subsystems (AI, scoring) that react to some fields.
+// After each committed change cycle (a Session tick or ClearPrevious), the
+// ops of its unprojected diff that touch the subtree are sent on the
+// channel: ops at or below prefix, and ops replacing or removing one of its
+// ancestors. Paths are as sent to clients (after PathMapper). Cycles that
+// touch nothing under prefix send nothing; "" watches everything.
+//
+// Sends never block: a receiver more than WatchBuffer patches behind misses
+// the patches that do not fit. cancel stops the subscription and closes
+// the channel.
+func (s *State[T, A]) Watch(prefix string) (<-chan Patch, func()) {
+	w := &watcher{prefix: prefix, ch: make(chan Patch, WatchBuffer)}
+	s.mu.Lock()
+	s.watchers = append(s.watchers, w)
+	s.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			s.mu.Lock()
+			for i, x := range s.watchers {
+				if x == w {
+					s.watchers = append(s.watchers[:i:i], s.watchers[i+1:]...)
+					break
+				}
+			}
+			s.mu.Unlock()
+
+			w.mu.Lock()
+			w.closed = true
+			close(w.ch)
+			w.mu.Unlock()
+		})
+	}
+	return w.ch, cancel
+}
+
+// OnChange registers a listener for committed changes, for server-internal
+// observers that would otherwise connect a fake Session client. After each
+// change cycle committed by ClearPrevious (and thus by Session.Tick) whose
+// unprojected diff is not empty, fn receives the states (with effects)
+// before and after, and the diff. Listeners run after the state lock is
+// released, so they may call back into the State; they must not modify
+// their arguments, which are shared.
+func (s *State[T, A]) OnChange(fn func(old, new T, patch Patch)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.changeListeners = append(s.changeListeners, fn)
+}
+
+// changeNotice is a committed cycle due to watchers and OnChange listeners
+// once the state lock is released
+type changeNotice[T any] struct {
+	old, new  T
+	patch     Patch
+	listeners []func(old, new T, patch Patch)
+	watched   []watchDelivery
+}
+
+// committedDiff diffs a committed cycle once for everything observing it:
+// it returns the element events if there are OnElementEvent listeners, and
+// the unprojected diff if there are watchers, OnChange listeners or a flap
+// detector. Caller must hold mu.
+func (s *State[T, A]) committedDiff(prev, cur T) ([]ElementEvent, Patch) {
+	keyed := s.arrayCfg.Strategy == ArrayByKey || s.arrayCfg.Strategy == ArrayAuto
+	wantEvents := len(s.elementListeners) > 0 && keyed
+	wantPatch := s.flaps != nil || len(s.watchers) > 0 || len(s.changeListeners) > 0
+	if !wantEvents && !wantPatch {
+		return nil, nil
+	}
+	oldDoc, err := toDocument(prev, s.arrayCfg)
+	if err != nil {
+		return nil, nil
+	}
+	newDoc, err := toDocument(cur, s.arrayCfg)
+	if err != nil {
+		return nil, nil
+	}
+	var events []ElementEvent
+	if wantEvents {
+		// Before diffing, which modifies oldDoc with IncludeOld
+		if s.arrayCfg.opts == nil || s.arrayCfg.opts.arrays == nil {
+			collectElementEvents("", oldDoc, newDoc, s.arrayCfg, &events)
+		} else {
+			events, _ = s.elementEvents(prev, cur) // Needs positional documents
+		}
+	}
+	if !wantPatch {
+		return events, nil
+	}
+	return events, diffDocuments(oldDoc, newDoc, s.arrayCfg)
+}
+
+// committed prepares the committed diff for the watchers and listeners, or
+// returns nil if there are none or nothing changed. Caller must hold mu.
+func (s *State[T, A]) committed(prev, cur T, patch Patch) *changeNotice[T] {
+	if len(s.watchers) == 0 && len(s.changeListeners) == 0 || len(patch) == 0 {
+		return nil
+	}
+	n := &changeNotice[T]{old: prev, new: cur, patch: patch, listeners: s.changeListeners}
+	for _, w := range s.watchers {
+		var ops Patch
+		for _, op := range patch {
+			if touches(op, w.prefix) {
+				ops = append(ops, op)
+			}
+		}
+		if len(ops) > 0 {
+			n.watched = append(n.watched, watchDelivery{w: w, patch: ops})
+		}
+	}
+	return n
+}
+
+// deliver sends the notice to watchers, then listeners. Call without mu held.
+func (n *changeNotice[T]) deliver() {
+	if n == nil {
+		return
+	}
+	for _, d := range n.watched {
+		d.w.mu.Lock()
+		if !d.w.closed {
+			select {
+			case d.w.ch <- d.patch:
+			default: // Receiver too far behind
+			}
+		}
+		d.w.mu.Unlock()
+	}
+	for _, fn := range n.listeners {
+		fn(n.old, n.new, n.patch)
+	}
+}
+
+// touches reports whether op changes a value at or below prefix
+func touches(op Op, prefix string) bool {
+	for _, p := range opPointers(op) {
+		if p == prefix || p == "" || prefix == "" ||
+			strings.HasPrefix(p, prefix+"/") || strings.HasPrefix(prefix, p+"/") {
+			return true
+		}
+	}
+	return false
+}
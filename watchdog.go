@@ -0,0 +1,51 @@
+package statediff
+
+import (
+	"log"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// SlowUpdate reports an Update closure that held the state lock longer than
+// Config.UpdateBudget. Each slow closure is reported twice: once when the
+// budget runs out while it is still running (Done false, Stack has every
+// goroutine, including the stuck one), and once when it returns (Done true,
+// Stack is the caller of Update).
+type SlowUpdate struct {
+	Held  time.Duration // Time the closure has held the lock so far
+	Done  bool          // The closure has returned
+	Stack []byte
+}
+
+// watchUpdate starts the watchdog for an Update closure and returns the
+// function that stops it, or nil if no budget is configured
+func (s *State[T, A]) watchUpdate() func() {
+	if s.updateBudget <= 0 {
+		return nil
+	}
+	start := time.Now()
+	timer := time.AfterFunc(s.updateBudget, func() {
+		buf := make([]byte, 64<<10)
+		n := runtime.Stack(buf, true)
+		s.reportSlowUpdate(SlowUpdate{Held: time.Since(start), Stack: buf[:n]})
+	})
+	return func() {
+		if !timer.Stop() {
+			s.reportSlowUpdate(SlowUpdate{Held: time.Since(start), Done: true, Stack: debug.Stack()})
+		}
+	}
+}
+
+// reportSlowUpdate delivers a slow update report to the hook or the log
+func (s *State[T, A]) reportSlowUpdate(r SlowUpdate) {
+	if s.onSlowUpdate != nil {
+		s.onSlowUpdate(r)
+		return
+	}
+	if r.Done {
+		log.Printf("statediff: Update closure held the state lock for %v (budget %v)\n%s", r.Held, s.updateBudget, r.Stack)
+	} else {
+		log.Printf("statediff: Update closure still holds the state lock after %v; goroutines:\n%s", r.Held, r.Stack)
+	}
+}